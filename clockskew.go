@@ -0,0 +1,84 @@
+// clockskew.go - Katzenpost server clock skew handling.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"strings"
+	"time"
+
+	"github.com/katzenpost/core/thwack"
+	"github.com/katzenpost/server/internal/clock"
+)
+
+const (
+	cmdClockSkew = "CLOCK_SKEW"
+
+	// maxClockJump is the maximum difference between the elapsed civil and
+	// monotonic time between periodic timer callbacks, before the civil
+	// time is considered to have jumped.
+	maxClockJump = 1 * time.Second
+)
+
+func (s *Server) maxClockSkew() time.Duration {
+	return time.Duration(s.cfg.Server.MaxClockSkew) * time.Millisecond
+}
+
+func (s *Server) onClockJump(deltaT time.Duration) {
+	if deltaT < 0 {
+		s.log.Warningf("Civil time jumped backwards: %v", deltaT)
+	} else {
+		s.log.Warningf("Civil time jumped forward: %v", deltaT)
+	}
+
+	// The existing skew samples were taken against the old civil time.
+	s.skew.OnJump(deltaT)
+
+	// The epoch may have changed, so have the PKI worker re-fetch the
+	// documents, and re-publish the descriptor, which also generates any
+	// mix and link keys that are now required.
+	s.pki.OnClockJump()
+}
+
+// checkClockSkew logs transitions in the clock skew health status, and
+// returns the current status.
+func (s *Server) checkClockSkew(lastStatus clock.SkewStatus) clock.SkewStatus {
+	status, skew := s.skew.Status(s.maxClockSkew())
+	if status == lastStatus {
+		return status
+	}
+
+	switch status {
+	case clock.SkewExcessive:
+		s.log.Warningf("Clock skew %v exceeds %v, descriptor publication is suspended.", skew, s.maxClockSkew())
+	case clock.SkewOk:
+		s.log.Noticef("Clock skew is within bounds: %v", skew)
+	default:
+		s.log.Debugf("Clock skew is unknown.")
+	}
+	return status
+}
+
+func (s *Server) onClockSkew(c *thwack.Conn, l string) error {
+	if sp := strings.Split(l, " "); len(sp) != 1 {
+		c.Log().Debugf("%v invalid syntax: '%v'", cmdClockSkew, l)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+
+	status, skew := s.skew.Status(s.maxClockSkew())
+	_, nrSamples := s.skew.Estimate()
+	return c.Writer().PrintfLine("%v %v (Skew: %v Max: %v Samples: %v Jumps: %v)", thwack.StatusOk, status, skew, s.maxClockSkew(), nrSamples, s.skew.NrJumps())
+}
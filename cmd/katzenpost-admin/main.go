@@ -0,0 +1,338 @@
+// main.go - Katzenpost server management interface client.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Command katzenpost-admin runs commands on a Katzenpost server's management
+// interface, either via the local socket, or via an authenticated TCP
+// connection.
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/server/config"
+	"github.com/katzenpost/server/internal/management"
+)
+
+const dialTimeout = 30 * time.Second
+
+// command is a management interface command.  Arguments are passed through
+// as is, other than the public key argument, if any, which may be read from
+// a file.
+type command struct {
+	name    string
+	usage   string
+	minArgs int
+	maxArgs int
+	keyArg  int
+}
+
+var commands = map[string]*command{
+	"add-user":           {"ADD_USER", "<user> <public key>", 2, 2, 1},
+	"update-user":        {"UPDATE_USER", "<user> <public key>", 2, 2, 1},
+	"remove-user":        {"REMOVE_USER", "<user>", 1, 1, -1},
+	"set-identity":       {"SET_USER_IDENTITY", "<user> [public key]", 1, 2, 1},
+	"identity":           {"USER_IDENTITY", "<user>", 1, 1, -1},
+	"shutdown":           {"SHUTDOWN", "", 0, 0, -1},
+	"drain":              {"DRAIN", "[deadline seconds]", 0, 1, -1},
+	"clock-skew":         {"CLOCK_SKEW", "", 0, 0, -1},
+	"sphinx-workers":     {"SPHINX_WORKERS", "", 0, 0, -1},
+	"set-sphinx-workers": {"SET_SPHINX_WORKERS", "<count>", 1, 1, -1},
+}
+
+// result is the outcome of a single command, and is the JSON output format.
+type result struct {
+	Command string `json:"command"`
+	Ok      bool   `json:"ok"`
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message"`
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %v [flags] <command> [args...]\n\nCommands:\n", os.Args[0])
+	for _, name := range sortedCommandNames() {
+		fmt.Fprintf(os.Stderr, "  %v %v\n", name, commands[name].usage)
+	}
+	fmt.Fprintf(os.Stderr, "  raw <line>\n  gen-key <private key file>\n\n")
+	fmt.Fprintf(os.Stderr, "Public keys may be given as `@file`, to read a Base64, Base16, or PEM encoded key.\n\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+func sortedCommandNames() []string {
+	names := make([]string, 0, len(commands))
+	for k := range commands {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// loadPublicKey parses a user public key, reading it from a file if s is of
+// the form `@file`.
+func loadPublicKey(s string) (*ecdh.PublicKey, error) {
+	pubKey := new(ecdh.PublicKey)
+	if !strings.HasPrefix(s, "@") {
+		return pubKey, pubKey.FromString(s)
+	}
+
+	buf, err := ioutil.ReadFile(s[1:])
+	if err != nil {
+		return nil, err
+	}
+	if blk, _ := pem.Decode(buf); blk != nil {
+		return pubKey, pubKey.FromBytes(blk.Bytes)
+	}
+	return pubKey, pubKey.FromString(strings.TrimSpace(string(buf)))
+}
+
+// toLine converts a command and it's arguments to a management interface
+// command line.
+func toLine(args []string) (string, error) {
+	if len(args) == 0 {
+		return "", errors.New("no command specified")
+	}
+	if args[0] == "raw" {
+		if len(args) == 1 {
+			return "", errors.New("raw: no line specified")
+		}
+		return strings.Join(args[1:], " "), nil
+	}
+
+	cmd, ok := commands[args[0]]
+	if !ok {
+		return "", fmt.Errorf("unknown command: '%v'", args[0])
+	}
+	cmdArgs := append([]string{}, args[1:]...)
+	if len(cmdArgs) < cmd.minArgs || len(cmdArgs) > cmd.maxArgs {
+		return "", fmt.Errorf("usage: %v %v", args[0], cmd.usage)
+	}
+	if cmd.keyArg >= 0 && cmd.keyArg < len(cmdArgs) {
+		pubKey, err := loadPublicKey(cmdArgs[cmd.keyArg])
+		if err != nil {
+			return "", fmt.Errorf("%v: invalid public key: %v", args[0], err)
+		}
+		cmdArgs[cmd.keyArg] = hex.EncodeToString(pubKey.Bytes())
+	}
+	return strings.Join(append([]string{cmd.name}, cmdArgs...), " "), nil
+}
+
+type client struct {
+	conn *textproto.Conn
+}
+
+func (c *client) run(l string) (*result, error) {
+	// Only the command name is echoed back, since the arguments may
+	// include keys.
+	r := &result{Command: strings.SplitN(l, " ", 2)[0]}
+	if err := c.conn.PrintfLine("%v", l); err != nil {
+		return nil, err
+	}
+	code, msg, err := c.conn.ReadResponse(0)
+	if err != nil {
+		return nil, err
+	}
+	r.Code = code
+	r.Ok = code/100 == 2
+	r.Message = msg
+	return r, nil
+}
+
+func dial(network, addr, keyFile, serverKey string) (*client, error) {
+	var conn net.Conn
+	var err error
+	switch network {
+	case "unix":
+		conn, err = net.DialTimeout("unix", addr, dialTimeout)
+	case "tcp":
+		var k ed25519.PrivateKey
+		if k, err = management.LoadKey(keyFile); err != nil {
+			return nil, err
+		}
+		var pubKey eddsa.PublicKey
+		if err = pubKey.FromString(serverKey); err != nil {
+			return nil, fmt.Errorf("invalid server key: %v", err)
+		}
+		var tlsCfg *tls.Config
+		if tlsCfg, err = management.NewClientTLSConfig(k, ed25519.PublicKey(pubKey.Bytes())); err != nil {
+			return nil, err
+		}
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: dialTimeout}, "tcp", addr, tlsCfg)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := &client{conn: textproto.NewConn(conn)}
+	if _, _, err = c.conn.ReadResponse(0); err != nil {
+		c.conn.Close()
+		return nil, fmt.Errorf("failed to read banner: %v", err)
+	}
+	return c, nil
+}
+
+// readBatch reads one command per line from r, ignoring blank lines and
+// lines starting with `#`.
+func readBatch(r io.Reader) ([][]string, error) {
+	var batch [][]string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		l := strings.TrimSpace(scanner.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		batch = append(batch, strings.Fields(l))
+	}
+	return batch, scanner.Err()
+}
+
+func genKey(args []string) {
+	if len(args) != 2 {
+		fmt.Fprintf(os.Stderr, "usage: gen-key <private key file>\n")
+		os.Exit(-1)
+	}
+	k, err := management.GenerateKey(args[1])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to generate key: %v\n", err)
+		os.Exit(-1)
+	}
+	fmt.Printf("%v\n", management.PublicKeyString(k.Public().(ed25519.PublicKey)))
+}
+
+func main() {
+	cfgFile := flag.String("f", "", "Path to the server config file, used to locate the management socket.")
+	sockPath := flag.String("s", "", "Path to the management socket.")
+	tcpAddr := flag.String("addr", "", "Address of the TCP management interface.")
+	keyFile := flag.String("key", "", "Path to the client private key (-addr only).")
+	serverKey := flag.String("server_key", "", "TCP management interface public key (-addr only).")
+	batchFile := flag.String("batch", "", "Path to a file with one command per line, or `-` for stdin.")
+	jsonOut := flag.Bool("json", false, "Output results as JSON, one object per line.")
+	flag.Usage = usage
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) > 0 && args[0] == "gen-key" {
+		genKey(args)
+		return
+	}
+
+	// Build the command lines before connecting, so that usage errors do
+	// not result in a partially executed batch.
+	var batch [][]string
+	switch {
+	case *batchFile == "" && len(args) == 0:
+		usage()
+		os.Exit(-1)
+	case *batchFile == "":
+		batch = [][]string{args}
+	case len(args) != 0:
+		fmt.Fprintf(os.Stderr, "Commands may not be specified with -batch.\n")
+		os.Exit(-1)
+	default:
+		var r io.Reader = os.Stdin
+		if *batchFile != "-" {
+			f, err := os.Open(*batchFile)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to open batch file: %v\n", err)
+				os.Exit(-1)
+			}
+			defer f.Close()
+			r = f
+		}
+		var err error
+		if batch, err = readBatch(r); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read batch file: %v\n", err)
+			os.Exit(-1)
+		}
+	}
+	lines := make([]string, 0, len(batch))
+	for i, v := range batch {
+		l, err := toLine(v)
+		if err != nil {
+			if *batchFile != "" {
+				fmt.Fprintf(os.Stderr, "Line %v: ", i+1)
+			}
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(-1)
+		}
+		lines = append(lines, l)
+	}
+
+	network, addr := "unix", *sockPath
+	switch {
+	case *tcpAddr != "":
+		if *keyFile == "" || *serverKey == "" {
+			fmt.Fprintf(os.Stderr, "-addr requires -key and -server_key.\n")
+			os.Exit(-1)
+		}
+		network, addr = "tcp", *tcpAddr
+	case addr == "" && *cfgFile != "":
+		cfg, err := config.LoadFile(*cfgFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load config file '%v': %v\n", *cfgFile, err)
+			os.Exit(-1)
+		}
+		addr = cfg.Management.Path
+	case addr == "":
+		fmt.Fprintf(os.Stderr, "One of -f, -s, or -addr must be specified.\n")
+		os.Exit(-1)
+	}
+
+	c, err := dial(network, addr, *keyFile, *serverKey)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to connect to '%v': %v\n", addr, err)
+		os.Exit(-1)
+	}
+	defer c.conn.Close()
+
+	isOk := true
+	enc := json.NewEncoder(os.Stdout)
+	for _, l := range lines {
+		r, err := c.run(l)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Connection failed: %v\n", err)
+			os.Exit(-1)
+		}
+		isOk = isOk && r.Ok
+		switch {
+		case *jsonOut:
+			enc.Encode(r)
+		case r.Ok:
+			fmt.Printf("%v\n", r.Message)
+		default:
+			fmt.Fprintf(os.Stderr, "%v failed: %v %v\n", r.Command, r.Code, r.Message)
+		}
+	}
+	if !isOk {
+		os.Exit(1)
+	}
+}
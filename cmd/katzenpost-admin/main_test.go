@@ -0,0 +1,259 @@
+// main_test.go - Katzenpost server management interface client tests.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadPublicKey(t *testing.T) {
+	require := require.New(t)
+
+	k, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err, "NewKeypair()")
+	pubKey := k.PublicKey()
+	b64 := base64.StdEncoding.EncodeToString(pubKey.Bytes())
+	b16 := hex.EncodeToString(pubKey.Bytes())
+
+	dir, err := ioutil.TempDir("", "admin_test")
+	require.NoError(err, "TempDir()")
+	defer os.RemoveAll(dir)
+	writeFile := func(name, content string) string {
+		f := filepath.Join(dir, name)
+		require.NoError(ioutil.WriteFile(f, []byte(content), 0600), "WriteFile(%v)", name)
+		return "@" + f
+	}
+	pemBlk := &pem.Block{Type: "X25519 PUBLIC KEY", Bytes: pubKey.Bytes()}
+
+	for _, v := range []struct {
+		name  string
+		arg   string
+		isErr bool
+	}{
+		{"Base64", b64, false},
+		{"Base16", b16, false},
+		{"Base64 file", writeFile("b64", b64+"\n"), false},
+		{"Base16 file", writeFile("b16", "  "+b16+"\n"), false},
+		{"PEM file", writeFile("pem", string(pem.EncodeToMemory(pemBlk))), false},
+		{"Invalid", "not a key", true},
+		{"Truncated", b16[:len(b16)-2], true},
+		{"Invalid file", writeFile("invalid", "not a key\n"), true},
+		{"Invalid PEM file", writeFile("invalid_pem", string(pem.EncodeToMemory(&pem.Block{Type: "X25519 PUBLIC KEY", Bytes: []byte("short")}))), true},
+		{"Missing file", "@" + filepath.Join(dir, "missing"), true},
+	} {
+		k, err := loadPublicKey(v.arg)
+		if v.isErr {
+			require.Error(err, "loadPublicKey(): %v", v.name)
+			continue
+		}
+		require.NoError(err, "loadPublicKey(): %v", v.name)
+		require.Equal(pubKey.Bytes(), k.Bytes(), "loadPublicKey(): %v", v.name)
+	}
+}
+
+func TestToLine(t *testing.T) {
+	require := require.New(t)
+
+	k, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err, "NewKeypair()")
+	b64 := base64.StdEncoding.EncodeToString(k.PublicKey().Bytes())
+	b16 := hex.EncodeToString(k.PublicKey().Bytes())
+
+	for _, v := range []struct {
+		args  []string
+		line  string
+		isErr bool
+	}{
+		{nil, "", true},
+		{[]string{"raw"}, "", true},
+		{[]string{"raw", "QUIT"}, "QUIT", false},
+		{[]string{"raw", "ADD_USER", "alice", b64}, "ADD_USER alice " + b64, false},
+		{[]string{"no-such-command"}, "", true},
+		{[]string{"shutdown"}, "SHUTDOWN", false},
+		{[]string{"shutdown", "now"}, "", true},
+		{[]string{"drain"}, "DRAIN", false},
+		{[]string{"drain", "60"}, "DRAIN 60", false},
+		{[]string{"remove-user"}, "", true},
+		{[]string{"remove-user", "alice"}, "REMOVE_USER alice", false},
+		{[]string{"add-user", "alice"}, "", true},
+		{[]string{"add-user", "alice", b64}, "ADD_USER alice " + b16, false},
+		{[]string{"add-user", "alice", "not-a-key"}, "", true},
+		{[]string{"update-user", "alice", b16}, "UPDATE_USER alice " + b16, false},
+		{[]string{"set-identity", "alice"}, "SET_USER_IDENTITY alice", false},
+		{[]string{"set-identity", "alice", b64}, "SET_USER_IDENTITY alice " + b16, false},
+		{[]string{"identity", "alice"}, "USER_IDENTITY alice", false},
+		{[]string{"sphinx-workers"}, "SPHINX_WORKERS", false},
+		{[]string{"sphinx-workers", "4"}, "", true},
+		{[]string{"set-sphinx-workers"}, "", true},
+		{[]string{"set-sphinx-workers", "4"}, "SET_SPHINX_WORKERS 4", false},
+	} {
+		l, err := toLine(v.args)
+		if v.isErr {
+			require.Error(err, "toLine(%v)", v.args)
+			continue
+		}
+		require.NoError(err, "toLine(%v)", v.args)
+		require.Equal(v.line, l, "toLine(%v)", v.args)
+	}
+}
+
+func TestReadBatch(t *testing.T) {
+	require := require.New(t)
+
+	for _, v := range []struct {
+		name  string
+		in    string
+		batch [][]string
+	}{
+		{"Empty", "", nil},
+		{"Comments and blank lines", "# Comment\n\n   \n\t# Indented comment\n", nil},
+		{"Single", "remove-user alice", [][]string{{"remove-user", "alice"}}},
+		{
+			"Multiple",
+			"# Users\nadd-user alice @alice.pub\r\n\n  remove-user   bob  \ndrain\n",
+			[][]string{{"add-user", "alice", "@alice.pub"}, {"remove-user", "bob"}, {"drain"}},
+		},
+	} {
+		batch, err := readBatch(strings.NewReader(v.in))
+		require.NoError(err, "readBatch(): %v", v.name)
+		require.Equal(v.batch, batch, "readBatch(): %v", v.name)
+	}
+}
+
+// registeredCommands returns the sorted names of the commands that the
+// server registers with the management interface, by walking the source
+// tree.
+func registeredCommands(t *testing.T) []string {
+	require := require.New(t)
+
+	root, err := filepath.Abs(filepath.Join("..", ".."))
+	require.NoError(err, "Abs()")
+
+	// The management package itself only forwards the registrations.
+	skip := filepath.Join(root, "internal", "management")
+
+	fset := token.NewFileSet()
+	files := make(map[string][]*ast.File)
+	err = filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			switch {
+			case path == skip, fi.Name() == "vendor", fi.Name() == "testdata", strings.HasPrefix(fi.Name(), "."):
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(path, ".go") || strings.HasSuffix(path, "_test.go") {
+			return nil
+		}
+
+		f, err := parser.ParseFile(fset, path, nil, 0)
+		if err != nil {
+			return err
+		}
+		dir := filepath.Dir(path)
+		files[dir] = append(files[dir], f)
+		return nil
+	})
+	require.NoError(err, "Walk()")
+
+	var cmds []string
+	for _, pkgFiles := range files {
+		// The command names are string constants, either package level or
+		// local to the registering function.
+		consts := make(map[string]string)
+		for _, f := range pkgFiles {
+			ast.Inspect(f, func(n ast.Node) bool {
+				if spec, ok := n.(*ast.ValueSpec); ok {
+					for i, id := range spec.Names {
+						if i >= len(spec.Values) {
+							break
+						}
+						if lit, ok := spec.Values[i].(*ast.BasicLit); ok && lit.Kind == token.STRING {
+							s, err := strconv.Unquote(lit.Value)
+							require.NoError(err, "Unquote(): %v", fset.Position(lit.Pos()))
+							consts[id.Name] = s
+						}
+					}
+				}
+				return true
+			})
+		}
+
+		for _, f := range pkgFiles {
+			ast.Inspect(f, func(n ast.Node) bool {
+				call, ok := n.(*ast.CallExpr)
+				if !ok {
+					return true
+				}
+				sel, ok := call.Fun.(*ast.SelectorExpr)
+				if !ok || sel.Sel.Name != "RegisterCommand" || len(call.Args) == 0 {
+					return true
+				}
+				switch arg := call.Args[0].(type) {
+				case *ast.BasicLit:
+					s, err := strconv.Unquote(arg.Value)
+					require.NoError(err, "Unquote(): %v", fset.Position(arg.Pos()))
+					cmds = append(cmds, s)
+				case *ast.Ident:
+					s, ok := consts[arg.Name]
+					require.True(ok, "%v: unresolved command name: %v", fset.Position(arg.Pos()), arg.Name)
+					cmds = append(cmds, s)
+				default:
+					require.Fail("unresolved command name", "%v", fset.Position(arg.Pos()))
+				}
+				return true
+			})
+		}
+	}
+	sort.Strings(cmds)
+	return cmds
+}
+
+func TestCommandsTable(t *testing.T) {
+	require := require.New(t)
+
+	var names []string
+	for k, v := range commands {
+		require.True(v.minArgs <= v.maxArgs, "%v: minArgs > maxArgs", k)
+		require.True(v.keyArg < v.maxArgs, "%v: keyArg out of range", k)
+		names = append(names, v.name)
+	}
+	sort.Strings(names)
+
+	// Every command the server registers must be reachable by name, and
+	// every name must be registered by the server.
+	require.Equal(registeredCommands(t), names, "commands")
+}
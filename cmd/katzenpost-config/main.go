@@ -0,0 +1,146 @@
+// main.go - Katzenpost server config tool.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Command katzenpost-config validates and prints the effective
+// configuration of a Katzenpost server, or generates a new configuration
+// along with the server's long term keys.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/server"
+	"github.com/katzenpost/server/config"
+)
+
+const (
+	roleMix      = "mix"
+	roleProvider = "provider"
+)
+
+func main() {
+	cfgFile := flag.String("f", "katzenpost.toml", "Path to the server config file.")
+	doValidate := flag.Bool("validate", false, "Validate the config file.")
+	doDump := flag.Bool("dump", false, "Validate the config file, and print the effective config.")
+	withSecrets := flag.Bool("secrets", false, "Include secrets in the effective config (-dump only).")
+	doGenerate := flag.Bool("generate", false, "Generate a new config file, and long term keys.")
+	role := flag.String("role", roleMix, "Node role, `mix` or `provider` (-generate only).")
+	identifier := flag.String("identifier", "", "Node identifier (-generate only).")
+	address := flag.String("address", "", "Address to listen on, guessed if unset (-generate only).")
+	dataDir := flag.String("datadir", "", "Absolute path to the data directory (-generate only).")
+	authorityAddr := flag.String("authority_addr", "", "Directory authority address (-generate only).")
+	authorityKey := flag.String("authority_key", "", "Directory authority public key (-generate only).")
+	flag.Parse()
+
+	nrModes := 0
+	for _, v := range []bool{*doValidate, *doDump, *doGenerate} {
+		if v {
+			nrModes++
+		}
+	}
+	if nrModes != 1 {
+		fmt.Fprintf(os.Stderr, "Exactly one of -validate, -dump or -generate must be specified.\n")
+		os.Exit(-1)
+	}
+
+	if *doGenerate {
+		p := &templateParams{
+			Identifier:    *identifier,
+			DataDir:       *dataDir,
+			AuthorityAddr: *authorityAddr,
+			AuthorityKey:  *authorityKey,
+		}
+		switch *role {
+		case roleMix:
+		case roleProvider:
+			p.IsProvider = true
+		default:
+			fmt.Fprintf(os.Stderr, "Invalid role: '%v'\n", *role)
+			os.Exit(-1)
+		}
+		if *address != "" {
+			p.Addresses = []string{*address}
+		}
+		if err := generate(*cfgFile, p); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(-1)
+		}
+		return
+	}
+
+	cfg, err := config.LoadFile(*cfgFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid config file '%v': %v\n", *cfgFile, err)
+		os.Exit(-1)
+	}
+	if *doDump {
+		if err = cfg.Dump(os.Stdout, *withSecrets); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to print config: %v\n", err)
+			os.Exit(-1)
+		}
+		return
+	}
+	fmt.Printf("Config file '%v' is valid.\n", *cfgFile)
+}
+
+func generate(cfgFile string, p *templateParams) error {
+	if p.Identifier == "" || p.DataDir == "" || p.AuthorityAddr == "" || p.AuthorityKey == "" {
+		return fmt.Errorf("-identifier, -datadir, -authority_addr, and -authority_key must be specified")
+	}
+
+	// Ensure that the generated config is valid before writing anything.
+	b, err := renderTemplate(p)
+	if err != nil {
+		return fmt.Errorf("Failed to generate config: %v", err)
+	}
+	cfg, err := config.Load(b)
+	if err != nil {
+		return fmt.Errorf("Failed to generate a valid config: %v", err)
+	}
+
+	f, err := os.OpenFile(cfgFile, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to create config file: %v", err)
+	}
+	_, err = f.Write(b)
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to write config file: %v", err)
+	}
+	fmt.Printf("Wrote: %v\n", cfgFile)
+
+	// Have the server generate the long term keys, exactly as it would on
+	// the first launch.
+	cfg.Logging.Disable = true
+	cfg.Debug.GenerateOnly = true
+	if _, err = server.New(cfg); err != server.ErrGenerateOnly {
+		return fmt.Errorf("Failed to generate keys: %v", err)
+	}
+	identityKey, err := eddsa.Load(filepath.Join(p.DataDir, "identity.private.pem"), filepath.Join(p.DataDir, "identity.public.pem"), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("Failed to load identity key: %v", err)
+	}
+	fmt.Printf("Generated keys in: %v\n", p.DataDir)
+	fmt.Printf("Identity public key: %v\n", identityKey.PublicKey())
+	return nil
+}
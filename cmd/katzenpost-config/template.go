@@ -0,0 +1,144 @@
+// template.go - Katzenpost server config template.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"text/template"
+)
+
+// templateParams are the values substituted into the config template.  The
+// string values are rendered with Go quoting, which is a valid TOML basic
+// string for every printable value.
+type templateParams struct {
+	Identifier    string
+	Addresses     []string
+	DataDir       string
+	IsProvider    bool
+	AuthorityAddr string
+	AuthorityKey  string
+}
+
+var configTemplate = template.Must(template.New("config").Parse(`# Katzenpost server configuration.
+#
+# Generated for a {{if .IsProvider}}provider{{else}}mix{{end}}.  Options that are commented out are
+# set to their default values.
+
+[Server]
+  # Identifier is the human readable identifier for the node (eg: FQDN).
+  Identifier = {{printf "%q" .Identifier}}
+
+  # Addresses are the IP address/port combinations that the server will
+  # bind to for incoming connections.  If unset, a suitable external IPv4
+  # address will be guessed.
+{{- if .Addresses}}
+  Addresses = [{{range $i, $a := .Addresses}}{{if $i}}, {{end}}{{printf "%q" $a}}{{end}}]
+{{- else}}
+  # Addresses = [ "192.0.2.1:3219" ]
+{{- end}}
+
+  # DataDir is the absolute path to the server's state files.
+  DataDir = {{printf "%q" .DataDir}}
+
+  # IsProvider specifies if the server is a provider (vs a mix).
+  IsProvider = {{.IsProvider}}
+
+  # LinkKeyLifetime specifies the number of epochs a link key will be used
+  # for before it is rotated.  If 0, the link key is never rotated.
+  # LinkKeyLifetime = 0
+
+  # MaxClockSkew is the maximum estimated skew between the local clock and
+  # the rest of the network, beyond which descriptors are not published.
+  # MaxClockSkew = "5m"
+
+[Logging]
+  # Disable disables logging entirely.
+  # Disable = false
+
+  # File specifies the log file, if omitted stdout will be used.  Relative
+  # paths are under the DataDir.
+  File = "katzenpost.log"
+
+  # Level specifies the log level out of ERROR, WARNING, NOTICE, INFO and
+  # DEBUG.  DEBUG logs sensitive information.
+  Level = "NOTICE"
+
+  # Format specifies the log format, either "text" or "json".
+  # Format = "text"
+
+  # Redact replaces user identifiers and keys in the log with keyed hashes.
+  # Redact = false
+
+[PKI]
+  [PKI.Nonvoting]
+    # Address is the authority's IP/port combination.
+    Address = {{printf "%q" .AuthorityAddr}}
+
+    # PublicKey is the authority's public key in Base64 or Base16 format.
+    PublicKey = {{printf "%q" .AuthorityKey}}
+{{if .IsProvider}}
+[Provider]
+  # AltAddresses is the map of extra transports and addresses at which the
+  # provider is reachable by clients.
+  # [Provider.AltAddresses]
+  #   TCP = [ "provider.example.com:3219" ]
+
+  # UserDB is the user database configuration.  If unset, a BoltDB
+  # database under the DataDir will be used.
+  # [Provider.UserDB]
+  #   Backend = "bolt"
+
+  # SpoolDB is the user message spool configuration.  If unset, a BoltDB
+  # database under the DataDir will be used.
+  # [Provider.SpoolDB]
+  #   Backend = "bolt"
+
+  # Kaetzchen are the auto-responder agents provided to clients.
+  [[Provider.Kaetzchen]]
+    Capability = "loop"
+    Endpoint = "+loop"
+{{end}}
+[Management]
+  # Enable enables the management interface.
+  Enable = true
+
+  # Path specifies the path to the management interface socket.  If unset,
+  # "management_sock" under the DataDir will be used.
+  # Path = {{printf "%q" (printf "%s/management_sock" .DataDir)}}
+
+  # TCPAddress specifies the address to listen on for authenticated
+  # management connections, from the clients listed as [[Management.Client]].
+  # TCPAddress = "127.0.0.1:3221"
+
+[Health]
+  # Enable enables the "/healthz" and "/readyz" HTTP endpoints.
+  # Enable = false
+  # Address = "127.0.0.1:3220"
+
+[KeyEncryption]
+  # Enable enables encrypting the private keys at rest.  Existing keys can
+  # be encrypted with katzenpost-keytool.
+  # Enable = false
+`))
+
+func renderTemplate(p *templateParams) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := configTemplate.Execute(&buf, p); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
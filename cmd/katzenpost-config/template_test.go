@@ -0,0 +1,64 @@
+// template_test.go - Katzenpost server config template tests.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/server/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenderTemplate(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "config_test")
+	require.NoError(err, "TempDir()")
+	defer os.RemoveAll(dir)
+
+	authorityKey, err := eddsa.NewKeypair(rand.Reader)
+	require.NoError(err, "NewKeypair()")
+
+	for _, isProvider := range []bool{false, true} {
+		// Values that need escaping must survive the round trip.
+		p := &templateParams{
+			Identifier:    `node "1" \ example`,
+			Addresses:     []string{"127.0.0.1:3219", "192.0.2.1:3219"},
+			DataDir:       filepath.Join(dir, `data "dir"`),
+			IsProvider:    isProvider,
+			AuthorityAddr: "127.0.0.1:3220",
+			AuthorityKey:  authorityKey.PublicKey().String(),
+		}
+		b, err := renderTemplate(p)
+		require.NoError(err, "renderTemplate(%v)", isProvider)
+
+		cfg, err := config.Load(b)
+		require.NoError(err, "config.Load(%v)", isProvider)
+		require.Equal(p.Identifier, cfg.Server.Identifier, "Identifier(%v)", isProvider)
+		require.Equal(p.Addresses, cfg.Server.Addresses, "Addresses(%v)", isProvider)
+		require.Equal(p.DataDir, cfg.Server.DataDir, "DataDir(%v)", isProvider)
+		require.Equal(isProvider, cfg.Server.IsProvider, "IsProvider(%v)", isProvider)
+		require.Equal(p.AuthorityAddr, cfg.PKI.Nonvoting.Address, "AuthorityAddr(%v)", isProvider)
+		require.Equal(p.AuthorityKey, cfg.PKI.Nonvoting.PublicKey, "AuthorityKey(%v)", isProvider)
+		require.Equal(isProvider, cfg.Provider != nil, "Provider(%v)", isProvider)
+	}
+}
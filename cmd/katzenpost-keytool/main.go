@@ -0,0 +1,137 @@
+// main.go - Katzenpost server offline key encryption tool.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Command katzenpost-keytool encrypts, or changes the passphrase of, the
+// private keys in a stopped Katzenpost server's data directory.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/katzenpost/core/utils"
+	"github.com/katzenpost/server"
+	"github.com/katzenpost/server/config"
+	"github.com/katzenpost/server/internal/keystore"
+	"github.com/katzenpost/server/internal/mixkey"
+)
+
+func main() {
+	cfgFile := flag.String("f", "katzenpost.toml", "Path to the server config file.")
+	doEncrypt := flag.Bool("encrypt", false, "Encrypt existing plaintext private keys.")
+	doRotate := flag.Bool("rotate", false, "Change the passphrase of encrypted private keys.")
+	newPassphraseFile := flag.String("new_passphrase_file", "", "Path to the new passphrase file (-rotate only), if unset it will be read from stdin.")
+	newKeyFile := flag.String("new_key_file", "", "Path to the new key file (-rotate only).")
+	flag.Parse()
+
+	if *doEncrypt == *doRotate {
+		fmt.Fprintf(os.Stderr, "Exactly one of -encrypt or -rotate must be specified.\n")
+		os.Exit(-1)
+	}
+
+	cfg, err := config.LoadFile(*cfgFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load config file '%v': %v\n", *cfgFile, err)
+		os.Exit(-1)
+	}
+	if !cfg.KeyEncryption.Enable {
+		fmt.Fprintf(os.Stderr, "Warning: KeyEncryption is not enabled in '%v', the server will fail to load the keys till it is.\n", *cfgFile)
+	}
+
+	// The passphrase in the config is the current one when rotating, and the
+	// new one when encrypting.
+	var oldKS, newKS *keystore.Keystore
+	if *doEncrypt {
+		kCfg := cfg.KeyEncryption
+		newKS = newKeystore(kCfg.PassphraseFile, kCfg.KeyFile, kCfg.Passphrase, "New key encryption passphrase: ")
+	} else {
+		if oldKS, err = keystore.NewFromConfig(cfg.KeyEncryption); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read passphrase: %v\n", err)
+			os.Exit(-1)
+		}
+		defer oldKS.Reset()
+		newKS = newKeystore(*newPassphraseFile, *newKeyFile, nil, "New key encryption passphrase: ")
+	}
+	defer newKS.Reset()
+
+	if err = reseal(cfg.Server.DataDir, oldKS, newKS); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(-1)
+	}
+}
+
+func newKeystore(passphraseFile, keyFile string, passphrase []byte, prompt string) *keystore.Keystore {
+	p, err := keystore.ReadNewPassphrase(passphraseFile, keyFile, passphrase, prompt)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read new passphrase: %v\n", err)
+		os.Exit(-1)
+	}
+	defer utils.ExplicitBzero(p)
+
+	ks, err := keystore.New(p)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to initialize new keystore: %v\n", err)
+		os.Exit(-1)
+	}
+	return ks
+}
+
+func reseal(dataDir string, oldKS, newKS *keystore.Keystore) error {
+	pemFiles := []struct {
+		name    string
+		keyType string
+	}{
+		{"identity.private.pem", keystore.IdentityKeyType},
+		{server.LegacyLinkKeyFile, keystore.LinkKeyType},
+	}
+	for _, v := range pemFiles {
+		f := filepath.Join(dataDir, v.name)
+		if _, err := os.Lstat(f); os.IsNotExist(err) {
+			continue
+		}
+		if err := keystore.ResealPEMFile(f, v.keyType, oldKS, newKS); err != nil {
+			return fmt.Errorf("Failed to process '%v': %v", f, err)
+		}
+		fmt.Printf("Processed: %v\n", f)
+	}
+
+	// If link key rotation is enabled, there are multiple link keys.
+	linkKeys, err := filepath.Glob(filepath.Join(dataDir, server.LinkKeyGlob))
+	if err != nil {
+		return fmt.Errorf("Failed to find link keys: %v", err)
+	}
+	for _, f := range linkKeys {
+		if err = keystore.ResealPEMFile(f, keystore.LinkKeyType, oldKS, newKS); err != nil {
+			return fmt.Errorf("Failed to process '%v': %v", f, err)
+		}
+		fmt.Printf("Processed: %v\n", f)
+	}
+
+	mixKeys, err := filepath.Glob(filepath.Join(dataDir, mixkey.KeyGlob))
+	if err != nil {
+		return fmt.Errorf("Failed to find mix keys: %v", err)
+	}
+	for _, f := range mixKeys {
+		if err = mixkey.ResealFile(f, oldKS, newKS); err != nil {
+			return fmt.Errorf("Failed to process '%v': %v", f, err)
+		}
+		fmt.Printf("Processed: %v\n", f)
+	}
+
+	return nil
+}
@@ -24,6 +24,7 @@ import (
 	"net"
 	"net/mail"
 	"net/url"
+	"os"
 	"path/filepath"
 	"runtime"
 	"strconv"
@@ -40,8 +41,10 @@ import (
 const (
 	defaultAddress            = ":3219"
 	defaultLogLevel           = "NOTICE"
+	defaultLogMaxFiles        = 5
 	defaultNumProviderWorkers = 1
 	defaultUnwrapDelay        = 10 // 10 ms.
+	defaultUnwrapBatchSize    = 16
 	defaultSchedulerSlack     = 10 // 10 ms.
 	defaultSchedulerMaxBurst  = 16
 	defaultSendSlack          = 50        // 50 ms.
@@ -53,6 +56,15 @@ const (
 	defaultUserDB             = "users.db"
 	defaultSpoolDB            = "spool.db"
 	defaultManagementSocket   = "management_sock"
+	defaultHealthAddress      = "127.0.0.1:3220"
+	defaultMaxClockSkew       = 5 * 60 * 1000 // 5 min.
+	maxManagementClientName   = 32
+
+	defaultReplayFilterSize              = 29 // 64 MiB.
+	defaultReplayFilterFalsePositiveRate = 0.001
+	defaultReplayFilterSnapshotInterval  = 5 * 60 * 1000 // 5 min.
+	minReplayFilterSize                  = 20
+	maxReplayFilterSize                  = 36
 
 	backendPgx = "pgx"
 
@@ -64,6 +76,24 @@ const (
 
 	// BackendExtern is a External (RESTful http) backend.
 	BackendExtern = "extern"
+
+	// LogFormatText is the human readable log format.
+	LogFormatText = "text"
+
+	// LogFormatJSON is the structured log format, with one JSON object
+	// per line.
+	LogFormatJSON = "json"
+
+	// RoleReadOnly is the management role that may only run commands that
+	// do not alter the server state.
+	RoleReadOnly = "read-only"
+
+	// RoleUserAdmin is the management role that may additionally add,
+	// modify and remove users.
+	RoleUserAdmin = "user-admin"
+
+	// RoleOperator is the management role that may run every command.
+	RoleOperator = "operator"
 )
 
 var defaultLogging = Logging{
@@ -86,6 +116,21 @@ type Server struct {
 
 	// IsProvider specifies if the server is a provider (vs a mix).
 	IsProvider bool
+
+	// LinkKeyLifetime specifies the number of epochs a link key will be used
+	// for before it is rotated.  If left as 0, the link key is never rotated.
+	LinkKeyLifetime uint64
+
+	// MaxClockSkew is the maximum estimated skew in milliseconds between the
+	// local clock and the rest of the network, beyond which the server will
+	// refuse to publish descriptors.
+	MaxClockSkew Duration
+}
+
+func (sCfg *Server) applyDefaults() {
+	if sCfg.MaxClockSkew <= 0 {
+		sCfg.MaxClockSkew = defaultMaxClockSkew
+	}
 }
 
 func (sCfg *Server) validate() error {
@@ -125,6 +170,15 @@ type Debug struct {
 	// inbound Sphinx packet processing.
 	NumSphinxWorkers int
 
+	// MaxSphinxWorkers specifies the maximum number of worker instances to
+	// use for inbound Sphinx packet processing, when the number of workers
+	// is adjusted at runtime.
+	MaxSphinxWorkers int
+
+	// AutoscaleSphinxWorkers enables adjusting the number of Sphinx worker
+	// instances based on the inbound packet queue delay.
+	AutoscaleSphinxWorkers bool
+
 	// NumProviderWorkers specifies the number pf worker instances to use for
 	// provider specific packet processing.
 	NumProviderWorkers int
@@ -144,36 +198,40 @@ type Debug struct {
 
 	// UnwrapDelay is the maximum allowed unwrap delay due to queueing in
 	// milliseconds.
-	UnwrapDelay int
+	UnwrapDelay Duration
+
+	// UnwrapBatchSize is the maximum number of packets that each Sphinx
+	// worker will process per wakeup.
+	UnwrapBatchSize int
 
 	// ProviderDelay is the maximum allowed provider delay due to queueing
 	// in milliseconds.
-	ProviderDelay int
+	ProviderDelay Duration
 
 	// SchedulerSlack is the maximum allowed scheduler slack due to queueing
 	// and or processing in milliseconds.
-	SchedulerSlack int
+	SchedulerSlack Duration
 
 	// SendSlack is the maximum allowed send queue slack due to queueing and
 	// or congestion in milliseconds.
-	SendSlack int
+	SendSlack Duration
 
 	// DecoySlack is the maximum allowed decoy sweep slack due to various
 	// external delays such as latency before a loop decoy packet will
 	// be considered lost.
-	DecoySlack int
+	DecoySlack Duration
 
 	// ConnectTimeout specifies the maximum time a connection can take to
 	// establish a TCP/IP connection in milliseconds.
-	ConnectTimeout int
+	ConnectTimeout Duration
 
 	// HandshakeTimeout specifies the maximum time a connection can take for a
 	// link protocol handshake in milliseconds.
-	HandshakeTimeout int
+	HandshakeTimeout Duration
 
 	// ReauthInterval specifies the interval at which a connection will be
 	// reauthenticated in milliseconds.
-	ReauthInterval int
+	ReauthInterval Duration
 
 	// SendDecoyTraffic enables sending decoy traffic.  This is still
 	// experimental and untuned and thus is disabled by default.
@@ -188,20 +246,52 @@ type Debug struct {
 	// GenerateOnly halts and cleans up the server right after long term
 	// key generation.
 	GenerateOnly bool
+
+	// AllowUnsignedPKI allows the Static PKI backend to use unsigned JSON
+	// serialized documents.  This option should only be used for testing.
+	AllowUnsignedPKI bool
+
+	// ReplayFilterSize is the base 2 logarithm of the size of each mix
+	// key's replay bloom filter in bits.
+	ReplayFilterSize int
+
+	// ReplayFilterFalsePositiveRate is the replay bloom filter false
+	// positive rate at capacity.  Past capacity, every packet will incur
+	// a database lookup.
+	ReplayFilterFalsePositiveRate float64
+
+	// ReplayFilterSnapshotInterval is the interval at which the replay
+	// bloom filter is persisted to disk in milliseconds.
+	ReplayFilterSnapshotInterval Duration
 }
 
 // IsUnsafe returns true iff any debug options that destroy security are set.
 func (dCfg *Debug) IsUnsafe() bool {
-	return dCfg.IdentityKey != nil
+	return dCfg.IdentityKey != nil || dCfg.AllowUnsignedPKI
+}
+
+func (dCfg *Debug) validate() error {
+	if dCfg.ReplayFilterSize < minReplayFilterSize || dCfg.ReplayFilterSize > maxReplayFilterSize {
+		return fmt.Errorf("config: Debug: ReplayFilterSize '%v' is out of range", dCfg.ReplayFilterSize)
+	}
+	if dCfg.ReplayFilterFalsePositiveRate >= 1 {
+		return fmt.Errorf("config: Debug: ReplayFilterFalsePositiveRate '%v' is out of range", dCfg.ReplayFilterFalsePositiveRate)
+	}
+	return nil
 }
 
 func (dCfg *Debug) applyDefaults() {
 	if dCfg.NumSphinxWorkers <= 0 {
-		// Pick a sane default for the number of workers.
-		//
-		// TODO/perf: This should detect the number of physical cores, since
-		// the AES-NI unit is a per-core resource.
-		dCfg.NumSphinxWorkers = runtime.NumCPU()
+		// Pick a sane default for the number of workers, which is the
+		// number of physical cores, since the AES-NI unit is a per-core
+		// resource.
+		dCfg.NumSphinxWorkers = numPhysicalCores()
+	}
+	if dCfg.MaxSphinxWorkers <= 0 {
+		dCfg.MaxSphinxWorkers = runtime.NumCPU()
+	}
+	if dCfg.MaxSphinxWorkers < dCfg.NumSphinxWorkers {
+		dCfg.MaxSphinxWorkers = dCfg.NumSphinxWorkers
 	}
 	if dCfg.NumProviderWorkers <= 0 {
 		// TODO/perf: This should do something clever as well, though 1 is
@@ -212,6 +302,9 @@ func (dCfg *Debug) applyDefaults() {
 	if dCfg.UnwrapDelay <= 0 {
 		dCfg.UnwrapDelay = defaultUnwrapDelay
 	}
+	if dCfg.UnwrapBatchSize <= 0 {
+		dCfg.UnwrapBatchSize = defaultUnwrapBatchSize
+	}
 	if dCfg.ProviderDelay <= 0 {
 		dCfg.ProviderDelay = defaultProviderDelay
 	}
@@ -239,6 +332,15 @@ func (dCfg *Debug) applyDefaults() {
 	if dCfg.ReauthInterval <= 0 {
 		dCfg.ReauthInterval = defaultReauthInterval
 	}
+	if dCfg.ReplayFilterSize <= 0 {
+		dCfg.ReplayFilterSize = defaultReplayFilterSize
+	}
+	if dCfg.ReplayFilterFalsePositiveRate <= 0 {
+		dCfg.ReplayFilterFalsePositiveRate = defaultReplayFilterFalsePositiveRate
+	}
+	if dCfg.ReplayFilterSnapshotInterval <= 0 {
+		dCfg.ReplayFilterSnapshotInterval = defaultReplayFilterSnapshotInterval
+	}
 }
 
 // Logging is the Katzenpost server logging configuration.
@@ -251,18 +353,104 @@ type Logging struct {
 
 	// Level specifies the log level.
 	Level string
+
+	// ModuleLevels specifies per-module log level overrides.  Each override
+	// also applies to the module's sub-modules, for example `incoming`
+	// applies to `incoming:1`, and `scheduler` to `scheduler/bolt`.
+	ModuleLevels map[string]string
+
+	// Format specifies the log format, either `text` (default) or `json`.
+	Format string
+
+	// MaxFileSize specifies the size in bytes at which the log File is
+	// rotated, 0 disables size based rotation.
+	MaxFileSize int64
+
+	// RotateInterval specifies the interval at which the log File is
+	// rotated in milliseconds, 0 disables time based rotation.
+	RotateInterval Duration
+
+	// MaxFiles specifies the number of rotated log files to keep.
+	MaxFiles int
+
+	// Redact replaces user identifiers and public keys in the log output
+	// with keyed hashes.  The key is regenerated each time the server is
+	// started, so the hashes can only be correlated within a single run.
+	Redact bool
 }
 
-func (lCfg *Logging) validate() error {
-	lvl := strings.ToUpper(lCfg.Level)
+// IsUnsafe returns true iff DEBUG logging is enabled for any module.
+func (lCfg *Logging) IsUnsafe() bool {
+	if lCfg.Level == "DEBUG" {
+		return true
+	}
+	for _, v := range lCfg.ModuleLevels {
+		if v == "DEBUG" {
+			return true
+		}
+	}
+	return false
+}
+
+// IsRotated returns true iff log file rotation is enabled.
+func (lCfg *Logging) IsRotated() bool {
+	return lCfg.MaxFileSize > 0 || lCfg.RotateInterval > 0
+}
+
+func validateLogLevel(lvl string) (string, error) {
+	lvl = strings.ToUpper(lvl)
 	switch lvl {
 	case "ERROR", "WARNING", "NOTICE", "INFO", "DEBUG":
-	case "":
-		lCfg.Level = defaultLogLevel
+		return lvl, nil
 	default:
+		return "", fmt.Errorf("invalid log level '%v'", lvl)
+	}
+}
+
+func (lCfg *Logging) validate() error {
+	if lCfg.Level == "" {
+		lCfg.Level = defaultLogLevel
+	}
+	lvl, err := validateLogLevel(lCfg.Level)
+	if err != nil {
 		return fmt.Errorf("config: Logging: Level '%v' is invalid", lCfg.Level)
 	}
 	lCfg.Level = lvl // Force uppercase.
+
+	for k, v := range lCfg.ModuleLevels {
+		if k == "" {
+			return errors.New("config: Logging: ModuleLevels has an empty module")
+		}
+		if lvl, err = validateLogLevel(v); err != nil {
+			return fmt.Errorf("config: Logging: ModuleLevels: '%v': %v", k, err)
+		}
+		lCfg.ModuleLevels[k] = lvl
+	}
+
+	lCfg.Format = strings.ToLower(lCfg.Format)
+	switch lCfg.Format {
+	case LogFormatText, LogFormatJSON:
+	case "":
+		lCfg.Format = LogFormatText
+	default:
+		return fmt.Errorf("config: Logging: Format '%v' is invalid", lCfg.Format)
+	}
+
+	if lCfg.MaxFileSize < 0 {
+		return fmt.Errorf("config: Logging: MaxFileSize %v is invalid", lCfg.MaxFileSize)
+	}
+	if lCfg.RotateInterval < 0 {
+		return fmt.Errorf("config: Logging: RotateInterval %v is invalid", lCfg.RotateInterval)
+	}
+	if lCfg.MaxFiles < 0 {
+		return fmt.Errorf("config: Logging: MaxFiles %v is invalid", lCfg.MaxFiles)
+	}
+	if lCfg.IsRotated() && lCfg.File == "" {
+		return errors.New("config: Logging: Rotation requires a File")
+	}
+	if lCfg.MaxFiles == 0 {
+		lCfg.MaxFiles = defaultLogMaxFiles
+	}
 	return nil
 }
 
@@ -312,6 +500,19 @@ type SQLDB struct {
 	//
 	//  - pgx: https://godoc.org/github.com/jackc/pgx#ParseConnectionString
 	DataSourceName string
+
+	// DataSourceNameFile specifies the path to a file containing the
+	// DataSourceName, so that database credentials need not be stored in
+	// the config file.  Trailing newlines are ignored.
+	DataSourceNameFile string
+
+	dataSourceName string
+}
+
+// ResolvedDataSourceName returns the DataSourceName, as read from the
+// DataSourceNameFile if set.
+func (sCfg *SQLDB) ResolvedDataSourceName() string {
+	return sCfg.dataSourceName
 }
 
 func (sCfg *SQLDB) validate() error {
@@ -320,12 +521,42 @@ func (sCfg *SQLDB) validate() error {
 	default:
 		return fmt.Errorf("config: SQLDB: Backend '%v' is invalid", sCfg.Backend)
 	}
-	if sCfg.DataSourceName == "" {
-		return fmt.Errorf("config: SQLDB: DataSourceName '%v' is invalid", sCfg.DataSourceName)
+	if sCfg.DataSourceNameFile == "" {
+		if sCfg.DataSourceName == "" {
+			return fmt.Errorf("config: SQLDB: DataSourceName '%v' is invalid", sCfg.DataSourceName)
+		}
+		sCfg.dataSourceName = sCfg.DataSourceName
+		return nil
 	}
+
+	if sCfg.DataSourceName != "" {
+		return errors.New("config: SQLDB: DataSourceName and DataSourceNameFile are mutually exclusive")
+	}
+	dsn, err := readSecretFile(sCfg.DataSourceNameFile)
+	if err != nil {
+		return fmt.Errorf("config: SQLDB: DataSourceNameFile is invalid: %v", err)
+	}
+	sCfg.dataSourceName = dsn
 	return nil
 }
 
+// readSecretFile returns the contents of the file f, which holds a secret
+// value, without any trailing newlines.
+func readSecretFile(f string) (string, error) {
+	if !filepath.IsAbs(f) {
+		return "", fmt.Errorf("'%v' is not an absolute path", f)
+	}
+	b, err := ioutil.ReadFile(f)
+	if err != nil {
+		return "", err
+	}
+	s := strings.TrimRight(string(b), "\r\n")
+	if s == "" {
+		return "", fmt.Errorf("'%v' is empty", f)
+	}
+	return s, nil
+}
+
 // UserDB is the userdb backend configuration.
 type UserDB struct {
 	// Backend is the active userdb backend.  If left empty, the BoltUserDB
@@ -545,9 +776,12 @@ func (pCfg *Provider) validate() error {
 type PKI struct {
 	// Nonvoting is a non-voting directory authority.
 	Nonvoting *Nonvoting
+
+	// Static is a file based PKI, suitable for testing.
+	Static *Static
 }
 
-func (pCfg *PKI) validate() error {
+func (pCfg *PKI) validate(dCfg *Debug) error {
 	nrCfg := 0
 	if pCfg.Nonvoting != nil {
 		if err := pCfg.Nonvoting.validate(); err != nil {
@@ -555,6 +789,12 @@ func (pCfg *PKI) validate() error {
 		}
 		nrCfg++
 	}
+	if pCfg.Static != nil {
+		if err := pCfg.Static.validate(dCfg.AllowUnsignedPKI); err != nil {
+			return err
+		}
+		nrCfg++
+	}
 	if nrCfg != 1 {
 		return fmt.Errorf("config: Only one authority backend should be configured, got: %v", nrCfg)
 	}
@@ -583,7 +823,48 @@ func (nCfg *Nonvoting) validate() error {
 	return nil
 }
 
+// Static is a file based PKI, where documents are read from, and descriptors
+// are written to, directories.
+type Static struct {
+	// DocumentDir is the absolute path to the directory containing the PKI
+	// documents, one per epoch.
+	DocumentDir string
+
+	// DescriptorDir is the absolute path to the directory that descriptors
+	// will be written to.
+	DescriptorDir string
+
+	// PublicKey is the public key in Base64 or Base16 format of the
+	// authority that signed the documents.  It must be left empty iff
+	// Debug.AllowUnsignedPKI is set.
+	PublicKey string
+}
+
+func (sCfg *Static) validate(allowUnsigned bool) error {
+	for _, d := range []string{sCfg.DocumentDir, sCfg.DescriptorDir} {
+		if !filepath.IsAbs(d) {
+			return fmt.Errorf("config: PKI/Static: '%v' is not an absolute path", d)
+		}
+	}
+
+	if allowUnsigned {
+		if sCfg.PublicKey != "" {
+			return errors.New("config: PKI/Static: PublicKey and Debug.AllowUnsignedPKI are mutually exclusive")
+		}
+		return nil
+	}
+	var pubKey eddsa.PublicKey
+	if err := pubKey.FromString(sCfg.PublicKey); err != nil {
+		return fmt.Errorf("config: PKI/Static: Invalid PublicKey: %v", err)
+	}
+
+	return nil
+}
+
 // Management is the Katzenpost management interface configuration.
+//
+// Every command that alters the server state is recorded in `audit.log`
+// under the DataDir, regardless of the Logging configuration.
 type Management struct {
 	// Enable enables the management interface.
 	Enable bool
@@ -591,6 +872,52 @@ type Management struct {
 	// Path specifies the path to the manaagment interface socket.  If left
 	// empty it will use `management_sock` under the DataDir.
 	Path string
+
+	// TCPAddress specifies the address to listen on for authenticated
+	// management connections over TCP.  If left empty, the management
+	// interface is only available via the socket.
+	TCPAddress string
+
+	// Client is the list of clients that may connect via TCPAddress.
+	Client []*ManagementClient
+}
+
+// ManagementClient is a client that is allowed to use the TCP management
+// interface.
+type ManagementClient struct {
+	// Name is the client name, used to identify the client in the audit log.
+	Name string
+
+	// PublicKey is the client's Ed25519 public key in Base64 or Base16
+	// format.
+	PublicKey string
+
+	// Role is the role of the client, one of `read-only`, `user-admin`, or
+	// `operator`.
+	Role string
+}
+
+func (cCfg *ManagementClient) validate() error {
+	if cCfg.Name == "" || len(cCfg.Name) > maxManagementClientName {
+		return fmt.Errorf("config: Management: Client Name '%v' is invalid", cCfg.Name)
+	}
+	for _, r := range cCfg.Name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return fmt.Errorf("config: Management: Client Name '%v' is invalid", cCfg.Name)
+		}
+	}
+
+	var pubKey eddsa.PublicKey
+	if err := pubKey.FromString(cCfg.PublicKey); err != nil {
+		return fmt.Errorf("config: Management: Client '%v' has an invalid PublicKey: %v", cCfg.Name, err)
+	}
+
+	switch cCfg.Role {
+	case RoleReadOnly, RoleUserAdmin, RoleOperator:
+	default:
+		return fmt.Errorf("config: Management: Client '%v' has an invalid Role: '%v'", cCfg.Name, cCfg.Role)
+	}
+	return nil
 }
 
 func (mCfg *Management) applyDefaults(sCfg *Server) {
@@ -606,16 +933,112 @@ func (mCfg *Management) validate() error {
 	if !filepath.IsAbs(mCfg.Path) {
 		return fmt.Errorf("config: Management: Path '%v' is not an absolute path", mCfg.Path)
 	}
+
+	if mCfg.TCPAddress == "" {
+		if len(mCfg.Client) != 0 {
+			return errors.New("config: Management: Client set without a TCPAddress")
+		}
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(mCfg.TCPAddress); err != nil {
+		return fmt.Errorf("config: Management: TCPAddress '%v' is invalid: %v", mCfg.TCPAddress, err)
+	}
+	if len(mCfg.Client) == 0 {
+		return errors.New("config: Management: TCPAddress set without any Clients")
+	}
+	names := make(map[string]bool)
+	keys := make(map[string]bool)
+	for _, v := range mCfg.Client {
+		if err := v.validate(); err != nil {
+			return err
+		}
+		if names[v.Name] {
+			return fmt.Errorf("config: Management: Client '%v' is defined more than once", v.Name)
+		}
+		names[v.Name] = true
+
+		var pubKey eddsa.PublicKey
+		pubKey.FromString(v.PublicKey)
+		k := string(pubKey.Bytes())
+		if keys[k] {
+			return fmt.Errorf("config: Management: Client '%v' PublicKey is used more than once", v.Name)
+		}
+		keys[k] = true
+	}
+	return nil
+}
+
+// Health is the Katzenpost HTTP health check endpoint configuration.
+type Health struct {
+	// Enable enables the HTTP health check endpoints.
+	Enable bool
+
+	// Address specifies the address to listen on for the `/healthz` and
+	// `/readyz` endpoints.  If left empty it will use `127.0.0.1:3220`.
+	Address string
+}
+
+func (hCfg *Health) applyDefaults() {
+	if hCfg.Address == "" {
+		hCfg.Address = defaultHealthAddress
+	}
+}
+
+func (hCfg *Health) validate() error {
+	if !hCfg.Enable {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(hCfg.Address); err != nil {
+		return fmt.Errorf("config: Health: Address '%v' is invalid: %v", hCfg.Address, err)
+	}
+	return nil
+}
+
+// KeyEncryption is the Katzenpost private key at rest encryption
+// configuration.
+type KeyEncryption struct {
+	// Enable enables encrypting the identity, link and mix private keys
+	// at rest.
+	Enable bool
+
+	// PassphraseFile specifies the path to a file containing the passphrase
+	// used to derive the key encryption key.  Trailing newlines are ignored.
+	PassphraseFile string
+
+	// KeyFile specifies the path to a file, the entire contents of which
+	// will be used to derive the key encryption key.
+	KeyFile string
+
+	// Passphrase specifies the passphrase.  If neither PassphraseFile,
+	// KeyFile, or Passphrase are set, the passphrase will be read from
+	// stdin.
+	Passphrase []byte `toml:"-"`
+}
+
+func (kCfg *KeyEncryption) validate() error {
+	if !kCfg.Enable {
+		return nil
+	}
+	if kCfg.PassphraseFile != "" && kCfg.KeyFile != "" {
+		return errors.New("config: KeyEncryption: PassphraseFile and KeyFile are mutually exclusive")
+	}
+	for _, f := range []string{kCfg.PassphraseFile, kCfg.KeyFile} {
+		if f != "" && !filepath.IsAbs(f) {
+			return fmt.Errorf("config: KeyEncryption: '%v' is not an absolute path", f)
+		}
+	}
 	return nil
 }
 
 // Config is the top level Katzenpost server configuration.
 type Config struct {
-	Server     *Server
-	Logging    *Logging
-	Provider   *Provider
-	PKI        *PKI
-	Management *Management
+	Server        *Server
+	Logging       *Logging
+	Provider      *Provider
+	PKI           *PKI
+	Management    *Management
+	Health        *Health
+	KeyEncryption *KeyEncryption
 
 	Debug *Debug
 }
@@ -640,12 +1063,19 @@ func (cfg *Config) FixupAndValidate() error {
 	if cfg.Management == nil {
 		cfg.Management = &Management{}
 	}
+	if cfg.Health == nil {
+		cfg.Health = &Health{}
+	}
+	if cfg.KeyEncryption == nil {
+		cfg.KeyEncryption = &KeyEncryption{}
+	}
 
 	// Perform basic validation.
+	cfg.Server.applyDefaults()
 	if err := cfg.Server.validate(); err != nil {
 		return err
 	}
-	if err := cfg.PKI.validate(); err != nil {
+	if err := cfg.PKI.validate(cfg.Debug); err != nil {
 		return err
 	}
 	if cfg.Server.IsProvider {
@@ -666,7 +1096,17 @@ func (cfg *Config) FixupAndValidate() error {
 	if err := cfg.Management.validate(); err != nil {
 		return err
 	}
+	cfg.Health.applyDefaults()
+	if err := cfg.Health.validate(); err != nil {
+		return err
+	}
+	if err := cfg.KeyEncryption.validate(); err != nil {
+		return err
+	}
 	cfg.Debug.applyDefaults()
+	if err := cfg.Debug.validate(); err != nil {
+		return err
+	}
 
 	var err error
 	cfg.Server.Identifier, err = idna.Lookup.ToASCII(cfg.Server.Identifier)
@@ -678,7 +1118,8 @@ func (cfg *Config) FixupAndValidate() error {
 }
 
 // Load parses and validates the provided buffer b as a config file body and
-// returns the Config.
+// returns the Config.  Values set via environment variables, as described
+// by EnvPrefix, take precedence over those in the config file.
 func Load(b []byte) (*Config, error) {
 	cfg := new(Config)
 	md, err := toml.Decode(string(b), cfg)
@@ -688,6 +1129,9 @@ func Load(b []byte) (*Config, error) {
 	if undecoded := md.Undecoded(); len(undecoded) != 0 {
 		return nil, fmt.Errorf("config: Undecoded keys in config file: %v", undecoded)
 	}
+	if err := cfg.applyEnvOverrides(os.LookupEnv); err != nil {
+		return nil, err
+	}
 	if err := cfg.FixupAndValidate(); err != nil {
 		return nil, err
 	}
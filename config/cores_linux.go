@@ -0,0 +1,56 @@
+// cores_linux.go - Linux CPU topology detection.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+const sysCPUDir = "/sys/devices/system/cpu"
+
+func numPhysicalCores() int {
+	nCPUs := runtime.NumCPU()
+
+	// Each physical core is uniquely identified by the package and core
+	// IDs.  Offline CPUs do not have topology information, and are skipped.
+	cpus, err := filepath.Glob(filepath.Join(sysCPUDir, "cpu[0-9]*"))
+	if err != nil {
+		return nCPUs
+	}
+	cores := make(map[[2]string]bool)
+	for _, cpu := range cpus {
+		pkgID, err := ioutil.ReadFile(filepath.Join(cpu, "topology", "physical_package_id"))
+		if err != nil {
+			continue
+		}
+		coreID, err := ioutil.ReadFile(filepath.Join(cpu, "topology", "core_id"))
+		if err != nil {
+			continue
+		}
+		cores[[2]string{strings.TrimSpace(string(pkgID)), strings.TrimSpace(string(coreID))}] = true
+	}
+
+	// The process may be restricted to a subset of the logical CPUs, in
+	// which case, the number of usable logical CPUs is the upper bound.
+	if n := len(cores); n > 0 && n < nCPUs {
+		return n
+	}
+	return nCPUs
+}
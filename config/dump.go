@@ -0,0 +1,40 @@
+// dump.go - Katzenpost server effective configuration output.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"io"
+
+	"github.com/BurntSushi/toml"
+)
+
+const redactedSecret = "[redacted]"
+
+// Dump writes the configuration to w as TOML, including every default that
+// was applied by FixupAndValidate.  Secrets are replaced with a placeholder
+// unless withSecrets is set.
+func (cfg *Config) Dump(w io.Writer, withSecrets bool) error {
+	c := *cfg
+	if !withSecrets && c.Provider != nil && c.Provider.SQLDB != nil && c.Provider.SQLDB.DataSourceName != "" {
+		pCfg := *c.Provider
+		sqlCfg := *pCfg.SQLDB
+		sqlCfg.DataSourceName = redactedSecret
+		pCfg.SQLDB = &sqlCfg
+		c.Provider = &pCfg
+	}
+	return toml.NewEncoder(w).Encode(&c)
+}
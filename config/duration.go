@@ -0,0 +1,57 @@
+// duration.go - Katzenpost server config durations.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// Duration is a time interval in milliseconds.  In the config file it may
+// be specified either as an integer number of milliseconds, or as a duration
+// string such as `30s` or `500ms`.
+type Duration int
+
+// UnmarshalTOML implements the toml.Unmarshaler interface.
+func (d *Duration) UnmarshalTOML(v interface{}) error {
+	switch t := v.(type) {
+	case int64:
+		*d = Duration(t)
+		return nil
+	case string:
+		return d.fromString(t)
+	default:
+		return fmt.Errorf("config: invalid duration: %v", v)
+	}
+}
+
+// MarshalText implements the encoding.TextMarshaler interface.
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte((time.Duration(d) * time.Millisecond).String()), nil
+}
+
+func (d *Duration) fromString(s string) error {
+	pd, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("config: invalid duration '%v': %v", s, err)
+	}
+	if pd%time.Millisecond != 0 {
+		return fmt.Errorf("config: invalid duration '%v': not a whole number of milliseconds", s)
+	}
+	*d = Duration(pd / time.Millisecond)
+	return nil
+}
@@ -0,0 +1,145 @@
+// env.go - Katzenpost server config environment overrides.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// EnvPrefix is the prefix of the environment variables that override config
+// values.  The variable name is the prefix followed by the upper case path
+// to the value, separated by `_` (eg: `KATZENPOST_DEBUG_SENDSLACK`, or
+// `KATZENPOST_PROVIDER_SQLDB_DATASOURCENAME`).  Lists are comma separated.
+// Values in maps and lists of tables can not be overridden.
+const EnvPrefix = "KATZENPOST"
+
+var durationType = reflect.TypeOf(Duration(0))
+
+// applyEnvOverrides sets the config values that have a corresponding
+// environment variable, as returned by lookupFn.
+func (cfg *Config) applyEnvOverrides(lookupFn func(string) (string, bool)) error {
+	_, err := applyEnvStruct(reflect.ValueOf(cfg).Elem(), EnvPrefix, lookupFn)
+	return err
+}
+
+func applyEnvStruct(v reflect.Value, prefix string, lookupFn func(string) (string, bool)) (bool, error) {
+	isSet := false
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" || sf.Tag.Get("toml") == "-" {
+			continue
+		}
+		name := prefix + "_" + strings.ToUpper(sf.Name)
+		fv := v.Field(i)
+
+		if fv.Kind() == reflect.Ptr && fv.Type().Elem().Kind() == reflect.Struct {
+			// Only sections that have an override are allocated, so that
+			// absent optional sections stay absent.
+			sv := fv
+			if fv.IsNil() {
+				sv = reflect.New(fv.Type().Elem())
+			}
+			ok, err := applyEnvStruct(sv.Elem(), name, lookupFn)
+			if err != nil {
+				return false, err
+			}
+			if ok && fv.IsNil() {
+				fv.Set(sv)
+			}
+			isSet = isSet || ok
+			continue
+		}
+
+		s, ok := lookupFn(name)
+		if !ok {
+			continue
+		}
+		if err := setEnvValue(fv, s); err != nil {
+			return false, fmt.Errorf("config: Invalid environment variable %v: %v", name, err)
+		}
+		isSet = true
+	}
+	return isSet, nil
+}
+
+func setEnvValue(v reflect.Value, s string) error {
+	if v.Type() == durationType {
+		var d Duration
+		if err := d.fromString(s); err != nil {
+			// Bare integers are milliseconds, as in the config file.
+			n, nErr := strconv.ParseInt(s, 10, 0)
+			if nErr != nil {
+				return err
+			}
+			d = Duration(n)
+		}
+		v.Set(reflect.ValueOf(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		switch v.Type().Elem().Kind() {
+		case reflect.Ptr, reflect.Struct, reflect.Slice, reflect.Map:
+			return fmt.Errorf("unsupported type: %v", v.Type())
+		}
+		var elems []string
+		if s != "" {
+			elems = strings.Split(s, ",")
+		}
+		sv := reflect.MakeSlice(v.Type(), len(elems), len(elems))
+		for i, e := range elems {
+			if err := setEnvValue(sv.Index(i), strings.TrimSpace(e)); err != nil {
+				return err
+			}
+		}
+		v.Set(sv)
+	default:
+		return fmt.Errorf("unsupported type: %v", v.Type())
+	}
+	return nil
+}
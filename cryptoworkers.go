@@ -0,0 +1,209 @@
+// cryptoworkers.go - Katzenpost server Sphinx crypto worker pool.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/core/thwack"
+	"github.com/katzenpost/server/internal/cryptoworker"
+	"github.com/katzenpost/server/internal/glue"
+	"github.com/katzenpost/server/internal/management"
+	"gopkg.in/op/go-logging.v1"
+)
+
+const (
+	cmdSphinxWorkers    = "SPHINX_WORKERS"
+	cmdSetSphinxWorkers = "SET_SPHINX_WORKERS"
+
+	autoscaleInterval = 10 * time.Second
+
+	// The pool is grown if the mean unwrap queue dwell time exceeds
+	// UnwrapDelay / autoscaleGrowDivisor, and shrunk if it stays under
+	// UnwrapDelay / autoscaleShrinkDivisor for autoscaleShrinkIntervals
+	// consecutive intervals.
+	autoscaleGrowDivisor     = 2
+	autoscaleShrinkDivisor   = 10
+	autoscaleShrinkIntervals = 6
+)
+
+type cryptoWorkers struct {
+	sync.Mutex
+
+	glue       glue.Glue
+	log        *logging.Logger
+	incomingCh <-chan interface{}
+	nrPending  *int64
+
+	workers []*cryptoworker.Worker
+	nextID  int
+
+	autoscale     bool
+	maxWorkers    int
+	lastAutoscale time.Duration
+	nLowIntervals int
+	lastMeanDwell time.Duration
+	lastNrSampled uint64
+}
+
+func (c *cryptoWorkers) setCount(n int) {
+	// The caller must hold the lock.
+	for len(c.workers) < n {
+		c.workers = append(c.workers, cryptoworker.New(c.glue, c.incomingCh, c.nrPending, c.nextID))
+		c.nextID++
+	}
+	for len(c.workers) > n {
+		idx := len(c.workers) - 1
+		c.workers[idx].Halt()
+		c.workers[idx] = nil
+		c.workers = c.workers[:idx]
+	}
+}
+
+// Reshadow forces every worker to re-shadow it's copy of the mix key(s).
+func (c *cryptoWorkers) Reshadow() {
+	c.Lock()
+	defer c.Unlock()
+
+	for _, w := range c.workers {
+		w.UpdateMixKeys()
+	}
+}
+
+// Autoscale grows or shrinks the pool based on the unwrap queue dwell time,
+// if enabled.  It is called from the periodic timer.
+func (c *cryptoWorkers) Autoscale() {
+	c.Lock()
+	defer c.Unlock()
+
+	now := c.glue.Clock().Mono()
+	if !c.autoscale || now-c.lastAutoscale < autoscaleInterval {
+		return
+	}
+	c.lastAutoscale = now
+
+	// Collect the dwell time of the packets processed since the last
+	// invocation.
+	var totalDwell time.Duration
+	var nrSampled uint64
+	for _, w := range c.workers {
+		d, n := w.DwellStats()
+		totalDwell += d
+		nrSampled += n
+	}
+	c.lastNrSampled = nrSampled
+	if nrSampled == 0 {
+		c.lastMeanDwell = 0
+		return
+	}
+	meanDwell := totalDwell / time.Duration(nrSampled)
+	c.lastMeanDwell = meanDwell
+
+	unwrapDelay := time.Duration(c.glue.Config().Debug.UnwrapDelay) * time.Millisecond
+	nWorkers := len(c.workers)
+	switch {
+	case meanDwell > unwrapDelay/autoscaleGrowDivisor:
+		c.nLowIntervals = 0
+		if nWorkers < c.maxWorkers {
+			c.log.Noticef("Growing Sphinx workers: %v -> %v (Mean dwell: %v)", nWorkers, nWorkers+1, meanDwell)
+			c.setCount(nWorkers + 1)
+		}
+	case meanDwell < unwrapDelay/autoscaleShrinkDivisor:
+		if c.nLowIntervals++; c.nLowIntervals >= autoscaleShrinkIntervals {
+			c.nLowIntervals = 0
+			if nWorkers > 1 {
+				c.log.Noticef("Shrinking Sphinx workers: %v -> %v (Mean dwell: %v)", nWorkers, nWorkers-1, meanDwell)
+				c.setCount(nWorkers - 1)
+			}
+		}
+	default:
+		c.nLowIntervals = 0
+	}
+}
+
+// Halt stops all of the workers.
+func (c *cryptoWorkers) Halt() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.setCount(0)
+}
+
+func (c *cryptoWorkers) onSphinxWorkers(conn *thwack.Conn, l string) error {
+	c.Lock()
+	defer c.Unlock()
+
+	if sp := strings.Split(l, " "); len(sp) != 1 {
+		conn.Log().Debugf("%v invalid syntax: '%v'", cmdSphinxWorkers, l)
+		return conn.WriteReply(thwack.StatusSyntaxError)
+	}
+
+	return conn.Writer().PrintfLine("%v %v workers (Max: %v Autoscale: %v Mean dwell: %v Sampled: %v)", thwack.StatusOk, len(c.workers), c.maxWorkers, c.autoscale, c.lastMeanDwell, c.lastNrSampled)
+}
+
+func (c *cryptoWorkers) onSetSphinxWorkers(conn *thwack.Conn, l string) error {
+	c.Lock()
+	defer c.Unlock()
+
+	sp := strings.Split(l, " ")
+	if len(sp) != 2 {
+		conn.Log().Debugf("%v invalid syntax: '%v'", cmdSetSphinxWorkers, l)
+		return conn.WriteReply(thwack.StatusSyntaxError)
+	}
+
+	n, err := strconv.Atoi(sp[1])
+	if err != nil || n < 1 || n > c.maxWorkers {
+		conn.Log().Errorf("%v invalid count: '%v'", cmdSetSphinxWorkers, sp[1])
+		return conn.WriteReply(thwack.StatusSyntaxError)
+	}
+
+	// Explicitly setting the count overrides the autoscaler.
+	if c.autoscale {
+		c.log.Noticef("Disabling Sphinx worker autoscaling due to management request.")
+		c.autoscale = false
+	}
+	c.log.Noticef("Setting Sphinx workers: %v -> %v", len(c.workers), n)
+	c.setCount(n)
+
+	return conn.WriteReply(thwack.StatusOk)
+}
+
+func newCryptoWorkers(glue glue.Glue, incomingCh <-chan interface{}, nrPending *int64) *cryptoWorkers {
+	dCfg := glue.Config().Debug
+	c := &cryptoWorkers{
+		glue:          glue,
+		log:           glue.LogBackend().GetLogger("cryptoworkers"),
+		incomingCh:    incomingCh,
+		nrPending:     nrPending,
+		workers:       make([]*cryptoworker.Worker, 0, dCfg.MaxSphinxWorkers),
+		autoscale:     dCfg.AutoscaleSphinxWorkers,
+		maxWorkers:    dCfg.MaxSphinxWorkers,
+		lastAutoscale: glue.Clock().Mono(),
+	}
+	c.setCount(dCfg.NumSphinxWorkers)
+	c.log.Noticef("Started %v Sphinx workers (Max: %v Autoscale: %v).", dCfg.NumSphinxWorkers, dCfg.MaxSphinxWorkers, dCfg.AutoscaleSphinxWorkers)
+
+	if glue.Management() != nil {
+		glue.Management().RegisterCommand(cmdSphinxWorkers, management.RoleReadOnly, c.onSphinxWorkers)
+		glue.Management().RegisterCommand(cmdSetSphinxWorkers, management.RoleOperator, c.onSetSphinxWorkers)
+	}
+
+	return c
+}
@@ -0,0 +1,177 @@
+// drain.go - Katzenpost server graceful drain.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/katzenpost/core/thwack"
+)
+
+const (
+	cmdDrain = "DRAIN"
+
+	// DefaultDrainDeadline is the drain deadline used when none is
+	// specified.
+	DefaultDrainDeadline = 10 * time.Minute
+
+	drainProgressInterval = 10 * time.Second
+)
+
+type drainState struct {
+	startedAt    time.Duration
+	deadline     time.Duration
+	lastProgress time.Duration
+	isDone       bool
+}
+
+// Drain stops accepting new connections and publishing descriptors for
+// future epochs, and shuts down the server once the queued packets have been
+// forwarded and all clients have disconnected, or the deadline passes.
+//
+// Calls made while a drain is already in progress have no effect.
+func (s *Server) Drain(deadline time.Duration) {
+	s.drainLock.Lock()
+	defer s.drainLock.Unlock()
+
+	if s.drain != nil || s.isHalting {
+		return
+	}
+
+	now := s.clock.Mono()
+	s.drain = &drainState{
+		startedAt:    now,
+		deadline:     now + deadline,
+		lastProgress: now,
+	}
+	s.log.Noticef("Starting drain (Deadline: %v).", deadline)
+
+	// Existing connections are left alone, both so that the queued packets
+	// can be forwarded, and so that clients can retrieve their messages.
+	s.pki.SetDraining()
+	for _, l := range s.listeners {
+		l.StopAccepting()
+	}
+}
+
+func (s *Server) isDraining() bool {
+	s.drainLock.Lock()
+	defer s.drainLock.Unlock()
+	return s.drain != nil
+}
+
+// stopDrain prevents drains from being started or completed, once the server
+// is shutting down.
+func (s *Server) stopDrain() {
+	s.drainLock.Lock()
+	defer s.drainLock.Unlock()
+	s.isHalting = true
+}
+
+func (s *Server) drainBacklog() (int, int) {
+	// Packets pending the Sphinx workers will end up in the scheduler, and
+	// packets leaving the scheduler wait in the per-peer send queues, so
+	// they are all counted as queued.
+	//
+	// Each stage counts a packet before the previous stage stops counting
+	// it, so reading the stages in order from the first to the last never
+	// misses a packet that is being handed off.  At worst the packet is
+	// counted twice.
+	nrQueued := int(atomic.LoadInt64(&s.nrUnwrapping))
+	nrQueued += s.scheduler.QueueLength()
+	nrQueued += s.connector.QueueLength()
+
+	nrClients := 0
+	for _, l := range s.listeners {
+		nrClients += l.NrClientConns()
+	}
+	return nrQueued, nrClients
+}
+
+// checkDrain logs the drain progress, and shuts the server down once the
+// drain has completed.
+func (s *Server) checkDrain() {
+	s.drainLock.Lock()
+	defer s.drainLock.Unlock()
+
+	d := s.drain
+	if d == nil || d.isDone || s.isHalting {
+		return
+	}
+
+	now := s.clock.Mono()
+	nrQueued, nrClients := s.drainBacklog()
+	switch {
+	case nrQueued == 0 && nrClients == 0:
+		s.log.Noticef("Drain completed in %v.", now-d.startedAt)
+	case now >= d.deadline:
+		s.log.Warningf("Drain deadline passed, discarding %v queued packets, and %v client connections.", nrQueued, nrClients)
+	default:
+		if now-d.lastProgress >= drainProgressInterval {
+			d.lastProgress = now
+			s.log.Noticef("Draining: %v queued packets, %v client connections, %v remaining.", nrQueued, nrClients, d.deadline-now)
+		}
+		return
+	}
+
+	// This is called from the periodic timer, which is torn down as part of
+	// the shutdown, so the shutdown must be done async.
+	d.isDone = true
+	go s.Shutdown()
+}
+
+func (s *Server) drainStatus() string {
+	s.drainLock.Lock()
+	defer s.drainLock.Unlock()
+
+	d := s.drain
+	if d == nil {
+		return "Not draining"
+	}
+	nrQueued, nrClients := s.drainBacklog()
+	remaining := d.deadline - s.clock.Mono()
+	if remaining < 0 {
+		remaining = 0
+	}
+	return fmt.Sprintf("Draining (Queued: %v Clients: %v Remaining: %v)", nrQueued, nrClients, remaining)
+}
+
+func (s *Server) onDrain(c *thwack.Conn, l string) error {
+	deadline := DefaultDrainDeadline
+	sp := strings.Split(l, " ")
+	switch len(sp) {
+	case 1:
+	case 2:
+		secs, err := strconv.ParseUint(sp[1], 10, 32)
+		if err != nil || secs == 0 {
+			c.Log().Debugf("%v invalid deadline: '%v'", cmdDrain, l)
+			return c.WriteReply(thwack.StatusSyntaxError)
+		}
+		deadline = time.Duration(secs) * time.Second
+	default:
+		c.Log().Debugf("%v invalid syntax: '%v'", cmdDrain, l)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+
+	// Starting a drain that is already in progress just reports the status.
+	s.Drain(deadline)
+	return c.Writer().PrintfLine("%v %v", thwack.StatusOk, s.drainStatus())
+}
@@ -0,0 +1,47 @@
+// drainsignal_posix.go - Katzenpost server drain signal.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package server
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// startDrainSignal starts a drain with the default deadline on SIGUSR1.
+func (s *Server) startDrainSignal() {
+	s.drainSigCh = make(chan os.Signal, 1)
+	signal.Notify(s.drainSigCh, syscall.SIGUSR1)
+
+	go func(ch <-chan os.Signal) {
+		for range ch {
+			s.log.Noticef("Received SIGUSR1, draining.")
+			s.Drain(DefaultDrainDeadline)
+		}
+	}(s.drainSigCh)
+}
+
+func (s *Server) stopDrainSignal() {
+	if s.drainSigCh != nil {
+		signal.Stop(s.drainSigCh)
+		close(s.drainSigCh)
+		s.drainSigCh = nil
+	}
+}
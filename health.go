@@ -0,0 +1,260 @@
+// health.go - Katzenpost server HTTP health checks.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	cpki "github.com/katzenpost/core/pki"
+	"github.com/katzenpost/core/worker"
+	"github.com/katzenpost/server/internal/clock"
+	"github.com/katzenpost/server/internal/constants"
+	"github.com/katzenpost/server/internal/glue"
+	"github.com/katzenpost/server/userdb"
+	"gopkg.in/op/go-logging.v1"
+)
+
+const (
+	healthCheckTimeout = 5 * time.Second
+
+	// healthProbeUser is the user name used to query the provider backends.
+	// It does not need to exist.
+	healthProbeUser = "healthcheck"
+)
+
+var errHealthCheckTimeout = errors.New("timed out")
+
+type healthCheck struct {
+	Name   string `json:"name"`
+	Ok     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type healthReport struct {
+	Ok     bool          `json:"ok"`
+	Epoch  uint64        `json:"epoch"`
+	Checks []healthCheck `json:"checks"`
+}
+
+type healthServer struct {
+	worker.Worker
+
+	s    *Server
+	glue glue.Glue
+	log  *logging.Logger
+
+	l   net.Listener
+	srv *http.Server
+}
+
+func (h *healthServer) Halt() {
+	// Wait for the in-flight requests, since they call into components
+	// that are about to be torn down.
+	ctx, cancelFn := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancelFn()
+	if err := h.srv.Shutdown(ctx); err != nil {
+		h.srv.Close()
+	}
+	h.Worker.Halt()
+}
+
+func (h *healthServer) worker() {
+	h.log.Noticef("Listening on: %v", h.l.Addr())
+	if err := h.srv.Serve(h.l); err != http.ErrServerClosed {
+		h.log.Errorf("Critical serve failure: %v", err)
+	}
+}
+
+// runWithTimeout runs fn, giving up after healthCheckTimeout, so that a
+// wedged backend is reported as such instead of hanging the request.
+func runWithTimeout(fn func() error) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- fn()
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-time.After(healthCheckTimeout):
+		return errHealthCheckTimeout
+	}
+}
+
+func newHealthCheck(name string, err error) healthCheck {
+	c := healthCheck{Name: name, Ok: err == nil}
+	if err != nil {
+		c.Detail = err.Error()
+	}
+	return c
+}
+
+// livenessChecks returns the checks for the components that the server can
+// not recover from the failure of on it's own.
+func (h *healthServer) livenessChecks() []healthCheck {
+	provider := h.glue.Provider()
+	if provider == nil {
+		return nil
+	}
+
+	u := []byte(healthProbeUser)
+	return []healthCheck{
+		newHealthCheck("userdb", runWithTimeout(func() error {
+			// Exists may be answered from a cache, while Identity has to
+			// query the database.  The probe user is not expected to exist.
+			_, err := provider.UserDB().Identity(u)
+			switch err {
+			case nil, userdb.ErrNoSuchUser, userdb.ErrNoIdentity:
+				return nil
+			default:
+				return err
+			}
+		})),
+		newHealthCheck("spool", runWithTimeout(func() error {
+			_, _, _, err := provider.Spool().Get(u, false)
+			return err
+		})),
+	}
+}
+
+// readinessChecks returns the checks for if the server is currently a useful
+// part of the network.
+func (h *healthServer) readinessChecks(epoch uint64) []healthCheck {
+	var checks []healthCheck
+
+	// There must be a document for the current epoch, that lists this node.
+	// Documents that do not list this node are rejected by the PKI worker,
+	// so the reason is used to tell the two cases apart.
+	var docErr, selfErr error
+	if ent := h.glue.PKI().EntryForEpoch(epoch); ent == nil {
+		switch err := h.glue.PKI().FailedFetch(epoch); err {
+		case nil, cpki.ErrNoDocument:
+			docErr = fmt.Errorf("no document for epoch %v", epoch)
+			selfErr = docErr
+		default:
+			selfErr = fmt.Errorf("document for epoch %v rejected: %v", epoch, err)
+		}
+	}
+	checks = append(checks, newHealthCheck("pki_document", docErr))
+	checks = append(checks, newHealthCheck("self_descriptor", selfErr))
+
+	// The mix keys must exist for the current and upcoming epochs.
+	var err error
+	for e := epoch; e < epoch+constants.NumMixKeys; e++ {
+		if _, ok := h.glue.MixKeys().Get(e); !ok {
+			err = fmt.Errorf("no mix key for epoch %v", e)
+			break
+		}
+	}
+	checks = append(checks, newHealthCheck("mix_keys", err))
+
+	// At least one of the outgoing connections must be established, the
+	// detail is provided regardless of the outcome.
+	nrConns, nrConnected := h.glue.Connector().NrConns()
+	c := healthCheck{
+		Name:   "outgoing_connections",
+		Ok:     nrConnected > 0,
+		Detail: fmt.Sprintf("%v/%v established", nrConnected, nrConns),
+	}
+	checks = append(checks, c)
+
+	// The local clock must not be known to be skewed, since the node will
+	// not publish descriptors.  The detail is provided regardless of the
+	// outcome.
+	status, skew := h.glue.Skew().Status(h.s.maxClockSkew())
+	checks = append(checks, healthCheck{
+		Name:   "clock_skew",
+		Ok:     status != clock.SkewExcessive,
+		Detail: fmt.Sprintf("%v (Skew: %v Max: %v)", status, skew, h.s.maxClockSkew()),
+	})
+
+	// A draining server is on it's way out.
+	err = nil
+	if h.s.isDraining() {
+		err = errors.New("draining")
+	}
+	checks = append(checks, newHealthCheck("accepting_connections", err))
+
+	return append(checks, h.livenessChecks()...)
+}
+
+func (h *healthServer) writeReport(w http.ResponseWriter, checks []healthCheck, epoch uint64) {
+	r := &healthReport{
+		Ok:     true,
+		Epoch:  epoch,
+		Checks: checks,
+	}
+	if r.Checks == nil {
+		r.Checks = []healthCheck{}
+	}
+	for _, v := range checks {
+		if !v.Ok {
+			r.Ok = false
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Ok {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(r); err != nil {
+		h.log.Debugf("Failed to write health report: %v", err)
+	}
+}
+
+func (h *healthServer) onHealthz(w http.ResponseWriter, req *http.Request) {
+	epoch, _, _ := h.glue.Clock().Epoch()
+	h.writeReport(w, h.livenessChecks(), epoch)
+}
+
+func (h *healthServer) onReadyz(w http.ResponseWriter, req *http.Request) {
+	epoch, _, _ := h.glue.Clock().Epoch()
+	h.writeReport(w, h.readinessChecks(epoch), epoch)
+}
+
+func newHealthServer(s *Server, glue glue.Glue) (*healthServer, error) {
+	h := &healthServer{
+		s:    s,
+		glue: glue,
+		log:  glue.LogBackend().GetLogger("health"),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", h.onHealthz)
+	mux.HandleFunc("/readyz", h.onReadyz)
+	h.srv = &http.Server{
+		Handler:     mux,
+		ReadTimeout: healthCheckTimeout,
+	}
+
+	var err error
+	if h.l, err = net.Listen("tcp", glue.Config().Health.Address); err != nil {
+		return nil, err
+	}
+
+	h.Go(h.worker)
+	return h, nil
+}
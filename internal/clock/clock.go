@@ -0,0 +1,135 @@
+// clock.go - Katzenpost server clock.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package clock provides the source of civil, epoch and monotonic time used
+// by the server's subsystems, so that it may be replaced for testing.
+package clock
+
+import (
+	"sync"
+	"time"
+
+	"github.com/katzenpost/core/epochtime"
+	"github.com/katzenpost/core/monotime"
+)
+
+// Clock is a source of time.
+type Clock interface {
+	// Now returns the current civil time.
+	Now() time.Time
+
+	// Epoch returns the current epoch, the time elapsed since the start of
+	// the epoch, and the time till the next epoch, like `epochtime.Now()`.
+	Epoch() (uint64, time.Duration, time.Duration)
+
+	// Mono returns the current monotonic time, like `monotime.Now()`.
+	Mono() time.Duration
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Epoch() (uint64, time.Duration, time.Duration) {
+	return epochtime.Now()
+}
+
+func (realClock) Mono() time.Duration {
+	return monotime.Now()
+}
+
+// Real is the system clock.
+var Real Clock = realClock{}
+
+// EpochAt returns the epoch, the time elapsed since the start of the epoch,
+// and the time till the next epoch for a given civil time.
+func EpochAt(t time.Time) (uint64, time.Duration, time.Duration) {
+	fromEpoch := t.Sub(epochtime.Epoch)
+	if fromEpoch < 0 {
+		panic("clock: time is before the Katzenpost epoch")
+	}
+	current := uint64(fromEpoch / epochtime.Period)
+	elapsed := fromEpoch - time.Duration(current)*epochtime.Period
+	return current, elapsed, epochtime.Period - elapsed
+}
+
+// EpochStart returns the civil time at which a given epoch starts.
+func EpochStart(epoch uint64) time.Time {
+	return epochtime.Epoch.Add(time.Duration(epoch) * epochtime.Period)
+}
+
+// Jump returns how far the civil time jumped between two readings, as the
+// difference between the elapsed civil time and the elapsed monotonic time.
+//
+// Times returned by `time.Now()` carry a monotonic clock reading, which
+// `time.Time.Sub` prefers over the civil time, so it is stripped first.
+func Jump(now, last time.Time, nowMono, lastMono time.Duration) time.Duration {
+	return now.Round(0).Sub(last.Round(0)) - (nowMono - lastMono)
+}
+
+// Fake is a manually advanced clock, for testing.
+type Fake struct {
+	sync.Mutex
+
+	now  time.Time
+	mono time.Duration
+}
+
+// Now returns the fake civil time.
+func (f *Fake) Now() time.Time {
+	f.Lock()
+	defer f.Unlock()
+	return f.now
+}
+
+// Epoch returns the epoch information for the fake civil time.
+func (f *Fake) Epoch() (uint64, time.Duration, time.Duration) {
+	return EpochAt(f.Now())
+}
+
+// Mono returns the fake monotonic time.
+func (f *Fake) Mono() time.Duration {
+	f.Lock()
+	defer f.Unlock()
+	return f.mono
+}
+
+// Advance advances both the civil and monotonic time by d.
+func (f *Fake) Advance(d time.Duration) {
+	if d < 0 {
+		panic("clock: attempted to advance the clock backwards")
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	f.now = f.now.Add(d)
+	f.mono += d
+}
+
+// Set sets the civil time to t, without altering the monotonic time, to
+// simulate the civil time jumping.
+func (f *Fake) Set(t time.Time) {
+	f.Lock()
+	defer f.Unlock()
+	f.now = t
+}
+
+// NewFake returns a new Fake clock, set to the civil time t.
+func NewFake(t time.Time) *Fake {
+	return &Fake{now: t}
+}
@@ -0,0 +1,139 @@
+// clock_test.go - Katzenpost server clock tests.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package clock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/katzenpost/core/epochtime"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEpochAt(t *testing.T) {
+	require := require.New(t)
+
+	now := time.Now()
+	epoch, elapsed, till := EpochAt(now)
+	require.Equal(epochtime.Period, elapsed+till, "elapsed + till")
+	require.True(now.Equal(EpochStart(epoch).Add(elapsed)), "EpochStart() + elapsed")
+
+	// The first instant of an epoch belongs to it.
+	e, elapsed, till := EpochAt(EpochStart(epoch + 1))
+	require.Equal(epoch+1, e, "EpochAt(EpochStart())")
+	require.Equal(time.Duration(0), elapsed, "EpochAt(EpochStart()): elapsed")
+	require.Equal(epochtime.Period, till, "EpochAt(EpochStart()): till")
+
+	// The real clock agrees, modulo an epoch transition mid-test.
+	realEpoch, _, _ := Real.Epoch()
+	require.True(realEpoch == epoch || realEpoch == epoch+1, "Real.Epoch()")
+}
+
+func TestFake(t *testing.T) {
+	require := require.New(t)
+
+	start := EpochStart(1000).Add(time.Minute)
+	f := NewFake(start)
+	require.Equal(start, f.Now(), "Now()")
+	require.Equal(time.Duration(0), f.Mono(), "Mono()")
+
+	epoch, elapsed, _ := f.Epoch()
+	require.Equal(uint64(1000), epoch, "Epoch()")
+	require.Equal(time.Minute, elapsed, "Epoch(): elapsed")
+
+	f.Advance(epochtime.Period)
+	epoch, elapsed, _ = f.Epoch()
+	require.Equal(uint64(1001), epoch, "Advance(): Epoch()")
+	require.Equal(time.Minute, elapsed, "Advance(): elapsed")
+	require.Equal(epochtime.Period, f.Mono(), "Advance(): Mono()")
+
+	// Civil time jumps do not alter the monotonic time.
+	f.Set(start)
+	epoch, _, _ = f.Epoch()
+	require.Equal(uint64(1000), epoch, "Set(): Epoch()")
+	require.Equal(epochtime.Period, f.Mono(), "Set(): Mono()")
+}
+
+func TestJump(t *testing.T) {
+	require := require.New(t)
+
+	// Real civil time readings carry a monotonic clock reading, which must
+	// not be what the jump is computed from.
+	last, lastMono := Real.Now(), Real.Mono()
+	time.Sleep(10 * time.Millisecond)
+	now, nowMono := Real.Now(), Real.Mono()
+	require.Contains(now.String(), "m=", "Real.Now(): monotonic reading")
+
+	wallDelta := time.Duration(now.UnixNano() - last.UnixNano())
+	require.Equal(wallDelta-(nowMono-lastMono), Jump(now, last, nowMono, lastMono), "Jump(): real clock")
+	require.True(Jump(now, last, nowMono, lastMono) < time.Second, "Jump(): real clock, no jump")
+
+	// A civil time step that the monotonic time did not see is detected,
+	// even when mixed with readings that carry a monotonic reading.
+	stepped := time.Unix(0, now.UnixNano()).Add(-time.Hour)
+	jump := Jump(stepped, last, nowMono, lastMono)
+	require.True(jump < -time.Hour+time.Second && jump > -time.Hour-time.Second, "Jump(): real clock, backwards step")
+
+	// The fake clock agrees.
+	f := NewFake(EpochStart(1000))
+	fLast, fLastMono := f.Now(), f.Mono()
+	f.Advance(time.Second)
+	f.Set(f.Now().Add(time.Minute))
+	require.Equal(time.Minute, Jump(f.Now(), fLast, f.Mono(), fLastMono), "Jump(): fake clock")
+}
+
+func TestSkew(t *testing.T) {
+	require := require.New(t)
+
+	const maxSkew = 5 * time.Minute
+
+	f := NewFake(EpochStart(1000).Add(epochtime.Period / 2))
+	s := NewSkew(f)
+	status, _ := s.Status(maxSkew)
+	require.Equal(SkewUnknown, status, "Status(): no samples")
+
+	// Documents for the local current and next epochs agree with the clock.
+	s.ObserveDocument(1000, f.Now())
+	s.ObserveDocument(1001, f.Now())
+	skew, n := s.Estimate()
+	require.Equal(time.Duration(0), skew, "Estimate()")
+	require.Equal(2, n, "Estimate(): samples")
+	status, _ = s.Status(maxSkew)
+	require.Equal(SkewOk, status, "Status()")
+
+	// The civil time jumping 2 epochs ahead contradicts the documents, by
+	// at least an epoch and a half.
+	f.Set(f.Now().Add(2 * epochtime.Period))
+	s.OnJump(2 * epochtime.Period)
+	status, skew = s.Status(maxSkew)
+	require.Equal(SkewExcessive, status, "OnJump(): Status()")
+	require.Equal(-3*epochtime.Period/2, skew, "OnJump(): skew")
+	require.Equal(uint64(1), s.NrJumps(), "NrJumps()")
+
+	// Newer documents that agree with the new civil time take precedence
+	// over the older samples that contradict them.
+	s.ObserveDocument(1002, f.Now())
+	s.ObserveDocument(1003, f.Now())
+	skew, n = s.Estimate()
+	require.Equal(time.Duration(0), skew, "Estimate(): corrected")
+	require.Equal(2, n, "Estimate(): corrected samples")
+
+	// Stale samples are discarded.
+	f.Advance(skewSampleTTL + time.Second)
+	status, _ = s.Status(maxSkew)
+	require.Equal(SkewUnknown, status, "Status(): stale")
+}
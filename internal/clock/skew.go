@@ -0,0 +1,194 @@
+// skew.go - Clock skew estimation.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package clock
+
+import (
+	"sync"
+	"time"
+
+	"github.com/katzenpost/core/epochtime"
+)
+
+const (
+	maxSkewSamples = 64
+
+	// skewSampleTTL is how long a sample is used for.  Documents are
+	// fetched at least once per epoch, so there is always a recent sample
+	// when the authority is reachable.
+	skewSampleTTL = 2 * epochtime.Period
+)
+
+// SkewStatus is the health status of the local clock.
+type SkewStatus int
+
+const (
+	// SkewUnknown is the status when there are no recent samples.
+	SkewUnknown SkewStatus = iota
+
+	// SkewOk is the status when the estimated skew is within bounds.
+	SkewOk
+
+	// SkewExcessive is the status when the estimated skew is out of bounds.
+	SkewExcessive
+)
+
+func (s SkewStatus) String() string {
+	switch s {
+	case SkewUnknown:
+		return "UNKNOWN"
+	case SkewOk:
+		return "OK"
+	case SkewExcessive:
+		return "EXCESSIVE"
+	default:
+		return "[INVALID]"
+	}
+}
+
+// skewSample bounds the offset of the remote civil time relative to the
+// local civil time to [lo, hi).
+type skewSample struct {
+	lo, hi time.Duration
+	at     time.Duration
+}
+
+// Skew estimates the skew between the local civil time and the civil time
+// of the directory authorities.
+//
+// Neither the authority protocol nor the wire handshake carries a timestamp,
+// so the estimate is derived from the epochs of the documents that the
+// authorities serve, and is the smallest skew that is consistent with the
+// recent samples.  Skew of less than about an epoch is not detected.
+type Skew struct {
+	sync.Mutex
+
+	clock   Clock
+	samples []skewSample
+	nrJumps uint64
+}
+
+// ObserveDocument records that the authority served the document for an
+// epoch at the local civil time local.  If the document was fetched via a
+// round trip, local should be the midpoint of the round trip.
+//
+// The authorities only serve the documents for their current and next
+// epochs, so the authority's civil time was in the range from the start of
+// the previous epoch to the end of the document's epoch.
+func (s *Skew) ObserveDocument(epoch uint64, local time.Time) {
+	remoteLo := EpochStart(epoch)
+	if epoch > 0 {
+		remoteLo = EpochStart(epoch - 1)
+	}
+	remoteHi := EpochStart(epoch + 1)
+
+	s.Lock()
+	defer s.Unlock()
+
+	if len(s.samples) >= maxSkewSamples {
+		s.samples = s.samples[1:]
+	}
+	s.samples = append(s.samples, skewSample{
+		lo: remoteLo.Sub(local),
+		hi: remoteHi.Sub(local),
+		at: s.clock.Mono(),
+	})
+}
+
+// OnJump notifies the estimator that the local civil time jumped by deltaT,
+// and adjusts the existing samples accordingly.
+func (s *Skew) OnJump(deltaT time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.nrJumps++
+	for i := range s.samples {
+		s.samples[i].lo -= deltaT
+		s.samples[i].hi -= deltaT
+	}
+}
+
+// NrJumps returns the number of civil time jumps that have been observed.
+func (s *Skew) NrJumps() uint64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.nrJumps
+}
+
+// Estimate returns the estimated offset of the remote civil time relative
+// to the local civil time (positive if the local clock is behind), and the
+// number of recent samples the estimate is based on.
+func (s *Skew) Estimate() (time.Duration, int) {
+	s.Lock()
+	defer s.Unlock()
+
+	// Discard stale samples.
+	now := s.clock.Mono()
+	for len(s.samples) > 0 && now-s.samples[0].at > skewSampleTTL {
+		s.samples = s.samples[1:]
+	}
+	if len(s.samples) == 0 {
+		return 0, 0
+	}
+
+	// Narrow the range with the samples, newest first.  Samples that
+	// contradict the newer ones were taken before the remote or local
+	// clock was corrected, and are ignored.
+	n := len(s.samples) - 1
+	lo, hi := s.samples[n].lo, s.samples[n].hi
+	nrUsed := 1
+	for i := n - 1; i >= 0; i-- {
+		v := s.samples[i]
+		if v.lo >= hi || v.hi <= lo {
+			break
+		}
+		if v.lo > lo {
+			lo = v.lo
+		}
+		if v.hi < hi {
+			hi = v.hi
+		}
+		nrUsed++
+	}
+
+	switch {
+	case lo > 0:
+		return lo, nrUsed
+	case hi < 0:
+		return hi, nrUsed
+	default:
+		return 0, nrUsed
+	}
+}
+
+// Status returns the health status of the local clock given the maximum
+// tolerated skew.
+func (s *Skew) Status(maxSkew time.Duration) (SkewStatus, time.Duration) {
+	skew, n := s.Estimate()
+	switch {
+	case n == 0:
+		return SkewUnknown, 0
+	case skew > maxSkew || skew < -maxSkew:
+		return SkewExcessive, skew
+	default:
+		return SkewOk, skew
+	}
+}
+
+// NewSkew returns a new Skew estimator using the provided clock.
+func NewSkew(c Clock) *Skew {
+	return &Skew{clock: c}
+}
@@ -25,4 +25,9 @@ const (
 
 	// KeepAliveInterval is the TCP/IP KeepAlive interval.
 	KeepAliveInterval = 3 * time.Minute
+
+	// MixKeyGracePeriod is the period around epoch transitions during which
+	// the adjacent epoch's mix key is also accepted, to tolerate clock skew
+	// and packets delayed in transit.
+	MixKeyGracePeriod = 2 * time.Minute
 )
@@ -20,13 +20,15 @@ package cryptoworker
 import (
 	"errors"
 	"fmt"
+	"sync/atomic"
 	"time"
 
 	"github.com/katzenpost/core/epochtime"
-	"github.com/katzenpost/core/monotime"
 	"github.com/katzenpost/core/sphinx"
+	"github.com/katzenpost/core/sphinx/commands"
 	"github.com/katzenpost/core/worker"
 	"github.com/katzenpost/server/internal/constants"
+	"github.com/katzenpost/server/internal/debug"
 	"github.com/katzenpost/server/internal/glue"
 	"github.com/katzenpost/server/internal/mixkey"
 	"github.com/katzenpost/server/internal/packet"
@@ -44,6 +46,16 @@ type Worker struct {
 
 	incomingCh <-chan interface{}
 	updateCh   chan bool
+	nrPending  *int64
+
+	dwellTotal int64
+	dwellCount uint64
+}
+
+// DwellStats returns the total unwrap queue dwell time and the number of
+// packets dequeued since the previous call.
+func (w *Worker) DwellStats() (time.Duration, uint64) {
+	return time.Duration(atomic.SwapInt64(&w.dwellTotal, 0)), atomic.SwapUint64(&w.dwellCount, 0)
 }
 
 // UpdateMixKeys forces the Worker to re-shadow it's copy of the mix key(s).
@@ -53,17 +65,17 @@ func (w *Worker) UpdateMixKeys() {
 	w.updateCh <- true
 }
 
-func (w *Worker) doUnwrap(pkt *packet.Packet) error {
-	const gracePeriod = 2 * time.Minute
+func (w *Worker) doUnwrap(pkt *packet.Packet) (*mixkey.MixKey, []byte, error) {
+	const gracePeriod = constants.MixKeyGracePeriod
 
 	// Figure out the candidate mix private keys for this packet.
 	keys := make([]*mixkey.MixKey, 0, 2)
-	epoch, elapsed, till := epochtime.Now()
+	epoch, elapsed, till := w.glue.Clock().Epoch()
 	k, ok := w.mixKeys[epoch]
 	if !ok || k == nil {
 		// There always will be a key for the current epoch, since
 		// key generation happens multiple epochs in advance.
-		return fmt.Errorf("crypto: No key for epoch %v", epoch)
+		return nil, nil, fmt.Errorf("crypto: No key for epoch %v", epoch)
 	}
 	keys = append(keys, k)
 
@@ -91,12 +103,12 @@ func (w *Worker) doUnwrap(pkt *packet.Packet) error {
 
 	var lastErr error
 	for _, k = range keys {
-		startAt := monotime.Now()
+		startAt := w.glue.Clock().Mono()
 
 		// TODO/perf: payload is a new heap allocation if it's returned,
 		// though that should only happen if this is a provider.
 		payload, tag, cmds, err := sphinx.Unwrap(k.PrivateKey(), pkt.Raw)
-		unwrapAt := monotime.Now()
+		unwrapAt := w.glue.Clock().Mono()
 
 		w.log.Debugf("Packet: %v (Unwrap took: %v)", pkt.ID, unwrapAt-startAt)
 
@@ -115,24 +127,64 @@ func (w *Worker) doUnwrap(pkt *packet.Packet) error {
 			break
 		}
 
-		// Check for replayed packets.
-		if k.IsReplay(tag) {
-			// The packet decrypted successfully, the MAC was valid, and the
-			// tag was seen before, therefore drop the packet as a replay.
-			lastErr = errors.New("crypto: Packet is a replay")
-			break
-		}
-
-		w.log.Debugf("Packet: %v (IsReplay took: %v)", pkt.ID, monotime.Now()-unwrapAt)
-
-		return nil
+		// The caller is responsible for checking for replayed packets.
+		return k, tag, nil
 	}
 
 	// Return the last error to signal Unwrap() failure.
 	if lastErr == nil {
 		lastErr = errors.New("BUG: crypto: Out of candidate keys for Unwrap(), no saved error")
 	}
-	return lastErr
+	return nil, nil, lastErr
+}
+
+// unwrapBatch unwraps a batch of packets, and returns the packets that were
+// successfully unwrapped and are not replays.  Rejected packets are disposed.
+func (w *Worker) unwrapBatch(pkts []*packet.Packet) []*packet.Packet {
+	type replayCheck struct {
+		pkts []*packet.Packet
+		tags [][]byte
+	}
+
+	// Unwrap each packet, grouping the replay tags by the key that was used.
+	checks := make(map[*mixkey.MixKey]*replayCheck, 2)
+	for _, pkt := range pkts {
+		w.log.Debugf("Attempting to unwrap packet: %v", pkt.ID)
+		k, tag, err := w.doUnwrap(pkt)
+		if err != nil {
+			w.log.Debugf("Dropping packet: %v (%v)", debug.PacketID(pkt.ID), debug.NewReason("%v", err))
+			pkt.Dispose()
+			continue
+		}
+		c, ok := checks[k]
+		if !ok {
+			c = &replayCheck{}
+			checks[k] = c
+		}
+		c.pkts = append(c.pkts, pkt)
+		c.tags = append(c.tags, tag)
+	}
+
+	// Check for replayed packets, with one batched test and set per key.
+	unwrapped := make([]*packet.Packet, 0, len(pkts))
+	for k, c := range checks {
+		startAt := w.glue.Clock().Mono()
+		isReplay := k.IsReplayBatch(c.tags)
+		w.log.Debugf("Batch: %v packets (IsReplayBatch took: %v)", len(c.pkts), w.glue.Clock().Mono()-startAt)
+
+		for i, pkt := range c.pkts {
+			if isReplay[i] {
+				// The packet decrypted successfully, the MAC was valid, and
+				// the tag was seen before, therefore drop the packet as a
+				// replay.
+				w.log.Debugf("Dropping packet: %v (%v)", debug.PacketID(pkt.ID), debug.NewReason("Packet is a replay"))
+				pkt.Dispose()
+				continue
+			}
+			unwrapped = append(unwrapped, pkt)
+		}
+	}
+	return unwrapped
 }
 
 func (w *Worker) worker() {
@@ -140,12 +192,15 @@ func (w *Worker) worker() {
 
 	isProvider := w.glue.Config().Server.IsProvider
 	unwrapSlack := time.Duration(w.glue.Config().Debug.UnwrapDelay) * time.Millisecond
+	batchSize := w.glue.Config().Debug.UnwrapBatchSize
 	defer w.derefKeys()
 
+	batch := make([]*packet.Packet, 0, batchSize)
+	var jobs []*packet.SURBJob
 	for {
 		// This is where the bulk of the inbound packet processing happens,
 		// and the only significant source of parallelism.
-		var pkt *packet.Packet
+		batch, jobs = batch[:0], jobs[:0]
 
 		select {
 		case <-w.HaltCh():
@@ -156,158 +211,246 @@ func (w *Worker) worker() {
 			w.glue.MixKeys().Shadow(w.mixKeys)
 			continue
 		case e := <-w.incomingCh:
-			pkt = e.(*packet.Packet)
+			batch, jobs = appendWork(batch, jobs, e)
+		}
+
+		// Drain up to the batch size of packets that are already queued,
+		// without waiting for more to arrive.
+	drainLoop:
+		for len(batch)+len(jobs) < batchSize {
+			select {
+			case e := <-w.incomingCh:
+				batch, jobs = appendWork(batch, jobs, e)
+			default:
+				break drainLoop
+			}
 		}
 
 		// This deliberately ignores the cryptographic processing time, since
 		// it (should) be constant across packets, and I'll go crazy trying
 		// to account for everything that impacts the actual delay vs
 		// requested.
-		now := monotime.Now()
+		now := w.glue.Clock().Mono()
 
-		// Drop the packet if it has been sitting in the queue waiting to
+		// Drop the packets that have been sitting in the queue waiting to
 		// be unwrapped for way too long.
-		dwellTime := now - pkt.RecvAt
-		if dwellTime > unwrapSlack {
-			w.log.Debugf("Dropping packet: %v (Spent %v waiting for Unwrap())", pkt.ID, dwellTime)
-			pkt.Dispose()
-			continue
-		} else {
+		toUnwrap := make([]*packet.Packet, 0, len(batch))
+		for _, pkt := range batch {
+			dwellTime := now - pkt.RecvAt
+			atomic.AddInt64(&w.dwellTotal, int64(dwellTime))
+			atomic.AddUint64(&w.dwellCount, 1)
+			if dwellTime > unwrapSlack {
+				w.log.Debugf("Dropping packet: %v (%v)", debug.PacketID(pkt.ID), debug.NewReason("Spent %v waiting for Unwrap()", dwellTime))
+				pkt.Dispose()
+				continue
+			}
 			w.log.Debugf("Packet: %v (Unwrap queue delay: %v)", pkt.ID, dwellTime)
+			toUnwrap = append(toUnwrap, pkt)
 		}
 
-		// Attempt to unwrap the packet.
-		w.log.Debugf("Attempting to unwrap packet: %v", pkt.ID)
-		if err := w.doUnwrap(pkt); err != nil {
-			w.log.Debugf("Dropping packet: %v (%v)", pkt.ID, err)
-			pkt.Dispose()
-			continue
-		}
-		w.log.Debugf("Packet: %v (doUnwrap took: %v)", pkt.ID, monotime.Now()-now)
+		// Attempt to unwrap the packets.
+		unwrapped := w.unwrapBatch(toUnwrap)
+		w.log.Debugf("Batch: %v/%v packets (unwrapBatch took: %v)", len(unwrapped), len(batch), w.glue.Clock().Mono()-now)
 
-		// The common (in the both most likely, and done by all modes) case
-		// is that the packet is destined for another node.
-		if pkt.IsForward() {
-			if pkt.Payload != nil {
-				w.log.Debugf("Dropping packet: %v (Unwrap() returned payload)", pkt.ID)
-				pkt.Dispose()
-				continue
-			}
-			if pkt.MustTerminate {
-				w.log.Debugf("Dropping packet: %v (Provider received forward packet from mix)", pkt.ID)
-				pkt.Dispose()
+		// Build the response packets requested by the provider.
+		var toScheduler, toProvider []*packet.Packet
+		for _, job := range jobs {
+			respPkt, err := newPacketFromSURB(job)
+			if err != nil {
+				w.log.Debugf("Failed to generate %v: %v (%v)", job.Kind(), job.SrcID, err)
 				continue
 			}
+			w.log.Debugf("Handing off newly generated %v: %v (Src:%v)", job.Kind(), respPkt.ID, job.SrcID)
+			toScheduler = append(toScheduler, respPkt)
+		}
 
-			// Check and adjust the delay for queue dwell time.
-			pkt.Delay = time.Duration(pkt.NodeDelay.Delay) * time.Millisecond
-			if pkt.Delay > constants.NumMixKeys*epochtime.Period {
-				w.log.Debugf("Dropping packet: %v (Delay %v is past what is possible)", pkt.ID, pkt.Delay)
-				pkt.Dispose()
-				continue
-			}
-			if pkt.Delay > dwellTime {
-				pkt.Delay -= dwellTime
-			} else if pkt.NodeDelay.Delay == 0 {
-				// If the packet has exactly 0 ms delay, then it is flat out
-				// impossible to adjust for the dwell because the client wants
-				// the packet dispatched immediately.
-				//
-				// Note: The reference client will NEVER do this, so despite
-				// the general crypto worker load shedding not kicking in,
-				// a more stringent limit on queue dwell time is applied.
-				if dwellTime < absoluteMinimumDelay {
-					// If the dwellTime is "small" (in the non-overload case),
-					// treat the packet as if it had a 1 ms delay to force
-					// some amount of mixing.
-					pkt.Delay = absoluteMinimumDelay - dwellTime
-				} else {
-					// Although the node isn't overloaded to the point
-					// where the load shedding has kicked in, the dwell
-					// time appears to be "excessive".  Discard the packet,
-					// the client is doing something non-standard anyway.
-					w.log.Debugf("Dropping packet: %v (Delay 0 queue delay: %v)", pkt.ID, dwellTime)
+		for _, pkt := range unwrapped {
+			dwellTime := now - pkt.RecvAt
+
+			// The common (in the both most likely, and done by all modes) case
+			// is that the packet is destined for another node.
+			if pkt.IsForward() {
+				if pkt.Payload != nil {
+					w.log.Debugf("Dropping packet: %v (%v)", debug.PacketID(pkt.ID), debug.NewReason("Unwrap() returned payload"))
+					pkt.Dispose()
+					continue
+				}
+				if pkt.MustTerminate {
+					w.log.Debugf("Dropping packet: %v (%v)", debug.PacketID(pkt.ID), debug.NewReason("Provider received forward packet from mix"))
 					pkt.Dispose()
 					continue
 				}
-			} else {
-				// The dwell time has exceeded the client requested delay.
-				//
-				// Under normal operation this should NEVER happen, because
-				// the dwell time should be extremely small, and the
-				// accounting here explicitly excludes the time taken for
-				// the Unwrap operation.
-				//
-				// The right thing to do here might be to dispose of the
-				// packet, but the adjustment is primarily a "best effort"
-				// attempt to honor the delay, and the queue backlog hasn't
-				// gotten to the point where the worker is aggressively
-				// shedding load.
-				//
-				// Do the closest thing to "dispatch immediately" that
-				// ensures that some mixing occurs.  The adjustment is
-				// "best effort" anyway.
-				pkt.Delay = absoluteMinimumDelay
-			}
 
-			// Hand off to the scheduler.
-			w.log.Debugf("Dispatching packet: %v", pkt.ID)
-			w.glue.Scheduler().OnPacket(pkt)
-			continue
-		} else if !isProvider {
-			// This may be a decoy traffic response.
-			if pkt.IsSURBReply() {
-				w.log.Debugf("Handing off decoy response packet: %v", pkt.ID)
-				w.glue.Decoy().OnPacket(pkt)
+				// Check and adjust the delay for queue dwell time.
+				pkt.Delay = time.Duration(pkt.NodeDelay.Delay) * time.Millisecond
+				if pkt.Delay > constants.NumMixKeys*epochtime.Period {
+					w.log.Debugf("Dropping packet: %v (%v)", debug.PacketID(pkt.ID), debug.NewReason("Delay %v is past what is possible", pkt.Delay))
+					pkt.Dispose()
+					continue
+				}
+				if pkt.Delay > dwellTime {
+					pkt.Delay -= dwellTime
+				} else if pkt.NodeDelay.Delay == 0 {
+					// If the packet has exactly 0 ms delay, then it is flat out
+					// impossible to adjust for the dwell because the client wants
+					// the packet dispatched immediately.
+					//
+					// Note: The reference client will NEVER do this, so despite
+					// the general crypto worker load shedding not kicking in,
+					// a more stringent limit on queue dwell time is applied.
+					if dwellTime < absoluteMinimumDelay {
+						// If the dwellTime is "small" (in the non-overload case),
+						// treat the packet as if it had a 1 ms delay to force
+						// some amount of mixing.
+						pkt.Delay = absoluteMinimumDelay - dwellTime
+					} else {
+						// Although the node isn't overloaded to the point
+						// where the load shedding has kicked in, the dwell
+						// time appears to be "excessive".  Discard the packet,
+						// the client is doing something non-standard anyway.
+						w.log.Debugf("Dropping packet: %v (%v)", debug.PacketID(pkt.ID), debug.NewReason("Delay 0 queue delay: %v", dwellTime))
+						pkt.Dispose()
+						continue
+					}
+				} else {
+					// The dwell time has exceeded the client requested delay.
+					//
+					// Under normal operation this should NEVER happen, because
+					// the dwell time should be extremely small, and the
+					// accounting here explicitly excludes the time taken for
+					// the Unwrap operation.
+					//
+					// The right thing to do here might be to dispose of the
+					// packet, but the adjustment is primarily a "best effort"
+					// attempt to honor the delay, and the queue backlog hasn't
+					// gotten to the point where the worker is aggressively
+					// shedding load.
+					//
+					// Do the closest thing to "dispatch immediately" that
+					// ensures that some mixing occurs.  The adjustment is
+					// "best effort" anyway.
+					pkt.Delay = absoluteMinimumDelay
+				}
+
+				// Hand off to the scheduler.
+				w.log.Debugf("Dispatching packet: %v", pkt.ID)
+				toScheduler = append(toScheduler, pkt)
+				continue
+			} else if !isProvider {
+				// This may be a decoy traffic response.
+				if pkt.IsSURBReply() {
+					w.log.Debugf("Handing off decoy response packet: %v", pkt.ID)
+					w.glue.Decoy().OnPacket(pkt)
+					continue
+				}
+
+				// Mixes will only ever see forward commands.
+				w.log.Debugf("Dropping mix packet: %v (%v)", pkt.ID, pkt.CmdsToString())
+				pkt.Dispose()
 				continue
 			}
 
-			// Mixes will only ever see forward commands.
-			w.log.Debugf("Dropping mix packet: %v (%v)", pkt.ID, pkt.CmdsToString())
-			pkt.Dispose()
-			continue
-		}
+			// This node is a provider and the packet is not destined for another
+			// node.  Both of the operations here end up hitting up disk among
+			// other things, so are just shunted off to a separate worker so that
+			// packet processing does not get blocked.
 
-		// This node is a provider and the packet is not destined for another
-		// node.  Both of the operations here end up hitting up disk among
-		// other things, so are just shunted off to a separate worker so that
-		// packet processing does not get blocked.
+			if pkt.MustForward {
+				w.log.Debugf("Dropping client packet: %v (Send to local user)", pkt.ID)
+				pkt.Dispose()
+				continue
+			}
 
-		if pkt.MustForward {
-			w.log.Debugf("Dropping client packet: %v (Send to local user)", pkt.ID)
-			pkt.Dispose()
-			continue
+			// Toss the packets over to the provider backend.
+			if pkt.IsToUser() || pkt.IsUnreliableToUser() || pkt.IsSURBReply() {
+				w.log.Debugf("Handing off user destined packet: %v", pkt.ID)
+				pkt.DispatchAt = now
+				toProvider = append(toProvider, pkt)
+			} else {
+				w.log.Debugf("Dropping user packet: %v (%v)", pkt.ID, pkt.CmdsToString())
+				pkt.Dispose()
+			}
 		}
 
-		// Toss the packets over to the provider backend.
-		// Note: Callee takes ownership of pkt.
-		if pkt.IsToUser() || pkt.IsUnreliableToUser() || pkt.IsSURBReply() {
-			w.log.Debugf("Handing off user destined packet: %v", pkt.ID)
-			pkt.DispatchAt = now
-			w.glue.Provider().OnPacket(pkt)
-		} else {
-			w.log.Debugf("Dropping user packet: %v (%v)", pkt.ID, pkt.CmdsToString())
-			pkt.Dispose()
+		// Hand off the batch in bulk.
+		// Note: Callee takes ownership of the packets.
+		if len(toScheduler) > 0 {
+			w.glue.Scheduler().OnPackets(toScheduler)
+		}
+		if len(toProvider) > 0 {
+			w.glue.Provider().OnPackets(toProvider)
 		}
+
+		// The work is only removed from the pending count once it has been
+		// handed off or dropped, so that it is always part of the drain
+		// backlog.
+		atomic.AddInt64(w.nrPending, -int64(len(batch)+len(jobs)))
 	}
 
 	// NOTREACHED
 }
 
+func appendWork(batch []*packet.Packet, jobs []*packet.SURBJob, e interface{}) ([]*packet.Packet, []*packet.SURBJob) {
+	switch v := e.(type) {
+	case *packet.Packet:
+		batch = append(batch, v)
+	case *packet.SURBJob:
+		jobs = append(jobs, v)
+	default:
+		panic(fmt.Sprintf("BUG: crypto: Invalid work type: %T", e))
+	}
+	return batch, jobs
+}
+
+func newPacketFromSURB(job *packet.SURBJob) (*packet.Packet, error) {
+	// Build a response packet using a SURB.
+	rawRespPkt, firstHop, err := sphinx.NewPacketFromSURB(job.SURB, job.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	// Build the command vector for the SURB-ACK
+	cmds := make([]commands.RoutingCommand, 0, 2)
+
+	nextHopCmd := new(commands.NextNodeHop)
+	copy(nextHopCmd.ID[:], firstHop[:])
+	cmds = append(cmds, nextHopCmd)
+
+	nodeDelayCmd := new(commands.NodeDelay)
+	nodeDelayCmd.Delay = job.Delay
+	cmds = append(cmds, nodeDelayCmd)
+
+	// Assemble the response packet.
+	respPkt, _ := packet.New(rawRespPkt)
+	respPkt.Set(nil, cmds)
+
+	respPkt.RecvAt = job.RecvAt
+	respPkt.Delay = time.Duration(nodeDelayCmd.Delay) * time.Millisecond
+	respPkt.MustForward = true
+
+	// XXX: This should probably fudge the delay to account for processing
+	// time.
+
+	return respPkt, nil
+}
+
 func (w *Worker) derefKeys() {
 	for _, v := range w.mixKeys {
 		v.Deref()
 	}
 }
 
-// New constructs a new Worker instance.
-func New(glue glue.Glue, incomingCh <-chan interface{}, id int) *Worker {
+// New constructs a new Worker instance.  nrPending is the count of work
+// submitted to incomingCh that has yet to be handed off or dropped, which the
+// Worker decrements as it completes each batch.
+func New(glue glue.Glue, incomingCh <-chan interface{}, nrPending *int64, id int) *Worker {
 	w := &Worker{
 		glue:       glue,
 		log:        glue.LogBackend().GetLogger(fmt.Sprintf("crypto:%d", id)),
 		mixKeys:    make(map[uint64]*mixkey.MixKey),
 		incomingCh: incomingCh,
 		updateCh:   make(chan bool),
+		nrPending:  nrPending,
 	}
 
 	w.glue.MixKeys().Shadow(w.mixKeys)
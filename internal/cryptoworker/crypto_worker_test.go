@@ -0,0 +1,224 @@
+// crypto_worker_test.go - Sphinx crypto worker benchmarks.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cryptoworker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	cConstants "github.com/katzenpost/core/constants"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/epochtime"
+	"github.com/katzenpost/core/log"
+	"github.com/katzenpost/core/sphinx"
+	"github.com/katzenpost/core/sphinx/commands"
+	"github.com/katzenpost/server/internal/clock"
+	"github.com/katzenpost/server/internal/constants"
+	"github.com/katzenpost/server/internal/glue"
+	"github.com/katzenpost/server/internal/mixkey"
+	"github.com/katzenpost/server/internal/packet"
+	"github.com/stretchr/testify/require"
+)
+
+type testGlue struct {
+	glue.Glue
+
+	clock clock.Clock
+}
+
+func (g *testGlue) Clock() clock.Clock {
+	return g.clock
+}
+
+func newTestPacket(pub *ecdh.PublicKey) (*packet.Packet, error) {
+	path := []*sphinx.PathHop{
+		&sphinx.PathHop{
+			PublicKey: pub,
+			Commands:  []commands.RoutingCommand{&commands.Recipient{}},
+		},
+	}
+	payload := make([]byte, cConstants.ForwardPayloadLength)
+	raw, err := sphinx.NewPacket(rand.Reader, path, payload)
+	if err != nil {
+		return nil, err
+	}
+	return packet.New(raw)
+}
+
+func TestDoUnwrap(t *testing.T) {
+	require := require.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "cryptoworker_tests")
+	require.NoError(err, "TempDir()")
+	defer os.RemoveAll(tmpDir)
+
+	logBackend, err := log.New("", "ERROR", false)
+	require.NoError(err, "log.New()")
+
+	// Keys for the epochs [e-1, e, e+1].
+	const e = 1000
+	clk := clock.NewFake(clock.EpochStart(e))
+	mixKeys := make(map[uint64]*mixkey.MixKey)
+	for epoch := uint64(e - 1); epoch <= e+1; epoch++ {
+		k, err := mixkey.New(tmpDir, epoch, nil, &mixkey.FilterConfig{Size: 20}, clk)
+		require.NoError(err, "mixkey.New(%v)", epoch)
+		defer k.Deref()
+		mixKeys[epoch] = k
+	}
+
+	w := &Worker{
+		glue:    &testGlue{clock: clk},
+		log:     logBackend.GetLogger("crypto:test"),
+		mixKeys: mixKeys,
+	}
+
+	const grace = constants.MixKeyGracePeriod
+	for _, v := range []struct {
+		name       string
+		at         time.Time
+		validEpoch []uint64
+	}{
+		{"start", clock.EpochStart(e), []uint64{e - 1, e}},
+		{"in grace period", clock.EpochStart(e).Add(grace - time.Second), []uint64{e - 1, e}},
+		{"after grace period", clock.EpochStart(e).Add(grace), []uint64{e}},
+		{"mid epoch", clock.EpochStart(e).Add(epochtime.Period / 2), []uint64{e}},
+		{"before grace period", clock.EpochStart(e + 1).Add(-grace), []uint64{e}},
+		{"next grace period", clock.EpochStart(e + 1).Add(-grace + time.Second), []uint64{e, e + 1}},
+	} {
+		clk.Set(v.at)
+		for epoch, k := range mixKeys {
+			isValid := false
+			for _, ve := range v.validEpoch {
+				isValid = isValid || ve == epoch
+			}
+
+			pkt, err := newTestPacket(k.PublicKey())
+			require.NoError(err, "newTestPacket()")
+			gotKey, tag, err := w.doUnwrap(pkt)
+			if isValid {
+				require.NoError(err, "%v: doUnwrap(%v)", v.name, epoch)
+				require.Equal(epoch, gotKey.Epoch(), "%v: doUnwrap(%v): key", v.name, epoch)
+				require.Len(tag, mixkey.TagLength, "%v: doUnwrap(%v): tag", v.name, epoch)
+			} else {
+				require.Error(err, "%v: doUnwrap(%v)", v.name, epoch)
+			}
+			pkt.Dispose()
+		}
+	}
+
+	// Outside of the range of available keys, everything is rejected.
+	clk.Set(clock.EpochStart(e + 2).Add(epochtime.Period / 2))
+	pkt, err := newTestPacket(mixKeys[e+1].PublicKey())
+	require.NoError(err, "newTestPacket()")
+	_, _, err = w.doUnwrap(pkt)
+	require.Error(err, "doUnwrap(): No key for epoch")
+	pkt.Dispose()
+}
+
+func BenchmarkUnwrapBatch(b *testing.B) {
+	nCores := []int{1, 2, 4}
+	if n := runtime.NumCPU(); n > 4 {
+		nCores = append(nCores, n)
+	}
+	for _, batchSize := range []int{1, 16, 64} {
+		for _, n := range nCores {
+			batchSize, n := batchSize, n
+			b.Run(fmt.Sprintf("batch=%d/workers=%d", batchSize, n), func(b *testing.B) {
+				doBenchUnwrapBatch(b, batchSize, n)
+			})
+		}
+	}
+}
+
+func doBenchUnwrapBatch(b *testing.B, batchSize, nWorkers int) {
+	tmpDir, err := ioutil.TempDir("", "cryptoworker_benchmarks")
+	if err != nil {
+		b.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	logBackend, err := log.New("", "ERROR", false)
+	if err != nil {
+		b.Fatalf("Failed to initialize logging: %v", err)
+	}
+
+	epoch, _, _ := clock.Real.Epoch()
+	k, err := mixkey.New(tmpDir, epoch, nil, &mixkey.FilterConfig{Size: 24}, clock.Real)
+	if err != nil {
+		b.Fatalf("Failed to create mix key: %v", err)
+	}
+	defer k.Deref()
+	mixKeys := map[uint64]*mixkey.MixKey{epoch: k}
+
+	// Generate all of the packets up front, since each packet can only be
+	// unwrapped once before it is treated as a replay.
+	pkts := make([]*packet.Packet, b.N)
+	for i := range pkts {
+		if pkts[i], err = newTestPacket(k.PublicKey()); err != nil {
+			b.Fatalf("Failed to create Sphinx packet: %v", err)
+		}
+	}
+
+	var (
+		wg         sync.WaitGroup
+		next       int64
+		nUnwrapped int64
+	)
+	b.ResetTimer()
+	startAt := time.Now()
+	for i := 0; i < nWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := &Worker{
+				glue:    &testGlue{clock: clock.Real},
+				log:     logBackend.GetLogger("crypto:bench"),
+				mixKeys: mixKeys,
+			}
+			for {
+				end := int(atomic.AddInt64(&next, int64(batchSize)))
+				start := end - batchSize
+				if start >= len(pkts) {
+					return
+				}
+				if end > len(pkts) {
+					end = len(pkts)
+				}
+				unwrapped := w.unwrapBatch(pkts[start:end])
+				atomic.AddInt64(&nUnwrapped, int64(len(unwrapped)))
+				for _, pkt := range unwrapped {
+					pkt.Dispose()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(startAt)
+	b.StopTimer()
+
+	if int(nUnwrapped) != b.N {
+		b.Fatalf("unwrapped (%v) != iterations (%v)", nUnwrapped, b.N)
+	}
+	b.ReportMetric(float64(b.N)/elapsed.Seconds(), "pkts/s")
+}
@@ -19,6 +19,7 @@ package debug
 
 import (
 	"encoding/hex"
+	"fmt"
 	"strings"
 
 	"github.com/katzenpost/core/sphinx/constants"
@@ -33,3 +34,29 @@ func NodeIDToPrintString(id *[constants.NodeIDLength]byte) string {
 func BytesToPrintString(b []byte) string {
 	return strings.ToUpper(hex.EncodeToString(b))
 }
+
+// PacketID is a packet identifier log argument, that is exposed as the
+// `packet_id` field by the structured log format.
+type PacketID uint64
+
+// Peer is a peer identifier log argument, that is exposed as the `peer`
+// field by the structured log format.
+type Peer string
+
+// Reason is a log argument explaining why something happened, that is
+// exposed as the `reason` field by the structured log format.
+type Reason struct {
+	format string
+	args   []interface{}
+}
+
+// String returns the formatted reason.
+func (r *Reason) String() string {
+	return fmt.Sprintf(r.format, r.args...)
+}
+
+// NewReason returns a new Reason.  Formatting is deferred till the reason is
+// actually logged.
+func NewReason(format string, args ...interface{}) *Reason {
+	return &Reason{format: format, args: args}
+}
@@ -0,0 +1,99 @@
+// redact.go - Log redaction helpers.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package debug
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/utils"
+)
+
+const redactedHashLength = 8
+
+var (
+	redactOnce sync.Once
+	redactKey  atomic.Value // []byte
+)
+
+// PublicKey is a public key that may be printed via KeyToPrintString.
+type PublicKey interface {
+	Bytes() []byte
+}
+
+// EnableRedaction enables redaction, where user identifiers and keys are
+// replaced by keyed hashes in the output of the print helpers.  The key is
+// randomly generated, so the hashes are consistent till the process exits,
+// and redaction can not be disabled once it is enabled.
+func EnableRedaction() {
+	redactOnce.Do(func() {
+		k := make([]byte, sha256.Size)
+		if _, err := rand.Reader.Read(k); err != nil {
+			panic("debug: failed to generate redaction key: " + err.Error())
+		}
+		redactKey.Store(k)
+	})
+}
+
+// IsRedacting returns true iff redaction is enabled.
+func IsRedacting() bool {
+	return redactKey.Load() != nil
+}
+
+func redact(b []byte) (string, bool) {
+	k, ok := redactKey.Load().([]byte)
+	if !ok {
+		return "", false
+	}
+
+	m := hmac.New(sha256.New, k)
+	m.Write(b)
+	return "[redacted:" + hex.EncodeToString(m.Sum(nil)[:redactedHashLength]) + "]", true
+}
+
+// UserToPrintString pretty-prints a user name or recipient, or returns it's
+// keyed hash if redaction is enabled.
+func UserToPrintString(u []byte) string {
+	if s, ok := redact(u); ok {
+		return s
+	}
+	return utils.ASCIIBytesToPrintString(u)
+}
+
+// CredentialToPrintString pretty-prints link layer authentication additional
+// data, which may be a user name, or returns it's keyed hash if redaction is
+// enabled.
+func CredentialToPrintString(ad []byte) string {
+	if s, ok := redact(ad); ok {
+		return s
+	}
+	return BytesToPrintString(ad)
+}
+
+// KeyToPrintString pretty-prints a public key, or returns it's keyed hash if
+// redaction is enabled.
+func KeyToPrintString(k PublicKey) string {
+	if s, ok := redact(k.Bytes()); ok {
+		return s
+	}
+	return fmt.Sprintf("%v", k)
+}
@@ -0,0 +1,276 @@
+// redact_test.go - Log redaction tests.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package debug
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedaction(t *testing.T) {
+	require := require.New(t)
+
+	k, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err, "NewKeypair()")
+	pk := k.PublicKey()
+
+	user := []byte("alice")
+	require.Equal("alice", UserToPrintString(user), "UserToPrintString(): Disabled")
+	require.Equal(BytesToPrintString(user), CredentialToPrintString(user), "CredentialToPrintString(): Disabled")
+	require.Equal(fmt.Sprintf("%v", pk), KeyToPrintString(pk), "KeyToPrintString(): Disabled")
+
+	EnableRedaction()
+	require.True(IsRedacting(), "IsRedacting()")
+
+	s := UserToPrintString(user)
+	require.NotContains(s, "alice", "UserToPrintString(): Enabled")
+	require.True(strings.HasPrefix(s, "[redacted:"), "UserToPrintString(): Enabled")
+	require.Equal(s, UserToPrintString([]byte("alice")), "UserToPrintString(): Consistent")
+	require.Equal(s, CredentialToPrintString(user), "CredentialToPrintString(): Consistent")
+	require.NotEqual(s, UserToPrintString([]byte("bob")), "UserToPrintString(): Distinct")
+	require.NotEqual(fmt.Sprintf("%v", pk), KeyToPrintString(pk), "KeyToPrintString(): Enabled")
+}
+
+var (
+	lintLogMethods = map[string]bool{
+		"Debug": true, "Debugf": true,
+		"Info": true, "Infof": true,
+		"Notice": true, "Noticef": true,
+		"Warning": true, "Warningf": true,
+		"Error": true, "Errorf": true,
+		"Critical": true, "Criticalf": true,
+		"Fatal": true, "Fatalf": true,
+		"Panic": true, "Panicf": true,
+	}
+
+	// lintRedactors are the helpers that make it safe to log their argument.
+	lintRedactors = map[string]bool{
+		"UserToPrintString":       true,
+		"CredentialToPrintString": true,
+		"KeyToPrintString":        true,
+		"len":                     true,
+	}
+
+	// lintUnsafePrinters are the helpers that print their argument as is.
+	lintUnsafePrinters = map[string]bool{
+		"ASCIIBytesToPrintString": true,
+		"BytesToPrintString":      true,
+	}
+
+	// lintUnsafeFields are the fields that hold user identifiers or keys.
+	lintUnsafeFields = map[string]bool{
+		"AdditionalData": true,
+		"PublicKey":      true,
+		"Recipient":      true,
+	}
+
+	// lintUnsafeIdents are the variable names that conventionally hold user
+	// identifiers.
+	lintUnsafeIdents = map[string]bool{
+		"u":         true,
+		"user":      true,
+		"username":  true,
+		"recipient": true,
+	}
+)
+
+func isLogger(e ast.Expr) bool {
+	switch v := e.(type) {
+	case *ast.Ident:
+		return v.Name == "log"
+	case *ast.SelectorExpr:
+		return v.Sel.Name == "log"
+	case *ast.CallExpr:
+		// `c.Log()` as used by the management interface handlers.
+		sel, ok := v.Fun.(*ast.SelectorExpr)
+		return ok && sel.Sel.Name == "Log"
+	}
+	return false
+}
+
+// lintArg returns a description of each unredacted user identifier or key
+// that is printed by a log call argument.
+func lintArg(e ast.Expr) []string {
+	var found []string
+	var walk func(ast.Node) bool
+	walk = func(n ast.Node) bool {
+		switch v := n.(type) {
+		case *ast.CallExpr:
+			var name string
+			switch fn := v.Fun.(type) {
+			case *ast.Ident:
+				name = fn.Name
+			case *ast.SelectorExpr:
+				name = fn.Sel.Name
+				if lintUnsafeFields[name] {
+					// A method call such as `k.PublicKey()` derives a
+					// public key from a private key that belongs to
+					// this node, so only the receiver is checked.
+					ast.Inspect(fn.X, walk)
+					for _, arg := range v.Args {
+						ast.Inspect(arg, walk)
+					}
+					return false
+				}
+			}
+			switch {
+			case lintRedactors[name]:
+				return false
+			case lintUnsafePrinters[name]:
+				found = append(found, name+"()")
+				return false
+			}
+		case *ast.TypeAssertExpr:
+			// The asserted type, such as `ed25519.PublicKey`, is not a
+			// field access.
+			ast.Inspect(v.X, walk)
+			return false
+		case *ast.SelectorExpr:
+			if lintUnsafeFields[v.Sel.Name] {
+				found = append(found, "."+v.Sel.Name)
+				return false
+			}
+		case *ast.Ident:
+			if lintUnsafeIdents[v.Name] {
+				found = append(found, v.Name)
+			}
+		}
+		return true
+	}
+	ast.Inspect(e, walk)
+	return found
+}
+
+// isErrorf returns true iff the selector is `fmt.Errorf`, since errors end
+// up being logged by the callers.
+func isErrorf(sel *ast.SelectorExpr) bool {
+	x, ok := sel.X.(*ast.Ident)
+	return ok && x.Name == "fmt" && sel.Sel.Name == "Errorf"
+}
+
+func lintFile(fset *token.FileSet, f *ast.File) []string {
+	var errs []string
+	ast.Inspect(f, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok {
+			return true
+		}
+		sel, ok := call.Fun.(*ast.SelectorExpr)
+		if !ok {
+			return true
+		}
+		var what string
+		switch {
+		case lintLogMethods[sel.Sel.Name] && isLogger(sel.X):
+			what = "logged"
+		case isErrorf(sel):
+			what = "included in an error"
+		default:
+			return true
+		}
+		for _, arg := range call.Args {
+			for _, v := range lintArg(arg) {
+				errs = append(errs, fmt.Sprintf("%v: %v %v without redaction", fset.Position(arg.Pos()), v, what))
+			}
+		}
+		return true
+	})
+	return errs
+}
+
+func lintSource(src string) ([]string, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "lint.go", src, 0)
+	if err != nil {
+		return nil, err
+	}
+	return lintFile(fset, f), nil
+}
+
+func TestLogRedactionLint(t *testing.T) {
+	require := require.New(t)
+
+	// Ensure that the lint catches the obvious cases.
+	const badSrc = `package bad
+func f() {
+	l.log.Debugf("User: '%v', Key: '%v'", utils.ASCIIBytesToPrintString(creds.AdditionalData), creds.PublicKey)
+	c.Log().Errorf("Failed to remove user '%v': %v", u, err)
+	p.log.Debugf("Dropping packet: %v (%v)", id, debug.NewReason("Invalid Recipient: '%v'", pkt.Recipient.ID))
+	fmt.Errorf("userdb: invalid username: %v", u)
+}
+`
+	errs, err := lintSource(badSrc)
+	require.NoError(err, "lintSource(bad)")
+	require.Len(errs, 5, "lintSource(bad): %v", errs)
+
+	const goodSrc = `package good
+func f() {
+	l.log.Debugf("User: '%v', Key: '%v'", debug.UserToPrintString(creds.AdditionalData), debug.KeyToPrintString(creds.PublicKey))
+	c.Log().Errorf("Failed to remove user '%v': %v", debug.UserToPrintString(u), err)
+	s.log.Noticef("Server identity public key is: %s", s.identityKey.PublicKey())
+	s.log.Noticef("Management public key: %v", PublicKeyString(k.Public().(ed25519.PublicKey)))
+	fmt.Errorf("userdb: invalid username length: %d", len(u))
+}
+`
+	errs, err = lintSource(goodSrc)
+	require.NoError(err, "lintSource(good)")
+	require.Empty(errs, "lintSource(good)")
+
+	// Lint the entire tree, other than this package which implements the
+	// redaction helpers.
+	root, err := filepath.Abs(filepath.Join("..", ".."))
+	require.NoError(err, "Abs()")
+	self, err := filepath.Abs(".")
+	require.NoError(err, "Abs(.)")
+
+	fset := token.NewFileSet()
+	err = filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			switch {
+			case path == self, fi.Name() == "vendor", fi.Name() == "testdata", strings.HasPrefix(fi.Name(), "."):
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(path, ".go") || strings.HasSuffix(path, "_test.go") {
+			return nil
+		}
+
+		f, err := parser.ParseFile(fset, path, nil, 0)
+		if err != nil {
+			return err
+		}
+		for _, v := range lintFile(fset, f) {
+			t.Error(v)
+		}
+		return nil
+	})
+	require.NoError(err, "Walk()")
+}
@@ -31,13 +31,13 @@ import (
 	"github.com/katzenpost/core/constants"
 	"github.com/katzenpost/core/crypto/rand"
 	"github.com/katzenpost/core/epochtime"
-	"github.com/katzenpost/core/monotime"
 	"github.com/katzenpost/core/pki"
 	"github.com/katzenpost/core/sphinx"
 	"github.com/katzenpost/core/sphinx/commands"
 	sConstants "github.com/katzenpost/core/sphinx/constants"
 	"github.com/katzenpost/core/sphinx/path"
 	"github.com/katzenpost/core/worker"
+	"github.com/katzenpost/server/internal/debug"
 	"github.com/katzenpost/server/internal/glue"
 	"github.com/katzenpost/server/internal/packet"
 	"github.com/katzenpost/server/internal/pkicache"
@@ -89,13 +89,13 @@ func (d *decoy) OnPacket(pkt *packet.Packet) {
 	// and that it was generated by this decoy instance.  Note that neither
 	// fields are visible to any other party involved.
 	if subtle.ConstantTimeCompare(pkt.Recipient.ID[:], d.recipient) != 1 {
-		d.log.Debugf("Dropping packet: %v (Invalid recipient)", pkt.ID)
+		d.log.Debugf("Dropping packet: %v (%v)", debug.PacketID(pkt.ID), debug.NewReason("Invalid recipient"))
 		return
 	}
 
 	idBase, id := binary.BigEndian.Uint64(pkt.SurbReply.ID[0:]), binary.BigEndian.Uint64(pkt.SurbReply.ID[8:])
 	if idBase != d.surbIDBase {
-		d.log.Debugf("Dropping packet: %v (Invalid SURB ID base: %v)", pkt.ID, idBase)
+		d.log.Debugf("Dropping packet: %v (%v)", debug.PacketID(pkt.ID), debug.NewReason("Invalid SURB ID base: %v", idBase))
 		return
 	}
 
@@ -103,12 +103,12 @@ func (d *decoy) OnPacket(pkt *packet.Packet) {
 
 	ctx := d.loadAndDeleteSURBCtx(id)
 	if ctx == nil {
-		d.log.Debugf("Dropping packet: %v (Unknown SURB ID: 0x%08x)", pkt.ID, id)
+		d.log.Debugf("Dropping packet: %v (%v)", debug.PacketID(pkt.ID), debug.NewReason("Unknown SURB ID: 0x%08x", id))
 		return
 	}
 
 	if _, err := sphinx.DecryptSURBPayload(pkt.Payload, ctx.sprpKey); err != nil {
-		d.log.Debugf("Dropping packet: %v (SURB ID: 0x08x%): %v", pkt.ID, id, err)
+		d.log.Debugf("Dropping packet: %v (%v)", debug.PacketID(pkt.ID), debug.NewReason("SURB ID: 0x%08x: %v", id, err))
 		return
 	}
 
@@ -136,7 +136,7 @@ func (d *decoy) worker() {
 				continue
 			}
 
-			now, _, _ := epochtime.Now()
+			now, _, _ := d.glue.Clock().Epoch()
 			if entEpoch := newEnt.Epoch(); entEpoch != now {
 				d.log.Debugf("Received PKI document for non-current epoch, ignoring: %v", entEpoch)
 				continue
@@ -151,7 +151,7 @@ func (d *decoy) worker() {
 			timerFired = true
 		}
 
-		now, _, _ := epochtime.Now()
+		now, _, _ := d.glue.Clock().Epoch()
 		if docCache == nil || docCache.Epoch() != now {
 			d.log.Debugf("Suspending operation till the next PKI document.")
 			wakeInterval = time.Duration(maxDuration)
@@ -234,9 +234,9 @@ func (d *decoy) sendLoopPacket(doc *pki.Document, recipient []byte, src, dst *pk
 	d.makeSURBID(&surbID)
 
 	for attempts := 0; attempts < maxAttempts; attempts++ {
-		now := time.Now()
+		now := d.glue.Clock().Now()
 
-		fwdPath, then, err := path.New(d.rng, doc, recipient, src, dst, &surbID, time.Now(), false, true)
+		fwdPath, then, err := path.New(d.rng, doc, recipient, src, dst, &surbID, now, false, true)
 		if err != nil {
 			d.log.Debugf("Failed to select forward path: %v", err)
 			return
@@ -265,7 +265,7 @@ func (d *decoy) sendLoopPacket(doc *pki.Document, recipient []byte, src, dst *pk
 			// are causing issues.
 			ctx := &surbCtx{
 				id:      binary.BigEndian.Uint64(surbID[8:]),
-				eta:     monotime.Now() + deltaT,
+				eta:     d.glue.Clock().Mono() + deltaT,
 				sprpKey: k,
 			}
 			d.storeSURBCtx(ctx)
@@ -292,9 +292,9 @@ func (d *decoy) sendDiscardPacket(doc *pki.Document, recipient []byte, src, dst
 	var payload [2 + sphinx.SURBLength + constants.UserForwardPayloadLength]byte
 
 	for attempts := 0; attempts < maxAttempts; attempts++ {
-		now := time.Now()
+		now := d.glue.Clock().Now()
 
-		fwdPath, then, err := path.New(d.rng, doc, recipient, src, dst, nil, time.Now(), false, true)
+		fwdPath, then, err := path.New(d.rng, doc, recipient, src, dst, nil, now, false, true)
 		if err != nil {
 			d.log.Debugf("Failed to select forward path: %v", err)
 			return
@@ -323,7 +323,7 @@ func (d *decoy) dispatchPacket(fwdPath []*sphinx.PathHop, raw []byte) {
 	}
 	pkt.NextNodeHop = &commands.NextNodeHop{}
 	copy(pkt.NextNodeHop.ID[:], fwdPath[0].ID[:])
-	pkt.DispatchAt = monotime.Now()
+	pkt.DispatchAt = d.glue.Clock().Mono()
 
 	d.log.Debugf("Dispatching packet: %v", pkt.ID)
 	d.glue.Connector().DispatchPacket(pkt)
@@ -407,7 +407,7 @@ func (d *decoy) sweepSURBCtxs() {
 		return
 	}
 
-	now := monotime.Now()
+	now := d.glue.Clock().Mono()
 	slack := time.Duration(d.glue.Config().Debug.DecoySlack) * time.Millisecond
 
 	var swept int
@@ -427,7 +427,7 @@ func (d *decoy) sweepSURBCtxs() {
 		d.surbETAs.Remove(node)
 	}
 
-	d.log.Debugf("Sweep: Count: %v (Removed: %v, Elapsed: %v)", len(d.surbStore), swept, monotime.Now()-now)
+	d.log.Debugf("Sweep: Count: %v (Removed: %v, Elapsed: %v)", len(d.surbStore), swept, d.glue.Clock().Mono()-now)
 }
 
 // New constructs a new decoy instance.
@@ -451,7 +451,7 @@ func New(glue glue.Glue) (glue.Decoy, error) {
 			}
 		}),
 		surbStore:  make(map[uint64]*surbCtx),
-		surbIDBase: uint64(time.Now().Unix()),
+		surbIDBase: uint64(glue.Clock().Now().Unix()),
 	}
 	if _, err := io.ReadFull(rand.Reader, d.recipient); err != nil {
 		return nil, err
@@ -24,12 +24,14 @@ import (
 	"github.com/katzenpost/core/log"
 	"github.com/katzenpost/core/pki"
 	"github.com/katzenpost/core/sphinx/constants"
-	"github.com/katzenpost/core/thwack"
 	"github.com/katzenpost/core/wire"
 	"github.com/katzenpost/server/config"
+	"github.com/katzenpost/server/internal/clock"
+	"github.com/katzenpost/server/internal/management"
 	"github.com/katzenpost/server/internal/mixkey"
 	"github.com/katzenpost/server/internal/packet"
 	"github.com/katzenpost/server/internal/pkicache"
+	"github.com/katzenpost/server/internal/translog"
 	"github.com/katzenpost/server/spool"
 	"github.com/katzenpost/server/userdb"
 )
@@ -38,10 +40,13 @@ import (
 type Glue interface {
 	Config() *config.Config
 	LogBackend() *log.Backend
+	Clock() clock.Clock
+	Skew() *clock.Skew
 	IdentityKey() *eddsa.PrivateKey
 	LinkKey() *ecdh.PrivateKey
 
-	Management() *thwack.Server
+	Management() *management.Server
+	LinkKeys() LinkKeys
 	MixKeys() MixKeys
 	PKI() PKI
 	Provider() Provider
@@ -51,6 +56,15 @@ type Glue interface {
 	Decoy() Decoy
 
 	ReshadowCryptoWorkers()
+	SubmitPacket(*packet.Packet)
+	SubmitCryptoJob(*packet.SURBJob)
+}
+
+type LinkKeys interface {
+	Halt()
+	Generate(uint64) (bool, error)
+	Prune() bool
+	Get(uint64) (*ecdh.PublicKey, bool)
 }
 
 type MixKeys interface {
@@ -67,14 +81,20 @@ type PKI interface {
 	OutgoingDestinations() map[[constants.NodeIDLength]byte]*pki.MixDescriptor
 	AuthenticateConnection(*wire.PeerCredentials, bool) (*pki.MixDescriptor, bool, bool)
 	GetRawConsensus(uint64) ([]byte, error)
+	EntryForEpoch(uint64) *pkicache.Entry
+	FailedFetch(uint64) error
+	OnClockJump()
+	SetDraining()
 }
 
 type Provider interface {
 	Halt()
 	UserDB() userdb.UserDB
 	Spool() spool.Spool
+	IdentityLog() *translog.Log
 	AuthenticateClient(*wire.PeerCredentials) bool
 	OnPacket(*packet.Packet)
+	OnPackets([]*packet.Packet)
 	KaetzchenForPKI() map[string]map[string]interface{}
 }
 
@@ -82,6 +102,8 @@ type Scheduler interface {
 	Halt()
 	OnNewMixMaxDelay(uint64)
 	OnPacket(*packet.Packet)
+	OnPackets([]*packet.Packet)
+	QueueLength() int
 }
 
 type Connector interface {
@@ -89,12 +111,16 @@ type Connector interface {
 	DispatchPacket(*packet.Packet)
 	IsValidForwardDest(*[constants.NodeIDLength]byte) bool
 	ForceUpdate()
+	NrConns() (int, int)
+	QueueLength() int
 }
 
 type Listener interface {
 	Halt()
 	IsConnUnique(interface{}) bool
 	OnNewSendShift(uint64)
+	StopAccepting()
+	NrClientConns() int
 }
 
 type Decoy interface {
@@ -26,10 +26,8 @@ import (
 
 	"github.com/katzenpost/core/constants"
 	"github.com/katzenpost/core/crypto/rand"
-	"github.com/katzenpost/core/monotime"
 	cpki "github.com/katzenpost/core/pki"
 	"github.com/katzenpost/core/sphinx"
-	"github.com/katzenpost/core/utils"
 	"github.com/katzenpost/core/wire"
 	"github.com/katzenpost/core/wire/commands"
 	"github.com/katzenpost/server/internal/debug"
@@ -53,6 +51,7 @@ type incomingConn struct {
 	sendTokenIncr time.Duration
 	sendTokenLast time.Duration
 	isInitialized bool // Set by listener.
+	isClient      bool // Set by listener.
 	fromClient    bool
 	fromMix       bool
 	canSend       bool
@@ -91,7 +90,7 @@ func (c *incomingConn) IsPeerValid(creds *wire.PeerCredentials) bool {
 			// If there was no previous limit start at 1 send credit.
 			if c.sendTokenIncr == 0 {
 				c.sendTokens = 1
-				c.sendTokenLast = monotime.Now()
+				c.sendTokenLast = c.l.glue.Clock().Mono()
 			}
 
 			c.sendTokenIncr = time.Duration(sendShift) * time.Millisecond
@@ -112,7 +111,7 @@ func (c *incomingConn) IsPeerValid(creds *wire.PeerCredentials) bool {
 		c.fromMix = true
 	}
 	if !isValid {
-		c.log.Debugf("Authenticate failed: '%v' (%v)", debug.BytesToPrintString(creds.AdditionalData), creds.PublicKey)
+		c.log.Debugf("Authenticate failed: '%v' (%v)", debug.Peer(debug.CredentialToPrintString(creds.AdditionalData)), debug.KeyToPrintString(creds.PublicKey))
 	}
 	return isValid
 }
@@ -153,9 +152,9 @@ func (c *incomingConn) worker() {
 	// Log the connection source.
 	creds := c.w.PeerCredentials()
 	if c.fromMix {
-		c.log.Debugf("Peer: '%v' (%v)", debug.BytesToPrintString(creds.AdditionalData), creds.PublicKey)
+		c.log.Debugf("Peer: '%v' (%v)", debug.Peer(debug.CredentialToPrintString(creds.AdditionalData)), debug.KeyToPrintString(creds.PublicKey))
 	} else {
-		c.log.Debugf("User: '%v', Key: '%v'", utils.ASCIIBytesToPrintString(creds.AdditionalData), creds.PublicKey)
+		c.log.Debugf("User: '%v', Key: '%v'", debug.Peer(debug.UserToPrintString(creds.AdditionalData)), debug.KeyToPrintString(creds.PublicKey))
 	}
 
 	// Ensure that there's only one incoming conn from any given peer, though
@@ -382,7 +381,7 @@ func (c *incomingConn) onSendPacket(cmd *commands.SendPacket) error {
 	// current epoch, enforce SendShift based rate limits.
 	if c.fromClient && c.sendTokenIncr != 0 {
 		// Update the token bucket for the time that we were idle.
-		deltaT := monotime.Now() - c.sendTokenLast
+		deltaT := c.l.glue.Clock().Mono() - c.sendTokenLast
 		c.log.Debugf("Rate limit: DeltaT: %v Tokens: %v", deltaT, c.sendTokens)
 		incrCount := uint64(deltaT / c.sendTokenIncr)
 		if incrCount > 0 {
@@ -398,7 +397,7 @@ func (c *incomingConn) onSendPacket(cmd *commands.SendPacket) error {
 		}
 
 		if c.sendTokens == 0 {
-			c.log.Debugf("Dropping packet: %v (Rate limited)", pkt.ID)
+			c.log.Debugf("Dropping packet: %v (%v)", debug.PacketID(pkt.ID), debug.NewReason("Rate limited"))
 			pkt.Dispose()
 			return nil
 		}
@@ -411,8 +410,8 @@ func (c *incomingConn) onSendPacket(cmd *commands.SendPacket) error {
 	// For purposes of fudging the scheduling delay based on queue dwell
 	// time, we treat the moment the packet is inserted into the crypto
 	// worker queue as the time the packet was received.
-	pkt.RecvAt = monotime.Now()
-	c.l.incomingCh <- pkt
+	pkt.RecvAt = c.l.glue.Clock().Mono()
+	c.l.glue.SubmitPacket(pkt)
 
 	return nil
 }
@@ -422,7 +421,7 @@ func newIncomingConn(l *listener, conn net.Conn) *incomingConn {
 		l:             l,
 		c:             conn,
 		id:            atomic.AddUint64(&incomingConnID, 1), // Diagnostic only, wrapping is fine.
-		sendTokenLast: monotime.Now(),
+		sendTokenLast: l.glue.Clock().Mono(),
 	}
 	c.log = l.glue.LogBackend().GetLogger(fmt.Sprintf("incoming:%d", c.id))
 
@@ -41,11 +41,11 @@ type listener struct {
 	l     net.Listener
 	conns *list.List
 
-	incomingCh chan<- interface{}
 	closeAllCh chan interface{}
 	closeAllWg sync.WaitGroup
 
-	sendShift uint64
+	sendShift  uint64
+	isDraining uint32
 }
 
 func (l *listener) Halt() {
@@ -65,6 +65,25 @@ func (l *listener) OnNewSendShift(newSendShift uint64) {
 	atomic.StoreUint64(&l.sendShift, newSendShift)
 }
 
+func (l *listener) StopAccepting() {
+	// Close the listener, but leave the established connections alone.
+	atomic.StoreUint32(&l.isDraining, 1)
+	l.l.Close()
+}
+
+func (l *listener) NrClientConns() int {
+	l.Lock()
+	defer l.Unlock()
+
+	n := 0
+	for e := l.conns.Front(); e != nil; e = e.Next() {
+		if e.Value.(*incomingConn).isClient {
+			n++
+		}
+	}
+	return n
+}
+
 func (l *listener) worker() {
 	addr := l.l.Addr()
 	l.log.Noticef("Listening on: %v", addr)
@@ -76,7 +95,9 @@ func (l *listener) worker() {
 		conn, err := l.l.Accept()
 		if err != nil {
 			if e, ok := err.(net.Error); ok && !e.Temporary() {
-				l.log.Errorf("Critical accept failure: %v", err)
+				if atomic.LoadUint32(&l.isDraining) == 0 {
+					l.log.Errorf("Critical accept failure: %v", err)
+				}
 				return
 			}
 			continue
@@ -111,6 +132,7 @@ func (l *listener) onInitializedConn(c *incomingConn) {
 	defer l.Unlock()
 
 	c.isInitialized = true
+	c.isClient = c.fromClient
 }
 
 func (l *listener) onClosedConn(c *incomingConn) {
@@ -152,14 +174,13 @@ func (l *listener) IsConnUnique(ptr interface{}) bool {
 }
 
 // New creates a new listener.
-func New(glue glue.Glue, incomingCh chan<- interface{}, id int, addr string) (glue.Listener, error) {
+func New(glue glue.Glue, id int, addr string) (glue.Listener, error) {
 	var err error
 
 	l := &listener{
 		glue:       glue,
 		log:        glue.LogBackend().GetLogger(fmt.Sprintf("listener:%d", id)),
 		conns:      list.New(),
-		incomingCh: incomingCh,
 		closeAllCh: make(chan interface{}),
 	}
 
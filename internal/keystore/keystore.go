@@ -0,0 +1,260 @@
+// keystore.go - Katzenpost server private key at rest encryption.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package keystore implements encryption of private key material at rest.
+package keystore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/utils"
+	"github.com/katzenpost/server/config"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+const (
+	sealedVersion = 0
+
+	saltLength  = 16
+	nonceLength = 24
+	keyLength   = 32
+
+	// The Argon2id parameters used for newly sealed blobs.  Existing blobs
+	// carry their own parameters.
+	kdfTime    = 3
+	kdfMemory  = 64 * 1024 // 64 MiB.
+	kdfThreads = 4
+
+	headerLength = 1 + 4 + 4 + 1 + saltLength + nonceLength
+)
+
+var (
+	// ErrDecrypt is the error returned when a sealed blob fails to decrypt,
+	// most likely due to an incorrect passphrase.
+	ErrDecrypt = errors.New("keystore: failed to decrypt, incorrect passphrase?")
+
+	// ErrPassphraseMismatch is the error returned when the confirmation of
+	// a new passphrase does not match.
+	ErrPassphraseMismatch = errors.New("keystore: passphrases do not match")
+
+	errMalformed = errors.New("keystore: malformed sealed blob")
+)
+
+type kdfParams struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+	salt    [saltLength]byte
+}
+
+// Keystore seals and opens private key material with a key derived from a
+// passphrase.
+type Keystore struct {
+	sync.Mutex
+
+	passphrase []byte
+	params     kdfParams
+	keys       map[kdfParams]*[keyLength]byte
+}
+
+func (ks *Keystore) deriveKey(p *kdfParams) *[keyLength]byte {
+	// Key derivation is deliberately expensive, so cache the derived keys,
+	// such that every key sealed by this process only pays the cost once.
+	if k, ok := ks.keys[*p]; ok {
+		return k
+	}
+	k := new([keyLength]byte)
+	dk := argon2.IDKey(ks.passphrase, p.salt[:], p.time, p.memory, p.threads, keyLength)
+	copy(k[:], dk)
+	utils.ExplicitBzero(dk)
+	ks.keys[*p] = k
+	return k
+}
+
+// Seal encrypts and authenticates the plaintext.
+func (ks *Keystore) Seal(plaintext []byte) ([]byte, error) {
+	ks.Lock()
+	defer ks.Unlock()
+
+	if ks.passphrase == nil {
+		return nil, errors.New("keystore: Seal() after Reset()")
+	}
+
+	var nonce [nonceLength]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, headerLength, headerLength+len(plaintext)+secretbox.Overhead)
+	b[0] = sealedVersion
+	binary.BigEndian.PutUint32(b[1:5], ks.params.time)
+	binary.BigEndian.PutUint32(b[5:9], ks.params.memory)
+	b[9] = ks.params.threads
+	copy(b[10:10+saltLength], ks.params.salt[:])
+	copy(b[10+saltLength:headerLength], nonce[:])
+
+	return secretbox.Seal(b, plaintext, &nonce, ks.deriveKey(&ks.params)), nil
+}
+
+// Open authenticates and decrypts a blob previously created by Seal, with
+// any passphrase.
+func (ks *Keystore) Open(sealed []byte) ([]byte, error) {
+	ks.Lock()
+	defer ks.Unlock()
+
+	if ks.passphrase == nil {
+		return nil, errors.New("keystore: Open() after Reset()")
+	}
+	if len(sealed) < headerLength+secretbox.Overhead || sealed[0] != sealedVersion {
+		return nil, errMalformed
+	}
+
+	var p kdfParams
+	p.time = binary.BigEndian.Uint32(sealed[1:5])
+	p.memory = binary.BigEndian.Uint32(sealed[5:9])
+	p.threads = sealed[9]
+	copy(p.salt[:], sealed[10:10+saltLength])
+	if p.time == 0 || p.threads == 0 {
+		return nil, errMalformed
+	}
+	var nonce [nonceLength]byte
+	copy(nonce[:], sealed[10+saltLength:headerLength])
+
+	plaintext, ok := secretbox.Open(nil, sealed[headerLength:], &nonce, ks.deriveKey(&p))
+	if !ok {
+		return nil, ErrDecrypt
+	}
+	return plaintext, nil
+}
+
+// Reset clears the passphrase and all derived key material.
+func (ks *Keystore) Reset() {
+	ks.Lock()
+	defer ks.Unlock()
+
+	utils.ExplicitBzero(ks.passphrase)
+	ks.passphrase = nil
+	for p, k := range ks.keys {
+		utils.ExplicitBzero(k[:])
+		delete(ks.keys, p)
+	}
+}
+
+// New creates a new Keystore with the provided passphrase.  The passphrase
+// is copied, so the caller is free to clear it.
+func New(passphrase []byte) (*Keystore, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("keystore: empty passphrase")
+	}
+
+	ks := &Keystore{
+		passphrase: append([]byte{}, passphrase...),
+		params: kdfParams{
+			time:    kdfTime,
+			memory:  kdfMemory,
+			threads: kdfThreads,
+		},
+		keys: make(map[kdfParams]*[keyLength]byte),
+	}
+	if _, err := io.ReadFull(rand.Reader, ks.params.salt[:]); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// NewFromConfig creates a new Keystore with the passphrase from the location
+// specified in the configuration, which may involve prompting on stdin.
+func NewFromConfig(cfg *config.KeyEncryption) (*Keystore, error) {
+	passphrase, err := ReadPassphrase(cfg.PassphraseFile, cfg.KeyFile, cfg.Passphrase, "Key encryption passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	defer utils.ExplicitBzero(passphrase)
+
+	return New(passphrase)
+}
+
+// ReadPassphrase returns a passphrase from the passphrase file, key file, the
+// provided passphrase, or stdin in that order of preference.
+func ReadPassphrase(passphraseFile, keyFile string, passphrase []byte, prompt string) ([]byte, error) {
+	switch {
+	case passphraseFile != "":
+		b, err := ioutil.ReadFile(passphraseFile)
+		if err != nil {
+			return nil, err
+		}
+		p := append([]byte{}, bytes.TrimRight(b, "\r\n")...)
+		utils.ExplicitBzero(b)
+		return p, nil
+	case keyFile != "":
+		return ioutil.ReadFile(keyFile)
+	case len(passphrase) > 0:
+		return append([]byte{}, passphrase...), nil
+	}
+
+	// Read the passphrase from stdin, without echoing it if stdin is a
+	// terminal.
+	fd := int(os.Stdin.Fd())
+	if terminal.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, prompt)
+		defer fmt.Fprintln(os.Stderr)
+		return terminal.ReadPassword(fd)
+	}
+	l, err := bufio.NewReader(os.Stdin).ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	p := append([]byte{}, bytes.TrimRight(l, "\r\n")...)
+	utils.ExplicitBzero(l)
+	return p, nil
+}
+
+// ReadNewPassphrase returns a new passphrase as with ReadPassphrase.  If the
+// passphrase is read from a terminal, it is prompted for twice, so that a
+// typo can not render every key unrecoverable.
+func ReadNewPassphrase(passphraseFile, keyFile string, passphrase []byte, prompt string) ([]byte, error) {
+	p, err := ReadPassphrase(passphraseFile, keyFile, passphrase, prompt)
+	if err != nil {
+		return nil, err
+	}
+	if passphraseFile != "" || keyFile != "" || len(passphrase) > 0 || !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		return p, nil
+	}
+
+	p2, err := ReadPassphrase("", "", nil, "Confirm passphrase: ")
+	if err != nil {
+		utils.ExplicitBzero(p)
+		return nil, err
+	}
+	isEqual := bytes.Equal(p, p2)
+	utils.ExplicitBzero(p2)
+	if !isEqual {
+		utils.ExplicitBzero(p)
+		return nil, ErrPassphraseMismatch
+	}
+	return p, nil
+}
@@ -0,0 +1,93 @@
+// keystore_test.go - Private key at rest encryption tests.
+// Copyright (C) 2017  Yawning Angel
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package keystore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeystore(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	ks, err := New([]byte("correct horse battery staple"))
+	require.NoError(err, "New()")
+	defer ks.Reset()
+
+	msg := []byte("This is a test private key, honest.")
+	sealed, err := ks.Seal(msg)
+	require.NoError(err, "Seal()")
+
+	opened, err := ks.Open(sealed)
+	require.NoError(err, "Open()")
+	assert.Equal(msg, opened, "Open(): round trip")
+
+	// A different passphrase should fail to open the blob.
+	badKS, err := New([]byte("incorrect horse battery staple"))
+	require.NoError(err, "New(): bad passphrase")
+	defer badKS.Reset()
+	_, err = badKS.Open(sealed)
+	assert.Equal(ErrDecrypt, err, "Open(): bad passphrase")
+
+	// Tampering should be detected.
+	sealed[len(sealed)-1] ^= 0xa5
+	_, err = ks.Open(sealed)
+	assert.Equal(ErrDecrypt, err, "Open(): tampered")
+}
+
+func TestKeystorePEM(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "keystore_tests")
+	require.NoError(err, "TempDir()")
+	defer os.RemoveAll(tmpDir)
+
+	ks, err := New([]byte("hunter2"))
+	require.NoError(err, "New()")
+	defer ks.Reset()
+
+	privFile := filepath.Join(tmpDir, "identity.private.pem")
+	pubFile := filepath.Join(tmpDir, "identity.public.pem")
+	k, err := ks.LoadIdentityKey(privFile, pubFile)
+	require.NoError(err, "LoadIdentityKey(): generate")
+	kLoaded, err := ks.LoadIdentityKey(privFile, pubFile)
+	require.NoError(err, "LoadIdentityKey(): load")
+	assert.Equal(k.Bytes(), kLoaded.Bytes(), "LoadIdentityKey(): round trip")
+
+	// Rotate the passphrase.
+	newKS, err := New([]byte("hunter3"))
+	require.NoError(err, "New(): rotated")
+	defer newKS.Reset()
+	err = ResealPEMFile(privFile, IdentityKeyType, ks, newKS)
+	require.NoError(err, "ResealPEMFile()")
+	_, err = ks.LoadIdentityKey(privFile, pubFile)
+	assert.Error(err, "LoadIdentityKey(): old passphrase")
+	kLoaded, err = newKS.LoadIdentityKey(privFile, pubFile)
+	require.NoError(err, "LoadIdentityKey(): new passphrase")
+	assert.Equal(k.Bytes(), kLoaded.Bytes(), "LoadIdentityKey(): rotated round trip")
+
+	// Link keys are typed separately.
+	_, err = newKS.LoadLinkKey(privFile)
+	assert.Error(err, "LoadLinkKey(): identity key")
+}
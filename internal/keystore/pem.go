@@ -0,0 +1,197 @@
+// pem.go - Katzenpost server sealed PEM files.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package keystore
+
+import (
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/utils"
+)
+
+const (
+	sealedPEMType = "KATZENPOST SEALED PRIVATE KEY"
+	keyTypeHeader = "Key-Type"
+
+	// IdentityKeyType is the Key-Type of sealed identity keys.
+	IdentityKeyType = "ED25519 PRIVATE KEY"
+
+	// LinkKeyType is the Key-Type of sealed link keys.
+	LinkKeyType = "X25519 PRIVATE KEY"
+
+	identityPublicKeyType = "ED25519 PUBLIC KEY"
+)
+
+// ErrNotSealed is the error returned when a private key that is expected to
+// be sealed is stored in plaintext.
+var ErrNotSealed = errors.New("keystore: private key is not encrypted")
+
+// LoadIdentityKey loads the sealed identity key from privFile, generating and
+// saving a new key (and the public key to pubFile) if it does not exist.
+func (ks *Keystore) LoadIdentityKey(privFile, pubFile string) (*eddsa.PrivateKey, error) {
+	var k *eddsa.PrivateKey
+	b, err := ks.loadOrGenerate(privFile, IdentityKeyType, func() ([]byte, error) {
+		var err error
+		if k, err = eddsa.NewKeypair(rand.Reader); err != nil {
+			return nil, err
+		}
+		pubBlk := &pem.Block{
+			Type:  identityPublicKeyType,
+			Bytes: k.PublicKey().Bytes(),
+		}
+		if err = writeFile(pubFile, pem.EncodeToMemory(pubBlk), 0644); err != nil {
+			return nil, err
+		}
+		return k.Bytes(), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if k != nil {
+		return k, nil
+	}
+
+	defer utils.ExplicitBzero(b)
+	k = new(eddsa.PrivateKey)
+	if err = k.FromBytes(b); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// LoadLinkKey loads the sealed link key from privFile, generating and saving
+// a new key if it does not exist.
+func (ks *Keystore) LoadLinkKey(privFile string) (*ecdh.PrivateKey, error) {
+	var k *ecdh.PrivateKey
+	b, err := ks.loadOrGenerate(privFile, LinkKeyType, func() ([]byte, error) {
+		var err error
+		if k, err = ecdh.NewKeypair(rand.Reader); err != nil {
+			return nil, err
+		}
+		return k.Bytes(), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if k != nil {
+		return k, nil
+	}
+
+	defer utils.ExplicitBzero(b)
+	k = new(ecdh.PrivateKey)
+	if err = k.FromBytes(b); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (ks *Keystore) loadOrGenerate(f, keyType string, generateFn func() ([]byte, error)) ([]byte, error) {
+	buf, err := ioutil.ReadFile(f)
+	switch {
+	case err == nil:
+		blk, _ := pem.Decode(buf)
+		if blk == nil {
+			return nil, fmt.Errorf("keystore: failed to decode PEM file '%v'", f)
+		}
+		if blk.Type != sealedPEMType {
+			return nil, fmt.Errorf("keystore: '%v': %v", f, ErrNotSealed)
+		}
+		if t := blk.Headers[keyTypeHeader]; t != keyType {
+			return nil, fmt.Errorf("keystore: '%v': unexpected key type '%v'", f, t)
+		}
+		return ks.Open(blk.Bytes)
+	case os.IsNotExist(err):
+	default:
+		return nil, err
+	}
+
+	b, err := generateFn()
+	if err != nil {
+		return nil, err
+	}
+	if err = ks.writeSealedPEM(f, keyType, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (ks *Keystore) writeSealedPEM(f, keyType string, b []byte) error {
+	sealed, err := ks.Seal(b)
+	if err != nil {
+		return err
+	}
+	blk := &pem.Block{
+		Type:    sealedPEMType,
+		Headers: map[string]string{keyTypeHeader: keyType},
+		Bytes:   sealed,
+	}
+	return writeFile(f, pem.EncodeToMemory(blk), 0600)
+}
+
+// ResealPEMFile re-encrypts the private key stored in f under newKS.  If
+// oldKS is nil, the key is expected to be a plaintext PEM file of keyType,
+// otherwise it is expected to be sealed under oldKS.
+func ResealPEMFile(f, keyType string, oldKS, newKS *Keystore) error {
+	buf, err := ioutil.ReadFile(f)
+	if err != nil {
+		return err
+	}
+	blk, _ := pem.Decode(buf)
+	if blk == nil {
+		return fmt.Errorf("keystore: failed to decode PEM file '%v'", f)
+	}
+
+	var b []byte
+	switch blk.Type {
+	case sealedPEMType:
+		if oldKS == nil {
+			return fmt.Errorf("keystore: '%v' is already encrypted", f)
+		}
+		if t := blk.Headers[keyTypeHeader]; t != keyType {
+			return fmt.Errorf("keystore: '%v': unexpected key type '%v'", f, t)
+		}
+		if b, err = oldKS.Open(blk.Bytes); err != nil {
+			return fmt.Errorf("keystore: '%v': %v", f, err)
+		}
+	case keyType:
+		if oldKS != nil {
+			return fmt.Errorf("keystore: '%v': %v", f, ErrNotSealed)
+		}
+		b = blk.Bytes
+	default:
+		return fmt.Errorf("keystore: '%v': unexpected PEM type '%v'", f, blk.Type)
+	}
+	defer utils.ExplicitBzero(b)
+
+	return newKS.writeSealedPEM(f, keyType, b)
+}
+
+func writeFile(f string, b []byte, perm os.FileMode) error {
+	// Write to a temporary file and rename over the destination, so that
+	// a crash mid-write never leaves a truncated key behind.
+	tmp := f + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f)
+}
@@ -0,0 +1,82 @@
+// json.go - Structured log format.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package logbackend
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/server/internal/debug"
+	"gopkg.in/op/go-logging.v1"
+)
+
+// jsonEntry is a single structured log entry.  The field names are part of
+// the log format, and should not be changed.
+type jsonEntry struct {
+	Time     string  `json:"time"`
+	Level    string  `json:"level"`
+	Module   string  `json:"module"`
+	Message  string  `json:"msg"`
+	PacketID *uint64 `json:"packet_id,omitempty"`
+	Peer     string  `json:"peer,omitempty"`
+	Reason   string  `json:"reason,omitempty"`
+}
+
+type jsonBackend struct {
+	sync.Mutex
+
+	w io.Writer
+}
+
+func (b *jsonBackend) Log(level logging.Level, calldepth int, rec *logging.Record) error {
+	ent := &jsonEntry{
+		Time:    rec.Time.UTC().Format(time.RFC3339Nano),
+		Level:   level.String(),
+		Module:  rec.Module,
+		Message: rec.Message(),
+	}
+
+	// Lift the well known arguments into their own fields.
+	for _, arg := range rec.Args {
+		switch v := arg.(type) {
+		case debug.PacketID:
+			id := uint64(v)
+			ent.PacketID = &id
+		case debug.Peer:
+			ent.Peer = string(v)
+		case *debug.Reason:
+			ent.Reason = v.String()
+		}
+	}
+
+	buf, err := json.Marshal(ent)
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+
+	b.Lock()
+	defer b.Unlock()
+	_, err = b.w.Write(buf)
+	return err
+}
+
+func newJSONBackend(w io.Writer) *jsonBackend {
+	return &jsonBackend{w: w}
+}
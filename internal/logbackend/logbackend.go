@@ -0,0 +1,147 @@
+// logbackend.go - Katzenpost server log backend.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package logbackend implements the configurable log backend, with support
+// for per-module log levels, structured output, and log file rotation.
+package logbackend
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/core/log"
+	"github.com/katzenpost/server/config"
+	"gopkg.in/op/go-logging.v1"
+)
+
+const textFormat = "%{time:15:04:05.000} %{level:.4s} %{module}: %{message}"
+
+// moduleLeveled is a leveled backend where the level of each module is
+// inherited from the closest parent module that has a level set.
+type moduleLeveled struct {
+	sync.RWMutex
+	logging.Backend
+
+	defaultLevel logging.Level
+	levels       map[string]logging.Level
+}
+
+func (b *moduleLeveled) GetLevel(module string) logging.Level {
+	b.RLock()
+	defer b.RUnlock()
+
+	// Modules are hierarchical, with `:` and `/` as the separators, for
+	// example `incoming:1` and `scheduler/bolt`.
+	for m := module; m != ""; {
+		if lvl, ok := b.levels[m]; ok {
+			return lvl
+		}
+		i := strings.LastIndexAny(m, ":/")
+		if i < 0 {
+			break
+		}
+		m = m[:i]
+	}
+	return b.defaultLevel
+}
+
+func (b *moduleLeveled) SetLevel(level logging.Level, module string) {
+	b.Lock()
+	defer b.Unlock()
+
+	if module == "" {
+		b.defaultLevel = level
+	} else {
+		b.levels[module] = level
+	}
+}
+
+func (b *moduleLeveled) IsEnabledFor(level logging.Level, module string) bool {
+	return level <= b.GetLevel(module)
+}
+
+func (b *moduleLeveled) Log(level logging.Level, calldepth int, rec *logging.Record) error {
+	if !b.IsEnabledFor(level, rec.Module) {
+		return nil
+	}
+	return b.Backend.Log(level, calldepth+1, rec)
+}
+
+func newModuleLeveled(backend logging.Backend, cfg *config.Logging) (*moduleLeveled, error) {
+	b := &moduleLeveled{
+		Backend: backend,
+		levels:  make(map[string]logging.Level),
+	}
+
+	lvl, err := logging.LogLevel(cfg.Level)
+	if err != nil {
+		return nil, err
+	}
+	b.SetLevel(lvl, "")
+	for k, v := range cfg.ModuleLevels {
+		if lvl, err = logging.LogLevel(v); err != nil {
+			return nil, err
+		}
+		b.SetLevel(lvl, k)
+	}
+	return b, nil
+}
+
+// New returns a new log backend for the provided configuration, logging to
+// the file f, or stdout if f is empty.
+func New(cfg *config.Logging, f string) (*log.Backend, error) {
+	// Figure out where the log should go to, creating a log file as needed.
+	var w io.Writer
+	switch {
+	case cfg.Disable:
+		w = ioutil.Discard
+	case f == "":
+		w = os.Stdout
+	case cfg.IsRotated():
+		interval := time.Duration(cfg.RotateInterval) * time.Millisecond
+		rf, err := newRotatingFile(f, cfg.MaxFileSize, interval, cfg.MaxFiles)
+		if err != nil {
+			return nil, err
+		}
+		w = rf
+	default:
+		const fileMode = 0600
+		var err error
+		flags := os.O_CREATE | os.O_APPEND | os.O_WRONLY
+		if w, err = os.OpenFile(f, flags, fileMode); err != nil {
+			return nil, err
+		}
+	}
+
+	var backend logging.Backend
+	switch cfg.Format {
+	case config.LogFormatJSON:
+		backend = newJSONBackend(w)
+	default:
+		base := logging.NewLogBackend(w, "", 0)
+		backend = logging.NewBackendFormatter(base, logging.MustStringFormatter(textFormat))
+	}
+
+	leveled, err := newModuleLeveled(backend, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &log.Backend{LeveledBackend: leveled}, nil
+}
@@ -0,0 +1,140 @@
+// logbackend_test.go - Katzenpost server log backend tests.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package logbackend
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/katzenpost/server/config"
+	"github.com/katzenpost/server/internal/debug"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/op/go-logging.v1"
+)
+
+func TestModuleLevels(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "logbackend_test")
+	require.NoError(err, "TempDir()")
+	defer os.RemoveAll(dir)
+
+	f := filepath.Join(dir, "katzenpost.log")
+	cfg := &config.Logging{
+		Level: "NOTICE",
+		ModuleLevels: map[string]string{
+			"incoming":  "DEBUG",
+			"scheduler": "ERROR",
+		},
+		Format: config.LogFormatText,
+	}
+	b, err := New(cfg, f)
+	require.NoError(err, "New()")
+
+	// Sub-modules inherit the level of the closest parent.
+	require.Equal(logging.DEBUG, b.GetLevel("incoming:1"), "GetLevel(incoming:1)")
+	require.Equal(logging.ERROR, b.GetLevel("scheduler/bolt"), "GetLevel(scheduler/bolt)")
+	require.Equal(logging.NOTICE, b.GetLevel("incomingx"), "GetLevel(incomingx)")
+	require.Equal(logging.NOTICE, b.GetLevel("pki"), "GetLevel(pki)")
+
+	b.GetLogger("incoming:1").Debugf("incoming debug")
+	b.GetLogger("pki").Debugf("pki debug")
+	b.GetLogger("pki").Noticef("pki notice")
+	b.GetLogger("scheduler/bolt").Warningf("scheduler warning")
+
+	buf, err := ioutil.ReadFile(f)
+	require.NoError(err, "ReadFile()")
+	lines := strings.Split(strings.TrimSpace(string(buf)), "\n")
+	require.Len(lines, 2, "Logged lines")
+	require.True(strings.HasSuffix(lines[0], "DEBU incoming:1: incoming debug"), "Line 0: %v", lines[0])
+	require.True(strings.HasSuffix(lines[1], "NOTI pki: pki notice"), "Line 1: %v", lines[1])
+}
+
+func TestJSON(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "logbackend_test")
+	require.NoError(err, "TempDir()")
+	defer os.RemoveAll(dir)
+
+	f := filepath.Join(dir, "katzenpost.log")
+	cfg := &config.Logging{
+		Level:  "DEBUG",
+		Format: config.LogFormatJSON,
+	}
+	b, err := New(cfg, f)
+	require.NoError(err, "New()")
+
+	l := b.GetLogger("outgoing:1")
+	l.Debugf("Dropping packet: %v (%v)", debug.PacketID(23), debug.NewReason("Deadline blown by %v", 42))
+	l.Noticef("Peer: '%v'", debug.Peer("ABCD"))
+
+	buf, err := ioutil.ReadFile(f)
+	require.NoError(err, "ReadFile()")
+	lines := strings.Split(strings.TrimSpace(string(buf)), "\n")
+	require.Len(lines, 2, "Logged lines")
+
+	var ent map[string]interface{}
+	require.NoError(json.Unmarshal([]byte(lines[0]), &ent), "Unmarshal(0)")
+	require.Equal("DEBUG", ent["level"], "level")
+	require.Equal("outgoing:1", ent["module"], "module")
+	require.Equal("Dropping packet: 23 (Deadline blown by 42)", ent["msg"], "msg")
+	require.Equal(float64(23), ent["packet_id"], "packet_id")
+	require.Equal("Deadline blown by 42", ent["reason"], "reason")
+	require.NotContains(ent, "peer", "peer")
+	require.Contains(ent, "time", "time")
+
+	ent = nil
+	require.NoError(json.Unmarshal([]byte(lines[1]), &ent), "Unmarshal(1)")
+	require.Equal("NOTICE", ent["level"], "level")
+	require.Equal("ABCD", ent["peer"], "peer")
+	require.NotContains(ent, "packet_id", "packet_id")
+}
+
+func TestRotatingFile(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "logbackend_test")
+	require.NoError(err, "TempDir()")
+	defer os.RemoveAll(dir)
+
+	f := filepath.Join(dir, "katzenpost.log")
+	r, err := newRotatingFile(f, 10, 0, 2)
+	require.NoError(err, "newRotatingFile()")
+
+	for _, s := range []string{"aaaaaaaa\n", "bbbbbbbb\n", "cccccccc\n", "dddddddd\n"} {
+		_, err = r.Write([]byte(s))
+		require.NoError(err, "Write()")
+	}
+
+	expected := map[string]string{
+		f:        "dddddddd\n",
+		f + ".1": "cccccccc\n",
+		f + ".2": "bbbbbbbb\n",
+	}
+	for k, v := range expected {
+		buf, err := ioutil.ReadFile(k)
+		require.NoError(err, "ReadFile(%v)", k)
+		require.Equal(v, string(buf), "ReadFile(%v)", k)
+	}
+	_, err = os.Stat(f + ".3")
+	require.True(os.IsNotExist(err), "Oldest file removed")
+}
@@ -0,0 +1,126 @@
+// rotate.go - Log file rotation.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package logbackend
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// rotatingFile is a log file that is rotated once it exceeds a maximum
+// size, or age.  Rotated files are suffixed with `.1` (most recent) up to
+// `.maxFiles`, with older files being removed.
+type rotatingFile struct {
+	sync.Mutex
+
+	path     string
+	maxSize  int64
+	interval time.Duration
+	maxFiles int
+
+	f        *os.File
+	size     int64
+	openedAt time.Time
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.needsRotation(len(p)) {
+		if err := r.rotate(); err != nil {
+			// There is no where to report the failure to, so keep on
+			// appending to the existing file, if any.
+			if r.f == nil {
+				return 0, err
+			}
+		}
+	}
+
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) needsRotation(n int) bool {
+	if r.size == 0 {
+		// Never rotate an empty file.
+		return false
+	}
+	if r.maxSize > 0 && r.size+int64(n) > r.maxSize {
+		return true
+	}
+	return r.interval > 0 && time.Since(r.openedAt) >= r.interval
+}
+
+func (r *rotatingFile) rotate() error {
+	// Shift the existing rotated files, discarding the oldest.
+	os.Remove(r.rotatedPath(r.maxFiles))
+	for i := r.maxFiles - 1; i > 0; i-- {
+		os.Rename(r.rotatedPath(i), r.rotatedPath(i+1))
+	}
+	if err := os.Rename(r.path, r.rotatedPath(1)); err != nil {
+		return err
+	}
+
+	old := r.f
+	r.f = nil
+	if err := r.open(); err != nil {
+		r.f = old
+		return err
+	}
+	old.Close()
+	return nil
+}
+
+func (r *rotatingFile) rotatedPath(i int) string {
+	return fmt.Sprintf("%s.%d", r.path, i)
+}
+
+func (r *rotatingFile) open() error {
+	const fileMode = 0600
+
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, fileMode)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	r.f = f
+	r.size = fi.Size()
+	r.openedAt = time.Now()
+	return nil
+}
+
+func newRotatingFile(path string, maxSize int64, interval time.Duration, maxFiles int) (*rotatingFile, error) {
+	r := &rotatingFile{
+		path:     path,
+		maxSize:  maxSize,
+		interval: interval,
+		maxFiles: maxFiles,
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
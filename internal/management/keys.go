@@ -0,0 +1,175 @@
+// keys.go - Management interface keys and certificates.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package management
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/katzenpost/core/crypto/rand"
+)
+
+const (
+	keyPEMType = "PRIVATE KEY"
+	certCN     = "katzenpost-management"
+)
+
+var errInvalidPeerKey = errors.New("management: peer key is not an Ed25519 key")
+
+// PublicKeyString returns the Base64 representation of a public key, as used
+// in the config file.
+func PublicKeyString(k ed25519.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(k)
+}
+
+// LoadKey loads a PEM encoded Ed25519 private key from the file f.
+func LoadKey(f string) (ed25519.PrivateKey, error) {
+	buf, err := ioutil.ReadFile(f)
+	if err != nil {
+		return nil, err
+	}
+	blk, _ := pem.Decode(buf)
+	if blk == nil || blk.Type != keyPEMType {
+		return nil, fmt.Errorf("management: failed to decode key file '%v'", f)
+	}
+	k, err := x509.ParsePKCS8PrivateKey(blk.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	edK, ok := k.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("management: key file '%v' is not an Ed25519 key", f)
+	}
+	return edK, nil
+}
+
+// GenerateKey generates a new Ed25519 private key, and saves it PEM encoded
+// to the file f, which must not exist.
+func GenerateKey(f string) (ed25519.PrivateKey, error) {
+	_, k, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(k)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err = pem.Encode(&buf, &pem.Block{Type: keyPEMType, Bytes: der}); err != nil {
+		return nil, err
+	}
+	fd, err := os.OpenFile(f, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	if _, err = fd.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	return k, fd.Sync()
+}
+
+// LoadOrGenerateKey loads the private key from the file f, generating it if
+// it does not exist.
+func LoadOrGenerateKey(f string) (ed25519.PrivateKey, error) {
+	if _, err := os.Lstat(f); os.IsNotExist(err) {
+		return GenerateKey(f)
+	}
+	return LoadKey(f)
+}
+
+// NewCertificate returns a self-signed certificate for the private key k.
+// Certificates are only used to carry the key, and peers are authenticated
+// by their public key alone.
+func NewCertificate(k ed25519.PrivateKey) (tls.Certificate, error) {
+	var serial [16]byte
+	if _, err := rand.Reader.Read(serial[:]); err != nil {
+		return tls.Certificate{}, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: new(big.Int).SetBytes(serial[:]),
+		Subject:      pkix.Name{CommonName: certCN},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, k.Public(), k)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: k}, nil
+}
+
+// PeerPublicKey returns the public key of the peer's certificate, as passed
+// to tls.Config.VerifyPeerCertificate.
+func PeerPublicKey(rawCerts [][]byte) (ed25519.PublicKey, error) {
+	if len(rawCerts) == 0 {
+		return nil, errInvalidPeerKey
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return nil, err
+	}
+	pubKey, ok := cert.PublicKey.(ed25519.PublicKey)
+	if !ok {
+		return nil, errInvalidPeerKey
+	}
+	return pubKey, nil
+}
+
+// NewClientTLSConfig returns the TLS configuration for a client that
+// authenticates with the private key k, to a server with the public key
+// serverKey.
+func NewClientTLSConfig(k ed25519.PrivateKey, serverKey ed25519.PublicKey) (*tls.Config, error) {
+	cert, err := NewCertificate(k)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS13,
+		ServerName:   certCN,
+
+		// The server certificate is self-signed, so the public key is
+		// checked instead.
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			pubKey, err := PeerPublicKey(rawCerts)
+			if err != nil {
+				return err
+			}
+			if !pubKey.Equal(serverKey) {
+				return errors.New("management: server key mismatch")
+			}
+			return nil
+		},
+	}, nil
+}
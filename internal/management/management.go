@@ -0,0 +1,358 @@
+// management.go - Katzenpost server management interface.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package management implements the role based management interface, which
+// is available via a local socket, and optionally via mutually authenticated
+// TCP connections.
+package management
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/log"
+	"github.com/katzenpost/core/thwack"
+	"github.com/katzenpost/core/worker"
+	"github.com/katzenpost/server/config"
+	"github.com/katzenpost/server/internal/debug"
+	"github.com/katzenpost/server/internal/logbackend"
+	"gopkg.in/op/go-logging.v1"
+)
+
+const (
+	// ServerKeyFile is the name of the file under the DataDir that holds the
+	// TCP management interface private key.
+	ServerKeyFile = "management.private.pem"
+
+	// AuditLogFile is the name of the file under the DataDir that holds the
+	// audit log.
+	AuditLogFile = "audit.log"
+
+	clientSocketDir = "management.d"
+	unixCaller      = "unix"
+)
+
+// Role is a management client role.  Each role may run every command that
+// the roles before it may.
+type Role int
+
+const (
+	// RoleReadOnly may only run commands that do not alter the server
+	// state.
+	RoleReadOnly Role = iota
+
+	// RoleUserAdmin may additionally add, modify and remove users.
+	RoleUserAdmin
+
+	// RoleOperator may run every command.
+	RoleOperator
+)
+
+// String returns the config file representation of the Role.
+func (r Role) String() string {
+	switch r {
+	case RoleReadOnly:
+		return config.RoleReadOnly
+	case RoleUserAdmin:
+		return config.RoleUserAdmin
+	case RoleOperator:
+		return config.RoleOperator
+	default:
+		return "[INVALID]"
+	}
+}
+
+func roleFromString(s string) (Role, error) {
+	switch s {
+	case config.RoleReadOnly:
+		return RoleReadOnly, nil
+	case config.RoleUserAdmin:
+		return RoleUserAdmin, nil
+	case config.RoleOperator:
+		return RoleOperator, nil
+	default:
+		return RoleReadOnly, errors.New("management: invalid role: " + s)
+	}
+}
+
+type client struct {
+	name   string
+	role   Role
+	pubKey string
+	path   string
+	srv    *thwack.Server
+}
+
+// Server is the management interface.  The local socket allows every
+// command to be run, while each TCP client is proxied to a private thwack
+// instance that only has the commands permitted by it's role registered.
+type Server struct {
+	sync.Mutex
+	worker.Worker
+
+	log      *logging.Logger
+	auditLog *logging.Logger
+
+	unix *thwack.Server
+
+	sockDir   string
+	clients   []*client
+	clientMap map[string]*client
+	l         net.Listener
+	tlsCfg    *tls.Config
+	conns     map[net.Conn]bool
+	isHalting bool
+}
+
+// RegisterCommand registers the handler fn for the command cmd, that may be
+// run by clients with at least the Role role.  Every command that requires
+// more than RoleReadOnly is recorded in the audit log, along with the
+// identity of the caller.
+func (s *Server) RegisterCommand(cmd string, role Role, fn func(*thwack.Conn, string) error) {
+	s.unix.RegisterCommand(cmd, s.auditFn(unixCaller, role, fn))
+	for _, c := range s.clients {
+		if c.role >= role {
+			c.srv.RegisterCommand(cmd, s.auditFn(c.name, role, fn))
+		}
+	}
+}
+
+func (s *Server) auditFn(caller string, role Role, fn func(*thwack.Conn, string) error) func(*thwack.Conn, string) error {
+	if role == RoleReadOnly {
+		return fn
+	}
+	return func(c *thwack.Conn, l string) error {
+		// The arguments may include user names and keys, so they are
+		// subject to redaction.
+		sp := strings.SplitN(l, " ", 2)
+		cmd := sp[0]
+		if len(sp) == 2 {
+			cmd += " " + debug.UserToPrintString([]byte(sp[1]))
+		}
+		s.auditLog.Noticef("%v (%v): %v", caller, role, cmd)
+
+		// Capture the status of the reply, so that the outcome is recorded
+		// as well.
+		w := c.Writer()
+		rec := &statusRecorder{w: w.W}
+		w.W = bufio.NewWriter(rec)
+		err := fn(c, l)
+		w.W.Flush()
+		w.W = rec.w
+
+		switch {
+		case err != nil:
+			s.auditLog.Noticef("%v (%v): %v: Failed: %v", caller, role, cmd, err)
+		case rec.status == "":
+			s.auditLog.Noticef("%v (%v): %v: No reply", caller, role, cmd)
+		default:
+			s.auditLog.Noticef("%v (%v): %v: %v", caller, role, cmd, rec.status)
+		}
+		return err
+	}
+}
+
+// statusRecorder passes a reply through to the underlying writer, and records
+// the status code of the first reply line.
+type statusRecorder struct {
+	w      *bufio.Writer
+	status string
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	const statusLen = 3
+	if r.status == "" && len(p) >= statusLen {
+		r.status = string(p[:statusLen])
+	}
+	n, err := r.w.Write(p)
+	if err == nil {
+		err = r.w.Flush()
+	}
+	return n, err
+}
+
+// newAuditLog returns the audit logger.  The audit log is written to it's own
+// file at a fixed level, so that the Logging configuration can not suppress
+// it.
+func newAuditLog(cfg *config.Config) (*logging.Logger, error) {
+	lCfg := &config.Logging{Level: "NOTICE"}
+	if cfg.Logging != nil {
+		lCfg.Format = cfg.Logging.Format
+	}
+	b, err := logbackend.New(lCfg, filepath.Join(cfg.Server.DataDir, AuditLogFile))
+	if err != nil {
+		return nil, err
+	}
+	return b.GetLogger("audit"), nil
+}
+
+// Start starts listening for management connections.  It should be called
+// after every command has been registered.
+func (s *Server) Start() {
+	s.unix.Start()
+	for _, c := range s.clients {
+		c.srv.Start()
+	}
+	if s.l != nil {
+		s.Go(s.acceptWorker)
+	}
+}
+
+// Halt stops the management interface, and closes all connections.
+func (s *Server) Halt() {
+	if s.l != nil {
+		s.l.Close()
+	}
+	s.Lock()
+	s.isHalting = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.Unlock()
+	s.Worker.Halt()
+
+	s.unix.Halt()
+	for _, c := range s.clients {
+		c.srv.Halt()
+	}
+	if s.sockDir != "" {
+		os.RemoveAll(s.sockDir)
+	}
+}
+
+func (s *Server) initTCP(cfg *config.Config, logBackend *log.Backend, serviceName string) error {
+	mCfg := cfg.Management
+
+	k, err := LoadOrGenerateKey(filepath.Join(cfg.Server.DataDir, ServerKeyFile))
+	if err != nil {
+		return err
+	}
+	cert, err := NewCertificate(k)
+	if err != nil {
+		return err
+	}
+	s.tlsCfg = &tls.Config{
+		Certificates:          []tls.Certificate{cert},
+		ClientAuth:            tls.RequireAnyClientCert,
+		MinVersion:            tls.VersionTLS13,
+		VerifyPeerCertificate: s.verifyClient,
+	}
+
+	// Each client gets a private socket that only the proxy is expected to
+	// connect to.
+	s.sockDir = filepath.Join(cfg.Server.DataDir, clientSocketDir)
+	if err = os.RemoveAll(s.sockDir); err != nil {
+		return err
+	}
+	if err = os.Mkdir(s.sockDir, 0700); err != nil {
+		return err
+	}
+
+	s.clientMap = make(map[string]*client)
+	for _, v := range mCfg.Client {
+		var pubKey eddsa.PublicKey
+		if err = pubKey.FromString(v.PublicKey); err != nil {
+			return err
+		}
+		role, err := roleFromString(v.Role)
+		if err != nil {
+			return err
+		}
+		c := &client{
+			name:   v.Name,
+			role:   role,
+			pubKey: string(pubKey.Bytes()),
+			path:   filepath.Join(s.sockDir, v.Name),
+		}
+		thwackCfg := &thwack.Config{
+			Net:         "unix",
+			Addr:        c.path,
+			ServiceName: serviceName,
+			LogModule:   "mgmt/" + c.name,
+			NewLoggerFn: logBackend.GetLogger,
+		}
+		if c.srv, err = thwack.New(thwackCfg); err != nil {
+			return err
+		}
+		s.clients = append(s.clients, c)
+		s.clientMap[c.pubKey] = c
+	}
+
+	if s.l, err = net.Listen("tcp", mCfg.TCPAddress); err != nil {
+		return err
+	}
+	s.log.Noticef("TCP management interface public key: %v", PublicKeyString(k.Public().(ed25519.PublicKey)))
+
+	return nil
+}
+
+func (s *Server) verifyClient(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if s.clientForCerts(rawCerts) == nil {
+		return errUnknownClient
+	}
+	return nil
+}
+
+func (s *Server) clientForCerts(rawCerts [][]byte) *client {
+	pubKey, err := PeerPublicKey(rawCerts)
+	if err != nil {
+		return nil
+	}
+	return s.clientMap[string(pubKey)]
+}
+
+// New constructs a new management interface instance.
+func New(cfg *config.Config, logBackend *log.Backend) (*Server, error) {
+	s := &Server{
+		log:   logBackend.GetLogger("mgmt"),
+		conns: make(map[net.Conn]bool),
+	}
+
+	var err error
+	if s.auditLog, err = newAuditLog(cfg); err != nil {
+		return nil, err
+	}
+
+	serviceName := cfg.Server.Identifier + " Katzenpost Management Interface"
+	thwackCfg := &thwack.Config{
+		Net:         "unix",
+		Addr:        cfg.Management.Path,
+		ServiceName: serviceName,
+		LogModule:   "mgmt",
+		NewLoggerFn: logBackend.GetLogger,
+	}
+	if s.unix, err = thwack.New(thwackCfg); err != nil {
+		return nil, err
+	}
+
+	if cfg.Management.TCPAddress != "" {
+		if err = s.initTCP(cfg, logBackend, serviceName); err != nil {
+			s.Halt()
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
@@ -0,0 +1,159 @@
+// management_test.go - Management interface tests.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package management
+
+import (
+	"crypto/ed25519"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/log"
+	"github.com/katzenpost/core/thwack"
+	"github.com/katzenpost/server/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTCPRoles(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "management_test")
+	require.NoError(err, "TempDir()")
+	defer os.RemoveAll(dir)
+
+	logBackend, err := log.New("", "ERROR", false)
+	require.NoError(err, "log.New()")
+
+	roKey, err := GenerateKey(filepath.Join(dir, "ro.private.pem"))
+	require.NoError(err, "GenerateKey(ro)")
+	opKey, err := GenerateKey(filepath.Join(dir, "op.private.pem"))
+	require.NoError(err, "GenerateKey(op)")
+	_, badKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(err, "GenerateKey(bad)")
+
+	cfg := &config.Config{
+		Server: &config.Server{
+			Identifier: "test.example.com",
+			DataDir:    dir,
+		},
+		Management: &config.Management{
+			Enable:     true,
+			Path:       filepath.Join(dir, "management_sock"),
+			TCPAddress: "127.0.0.1:0",
+			Client: []*config.ManagementClient{
+				{
+					Name:      "monitoring",
+					PublicKey: PublicKeyString(roKey.Public().(ed25519.PublicKey)),
+					Role:      config.RoleReadOnly,
+				},
+				{
+					Name:      "ops",
+					PublicKey: PublicKeyString(opKey.Public().(ed25519.PublicKey)),
+					Role:      config.RoleOperator,
+				},
+			},
+		},
+	}
+	s, err := New(cfg, logBackend)
+	require.NoError(err, "New()")
+	defer s.Halt()
+
+	var nrPokes uint32
+	s.RegisterCommand("PING", RoleReadOnly, func(c *thwack.Conn, l string) error {
+		return c.WriteReply(thwack.StatusOk)
+	})
+	s.RegisterCommand("POKE", RoleOperator, func(c *thwack.Conn, l string) error {
+		atomic.AddUint32(&nrPokes, 1)
+		return c.WriteReply(thwack.StatusOk)
+	})
+	s.Start()
+
+	serverKey, err := LoadKey(filepath.Join(dir, ServerKeyFile))
+	require.NoError(err, "LoadKey(server)")
+	addr := s.l.Addr().String()
+	statusOk := fmt.Sprintf("%v", thwack.StatusOk)
+
+	dial := func(k ed25519.PrivateKey) (*textproto.Conn, error) {
+		tlsCfg, err := NewClientTLSConfig(k, serverKey.Public().(ed25519.PublicKey))
+		require.NoError(err, "NewClientTLSConfig()")
+		conn, err := tls.Dial("tcp", addr, tlsCfg)
+		if err != nil {
+			return nil, err
+		}
+		c := textproto.NewConn(conn)
+
+		// Consume the banner.
+		if _, err = c.ReadLine(); err != nil {
+			c.Close()
+			return nil, err
+		}
+		return c, nil
+	}
+	isOk := func(c *textproto.Conn, cmd string) bool {
+		require.NoError(c.PrintfLine("%v", cmd), "PrintfLine(%v)", cmd)
+		l, err := c.ReadLine()
+		require.NoError(err, "ReadLine(%v)", cmd)
+		return strings.HasPrefix(l, statusOk)
+	}
+
+	// The read-only client may not run operator commands.
+	c, err := dial(roKey)
+	require.NoError(err, "dial(ro)")
+	require.True(isOk(c, "PING"), "ro: PING")
+	require.False(isOk(c, "POKE"), "ro: POKE")
+	c.Close()
+	require.Equal(uint32(0), atomic.LoadUint32(&nrPokes), "ro: POKE ran")
+
+	// The operator may.
+	c, err = dial(opKey)
+	require.NoError(err, "dial(op)")
+	require.True(isOk(c, "PING"), "op: PING")
+	require.True(isOk(c, "POKE"), "op: POKE")
+	c.Close()
+	require.Equal(uint32(1), atomic.LoadUint32(&nrPokes), "op: POKE ran")
+
+	// Commands that alter the state are audited, along with the outcome,
+	// even though the log level would suppress them.
+	auditEntry := fmt.Sprintf("ops (%v): POKE: %v", RoleOperator, statusOk)
+	require.Eventually(func() bool {
+		b, err := ioutil.ReadFile(filepath.Join(dir, AuditLogFile))
+		return err == nil && strings.Contains(string(b), auditEntry)
+	}, 5*time.Second, 10*time.Millisecond, "audit log: POKE")
+
+	// Unknown clients are rejected.
+	c, err = dial(badKey)
+	if err == nil {
+		c.Close()
+	}
+	require.Error(err, "dial(bad)")
+
+	// A server with a different key is rejected by the client.
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(err, "GenerateKey(other)")
+	tlsCfg, err := NewClientTLSConfig(opKey, otherKey.Public().(ed25519.PublicKey))
+	require.NoError(err, "NewClientTLSConfig(other)")
+	_, err = tls.Dial("tcp", addr, tlsCfg)
+	require.Error(err, "tls.Dial(other)")
+}
@@ -0,0 +1,124 @@
+// tcp.go - Authenticated TCP management connections.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package management
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+const handshakeTimeout = 30 * time.Second
+
+var errUnknownClient = errors.New("management: unknown client key")
+
+func (s *Server) acceptWorker() {
+	addr := s.l.Addr()
+	s.log.Noticef("Listening on: %v", addr)
+	defer s.log.Noticef("Stopping listening on: %v", addr)
+
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			select {
+			case <-s.HaltCh():
+				return
+			default:
+			}
+			if e, ok := err.(net.Error); ok && e.Temporary() {
+				continue
+			}
+			s.log.Errorf("Critical accept failure: %v", err)
+			return
+		}
+		s.Go(func() {
+			s.onConn(conn)
+		})
+	}
+}
+
+func (s *Server) trackConn(conn net.Conn, isAdd bool) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if !isAdd {
+		delete(s.conns, conn)
+		return true
+	}
+	if s.isHalting {
+		return false
+	}
+	s.conns[conn] = true
+	return true
+}
+
+func (s *Server) onConn(conn net.Conn) {
+	defer conn.Close()
+	if !s.trackConn(conn, true) {
+		return
+	}
+	defer s.trackConn(conn, false)
+
+	// Authenticate the client.  The certificate is checked by
+	// verifyClient as part of the handshake.
+	tlsConn := tls.Server(conn, s.tlsCfg)
+	tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		s.log.Warningf("Rejecting connection from %v: %v", conn.RemoteAddr(), err)
+		return
+	}
+	tlsConn.SetDeadline(time.Time{})
+	var rawCerts [][]byte
+	for _, v := range tlsConn.ConnectionState().PeerCertificates {
+		rawCerts = append(rawCerts, v.Raw)
+	}
+	c := s.clientForCerts(rawCerts)
+	if c == nil {
+		// Should never happen, since the handshake would have failed.
+		s.log.Errorf("Rejecting connection from %v: %v", conn.RemoteAddr(), errUnknownClient)
+		return
+	}
+	s.log.Noticef("Client '%v' (%v) connected from: %v", c.name, c.role, conn.RemoteAddr())
+	defer s.log.Noticef("Client '%v' disconnected.", c.name)
+
+	// Proxy the connection to the client's thwack instance, which only
+	// has the commands permitted by the client's role.
+	backend, err := net.Dial("unix", c.path)
+	if err != nil {
+		s.log.Errorf("Failed to connect to the backend for client '%v': %v", c.name, err)
+		return
+	}
+	defer backend.Close()
+
+	errCh := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(backend, tlsConn)
+		errCh <- err
+	}()
+	go func() {
+		_, err := io.Copy(tlsConn, backend)
+		errCh <- err
+	}()
+
+	// Once either side is done, tear down both connections.
+	<-errCh
+	backend.Close()
+	conn.Close()
+	<-errCh
+}
@@ -0,0 +1,297 @@
+// filter.go - Sharded replay bloom filter.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package mixkey
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dchest/siphash"
+	"github.com/katzenpost/core/crypto/rand"
+)
+
+const (
+	// The filter is split into filterShards independently locked shards,
+	// selected by the first byte of the tag.
+	filterShardsLn2 = 4
+	filterShards    = 1 << filterShardsLn2
+
+	minFilterSize = filterShardsLn2 + 16
+	maxFilterSize = filterShardsLn2 + 32
+
+	snapshotMagic   = "KPRFSNAP"
+	snapshotVersion = 0
+
+	defaultFilterSize              = 29 // 64 MiB, 37,240,820 entries.
+	defaultFilterFalsePositiveRate = 0.001
+	defaultFilterSnapshotInterval  = 5 * time.Minute
+)
+
+var errInvalidSnapshot = errors.New("mixkey: invalid replay filter snapshot")
+
+// FilterConfig is the replay filter configuration.
+type FilterConfig struct {
+	// Size is the base 2 logarithm of the size of the filter in bits.
+	Size int
+
+	// FalsePositiveRate is the false positive rate of the filter at
+	// capacity.
+	FalsePositiveRate float64
+
+	// SnapshotInterval is the interval at which the filter is persisted to
+	// disk.  Snapshots are also taken when the key is closed.
+	SnapshotInterval time.Duration
+}
+
+func (cfg *FilterConfig) applyDefaults() *FilterConfig {
+	c := &FilterConfig{
+		Size:              defaultFilterSize,
+		FalsePositiveRate: defaultFilterFalsePositiveRate,
+		SnapshotInterval:  defaultFilterSnapshotInterval,
+	}
+	if cfg == nil {
+		return c
+	}
+	if cfg.Size > 0 {
+		c.Size = cfg.Size
+	}
+	if cfg.FalsePositiveRate > 0 {
+		c.FalsePositiveRate = cfg.FalsePositiveRate
+	}
+	if cfg.SnapshotInterval > 0 {
+		c.SnapshotInterval = cfg.SnapshotInterval
+	}
+	return c
+}
+
+type filterShard struct {
+	sync.Mutex
+
+	b         []byte
+	nEntries  uint64
+	writeBack map[[TagLength]byte]bool
+}
+
+type replayFilter struct {
+	k0, k1 uint64
+
+	size       uint8
+	nHashes    uint8
+	shardMask  uint64
+	maxEntries uint64
+
+	shards [filterShards]filterShard
+}
+
+func (f *replayFilter) hashes(tag *[TagLength]byte) (*filterShard, uint64, uint64) {
+	h1, h2 := siphash.Hash128(f.k0, f.k1, tag[:])
+	return &f.shards[shardIndex(tag)], h1, h2 | 1
+}
+
+func shardIndex(tag *[TagLength]byte) int {
+	return int(tag[0] & (filterShards - 1))
+}
+
+// testAndSet adds the tag to the shard, and returns true iff the tag was
+// possibly present.  The caller must hold the shard lock.
+func (f *replayFilter) testAndSet(s *filterShard, h1, h2 uint64) bool {
+	isSet := true
+	for i := uint64(0); i < uint64(f.nHashes); i++ {
+		idx := (h1 + i*h2) & f.shardMask
+		b, bit := idx>>3, byte(1<<(idx&7))
+		if s.b[b]&bit == 0 {
+			isSet = false
+			s.b[b] |= bit
+		}
+	}
+	if !isSet {
+		s.nEntries++
+	}
+	return isSet
+}
+
+// isSaturated returns true iff the shard is at capacity.  The caller must hold
+// the shard lock.
+func (f *replayFilter) isSaturated(s *filterShard) bool {
+	return s.nEntries >= f.maxEntries
+}
+
+// add unconditionally adds the tag to the filter.  This is only used when
+// rebuilding the filter, and is not safe for concurrent use.
+func (f *replayFilter) add(rawTag []byte) {
+	if len(rawTag) != TagLength {
+		return
+	}
+	var tag [TagLength]byte
+	copy(tag[:], rawTag)
+	s, h1, h2 := f.hashes(&tag)
+	f.testAndSet(s, h1, h2)
+}
+
+func (f *replayFilter) writeSnapshot(fn string, journalSeq uint64) error {
+	tmp := fn + ".tmp"
+	fd, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if fd != nil {
+			fd.Close()
+			os.Remove(tmp)
+		}
+	}()
+
+	h := sha512.New512_256()
+	w := bufio.NewWriter(io.MultiWriter(fd, h))
+
+	var hdr [8 + 1 + 1 + 1 + 8 + 8 + 8]byte
+	copy(hdr[0:], snapshotMagic)
+	hdr[8] = snapshotVersion
+	hdr[9] = f.size
+	hdr[10] = f.nHashes
+	binary.LittleEndian.PutUint64(hdr[11:], f.k0)
+	binary.LittleEndian.PutUint64(hdr[19:], f.k1)
+	binary.LittleEndian.PutUint64(hdr[27:], journalSeq)
+	w.Write(hdr[:])
+
+	// Copy each shard under it's lock, but do the actual I/O without
+	// holding it, so that the crypto workers are not stalled.
+	buf := make([]byte, len(f.shards[0].b))
+	for i := range f.shards {
+		s := &f.shards[i]
+		s.Lock()
+		nEntries := s.nEntries
+		copy(buf, s.b)
+		s.Unlock()
+
+		var nBuf [8]byte
+		binary.LittleEndian.PutUint64(nBuf[:], nEntries)
+		w.Write(nBuf[:])
+		w.Write(buf)
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	if _, err = fd.Write(h.Sum(nil)); err != nil {
+		return err
+	}
+	if err = fd.Sync(); err != nil {
+		return err
+	}
+	if err = fd.Close(); err != nil {
+		return err
+	}
+	fd = nil
+
+	return os.Rename(tmp, fn)
+}
+
+// readSnapshot loads the filter contents from a snapshot, and returns the
+// journal sequence number at the time the snapshot was taken.
+func (f *replayFilter) readSnapshot(fn string) (uint64, error) {
+	fd, err := os.Open(fn)
+	if err != nil {
+		return 0, err
+	}
+	defer fd.Close()
+
+	h := sha512.New512_256()
+	br := bufio.NewReader(fd)
+	r := io.TeeReader(br, h)
+
+	var hdr [8 + 1 + 1 + 1 + 8 + 8 + 8]byte
+	if _, err = io.ReadFull(r, hdr[:]); err != nil {
+		return 0, err
+	}
+	if string(hdr[0:8]) != snapshotMagic || hdr[8] != snapshotVersion {
+		return 0, errInvalidSnapshot
+	}
+	if hdr[9] != f.size || hdr[10] != f.nHashes {
+		return 0, fmt.Errorf("mixkey: replay filter snapshot parameter mismatch")
+	}
+	k0 := binary.LittleEndian.Uint64(hdr[11:])
+	k1 := binary.LittleEndian.Uint64(hdr[19:])
+	journalSeq := binary.LittleEndian.Uint64(hdr[27:])
+
+	shards := make([][]byte, filterShards)
+	nEntries := make([]uint64, filterShards)
+	for i := range shards {
+		var nBuf [8]byte
+		if _, err = io.ReadFull(r, nBuf[:]); err != nil {
+			return 0, err
+		}
+		nEntries[i] = binary.LittleEndian.Uint64(nBuf[:])
+		shards[i] = make([]byte, len(f.shards[i].b))
+		if _, err = io.ReadFull(r, shards[i]); err != nil {
+			return 0, err
+		}
+	}
+	expectedDigest := h.Sum(nil)
+	digest := make([]byte, len(expectedDigest))
+	if _, err = io.ReadFull(br, digest); err != nil {
+		return 0, err
+	}
+	if !bytes.Equal(digest, expectedDigest) {
+		return 0, errInvalidSnapshot
+	}
+
+	f.k0, f.k1 = k0, k1
+	for i := range f.shards {
+		f.shards[i].b = shards[i]
+		f.shards[i].nEntries = nEntries[i]
+	}
+	return journalSeq, nil
+}
+
+func newReplayFilter(cfg *FilterConfig) (*replayFilter, error) {
+	if cfg.Size < minFilterSize || cfg.Size > maxFilterSize {
+		return nil, fmt.Errorf("mixkey: invalid replay filter size: %v", cfg.Size)
+	}
+	if cfg.FalsePositiveRate <= 0 || cfg.FalsePositiveRate >= 1 {
+		return nil, fmt.Errorf("mixkey: invalid replay filter false positive rate: %v", cfg.FalsePositiveRate)
+	}
+
+	shardBits := uint64(1) << uint(cfg.Size-filterShardsLn2)
+	f := &replayFilter{
+		size:      uint8(cfg.Size),
+		nHashes:   uint8(math.Ceil(-math.Log2(cfg.FalsePositiveRate))),
+		shardMask: shardBits - 1,
+	}
+	f.maxEntries = uint64(float64(shardBits) * math.Ln2 * math.Ln2 / -math.Log(cfg.FalsePositiveRate))
+	for i := range f.shards {
+		f.shards[i].b = make([]byte, shardBits/8)
+		f.shards[i].writeBack = make(map[[TagLength]byte]bool)
+	}
+
+	var kBuf [16]byte
+	if _, err := io.ReadFull(rand.Reader, kBuf[:]); err != nil {
+		return nil, err
+	}
+	f.k0 = binary.LittleEndian.Uint64(kBuf[0:])
+	f.k1 = binary.LittleEndian.Uint64(kBuf[8:])
+
+	return f, nil
+}
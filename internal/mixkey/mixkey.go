@@ -24,21 +24,27 @@ import (
 	"math"
 	"os"
 	"path/filepath"
-	"sync"
 	"sync/atomic"
 	"time"
 
-	"git.schwanenlied.me/yawning/bloom.git"
 	bolt "github.com/coreos/bbolt"
 	"github.com/katzenpost/core/crypto/ecdh"
 	"github.com/katzenpost/core/crypto/rand"
-	"github.com/katzenpost/core/epochtime"
+	"github.com/katzenpost/core/utils"
 	"github.com/katzenpost/core/worker"
+	"github.com/katzenpost/server/internal/clock"
+	"github.com/katzenpost/server/internal/keystore"
 )
 
 const (
 	replayBucket   = "replay"
 	metadataBucket = "metadata"
+	journalBucket  = "journal"
+
+	versionKey  = "version"
+	pkKey       = "privateKey"
+	sealedPKKey = "sealedPrivateKey"
+	epochKey    = "epochKey"
 
 	writeBackInterval = 10 * time.Second
 	writeBackSize     = 4096 // TODO/perf: Tune this.
@@ -53,6 +59,10 @@ const (
 	// KeyFmt is the format string corresponding to filenames for keys that
 	// have been persisted to disk.
 	KeyFmt = "mixkey-%d.db"
+
+	// SnapshotFmt is the format string corresponding to filenames for the
+	// replay filter snapshots of keys that have been persisted to disk.
+	SnapshotFmt = "mixkey-%d.filter"
 )
 
 var dbOptions = &bolt.Options{
@@ -61,17 +71,19 @@ var dbOptions = &bolt.Options{
 
 // MixKey is a Katzenpost server mix key.
 type MixKey struct {
-	sync.Mutex
 	worker.Worker
 
 	db      *bolt.DB
 	keypair *ecdh.PrivateKey
 	epoch   uint64
 
-	f         *bloom.Filter
-	writeBack map[[TagLength]byte]bool
-	flushCh   chan interface{}
+	f                *replayFilter
+	snapshotPath     string
+	snapshotInterval time.Duration
+	nWriteBack       int32
+	flushCh          chan interface{}
 
+	clock           clock.Clock
 	refCount        int32
 	unlinkIfExpired bool
 }
@@ -110,14 +122,9 @@ func (k *MixKey) IsReplay(rawTag []byte) bool {
 	// Check the bloom filter for the tag, to see if it might be a replay.
 	maybeReplay, inWriteBack := k.testAndSetTagMemory(&tag)
 	if !maybeReplay {
-		// k.isNotReplay() will add the tag to the write-back cache, so
-		// just poke the flush routine and return.
-		select {
-		case k.flushCh <- true:
-		default:
-			// Non-blocking channel write, because the channel is buffered
-			// and has a timer fallback.
-		}
+		// k.testAndSetTagMemory() will add the tag to the write-back
+		// cache, so just poke the flush routine and return.
+		k.pokeFlush()
 		return false
 	}
 
@@ -134,9 +141,15 @@ func (k *MixKey) IsReplay(rawTag []byte) bool {
 		// Since we're stuck hitting the database anyway, might as well
 		// bypass the cache and save ourselves some pain by doing the
 		// insertion here.
+		//
+		// Note: Entries that are being flushed are removed from the
+		// write-back cache before the flush transaction is committed, but
+		// since bolt serializes write transactions, this will observe
+		// the flushed entries.
 		if err := k.db.Update(func(tx *bolt.Tx) error {
 			bkt := tx.Bucket([]byte(replayBucket))
-			isReplay = testAndSetTagDB(bkt, tag[:])
+			jBkt := tx.Bucket([]byte(journalBucket))
+			isReplay = testAndSetTagDB(bkt, jBkt, tag[:])
 			return nil
 		}); err != nil {
 			panic("BUG: mixkey: Failed to query the replay filter: " + err.Error())
@@ -145,7 +158,77 @@ func (k *MixKey) IsReplay(rawTag []byte) bool {
 	return isReplay
 }
 
-func testAndSetTagDB(bkt *bolt.Bucket, tag []byte) bool {
+// IsReplayBatch is the batched form of IsReplay, and returns a slice where
+// each entry is true iff the corresponding tag has been seen previously.
+// Each filter shard is locked at most once, and at most one database
+// transaction is done for the entire batch.
+func (k *MixKey) IsReplayBatch(rawTags [][]byte) []bool {
+	isReplay := make([]bool, len(rawTags))
+
+	type batchEntry struct {
+		idx    int
+		h1, h2 uint64
+		tag    [TagLength]byte
+	}
+	var shards [filterShards][]*batchEntry
+	for i, rawTag := range rawTags {
+		// Treat all pathologically malformed tags as replays.
+		if len(rawTag) != TagLength {
+			isReplay[i] = true
+			continue
+		}
+		e := &batchEntry{idx: i}
+		copy(e.tag[:], rawTag)
+		_, e.h1, e.h2 = k.f.hashes(&e.tag)
+		sIdx := shardIndex(&e.tag)
+		shards[sIdx] = append(shards[sIdx], e)
+	}
+
+	// Check the bloom filter for the tags, one shard at a time.
+	var slowPath []*batchEntry
+	didAdd := false
+	for i, entries := range shards {
+		if len(entries) == 0 {
+			continue
+		}
+		s := &k.f.shards[i]
+		s.Lock()
+		for _, e := range entries {
+			maybeReplay, inWriteBack := k.testAndSetTagShard(s, e.h1, e.h2, &e.tag)
+			switch {
+			case !maybeReplay:
+				didAdd = true
+			case inWriteBack:
+				isReplay[e.idx] = true
+			default:
+				slowPath = append(slowPath, e)
+			}
+		}
+		s.Unlock()
+	}
+	if didAdd {
+		k.pokeFlush()
+	}
+
+	// Slow path, either false positives or replays that are not in the
+	// write-back cache, see k.IsReplay().
+	if len(slowPath) > 0 {
+		if err := k.db.Update(func(tx *bolt.Tx) error {
+			bkt := tx.Bucket([]byte(replayBucket))
+			jBkt := tx.Bucket([]byte(journalBucket))
+			for _, e := range slowPath {
+				isReplay[e.idx] = testAndSetTagDB(bkt, jBkt, e.tag[:])
+			}
+			return nil
+		}); err != nil {
+			panic("BUG: mixkey: Failed to query the replay filter: " + err.Error())
+		}
+	}
+
+	return isReplay
+}
+
+func testAndSetTagDB(bkt, jBkt *bolt.Bucket, tag []byte) bool {
 	// Retreive the counter from the database for the tag if it exists.
 	//
 	// XXX: The counter isn't actually used for anything since it isn't
@@ -169,38 +252,69 @@ func testAndSetTagDB(bkt *bolt.Bucket, tag []byte) bool {
 	var seenBytes [8]byte
 	binary.LittleEndian.PutUint64(seenBytes[:], seenCount)
 	bkt.Put(tag, seenBytes[:])
+
+	// Journal newly seen tags, so that they can be added to the last
+	// replay filter snapshot on load.
+	if seenCount == 1 {
+		seq, _ := jBkt.NextSequence()
+		var seqBytes [8]byte
+		binary.BigEndian.PutUint64(seqBytes[:], seq)
+		jBkt.Put(seqBytes[:], tag)
+	}
+
 	return seenCount != 1
 }
 
 func (k *MixKey) testAndSetTagMemory(tag *[TagLength]byte) (bool, bool) {
-	k.Lock()
-	defer k.Unlock()
+	s, h1, h2 := k.f.hashes(tag)
+
+	s.Lock()
+	defer s.Unlock()
 
-	// TODO/perf: Perhaps the lock should only cover the bloom filter,
-	// and a sync.Map used for the pending write-back entries.
+	return k.testAndSetTagShard(s, h1, h2, tag)
+}
 
+// testAndSetTagShard does the in-memory test and set of a tag.  The caller
+// must hold the shard lock.
+func (k *MixKey) testAndSetTagShard(s *filterShard, h1, h2 uint64, tag *[TagLength]byte) (bool, bool) {
 	// If the filter is saturated then force a database lookup.
-	if k.f.Entries() >= k.f.MaxEntries() {
-		return true, k.writeBack[*tag]
+	if k.f.isSaturated(s) {
+		return true, s.writeBack[*tag]
 	}
-	if !k.f.TestAndSet(tag[:]) {
+	if !k.f.testAndSet(s, h1, h2) {
 		// The tag is not in the bloom filter, so by definition it is not a replay.
 
 		// Insert it into the write-back cache.
-		k.writeBack[*tag] = true
+		s.writeBack[*tag] = true
+		atomic.AddInt32(&k.nWriteBack, 1)
 		return false, true
 	}
 
 	// Do the write-back cache lookup while we hold the lock.
-	return true, k.writeBack[*tag]
+	return true, s.writeBack[*tag]
+}
+
+func (k *MixKey) pokeFlush() {
+	select {
+	case k.flushCh <- true:
+	default:
+		// Non-blocking channel write, because the channel is buffered
+		// and has a timer fallback.
+	}
 }
 
 func (k *MixKey) worker() {
-	defer k.doFlush(true)
+	defer func() {
+		k.doFlush(true)
+		k.doSnapshot()
+	}()
 
 	ticker := time.NewTicker(writeBackInterval)
 	defer ticker.Stop()
 
+	snapshotTicker := time.NewTicker(k.snapshotInterval)
+	defer snapshotTicker.Stop()
+
 	for {
 		forceFlush := false
 		select {
@@ -209,31 +323,77 @@ func (k *MixKey) worker() {
 		case <-k.flushCh:
 		case <-ticker.C:
 			forceFlush = true
+		case <-snapshotTicker.C:
+			k.doSnapshot()
+			continue
 		}
 		k.doFlush(forceFlush)
 	}
 }
 
-func (k *MixKey) doFlush(forceFlush bool) {
-	k.Lock()
-	defer k.Unlock()
+// doFlush writes the write-back cache to the database, and returns the
+// journal sequence number after the flush.
+func (k *MixKey) doFlush(forceFlush bool) uint64 {
+	var seq uint64
 
 	// Accumulate up to writeBackSize entries.
-	nEntries := len(k.writeBack)
+	nEntries := atomic.LoadInt32(&k.nWriteBack)
 	if nEntries == 0 || (!forceFlush && nEntries < writeBackSize) {
-		return
+		if err := k.db.View(func(tx *bolt.Tx) error {
+			seq = tx.Bucket([]byte(journalBucket)).Sequence()
+			return nil
+		}); err != nil {
+			panic("BUG: mixkey: Failed to query the journal: " + err.Error())
+		}
+		return seq
 	}
 
 	if err := k.db.Update(func(tx *bolt.Tx) error {
 		bkt := tx.Bucket([]byte(replayBucket))
-		for tag := range k.writeBack {
-			testAndSetTagDB(bkt, tag[:])
+		jBkt := tx.Bucket([]byte(journalBucket))
+
+		// Only one shard is locked at a time, so that the crypto workers
+		// can make progress on the other shards while the flush happens.
+		for i := range k.f.shards {
+			s := &k.f.shards[i]
+			s.Lock()
+			for tag := range s.writeBack {
+				testAndSetTagDB(bkt, jBkt, tag[:])
+			}
+			atomic.AddInt32(&k.nWriteBack, -int32(len(s.writeBack)))
+			s.writeBack = make(map[[TagLength]byte]bool)
+			s.Unlock()
 		}
+		seq = jBkt.Sequence()
 		return nil
 	}); err != nil {
 		panic("BUG: mixkey: Failed to flush write-back cache: " + err.Error())
 	}
-	k.writeBack = make(map[[TagLength]byte]bool)
+	return seq
+}
+
+func (k *MixKey) doSnapshot() {
+	// Every tag journaled as of seq is in the filter, since the filter is
+	// updated before the write-back cache, and bits are never cleared.
+	seq := k.doFlush(true)
+	if err := k.f.writeSnapshot(k.snapshotPath, seq); err != nil {
+		// Not fatal, the journal is retained, and loading will fall back
+		// to a full rebuild if the snapshot is missing or corrupted.
+		return
+	}
+
+	// Discard the journal entries that are covered by the snapshot.
+	if err := k.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(journalBucket)).Cursor()
+		for key, _ := c.First(); key != nil && binary.BigEndian.Uint64(key) <= seq; key, _ = c.First() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		panic("BUG: mixkey: Failed to prune the journal: " + err.Error())
+	}
 }
 
 // Deref reduces the refcount by one, and closes the key if the refcount hits
@@ -269,7 +429,7 @@ func (k *MixKey) forceClose() {
 
 		// Delete the database if the key is expired, and the owner requested
 		// full cleanup.
-		epoch, _, _ := epochtime.Now()
+		epoch, _, _ := k.clock.Epoch()
 		if k.unlinkIfExpired && k.epoch < epoch-1 {
 			// People will probably complain that this doesn't attempt
 			// "secure" deletion, but that's fundementally a lost cause
@@ -277,6 +437,7 @@ func (k *MixKey) forceClose() {
 			// the raw physical media, and the cleanup process being slightly
 			// race prone around epoch transitions.  Use FDE.
 			os.Remove(f)
+			os.Remove(k.snapshotPath)
 		}
 	}
 	if k.keypair != nil {
@@ -286,21 +447,25 @@ func (k *MixKey) forceClose() {
 }
 
 // New creates (or loads) a mix key in the provided data directory, for the
-// given epoch.
-func New(dataDir string, epoch uint64) (*MixKey, error) {
-	const (
-		versionKey = "version"
-		pkKey      = "privateKey"
-		epochKey   = "epochKey"
-	)
+// given epoch.  If ks is non-nil, the private key will be encrypted at rest.
+// If fCfg is nil, the default replay filter configuration will be used.  The
+// clock c is used to determine if the key has expired when it is closed.
+func New(dataDir string, epoch uint64, ks *keystore.Keystore, fCfg *FilterConfig, c clock.Clock) (*MixKey, error) {
 	var err error
 
+	fCfg = fCfg.applyDefaults()
+
 	// Initialize the structure and create or open the database.
 	k := &MixKey{
-		epoch:     epoch,
-		refCount:  1,
-		writeBack: make(map[[TagLength]byte]bool),
-		flushCh:   make(chan interface{}, 1),
+		epoch:            epoch,
+		clock:            c,
+		refCount:         1,
+		snapshotPath:     filepath.Join(dataDir, fmt.Sprintf(SnapshotFmt, epoch)),
+		snapshotInterval: fCfg.SnapshotInterval,
+		flushCh:          make(chan interface{}, 1),
+	}
+	if k.f, err = newReplayFilter(fCfg); err != nil {
+		return nil, err
 	}
 
 	f := filepath.Join(dataDir, fmt.Sprintf(KeyFmt, epoch))
@@ -308,12 +473,8 @@ func New(dataDir string, epoch uint64) (*MixKey, error) {
 	if err != nil {
 		return nil, err
 	}
-	k.f, err = bloom.New(rand.Reader, 29, 0.001) // 64 MiB, 37,240,820 entries.
-	if err != nil {
-		return nil, err
-	}
 
-	didCreate := false
+	didCreate, didEncrypt := false, false
 	if err := k.db.Update(func(tx *bolt.Tx) error {
 		// Ensure that all the buckets exist.
 		bkt, err := tx.CreateBucketIfNotExists([]byte(metadataBucket))
@@ -324,6 +485,10 @@ func New(dataDir string, epoch uint64) (*MixKey, error) {
 		if err != nil {
 			return err
 		}
+		journalBkt, err := tx.CreateBucketIfNotExists([]byte(journalBucket))
+		if err != nil {
+			return err
+		}
 
 		if b := bkt.Get([]byte(versionKey)); b != nil {
 			// Well, looks like we loaded as opposed to created.
@@ -332,13 +497,23 @@ func New(dataDir string, epoch uint64) (*MixKey, error) {
 			}
 
 			// Deserialize the key.
-			if b = bkt.Get([]byte(pkKey)); b == nil {
-				return fmt.Errorf("mixkey: db missing privateKey entry")
+			if b, err = getPrivateKey(bkt, ks); err != nil {
+				return err
 			}
 			k.keypair = new(ecdh.PrivateKey)
-			if err = k.keypair.FromBytes(b); err != nil {
+			err = k.keypair.FromBytes(b)
+			utils.ExplicitBzero(b)
+			if err != nil {
 				return err
 			}
+			if ks != nil && bkt.Get([]byte(pkKey)) != nil {
+				// Encryption was enabled after the key was created,
+				// so encrypt the key.
+				if err = putPrivateKey(bkt, k.keypair, ks); err != nil {
+					return err
+				}
+				didEncrypt = true
+			}
 
 			getUint64 := func(key string) (uint64, error) {
 				var buf []byte
@@ -360,9 +535,22 @@ func New(dataDir string, epoch uint64) (*MixKey, error) {
 				return fmt.Errorf("mixkey: db epoch mismatch")
 			}
 
-			// Rebuild the bloom filter.
+			// Load the bloom filter from the snapshot, and add the tags
+			// that were seen after the snapshot was taken.
+			if seq, err := k.f.readSnapshot(k.snapshotPath); err == nil {
+				c := journalBkt.Cursor()
+				var seqBytes [8]byte
+				binary.BigEndian.PutUint64(seqBytes[:], seq+1)
+				for key, tag := c.Seek(seqBytes[:]); key != nil; key, tag = c.Next() {
+					k.f.add(tag)
+				}
+				return nil
+			}
+
+			// Rebuild the bloom filter from scratch, a failed snapshot load
+			// leaves the filter untouched.
 			replayBkt.ForEach(func(tag, rawCount []byte) error {
-				k.f.TestAndSet(tag)
+				k.f.add(tag)
 				return nil
 			})
 
@@ -380,20 +568,160 @@ func New(dataDir string, epoch uint64) (*MixKey, error) {
 
 		// Stash the version/key/epoch in the metadata bucket.
 		bkt.Put([]byte(versionKey), []byte{0})
-		bkt.Put([]byte(pkKey), k.keypair.Bytes())
 		bkt.Put([]byte(epochKey), epochBytes[:])
 
-		return nil
+		return putPrivateKey(bkt, k.keypair, ks)
 	}); err != nil {
 		k.db.Close()
 		return nil, err
 	}
 	if didCreate {
-		// Flush the newly created database to disk.
+		// Flush the newly created database to disk, and ensure that a stale
+		// snapshot from a previous key can never be loaded.
 		k.db.Sync()
+		os.Remove(k.snapshotPath)
+	}
+	if didEncrypt {
+		// The plaintext private key is still present in the database's
+		// free pages, so rewrite the database without it.
+		k.db.Close()
+		if err = compactFile(f); err != nil {
+			return nil, err
+		}
+		if k.db, err = bolt.Open(f, 0600, dbOptions); err != nil {
+			return nil, err
+		}
 	}
 
 	k.Go(k.worker)
 
 	return k, nil
 }
+
+// getPrivateKey returns a copy of the serialized private key, that the
+// caller is responsible for clearing.
+func getPrivateKey(bkt *bolt.Bucket, ks *keystore.Keystore) ([]byte, error) {
+	if b := bkt.Get([]byte(sealedPKKey)); b != nil {
+		if ks == nil {
+			return nil, fmt.Errorf("mixkey: db privateKey is encrypted, and no keystore is configured")
+		}
+		return ks.Open(b)
+	}
+	if b := bkt.Get([]byte(pkKey)); b != nil {
+		// The slice is backed by the read-only mmap-ed database.
+		return append([]byte{}, b...), nil
+	}
+	return nil, fmt.Errorf("mixkey: db missing privateKey entry")
+}
+
+func putPrivateKey(bkt *bolt.Bucket, keypair *ecdh.PrivateKey, ks *keystore.Keystore) error {
+	if ks == nil {
+		return bkt.Put([]byte(pkKey), keypair.Bytes())
+	}
+
+	sealed, err := ks.Seal(keypair.Bytes())
+	if err != nil {
+		return err
+	}
+	if err = bkt.Put([]byte(sealedPKKey), sealed); err != nil {
+		return err
+	}
+	return bkt.Delete([]byte(pkKey))
+}
+
+// ResealFile re-encrypts the private key of the persisted mix key f under
+// newKS.  If oldKS is nil, the private key is expected to be stored in
+// plaintext, and the database is compacted afterwards so that the plaintext
+// does not persist in free pages.  Note that this can not guarantee that
+// the plaintext is removed from the underlying storage medium.
+func ResealFile(f string, oldKS, newKS *keystore.Keystore) error {
+	db, err := bolt.Open(f, 0600, dbOptions)
+	if err != nil {
+		return err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(metadataBucket))
+		if bkt == nil {
+			return fmt.Errorf("mixkey: db missing metadata bucket")
+		}
+		if oldKS == nil && bkt.Get([]byte(sealedPKKey)) != nil {
+			return fmt.Errorf("mixkey: db privateKey is already encrypted")
+		}
+		b, err := getPrivateKey(bkt, oldKS)
+		if err != nil {
+			return err
+		}
+		keypair := new(ecdh.PrivateKey)
+		err = keypair.FromBytes(b)
+		utils.ExplicitBzero(b)
+		if err != nil {
+			return err
+		}
+		defer keypair.Reset()
+
+		return putPrivateKey(bkt, keypair, newKS)
+	})
+	db.Close()
+	if err != nil || oldKS != nil {
+		return err
+	}
+	return compactFile(f)
+}
+
+// compactFile rewrites the database f, so that deleted entries do not
+// persist in the free pages.
+func compactFile(f string) error {
+	tmpFile := f + ".compact"
+	os.Remove(tmpFile)
+
+	src, err := bolt.Open(f, 0600, dbOptions)
+	if err != nil {
+		return err
+	}
+	dst, err := bolt.Open(tmpFile, 0600, dbOptions)
+	if err != nil {
+		src.Close()
+		return err
+	}
+
+	err = src.View(func(srcTx *bolt.Tx) error {
+		return dst.Update(func(dstTx *bolt.Tx) error {
+			return srcTx.ForEach(func(name []byte, srcBkt *bolt.Bucket) error {
+				dstBkt, err := dstTx.CreateBucket(name)
+				if err != nil {
+					return err
+				}
+				return copyBucket(dstBkt, srcBkt)
+			})
+		})
+	})
+	if err == nil {
+		err = dst.Sync()
+	}
+	dst.Close()
+	src.Close()
+	if err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	return os.Rename(tmpFile, f)
+}
+
+func copyBucket(dst, src *bolt.Bucket) error {
+	if err := dst.SetSequence(src.Sequence()); err != nil {
+		return err
+	}
+	return src.ForEach(func(key, value []byte) error {
+		if value != nil {
+			return dst.Put(key, value)
+		}
+
+		// A nil value denotes a nested bucket.
+		nested, err := dst.CreateBucket(key)
+		if err != nil {
+			return err
+		}
+		return copyBucket(nested, src.Bucket(key))
+	})
+}
@@ -17,6 +17,7 @@
 package mixkey
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/hex"
 	"io/ioutil"
@@ -24,6 +25,9 @@ import (
 	"testing"
 
 	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/epochtime"
+	"github.com/katzenpost/server/internal/clock"
+	"github.com/katzenpost/server/internal/keystore"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -33,8 +37,9 @@ const testEpoch = 0x23 // Way in the past on systems with correct time.
 var (
 	tmpDir string
 
-	testKeyPath string
-	testKey     ecdh.PrivateKey
+	testKeyPath      string
+	testSnapshotPath string
+	testKey          ecdh.PrivateKey
 
 	testPositiveTags, testNegativeTags map[[TagLength]byte]bool
 )
@@ -58,9 +63,10 @@ func doTestCreate(t *testing.T) {
 	require := require.New(t)
 	assert := assert.New(t)
 
-	k, err := New(tmpDir, testEpoch)
+	k, err := New(tmpDir, testEpoch, nil, nil, clock.Real)
 	require.NoError(err, "New()")
 	testKeyPath = k.db.Path()
+	testSnapshotPath = k.snapshotPath
 	defer k.Deref()
 
 	t.Logf("db: %v", testKeyPath)
@@ -80,13 +86,29 @@ func doTestCreate(t *testing.T) {
 		isReplay := k.IsReplay(tag[:])
 		assert.False(isReplay, "IsReplay() new: %v", hex.EncodeToString(tag[:]))
 	}
+
+	// Ensure that the batched form behaves, including duplicate tags in
+	// the same batch.
+	var batchTag [TagLength]byte
+	rand.Read(batchTag[:])
+	batch := [][]byte{batchTag[:], batchTag[:], []byte{}}
+	expected := []bool{false, true, true}
+	for tag := range testPositiveTags {
+		batch = append(batch, append([]byte{}, tag[:]...))
+		expected = append(expected, true)
+	}
+	assert.Equal(expected, k.IsReplayBatch(batch), "IsReplayBatch()")
 }
 
 func doTestLoad(t *testing.T) {
 	require := require.New(t)
 	assert := assert.New(t)
 
-	k, err := New(tmpDir, testEpoch)
+	// doTestCreate() should have snapshotted the replay filter on close.
+	_, err := os.Lstat(testSnapshotPath)
+	require.NoError(err, "Snapshot should exist")
+
+	k, err := New(tmpDir, testEpoch, nil, nil, clock.Real)
 	require.NoError(err, "New() load")
 	k.SetUnlinkIfExpired(true)
 	defer k.Deref()
@@ -113,6 +135,94 @@ func doTestUnlink(t *testing.T) {
 	// doTestLoad() should have removed the database, unless it failed to load.
 	_, err := os.Lstat(testKeyPath)
 	require.True(os.IsNotExist(err), "Database should not exist")
+	_, err = os.Lstat(testSnapshotPath)
+	require.True(os.IsNotExist(err), "Snapshot should not exist")
+}
+
+func TestMixKeyUnlinkExpired(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "mixkey_unlink")
+	require.NoError(err, "TempDir()")
+	defer os.RemoveAll(dir)
+
+	// The key is only deleted when it has expired by the clock it was
+	// opened with, regardless of the system time.
+	const epoch = 1000
+	clk := clock.NewFake(clock.EpochStart(epoch + 1))
+	k, err := New(dir, epoch, nil, nil, clk)
+	require.NoError(err, "New()")
+	f := k.db.Path()
+	k.SetUnlinkIfExpired(true)
+	k.Deref()
+	_, err = os.Lstat(f)
+	require.NoError(err, "Deref(): Not expired")
+
+	clk.Advance(epochtime.Period)
+	k, err = New(dir, epoch, nil, nil, clk)
+	require.NoError(err, "New() load")
+	k.SetUnlinkIfExpired(true)
+	k.Deref()
+	_, err = os.Lstat(f)
+	require.True(os.IsNotExist(err), "Deref(): Expired")
+}
+
+func TestMixKeyEncryption(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "mixkey_encryption_tests")
+	require.NoError(err, "TempDir()")
+	defer os.RemoveAll(dir)
+
+	ks, err := keystore.New([]byte("correct horse battery staple"))
+	require.NoError(err, "keystore.New()")
+	defer ks.Reset()
+	newKS, err := keystore.New([]byte("incorrect horse battery staple"))
+	require.NoError(err, "keystore.New(): new")
+	defer newKS.Reset()
+
+	newPlaintextKey := func(epoch uint64) (string, []byte) {
+		k, err := New(dir, epoch, nil, nil, clock.Real)
+		require.NoError(err, "New(): plaintext")
+		f := k.db.Path()
+		rawKey := append([]byte{}, k.PrivateKey().Bytes()...)
+		k.Deref()
+		return f, rawKey
+	}
+	requirePlaintextGone := func(f string, rawKey []byte) {
+		b, err := ioutil.ReadFile(f)
+		require.NoError(err, "ReadFile()")
+		require.False(bytes.Contains(b, rawKey), "Plaintext private key persisted")
+	}
+	requireLoads := func(epoch uint64, ks *keystore.Keystore, rawKey []byte) {
+		k, err := New(dir, epoch, ks, nil, clock.Real)
+		require.NoError(err, "New(): load")
+		require.Equal(rawKey, k.PrivateKey().Bytes(), "New(): load")
+		k.Deref()
+	}
+
+	// Enabling encryption for an existing plaintext key encrypts it in
+	// place.
+	f, rawKey := newPlaintextKey(testEpoch)
+	requireLoads(testEpoch, ks, rawKey)
+	requirePlaintextGone(f, rawKey)
+	_, err = New(dir, testEpoch, nil, nil, clock.Real)
+	require.Error(err, "New(): encrypted, no keystore")
+	requireLoads(testEpoch, ks, rawKey)
+
+	// Changing the passphrase.
+	require.NoError(ResealFile(f, ks, newKS), "ResealFile(): change passphrase")
+	_, err = New(dir, testEpoch, ks, nil, clock.Real)
+	require.Error(err, "New(): old keystore")
+	requireLoads(testEpoch, newKS, rawKey)
+	require.Error(ResealFile(f, nil, ks), "ResealFile(): already encrypted")
+	require.Error(ResealFile(f, ks, newKS), "ResealFile(): wrong keystore")
+
+	// Encrypting a plaintext key offline.
+	f, rawKey = newPlaintextKey(testEpoch + 1)
+	require.NoError(ResealFile(f, nil, ks), "ResealFile(): plaintext")
+	requirePlaintextGone(f, rawKey)
+	requireLoads(testEpoch+1, ks, rawKey)
 }
 
 func BenchmarkMixKey(b *testing.B) {
@@ -125,10 +235,12 @@ func BenchmarkMixKey(b *testing.B) {
 
 	b.Run("IsReplay (miss)", doBenchIsReplayMiss)
 	b.Run("IsReplay (hit)", doBenchIsReplayHit)
+	b.Run("IsReplay (miss, parallel)", doBenchIsReplayMissParallel)
+	b.Run("IsReplayBatch (miss)", doBenchIsReplayBatchMiss)
 }
 
 func doBenchIsReplayMiss(b *testing.B) {
-	k, err := New(tmpDir, testEpoch)
+	k, err := New(tmpDir, testEpoch, nil, nil, clock.Real)
 	if err != nil {
 		b.Fatalf("Failed to open key: %v", err)
 	}
@@ -154,8 +266,53 @@ func doBenchIsReplayMiss(b *testing.B) {
 	}
 }
 
+func doBenchIsReplayMissParallel(b *testing.B) {
+	k, err := New(tmpDir, testEpoch, nil, nil, clock.Real)
+	if err != nil {
+		b.Fatalf("Failed to open key: %v", err)
+	}
+	k.SetUnlinkIfExpired(true)
+	defer k.Deref()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var tag [TagLength]byte
+		for pb.Next() {
+			rand.Read(tag[:])
+			k.IsReplay(tag[:])
+		}
+	})
+}
+
+func doBenchIsReplayBatchMiss(b *testing.B) {
+	const batchSize = 16
+
+	k, err := New(tmpDir, testEpoch, nil, nil, clock.Real)
+	if err != nil {
+		b.Fatalf("Failed to open key: %v", err)
+	}
+	k.SetUnlinkIfExpired(true)
+	defer k.Deref()
+
+	batch := make([][]byte, batchSize)
+	for i := range batch {
+		batch[i] = make([]byte, TagLength)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i += batchSize {
+		b.StopTimer()
+		for _, tag := range batch {
+			rand.Read(tag)
+		}
+		b.StartTimer()
+
+		k.IsReplayBatch(batch)
+	}
+}
+
 func doBenchIsReplayHit(b *testing.B) {
-	k, err := New(tmpDir, testEpoch)
+	k, err := New(tmpDir, testEpoch, nil, nil, clock.Real)
 	if err != nil {
 		b.Fatalf("Failed to open key: %v", err)
 	}
@@ -19,6 +19,7 @@ package outgoing
 
 import (
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/katzenpost/core/sphinx/constants"
@@ -68,7 +69,7 @@ func (co *connector) DispatchPacket(pkt *packet.Packet) {
 
 	c, ok := co.conns[pkt.NextNodeHop.ID]
 	if !ok {
-		co.log.Debugf("Dropping packet: %v (No connection for destination)", pkt.ID)
+		co.log.Debugf("Dropping packet: %v (%v)", debug.PacketID(pkt.ID), debug.NewReason("No connection for destination"))
 		pkt.Dispose()
 		return
 	}
@@ -126,7 +127,7 @@ func (co *connector) spawnNewConns() {
 
 	// Spawn the new outgoingConn objects.
 	for id, v := range newPeerMap {
-		co.log.Debugf("Spawning connection to: '%v'.", debug.NodeIDToPrintString(&id))
+		co.log.Debugf("Spawning connection to: '%v'.", debug.Peer(debug.NodeIDToPrintString(&id)))
 		c := newOutgoingConn(co, v)
 		co.onNewConn(c)
 	}
@@ -143,7 +144,7 @@ func (co *connector) onNewConn(c *outgoingConn) {
 	}()
 	if _, ok := co.conns[nodeID]; ok {
 		// This should NEVER happen.  Not sure what the sensible thing to do is.
-		co.log.Warningf("Connection to peer: '%v' already exists.", debug.NodeIDToPrintString(&nodeID))
+		co.log.Warningf("Connection to peer: '%v' already exists.", debug.Peer(debug.NodeIDToPrintString(&nodeID)))
 	}
 	co.conns[nodeID] = c
 }
@@ -169,6 +170,30 @@ func (co *connector) IsValidForwardDest(id *[constants.NodeIDLength]byte) bool {
 	return ok
 }
 
+func (co *connector) NrConns() (int, int) {
+	co.RLock()
+	defer co.RUnlock()
+
+	nrConnected := 0
+	for _, c := range co.conns {
+		if atomic.LoadUint32(&c.isConnected) != 0 {
+			nrConnected++
+		}
+	}
+	return len(co.conns), nrConnected
+}
+
+func (co *connector) QueueLength() int {
+	co.RLock()
+	defer co.RUnlock()
+
+	nrQueued := 0
+	for _, c := range co.conns {
+		nrQueued += len(c.ch)
+	}
+	return nrQueued
+}
+
 // New creates a new connector.
 func New(glue glue.Glue) glue.Connector {
 	co := &connector{
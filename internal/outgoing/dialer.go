@@ -0,0 +1,250 @@
+// dialer.go - Katzenpost server outgoing connection dialer.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package outgoing
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	cpki "github.com/katzenpost/core/pki"
+)
+
+const (
+	retryIncrement = 15 * time.Second
+	maxRetryDelay  = 120 * time.Second
+
+	// attemptDelay is the delay between starting racing connection attempts
+	// to successive addresses, as in the "Connection Attempt Delay" from
+	// RFC 8305.
+	attemptDelay = 250 * time.Millisecond
+)
+
+var errNoDialCandidates = errors.New("outgoing: no addresses to dial")
+
+// dialState is the reconnect back off state for a single peer address.
+type dialState struct {
+	retryDelay  time.Duration
+	nextAttempt time.Time
+}
+
+// dialAddrs returns the peer's addresses in the order that connections should
+// be attempted, and prunes the back off state of addresses that are no
+// longer listed.
+func (c *outgoingConn) dialAddrs() []string {
+	// Bucket the addresses by transport, preserving the order of the
+	// internal transports.
+	var byTransport [][]string
+	for _, t := range cpki.InternalTransports {
+		if v, ok := c.dst.Addresses[t]; ok && len(v) > 0 {
+			byTransport = append(byTransport, v)
+		}
+	}
+
+	// Pull the preferred address (the last address that a connection was
+	// successfully established to) to the front, and start with it's
+	// address family.
+	var addrs []string
+	for i, v := range byTransport {
+		j := indexOf(v, c.preferredAddr)
+		if j < 0 {
+			continue
+		}
+		addrs = append(addrs, c.preferredAddr)
+		byTransport[i] = append(append([]string{}, v[:j]...), v[j+1:]...)
+
+		// Interleaving starts with the next address family.
+		byTransport = append(append([][]string{}, byTransport[i+1:]...), byTransport[:i+1]...)
+		break
+	}
+
+	// Interleave the address families, so that a dead IPv6 (or IPv4)
+	// address does not delay trying the other family.
+	for {
+		didAppend := false
+		for i, v := range byTransport {
+			if len(v) == 0 {
+				continue
+			}
+			addrs = append(addrs, v[0])
+			byTransport[i] = v[1:]
+			didAppend = true
+		}
+		if !didAppend {
+			break
+		}
+	}
+
+	// Discard the state for addresses no longer in the descriptor.
+	listed := make(map[string]bool)
+	for _, a := range addrs {
+		listed[a] = true
+		if _, ok := c.addrStates[a]; !ok {
+			c.addrStates[a] = new(dialState)
+		}
+	}
+	for a := range c.addrStates {
+		if !listed[a] {
+			delete(c.addrStates, a)
+		}
+	}
+	if !listed[c.preferredAddr] {
+		c.preferredAddr = ""
+	}
+
+	return addrs
+}
+
+// nextDialDelay returns the time till at least one address is eligible to
+// be dialed.
+func (c *outgoingConn) nextDialDelay(addrs []string) time.Duration {
+	now := c.co.glue.Clock().Now()
+	var next time.Time
+	for i, a := range addrs {
+		if t := c.addrStates[a].nextAttempt; i == 0 || t.Before(next) {
+			next = t
+		}
+	}
+	if d := next.Sub(now); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// dialCandidates returns the addresses that are not currently backing off,
+// preserving order.
+func (c *outgoingConn) dialCandidates(addrs []string) []string {
+	now := c.co.glue.Clock().Now()
+	candidates := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		if !c.addrStates[a].nextAttempt.After(now) {
+			candidates = append(candidates, a)
+		}
+	}
+	return candidates
+}
+
+func (c *outgoingConn) onDialFailure(addr string) {
+	st, ok := c.addrStates[addr]
+	if !ok {
+		return
+	}
+
+	// Back off incrementally on reconnects, with jitter so that all of the
+	// connections to a peer that went away do not retry in lockstep.
+	st.retryDelay += retryIncrement
+	if st.retryDelay > maxRetryDelay {
+		st.retryDelay = maxRetryDelay
+	}
+	jitter := time.Duration(c.rng.Int63n(int64(st.retryDelay / 2)))
+	st.nextAttempt = c.co.glue.Clock().Now().Add(st.retryDelay/2 + jitter)
+
+	if addr == c.preferredAddr {
+		c.preferredAddr = ""
+	}
+}
+
+func (c *outgoingConn) onDialSuccess(addr string) {
+	if st, ok := c.addrStates[addr]; ok {
+		st.retryDelay = 0
+		st.nextAttempt = time.Time{}
+	}
+	c.preferredAddr = addr
+}
+
+// raceDial attempts to connect to each of the addresses in order, starting
+// a new attempt every attemptDelay (or immediately on failure) till a
+// connection is established, and returns the first successful connection.
+func (c *outgoingConn) raceDial(ctx context.Context, dialer *net.Dialer, addrs []string) (net.Conn, string, error) {
+	if len(addrs) == 0 {
+		return nil, "", errNoDialCandidates
+	}
+
+	type dialResult struct {
+		conn net.Conn
+		addr string
+		err  error
+	}
+
+	raceCtx, cancelFn := context.WithCancel(ctx)
+	resultCh := make(chan *dialResult, len(addrs))
+	nStarted, nDone := 0, 0
+	defer func() {
+		// Abort the attempts that are still in progress, and close any
+		// connections that happened to succeed after the race was over.
+		cancelFn()
+		for ; nDone < nStarted; nDone++ {
+			if r := <-resultCh; r.conn != nil {
+				r.conn.Close()
+			}
+		}
+	}()
+
+	var nextCh <-chan time.Time
+	startNext := func() {
+		addr := addrs[nStarted]
+		nStarted++
+		c.log.Debugf("Dialing: %v", addr)
+		go func() {
+			conn, err := dialer.DialContext(raceCtx, "tcp", addr)
+			resultCh <- &dialResult{conn, addr, err}
+		}()
+		if nStarted < len(addrs) {
+			nextCh = time.After(attemptDelay)
+		} else {
+			nextCh = nil
+		}
+	}
+
+	var lastErr error
+	startNext()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, "", ctx.Err()
+		case <-nextCh:
+			startNext()
+		case r := <-resultCh:
+			nDone++
+			if r.err == nil {
+				return r.conn, r.addr, nil
+			}
+			c.log.Debugf("Failed to connect to '%v': %v", r.addr, r.err)
+			c.onDialFailure(r.addr)
+			lastErr = r.err
+			if nStarted < len(addrs) {
+				// Do not wait for the attempt delay on failure.
+				startNext()
+			} else if nDone == nStarted {
+				return nil, "", lastErr
+			}
+		}
+	}
+}
+
+func indexOf(s []string, v string) int {
+	if v == "" {
+		return -1
+	}
+	for i, a := range s {
+		if a == v {
+			return i
+		}
+	}
+	return -1
+}
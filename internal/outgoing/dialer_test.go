@@ -0,0 +1,219 @@
+// dialer_test.go - Katzenpost server outgoing connection dialer tests.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package outgoing
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/log"
+	cpki "github.com/katzenpost/core/pki"
+	"github.com/katzenpost/server/internal/clock"
+	"github.com/katzenpost/server/internal/glue"
+	"github.com/stretchr/testify/require"
+)
+
+type testGlue struct {
+	glue.Glue
+
+	clock *clock.Fake
+}
+
+func (g *testGlue) Clock() clock.Clock {
+	return g.clock
+}
+
+func newTestConn(t *testing.T, addrs map[cpki.Transport][]string) *outgoingConn {
+	logBackend, err := log.New("", "ERROR", false)
+	require.NoError(t, err, "log.New()")
+
+	g := &testGlue{clock: clock.NewFake(clock.EpochStart(1000))}
+	return &outgoingConn{
+		co:         &connector{glue: g},
+		log:        logBackend.GetLogger("outgoing:test"),
+		dst:        &cpki.MixDescriptor{Addresses: addrs},
+		addrStates: make(map[string]*dialState),
+		rng:        rand.NewMath(),
+	}
+}
+
+func TestDialAddrs(t *testing.T) {
+	require := require.New(t)
+
+	t0, t1 := cpki.InternalTransports[0], cpki.InternalTransports[1]
+	c := newTestConn(t, map[cpki.Transport][]string{
+		t0: {"a1", "a2", "a3"},
+		t1: {"b1"},
+	})
+
+	// The address families are interleaved.
+	require.Equal([]string{"a1", "b1", "a2", "a3"}, c.dialAddrs(), "dialAddrs()")
+	require.Len(c.addrStates, 4, "addrStates")
+
+	// The preferred address is tried first, followed by the other family.
+	c.onDialSuccess("a2")
+	require.Equal([]string{"a2", "b1", "a1", "a3"}, c.dialAddrs(), "dialAddrs(): Preferred")
+
+	// Addresses that are no longer listed are forgotten.
+	c.dst.Addresses = map[cpki.Transport][]string{t1: {"b1", "b2"}}
+	require.Equal([]string{"b1", "b2"}, c.dialAddrs(), "dialAddrs(): Updated")
+	require.Len(c.addrStates, 2, "addrStates: Updated")
+	require.Empty(c.preferredAddr, "preferredAddr: Updated")
+}
+
+func TestDialBackoff(t *testing.T) {
+	require := require.New(t)
+
+	c := newTestConn(t, map[cpki.Transport][]string{
+		cpki.InternalTransports[0]: {"a1", "a2"},
+	})
+	clk := c.co.glue.(*testGlue).clock
+	addrs := c.dialAddrs()
+	require.Equal(addrs, c.dialCandidates(addrs), "dialCandidates(): Initial")
+	require.Equal(time.Duration(0), c.nextDialDelay(addrs), "nextDialDelay(): Initial")
+
+	// The delay increases by retryIncrement per failure, up to
+	// maxRetryDelay, and the next attempt is jittered between half and all
+	// of the delay.
+	c.onDialSuccess("a1")
+	for i := 1; i <= 10; i++ {
+		c.onDialFailure("a1")
+
+		expected := time.Duration(i) * retryIncrement
+		if expected > maxRetryDelay {
+			expected = maxRetryDelay
+		}
+		st := c.addrStates["a1"]
+		require.Equal(expected, st.retryDelay, "retryDelay(%d)", i)
+		require.False(st.nextAttempt.Before(clk.Now().Add(expected/2)), "nextAttempt(%d): Min", i)
+		require.False(st.nextAttempt.After(clk.Now().Add(expected)), "nextAttempt(%d): Max", i)
+	}
+	require.Empty(c.preferredAddr, "preferredAddr: After failure")
+
+	// Addresses that are backing off are skipped.
+	require.Equal([]string{"a2"}, c.dialCandidates(addrs), "dialCandidates(): a1 backing off")
+	require.Equal(time.Duration(0), c.nextDialDelay(addrs), "nextDialDelay(): a2 available")
+	c.onDialFailure("a2")
+	require.Empty(c.dialCandidates(addrs), "dialCandidates(): All backing off")
+	d := c.nextDialDelay(addrs)
+	require.True(d > 0 && d <= retryIncrement, "nextDialDelay(): All backing off: %v", d)
+
+	// The back off expires with the passage of time.
+	clk.Advance(d)
+	require.Equal([]string{"a2"}, c.dialCandidates(addrs), "dialCandidates(): a2 backed off")
+	require.Equal(time.Duration(0), c.nextDialDelay(addrs), "nextDialDelay(): a2 backed off")
+	clk.Advance(maxRetryDelay)
+	require.Equal(addrs, c.dialCandidates(addrs), "dialCandidates(): All backed off")
+	c.onDialFailure("a1")
+	c.onDialFailure("a2")
+
+	// Success resets the back off.
+	c.onDialSuccess("a2")
+	require.Equal([]string{"a2"}, c.dialCandidates(addrs), "dialCandidates(): After success")
+	require.Equal(time.Duration(0), c.addrStates["a2"].retryDelay, "retryDelay: After success")
+	require.Equal("a2", c.preferredAddr, "preferredAddr: After success")
+
+	// Failures for addresses that are not being tracked are ignored.
+	c.onDialFailure("a3")
+	require.NotContains(c.addrStates, "a3", "addrStates: Untracked")
+}
+
+func TestRaceDial(t *testing.T) {
+	require := require.New(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err, "Listen()")
+	defer l.Close()
+	acceptCh := make(chan time.Time, 8)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			acceptCh <- time.Now()
+			conn.Close()
+		}
+	}()
+	liveAddr := l.Addr().String()
+
+	// Grab a port that nothing is listening on.
+	dl, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err, "Listen()")
+	deadAddr := dl.Addr().String()
+	dl.Close()
+
+	// Connections to the hanging address stall for far longer than the
+	// attempt delay.
+	const hangTime = 2 * time.Second
+	hl, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err, "Listen()")
+	hangAddr := hl.Addr().String()
+	hl.Close()
+	dialer := &net.Dialer{
+		Control: func(_, address string, _ syscall.RawConn) error {
+			if address == hangAddr {
+				time.Sleep(hangTime)
+				return errors.New("hung")
+			}
+			return nil
+		},
+	}
+
+	c := newTestConn(t, nil)
+	for _, a := range []string{liveAddr, deadAddr, hangAddr} {
+		c.addrStates[a] = new(dialState)
+	}
+
+	_, _, err = c.raceDial(context.Background(), dialer, nil)
+	require.Equal(errNoDialCandidates, err, "raceDial(): No addresses")
+
+	// A failed attempt starts the next attempt immediately, and backs off.
+	conn, addr, err := c.raceDial(context.Background(), dialer, []string{deadAddr, liveAddr})
+	require.NoError(err, "raceDial(): Dead, Live")
+	conn.Close()
+	require.Equal(liveAddr, addr, "raceDial(): Dead, Live")
+	require.NotZero(c.addrStates[deadAddr].retryDelay, "raceDial(): Dead backing off")
+	require.Zero(c.addrStates[liveAddr].retryDelay, "raceDial(): Live not backing off")
+
+	// A stalled attempt does not hold up the next address for longer than
+	// the attempt delay.  raceDial waits for the stalled attempt before
+	// returning, so the time to connect is measured by the listener.
+	<-acceptCh
+	start := time.Now()
+	conn, addr, err = c.raceDial(context.Background(), dialer, []string{hangAddr, liveAddr})
+	require.NoError(err, "raceDial(): Hang, Live")
+	conn.Close()
+	require.Equal(liveAddr, addr, "raceDial(): Hang, Live")
+	acceptedAt := <-acceptCh
+	require.True(acceptedAt.Sub(start) < hangTime/2, "raceDial(): Hang, Live: %v", acceptedAt.Sub(start))
+
+	// Every attempt failing returns the last error.
+	_, _, err = c.raceDial(context.Background(), dialer, []string{deadAddr})
+	require.Error(err, "raceDial(): Dead")
+
+	// Cancellation aborts the race.
+	ctx, cancelFn := context.WithTimeout(context.Background(), attemptDelay)
+	defer cancelFn()
+	_, _, err = c.raceDial(ctx, dialer, []string{hangAddr})
+	require.Equal(context.DeadlineExceeded, err, "raceDial(): Cancelled")
+}
@@ -20,16 +20,17 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	mRand "math/rand"
 	"net"
 	"sync/atomic"
 	"time"
 
 	"github.com/katzenpost/core/crypto/rand"
-	"github.com/katzenpost/core/monotime"
 	cpki "github.com/katzenpost/core/pki"
 	"github.com/katzenpost/core/wire"
 	"github.com/katzenpost/core/wire/commands"
 	"github.com/katzenpost/server/internal/constants"
+	"github.com/katzenpost/server/internal/debug"
 	"github.com/katzenpost/server/internal/packet"
 	"gopkg.in/op/go-logging.v1"
 )
@@ -43,9 +44,14 @@ type outgoingConn struct {
 	dst *cpki.MixDescriptor
 	ch  chan *packet.Packet
 
-	id         uint64
-	retryDelay time.Duration
-	canSend    bool
+	id          uint64
+	canSend     bool
+	isConnected uint32
+
+	// The dial state is only ever touched by the worker.
+	addrStates    map[string]*dialState
+	preferredAddr string
+	rng           *mRand.Rand
 }
 
 func (c *outgoingConn) IsPeerValid(creds *wire.PeerCredentials) bool {
@@ -54,14 +60,19 @@ func (c *outgoingConn) IsPeerValid(creds *wire.PeerCredentials) bool {
 	if !bytes.Equal(c.dst.IdentityKey.Bytes(), creds.AdditionalData) {
 		return false
 	}
-	if !c.dst.LinkKey.Equal(creds.PublicKey) {
-		return false
-	}
 
 	// Query the PKI to figure out if we can send or not, and to ensure that
 	// the peer is listed in a PKI document that's valid.
+	//
+	// Note: The link key is allowed to differ from the one in the most
+	// recent descriptor, because peers rotate their link keys at epoch
+	// transitions, and the PKI will validate that the key the peer is
+	// presenting is listed in a valid document.
 	var isValid bool
 	_, c.canSend, isValid = c.co.glue.PKI().AuthenticateConnection(creds, true)
+	if isValid && !c.dst.LinkKey.Equal(creds.PublicKey) {
+		c.log.Debugf("Peer is using a link key from another epoch: %v", debug.KeyToPrintString(creds.PublicKey))
+	}
 
 	return isValid
 }
@@ -85,11 +96,6 @@ func (c *outgoingConn) dispatchPacket(pkt *packet.Packet) {
 }
 
 func (c *outgoingConn) worker() {
-	const (
-		retryIncrement = 15 * time.Second
-		maxRetryDelay  = 120 * time.Second
-	)
-
 	defer func() {
 		c.log.Debugf("Halting connect worker.")
 		c.co.onClosedConn(c)
@@ -144,12 +150,7 @@ func (c *outgoingConn) worker() {
 		}
 
 		// Flatten the lists of addresses to Dial to.
-		var dstAddrs []string
-		for _, t := range cpki.InternalTransports {
-			if v, ok := c.dst.Addresses[t]; ok {
-				dstAddrs = append(dstAddrs, v...)
-			}
-		}
+		dstAddrs := c.dialAddrs()
 		if len(dstAddrs) == 0 {
 			// Should *NEVER* happen because descriptors currently MUST have
 			// at least once `tcp4` address to be considered valid.
@@ -157,63 +158,52 @@ func (c *outgoingConn) worker() {
 			return
 		}
 
-		for _, addrPort := range dstAddrs {
-			select {
-			case <-time.After(c.retryDelay):
-				// Back off incrementally on reconnects.
-				//
-				// This maybe should be tracked per address, but whatever.  I
-				// remember when IPng was supposed to take over the world in
-				// the 90s, and it still hasn't happened yet.
-				c.retryDelay += retryIncrement
-				if c.retryDelay > maxRetryDelay {
-					c.retryDelay = maxRetryDelay
-				}
-			case <-dialCtx.Done():
-				// Canceled mid-retry delay.
-				c.log.Debugf("(Re)connection attempts canceled.")
-				return
-			}
+		// Wait till at least one of the addresses is out of it's back off
+		// period.
+		select {
+		case <-time.After(c.nextDialDelay(dstAddrs)):
+		case <-dialCtx.Done():
+			// Canceled mid-retry delay.
+			c.log.Debugf("(Re)connection attempts canceled.")
+			return
+		}
 
-			// Dial.
-			c.log.Debugf("Dialing: %v", addrPort)
-			conn, err := dialer.DialContext(dialCtx, "tcp", addrPort)
-			select {
-			case <-dialCtx.Done():
-				// Canceled.
-				if conn != nil {
-					conn.Close()
-				}
-				return
-			default:
-				if err != nil {
-					c.log.Warningf("Failed to connect to '%v': %v", addrPort, err)
-					continue
-				}
+		// Dial, racing all of the addresses that are eligible.
+		conn, addrPort, err := c.raceDial(dialCtx, &dialer, c.dialCandidates(dstAddrs))
+		select {
+		case <-dialCtx.Done():
+			// Canceled.
+			if conn != nil {
+				conn.Close()
 			}
-			c.log.Debugf("TCP connection established.")
-			start := time.Now()
-
-			// Handle the new connection.
-			if c.onConnEstablished(conn, dialCtx.Done()) {
-				// Canceled with a connection established.
-				c.log.Debugf("Existing connection canceled.")
-				return
+			return
+		default:
+			if err != nil {
+				c.log.Warningf("Failed to connect: %v", err)
+				continue
 			}
+		}
+		c.log.Debugf("TCP connection established: %v", addrPort)
+		start := c.co.glue.Clock().Mono()
 
-			// That's odd, the connection died, reconnect.
-			c.log.Debugf("Connection terminated, will reconnect.")
-			if time.Since(start) < retryIncrement {
-				// If the connection was not alive for a sensible amount of
-				// time, re-impose a reconnect delay.
-				c.retryDelay = retryIncrement
-			}
-			break
+		// Handle the new connection.
+		if c.onConnEstablished(conn, addrPort, dialCtx.Done()) {
+			// Canceled with a connection established.
+			c.log.Debugf("Existing connection canceled.")
+			return
+		}
+
+		// That's odd, the connection died, reconnect.
+		c.log.Debugf("Connection terminated, will reconnect.")
+		if c.co.glue.Clock().Mono()-start < retryIncrement {
+			// If the connection was not alive for a sensible amount of
+			// time, re-impose a reconnect delay.
+			c.onDialFailure(addrPort)
 		}
 	}
 }
 
-func (c *outgoingConn) onConnEstablished(conn net.Conn, closeCh <-chan struct{}) (wasHalted bool) {
+func (c *outgoingConn) onConnEstablished(conn net.Conn, addrPort string, closeCh <-chan struct{}) (wasHalted bool) {
 	defer func() {
 		c.log.Debugf("TCP connection closed. (wasHalted: %v)", wasHalted)
 		conn.Close()
@@ -234,6 +224,9 @@ func (c *outgoingConn) onConnEstablished(conn net.Conn, closeCh <-chan struct{})
 	defer w.Close()
 
 	// Bind the session to the conn, handshake, authenticate.
+	//
+	// Note: Deadlines are enforced against the system clock by the runtime,
+	// so they can not use the server's clock.
 	timeoutMs := time.Duration(c.co.glue.Config().Debug.HandshakeTimeout) * time.Millisecond
 	conn.SetDeadline(time.Now().Add(timeoutMs))
 	if err = w.Initialize(conn); err != nil {
@@ -242,7 +235,9 @@ func (c *outgoingConn) onConnEstablished(conn net.Conn, closeCh <-chan struct{})
 	}
 	c.log.Debugf("Handshake completed.")
 	conn.SetDeadline(time.Time{})
-	c.retryDelay = 0 // Reset the retry delay on successful handshakes.
+	c.onDialSuccess(addrPort) // Reset the retry delay on successful handshakes.
+	atomic.StoreUint32(&c.isConnected, 1)
+	defer atomic.StoreUint32(&c.isConnected, 0)
 
 	// Since outgoing connections have no reverse traffic, read from the
 	// reverse path to detect that the connection has been closed.
@@ -275,7 +270,7 @@ func (c *outgoingConn) onConnEstablished(conn net.Conn, closeCh <-chan struct{})
 				SphinxPacket: pkt.Raw,
 			}
 			if err := w.SendCommand(&cmd); err != nil {
-				c.log.Debugf("Dropping packet: %v (SendCommand failed: %v)", pkt.ID, err)
+				c.log.Debugf("Dropping packet: %v (%v)", debug.PacketID(pkt.ID), debug.NewReason("SendCommand failed: %v", err))
 				pkt.Dispose()
 				return
 			}
@@ -309,9 +304,9 @@ func (c *outgoingConn) onConnEstablished(conn net.Conn, closeCh <-chan struct{})
 			continue
 		case pkt = <-c.ch:
 			// Check the packet queue dwell time and drop it if it is excessive.
-			now := monotime.Now()
+			now := c.co.glue.Clock().Mono()
 			if now-pkt.DispatchAt > time.Duration(c.co.glue.Config().Debug.SendSlack)*time.Millisecond {
-				c.log.Debugf("Dropping packet: %v (Deadline blown by %v)", pkt.ID, now-pkt.DispatchAt)
+				c.log.Debugf("Dropping packet: %v (%v)", debug.PacketID(pkt.ID), debug.NewReason("Deadline blown by %v", now-pkt.DispatchAt))
 				pkt.Dispose()
 				continue
 			}
@@ -320,7 +315,7 @@ func (c *outgoingConn) onConnEstablished(conn net.Conn, closeCh <-chan struct{})
 		if !c.canSend {
 			// This is presumably a early connect, and we aren't allowed to
 			// actually send packets to the peer yet.
-			c.log.Debugf("Dropping packet: %v (Out of epoch)", pkt.ID)
+			c.log.Debugf("Dropping packet: %v (%v)", debug.PacketID(pkt.ID), debug.NewReason("Out of epoch"))
 			pkt.Dispose()
 			continue
 		}
@@ -349,6 +344,9 @@ func newOutgoingConn(co *connector, dst *cpki.MixDescriptor) *outgoingConn {
 		dst: dst,
 		ch:  make(chan *packet.Packet, maxQueueSize),
 		id:  atomic.AddUint64(&outgoingConnID, 1), // Diagnostic only, wrapping is fine.
+
+		addrStates: make(map[string]*dialState),
+		rng:        rand.NewMath(),
 	}
 	c.log = co.glue.LogBackend().GetLogger(fmt.Sprintf("outgoing:%d", c.id))
 
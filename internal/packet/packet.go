@@ -210,6 +210,40 @@ func NewWithID(raw []byte, id uint64) (*Packet, error) {
 	return pkt, nil
 }
 
+// SURBJob is a request to build a response packet from a SURB, which is
+// submitted to the crypto workers so that the provider worker is not
+// stalled by the packet construction.
+type SURBJob struct {
+	// SrcID is the ID of the packet that contained the SURB.
+	SrcID uint64
+
+	// SURB is the SURB used to construct the response packet.
+	SURB []byte
+
+	// Payload is the response payload, padded to the full length.
+	Payload []byte
+
+	// Delay is the node delay of the packet that contained the SURB, in
+	// milliseconds.
+	Delay uint32
+
+	// RecvAt is the time at which the packet that contained the SURB was
+	// received.
+	RecvAt time.Duration
+
+	// IsSURBACK is true iff the response is a SURB-ACK, as opposed to a
+	// SURB-Reply.
+	IsSURBACK bool
+}
+
+// Kind returns the kind of response packet requested, suitable for logging.
+func (job *SURBJob) Kind() string {
+	if job.IsSURBACK {
+		return "SURB-ACK"
+	}
+	return "SURB-Reply"
+}
+
 func newRedundantError(cmd commands.RoutingCommand) error {
 	return fmt.Errorf("redundant command: %T", cmd)
 }
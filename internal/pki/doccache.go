@@ -0,0 +1,130 @@
+// doccache.go - Katzenpost server on-disk PKI document cache.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package pki
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/katzenpost/server/internal/constants"
+	"github.com/katzenpost/server/internal/pkicache"
+)
+
+const (
+	docCacheGlob = "pki-*.doc"
+	docCacheFmt  = "pki-%d.doc"
+)
+
+func (p *pki) docCachePath(epoch uint64) string {
+	return filepath.Join(p.glue.Config().Server.DataDir, fmt.Sprintf(docCacheFmt, epoch))
+}
+
+// isDocEpochExpired returns true iff a document for the epoch would be
+// discarded by pruneDocuments().
+func isDocEpochExpired(epoch, now uint64) bool {
+	return epoch < now-(constants.NumMixKeys-1)
+}
+
+// storeDocument persists a raw verified document to the on-disk cache.
+func (p *pki) storeDocument(epoch uint64, rawDoc []byte) {
+	f := p.docCachePath(epoch)
+	tmp := f + ".tmp"
+	if err := ioutil.WriteFile(tmp, rawDoc, 0600); err != nil {
+		p.log.Warningf("Failed to persist PKI for epoch %v: %v", epoch, err)
+		os.Remove(tmp)
+		return
+	}
+	if err := os.Rename(tmp, f); err != nil {
+		p.log.Warningf("Failed to persist PKI for epoch %v: %v", epoch, err)
+		os.Remove(tmp)
+	}
+}
+
+// removeDocument removes a document from the on-disk cache.
+func (p *pki) removeDocument(epoch uint64) {
+	if err := os.Remove(p.docCachePath(epoch)); err != nil && !os.IsNotExist(err) {
+		p.log.Warningf("Failed to remove cached PKI for epoch %v: %v", epoch, err)
+	}
+}
+
+// loadDocuments loads, and re-verifies, the documents in the on-disk cache
+// that are still usable, and returns true iff any were loaded.  It is called
+// before the worker is started.
+func (p *pki) loadDocuments() bool {
+	files, err := filepath.Glob(filepath.Join(p.glue.Config().Server.DataDir, docCacheGlob))
+	if err != nil {
+		p.log.Warningf("Failed to find cached PKI documents: %v", err)
+		return false
+	}
+
+	now, _, _ := p.glue.Clock().Epoch()
+	docFmt := filepath.Join(p.glue.Config().Server.DataDir, docCacheFmt)
+	didLoad := false
+	for _, f := range files {
+		var epoch uint64
+		if _, err := fmt.Sscanf(f, docFmt, &epoch); err != nil {
+			p.log.Debugf("Failed to extract epoch from '%v': %v", f, err)
+			continue
+		}
+		if isDocEpochExpired(epoch, now) || epoch > now+1 {
+			p.log.Debugf("Purging stale cached PKI for epoch: %v", epoch)
+			p.removeDocument(epoch)
+			continue
+		}
+
+		if err = p.loadDocument(epoch, f); err != nil {
+			p.log.Warningf("Discarding cached PKI for epoch %v: %v", epoch, err)
+			p.removeDocument(epoch)
+			continue
+		}
+		p.log.Noticef("Loaded cached PKI for epoch: %v", epoch)
+		didLoad = true
+	}
+	return didLoad
+}
+
+func (p *pki) loadDocument(epoch uint64, f string) error {
+	rawDoc, err := ioutil.ReadFile(f)
+	if err != nil {
+		return err
+	}
+
+	// The document is treated as untrusted, and goes through the same
+	// verification as a freshly fetched one.
+	d, err := p.impl.Deserialize(rawDoc)
+	if err != nil {
+		return err
+	}
+	if d.Epoch != epoch {
+		return fmt.Errorf("document epoch mismatch: %v", d.Epoch)
+	}
+	ent, err := pkicache.New(d, p.glue.IdentityKey().PublicKey(), p.glue.Config().Server.IsProvider)
+	if err != nil {
+		return err
+	}
+	if err = p.validateCacheEntry(ent); err != nil {
+		return err
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	p.rawDocs[epoch] = rawDoc
+	p.docs[epoch] = ent
+	return nil
+}
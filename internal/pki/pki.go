@@ -25,16 +25,17 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	nClient "github.com/katzenpost/authority/nonvoting/client"
 	"github.com/katzenpost/core/crypto/ecdh"
 	"github.com/katzenpost/core/crypto/eddsa"
-	"github.com/katzenpost/core/epochtime"
 	cpki "github.com/katzenpost/core/pki"
 	sConstants "github.com/katzenpost/core/sphinx/constants"
 	"github.com/katzenpost/core/wire"
 	"github.com/katzenpost/core/worker"
+	"github.com/katzenpost/server/internal/clock"
 	"github.com/katzenpost/server/internal/constants"
 	"github.com/katzenpost/server/internal/debug"
 	"github.com/katzenpost/server/internal/glue"
@@ -58,6 +59,9 @@ type pki struct {
 	failedFetches      map[uint64]error
 	lastPublishedEpoch uint64
 	lastWarnedEpoch    uint64
+	jumpCh             chan struct{}
+	isDraining         uint32
+	hasCachedDocs      bool
 }
 
 func (p *pki) StartWorker() {
@@ -67,7 +71,14 @@ func (p *pki) StartWorker() {
 func (p *pki) worker() {
 	const initialSpawnDelay = 5 * time.Second
 
-	timer := time.NewTimer(initialSpawnDelay)
+	// If documents were loaded from the on-disk cache, the node can rejoin
+	// the network immediately, without waiting for the authority.
+	spawnDelay := initialSpawnDelay
+	if p.hasCachedDocs {
+		spawnDelay = 0
+		p.glue.Connector().ForceUpdate()
+	}
+	timer := time.NewTimer(spawnDelay)
 	defer func() {
 		p.log.Debugf("Halting PKI worker.")
 		timer.Stop()
@@ -112,6 +123,16 @@ func (p *pki) worker() {
 			return
 		case <-timer.C:
 			timerFired = true
+		case <-p.jumpCh:
+			// The civil time jumped, so the cached failures, and the last
+			// published epoch can no longer be trusted.  Re-fetch, and
+			// re-publish (and generate keys) as if the node just started.
+			p.log.Noticef("Civil time jumped, re-fetching documents and re-publishing.")
+			p.Lock()
+			p.failedFetches = make(map[uint64]error)
+			p.Unlock()
+			p.lastPublishedEpoch = 0
+			p.lastWarnedEpoch = 0
 		}
 		if !timerFired && !timer.Stop() {
 			<-timer.C
@@ -128,6 +149,7 @@ func (p *pki) worker() {
 				continue
 			}
 
+			fetchStart := p.glue.Clock().Now()
 			d, rawDoc, err := p.impl.Get(pkiCtx, epoch)
 			if isCanceled() {
 				// Canceled mid-fetch.
@@ -141,6 +163,11 @@ func (p *pki) worker() {
 				continue
 			}
 
+			// The authority serving the document bounds it's civil time,
+			// regardless of if the document is usable.
+			fetchEnd := p.glue.Clock().Now()
+			p.glue.Skew().ObserveDocument(d.Epoch, fetchStart.Add(fetchEnd.Sub(fetchStart)/2))
+
 			ent, err := pkicache.New(d, p.glue.IdentityKey().PublicKey(), p.glue.Config().Server.IsProvider)
 			if err != nil {
 				p.log.Warningf("Failed to generate PKI cache for epoch %v: %v", epoch, err)
@@ -157,6 +184,7 @@ func (p *pki) worker() {
 			p.rawDocs[epoch] = rawDoc
 			p.docs[epoch] = ent
 			p.Unlock()
+			p.storeDocument(epoch, rawDoc)
 			didUpdate = true
 		}
 		p.pruneFailures()
@@ -182,8 +210,8 @@ func (p *pki) worker() {
 		// Internal component depend on network wide paramemters, and or the
 		// list of nodes.  Update if there is a new document for the current
 		// epoch.
-		if now, _, _ := epochtime.Now(); now != lastUpdateEpoch {
-			if ent := p.entryForEpoch(now); ent != nil {
+		if now, _, _ := p.glue.Clock().Epoch(); now != lastUpdateEpoch {
+			if ent := p.EntryForEpoch(now); ent != nil {
 				if newMixMaxDelay := ent.MixMaxDelay(); newMixMaxDelay != lastMixMaxDelay {
 					p.log.Debugf("Updating scheduler MixMaxDelay for epoch %v: %v", now, newMixMaxDelay)
 					p.glue.Scheduler().OnNewMixMaxDelay(newMixMaxDelay)
@@ -222,7 +250,7 @@ func (p *pki) validateCacheEntry(ent *pkicache.Entry) error {
 	if !desc.IdentityKey.Equal(p.glue.IdentityKey().PublicKey()) {
 		return fmt.Errorf("self identity key mismatch")
 	}
-	if !desc.LinkKey.Equal(p.glue.LinkKey().PublicKey()) {
+	if linkKey, ok := p.glue.LinkKeys().Get(ent.Epoch()); !ok || !desc.LinkKey.Equal(linkKey) {
 		return fmt.Errorf("self link key mismatch")
 	}
 	return nil
@@ -245,7 +273,7 @@ func (p *pki) pruneFailures() {
 	p.Lock()
 	defer p.Unlock()
 
-	now, _, _ := epochtime.Now()
+	now, _, _ := p.glue.Clock().Epoch()
 
 	for epoch := range p.failedFetches {
 		// Be more aggressive about pruning failures than pruning documents,
@@ -257,15 +285,16 @@ func (p *pki) pruneFailures() {
 }
 
 func (p *pki) pruneDocuments() {
-	now, _, _ := epochtime.Now()
+	now, _, _ := p.glue.Clock().Epoch()
 
 	p.Lock()
 	defer p.Unlock()
 	for epoch := range p.docs {
-		if epoch < now-(constants.NumMixKeys-1) {
+		if isDocEpochExpired(epoch, now) {
 			p.log.Debugf("Discarding PKI for epoch: %v", epoch)
 			delete(p.docs, epoch)
 			delete(p.rawDocs, epoch)
+			p.removeDocument(epoch)
 		}
 		if epoch > now+1 {
 			// This should NEVER happen.
@@ -277,7 +306,14 @@ func (p *pki) pruneDocuments() {
 func (p *pki) publishDescriptorIfNeeded(pkiCtx context.Context) error {
 	const publishDeadline = 3600 * time.Second
 
-	epoch, _, till := epochtime.Now()
+	// Refuse to publish if the local clock is known to be badly skewed,
+	// since the keys and the publication time will be wrong.
+	maxSkew := time.Duration(p.glue.Config().Server.MaxClockSkew) * time.Millisecond
+	if status, skew := p.glue.Skew().Status(maxSkew); status == clock.SkewExcessive {
+		return fmt.Errorf("refusing to publish, clock skew %v exceeds %v", skew, maxSkew)
+	}
+
+	epoch, _, till := p.glue.Clock().Epoch()
 	doPublishEpoch := uint64(0)
 	switch p.lastPublishedEpoch {
 	case 0:
@@ -314,15 +350,32 @@ func (p *pki) publishDescriptorIfNeeded(pkiCtx context.Context) error {
 		doPublishEpoch = epoch
 	}
 
+	// A node that is draining will be gone by the time any future epoch
+	// starts, so it should not be listed in those documents.
+	if doPublishEpoch > epoch && atomic.LoadUint32(&p.isDraining) != 0 {
+		p.log.Debugf("Draining, not publishing for epoch: %v", doPublishEpoch)
+		return nil
+	}
+
 	// Note: Why, yes I *could* cache the descriptor and save a trivial amount
 	// of time and CPU, but this is invoked infrequently enough that it's
 	// probably not worth it.
 
+	// Ensure that there is a link key for the epoch, rotating it if needed.
+	if _, err := p.glue.LinkKeys().Generate(doPublishEpoch); err != nil {
+		return err
+	}
+	p.glue.LinkKeys().Prune()
+	linkKey, ok := p.glue.LinkKeys().Get(doPublishEpoch)
+	if !ok {
+		return fmt.Errorf("no link key for epoch: %v", doPublishEpoch)
+	}
+
 	// Generate the non-key parts of the descriptor.
 	desc := &cpki.MixDescriptor{
 		Name:        p.glue.Config().Server.Identifier,
 		IdentityKey: p.glue.IdentityKey().PublicKey(),
-		LinkKey:     p.glue.LinkKey().PublicKey(),
+		LinkKey:     linkKey,
 		Addresses:   p.descAddrMap,
 	}
 	if p.glue.Config().Server.IsProvider {
@@ -383,7 +436,7 @@ func (p *pki) publishDescriptorIfNeeded(pkiCtx context.Context) error {
 	return err
 }
 
-func (p *pki) entryForEpoch(epoch uint64) *pkicache.Entry {
+func (p *pki) EntryForEpoch(epoch uint64) *pkicache.Entry {
 	p.RLock()
 	defer p.RUnlock()
 
@@ -393,11 +446,18 @@ func (p *pki) entryForEpoch(epoch uint64) *pkicache.Entry {
 	return nil
 }
 
+// FailedFetch returns the reason the document for an epoch is unavailable,
+// if it was not published, or was fetched and rejected.
+func (p *pki) FailedFetch(epoch uint64) error {
+	err, _ := p.getFailedFetch(epoch)
+	return err
+}
+
 func (p *pki) documentsToFetch() []uint64 {
 	const nextFetchTill = 45 * time.Minute
 
 	ret := make([]uint64, 0, constants.NumMixKeys+1)
-	now, _, till := epochtime.Now()
+	now, _, till := p.glue.Clock().Epoch()
 	start := now
 	if till < nextFetchTill {
 		start = now + 1
@@ -422,7 +482,7 @@ func (p *pki) documentsForAuthentication() ([]*pkicache.Entry, *pkicache.Entry,
 	//
 	// Note: The ordering is important and should not be changed without
 	// changes to pki.AuthenticateConnection().
-	now, _, till := epochtime.Now()
+	now, _, till := p.glue.Clock().Epoch()
 	epochs := make([]uint64, 0, constants.NumMixKeys+1)
 	start := now
 	if till < pkiEarlyConnectSlack {
@@ -461,7 +521,7 @@ func (p *pki) AuthenticateConnection(c *wire.PeerCredentials, isOutgoing bool) (
 
 	// Ensure the additional data is valid.
 	if len(c.AdditionalData) != sConstants.NodeIDLength {
-		p.log.Debugf("%v: '%v' AD not an IdentityKey?.", dirStr, debug.BytesToPrintString(c.AdditionalData))
+		p.log.Debugf("%v: '%v' AD not an IdentityKey?.", dirStr, debug.CredentialToPrintString(c.AdditionalData))
 		return nil, false, false
 	}
 	var nodeID [sConstants.NodeIDLength]byte
@@ -490,7 +550,7 @@ func (p *pki) AuthenticateConnection(c *wire.PeerCredentials, isOutgoing bool) (
 		// the most recent descriptor we have for the node.
 		if !m.LinkKey.Equal(c.PublicKey) {
 			if desc == m || !desc.LinkKey.Equal(c.PublicKey) {
-				p.log.Warningf("%v: '%v' Public Key mismatch: '%v'", dirStr, debug.BytesToPrintString(c.AdditionalData), c.PublicKey)
+				p.log.Warningf("%v: '%v' Public Key mismatch: '%v'", dirStr, debug.CredentialToPrintString(c.AdditionalData), debug.KeyToPrintString(c.PublicKey))
 				continue
 			}
 		}
@@ -533,6 +593,20 @@ func (p *pki) AuthenticateConnection(c *wire.PeerCredentials, isOutgoing bool) (
 	return
 }
 
+// OnClockJump notifies the PKI worker that the civil time jumped.
+func (p *pki) OnClockJump() {
+	select {
+	case p.jumpCh <- struct{}{}:
+	default:
+		// A notification is already pending.
+	}
+}
+
+// SetDraining stops the publication of descriptors for future epochs.
+func (p *pki) SetDraining() {
+	atomic.StoreUint32(&p.isDraining, 1)
+}
+
 func (p *pki) OutgoingDestinations() map[[sConstants.NodeIDLength]byte]*cpki.MixDescriptor {
 	docs, nowDoc, now, _ := p.documentsForAuthentication()
 	descMap := make(map[[sConstants.NodeIDLength]byte]*cpki.MixDescriptor)
@@ -574,7 +648,7 @@ func (p *pki) GetRawConsensus(epoch uint64) ([]byte, error) {
 	defer p.RUnlock()
 	val, ok := p.rawDocs[epoch]
 	if !ok {
-		now, _, _ := epochtime.Now()
+		now, _, _ := p.glue.Clock().Epoch()
 		// Return cpki.ErrNoDocument if documents will never exist.
 		if epoch < now-1 {
 			return nil, cpki.ErrNoDocument
@@ -592,6 +666,7 @@ func New(glue glue.Glue) (glue.PKI, error) {
 		docs:          make(map[uint64]*pkicache.Entry),
 		rawDocs:       make(map[uint64][]byte),
 		failedFetches: make(map[uint64]error),
+		jumpCh:        make(chan struct{}, 1),
 	}
 
 	var err error
@@ -626,8 +701,19 @@ func New(glue glue.Glue) (glue.PKI, error) {
 			return nil, err
 		}
 	}
+	if glue.Config().PKI.Static != nil {
+		if p.impl, err = newStaticClient(glue.Config().PKI.Static, glue.Config().Debug.AllowUnsignedPKI, glue.LogBackend()); err != nil {
+			return nil, err
+		}
+	}
 	// TODO: Wire in a real PKI implementation in addition to the test one.
 
+	// Load the documents persisted by a previous run, so that peers can be
+	// authenticated without waiting for the authority.
+	if p.impl != nil {
+		p.hasCachedDocs = p.loadDocuments()
+	}
+
 	// Note: This does not start the worker immediately since the worker can
 	// make calls into the connector and crypto workers (on PKI updates),
 	// which are initialized after the pki object.
@@ -0,0 +1,432 @@
+// pki_test.go - Katzenpost server PKI handler tests.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package pki
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/epochtime"
+	"github.com/katzenpost/core/log"
+	cpki "github.com/katzenpost/core/pki"
+	"github.com/katzenpost/core/wire"
+	"github.com/katzenpost/server/config"
+	"github.com/katzenpost/server/internal/clock"
+	"github.com/katzenpost/server/internal/constants"
+	"github.com/katzenpost/server/internal/glue"
+	"github.com/katzenpost/server/internal/pkicache"
+	"github.com/stretchr/testify/require"
+)
+
+const testEpoch = 1000
+
+type testGlue struct {
+	glue.Glue
+
+	cfg         *config.Config
+	clock       *clock.Fake
+	skew        *clock.Skew
+	identityKey *eddsa.PrivateKey
+	linkKeys    *testKeys
+	mixKeys     *testKeys
+	connector   *testConnector
+}
+
+func (g *testGlue) Config() *config.Config {
+	return g.cfg
+}
+
+func (g *testGlue) Clock() clock.Clock {
+	return g.clock
+}
+
+func (g *testGlue) Skew() *clock.Skew {
+	return g.skew
+}
+
+func (g *testGlue) IdentityKey() *eddsa.PrivateKey {
+	return g.identityKey
+}
+
+func (g *testGlue) LinkKeys() glue.LinkKeys {
+	return g.linkKeys
+}
+
+func (g *testGlue) MixKeys() glue.MixKeys {
+	return g.mixKeys
+}
+
+func (g *testGlue) ReshadowCryptoWorkers() {}
+
+func (g *testGlue) Connector() glue.Connector {
+	return g.connector
+}
+
+// testConnector is a glue.Connector that records forced updates.
+type testConnector struct {
+	glue.Connector
+
+	forceUpdateCh chan struct{}
+}
+
+func (c *testConnector) ForceUpdate() {
+	select {
+	case c.forceUpdateCh <- struct{}{}:
+	default:
+	}
+}
+
+// testKeys is a trivial in-memory implementation of both glue.LinkKeys and
+// glue.MixKeys, that generates constants.NumMixKeys keys at a time.
+type testKeys struct {
+	glue.MixKeys
+
+	keys map[uint64]*ecdh.PublicKey
+}
+
+func (k *testKeys) Generate(baseEpoch uint64) (bool, error) {
+	didGenerate := false
+	for e := baseEpoch; e < baseEpoch+constants.NumMixKeys; e++ {
+		if _, ok := k.keys[e]; ok {
+			continue
+		}
+		priv, err := ecdh.NewKeypair(rand.Reader)
+		if err != nil {
+			return false, err
+		}
+		k.keys[e] = priv.PublicKey()
+		didGenerate = true
+	}
+	return didGenerate, nil
+}
+
+func (k *testKeys) Prune() bool {
+	return false
+}
+
+func (k *testKeys) Get(epoch uint64) (*ecdh.PublicKey, bool) {
+	pub, ok := k.keys[epoch]
+	return pub, ok
+}
+
+// testClient is a cpki.Client that records the fetches and posted
+// descriptors, and serves doc if set.
+type testClient struct {
+	posted  map[uint64]*cpki.MixDescriptor
+	fetchCh chan uint64
+	doc     *cpki.Document
+}
+
+func (c *testClient) Get(ctx context.Context, epoch uint64) (*cpki.Document, []byte, error) {
+	select {
+	case c.fetchCh <- epoch:
+	default:
+	}
+	if c.doc != nil && c.doc.Epoch == epoch {
+		return c.doc, []byte("document"), nil
+	}
+	return nil, nil, cpki.ErrNoDocument
+}
+
+func (c *testClient) Post(ctx context.Context, epoch uint64, signingKey *eddsa.PrivateKey, d *cpki.MixDescriptor) error {
+	c.posted[epoch] = d
+	return nil
+}
+
+func (c *testClient) Deserialize(raw []byte) (*cpki.Document, error) {
+	return nil, errors.New("not implemented")
+}
+
+func newTestPKI(t *testing.T) (*pki, *testGlue, *testClient) {
+	require := require.New(t)
+
+	logBackend, err := log.New("", "ERROR", false)
+	require.NoError(err, "log.New()")
+	identityKey, err := eddsa.NewKeypair(rand.Reader)
+	require.NoError(err, "eddsa.NewKeypair()")
+
+	g := &testGlue{
+		cfg: &config.Config{
+			Server: &config.Server{
+				Identifier:   "test",
+				MaxClockSkew: 5 * 60 * 1000,
+			},
+		},
+		clock:       clock.NewFake(clock.EpochStart(testEpoch).Add(epochtime.Period / 2)),
+		identityKey: identityKey,
+		linkKeys:    &testKeys{keys: make(map[uint64]*ecdh.PublicKey)},
+		mixKeys:     &testKeys{keys: make(map[uint64]*ecdh.PublicKey)},
+		connector:   &testConnector{forceUpdateCh: make(chan struct{}, 1)},
+	}
+	g.skew = clock.NewSkew(g.clock)
+	c := &testClient{
+		posted:  make(map[uint64]*cpki.MixDescriptor),
+		fetchCh: make(chan uint64, 1),
+	}
+	p := &pki{
+		glue:          g,
+		log:           logBackend.GetLogger("pki"),
+		impl:          c,
+		descAddrMap:   map[cpki.Transport][]string{cpki.TransportTCPv4: {"127.0.0.1:29483"}},
+		docs:          make(map[uint64]*pkicache.Entry),
+		rawDocs:       make(map[uint64][]byte),
+		failedFetches: make(map[uint64]error),
+	}
+	return p, g, c
+}
+
+func TestPublishDescriptorIfNeeded(t *testing.T) {
+	require := require.New(t)
+
+	p, g, c := newTestPKI(t)
+	ctx := context.Background()
+
+	// Initial startup publishes for the current epoch, regardless of the
+	// deadline.
+	g.clock.Set(clock.EpochStart(testEpoch).Add(epochtime.Period - time.Minute))
+	require.NoError(p.publishDescriptorIfNeeded(ctx), "initial")
+	require.Equal(uint64(testEpoch), p.lastPublishedEpoch, "initial: lastPublishedEpoch")
+	desc, ok := c.posted[testEpoch]
+	require.True(ok, "initial: Post()")
+	require.Equal("test", desc.Name, "initial: Name")
+	require.True(desc.IdentityKey.Equal(g.identityKey.PublicKey()), "initial: IdentityKey")
+	require.Len(desc.MixKeys, constants.NumMixKeys, "initial: MixKeys")
+	for e := uint64(testEpoch); e < testEpoch+constants.NumMixKeys; e++ {
+		require.NotNil(desc.MixKeys[e], "initial: MixKeys[%v]", e)
+	}
+
+	// Past the deadline for the next epoch, there is an error, once.
+	require.Error(p.publishDescriptorIfNeeded(ctx), "missed deadline")
+	require.NoError(p.publishDescriptorIfNeeded(ctx), "missed deadline (debounced)")
+	require.Len(c.posted, 1, "missed deadline: Post()")
+
+	// Within the deadline for the next epoch, the next epoch is published.
+	g.clock.Set(clock.EpochStart(testEpoch).Add(time.Minute))
+	require.NoError(p.publishDescriptorIfNeeded(ctx), "next")
+	require.Equal(uint64(testEpoch+1), p.lastPublishedEpoch, "next: lastPublishedEpoch")
+	_, ok = c.posted[testEpoch+1]
+	require.True(ok, "next: Post()")
+
+	// Once the next epoch is published, there is nothing to do.
+	require.NoError(p.publishDescriptorIfNeeded(ctx), "published")
+	require.Len(c.posted, 2, "published: Post()")
+
+	// The epoch transition makes the next epoch current.
+	g.clock.Set(clock.EpochStart(testEpoch + 1).Add(time.Minute))
+	require.NoError(p.publishDescriptorIfNeeded(ctx), "transition")
+	require.Equal(uint64(testEpoch+2), p.lastPublishedEpoch, "transition: lastPublishedEpoch")
+
+	// A civil time jump results in publishing for the current epoch.
+	const jumpEpoch = testEpoch + 10
+	g.clock.Set(clock.EpochStart(jumpEpoch).Add(epochtime.Period / 2))
+	require.NoError(p.publishDescriptorIfNeeded(ctx), "jump")
+	require.Equal(uint64(jumpEpoch), p.lastPublishedEpoch, "jump: lastPublishedEpoch")
+	desc, ok = c.posted[jumpEpoch]
+	require.True(ok, "jump: Post()")
+	require.NotNil(desc.MixKeys[jumpEpoch], "jump: MixKeys")
+}
+
+func TestWorkerCachedDocuments(t *testing.T) {
+	require := require.New(t)
+
+	// With documents loaded from the on-disk cache, the connector is kicked,
+	// and the authority is queried without the initial delay.
+	p, g, c := newTestPKI(t)
+	p.jumpCh = make(chan struct{}, 1)
+	p.hasCachedDocs = true
+	p.StartWorker()
+	defer p.Halt()
+
+	select {
+	case <-g.connector.forceUpdateCh:
+	case <-time.After(time.Second):
+		require.Fail("ForceUpdate() not called")
+	}
+	select {
+	case <-c.fetchCh:
+	case <-time.After(time.Second):
+		require.Fail("Get() not called")
+	}
+}
+
+func TestPublishDescriptorClockSkew(t *testing.T) {
+	require := require.New(t)
+
+	p, g, c := newTestPKI(t)
+	ctx := context.Background()
+
+	// The authority served the document for the current epoch, and then
+	// the civil time jumped 2 epochs ahead, which exceeds the bound.
+	g.skew.ObserveDocument(testEpoch, g.clock.Now())
+	g.clock.Set(g.clock.Now().Add(2 * epochtime.Period))
+	g.skew.OnJump(2 * epochtime.Period)
+	require.Error(p.publishDescriptorIfNeeded(ctx), "excessive skew")
+	require.Len(c.posted, 0, "excessive skew: Post()")
+
+	// Once the civil time is corrected, publication resumes.
+	g.clock.Set(g.clock.Now().Add(-2 * epochtime.Period))
+	g.skew.OnJump(-2 * epochtime.Period)
+	require.NoError(p.publishDescriptorIfNeeded(ctx), "corrected skew")
+	require.Len(c.posted, 1, "corrected skew: Post()")
+}
+
+func TestWorkerRejectedDocument(t *testing.T) {
+	require := require.New(t)
+
+	p, g, c := newTestPKI(t)
+	p.jumpCh = make(chan struct{}, 1)
+	p.hasCachedDocs = true
+
+	// The document for the current epoch does not list this node, so it is
+	// rejected, and the reason is available, unlike for the previous epoch,
+	// which was not published.
+	peerIdentityKey, err := eddsa.NewKeypair(rand.Reader)
+	require.NoError(err, "eddsa.NewKeypair()")
+	c.doc = &cpki.Document{
+		Epoch:     testEpoch,
+		Providers: []*cpki.MixDescriptor{{Name: "peer", IdentityKey: peerIdentityKey.PublicKey(), Layer: cpki.LayerProvider}},
+	}
+	p.StartWorker()
+	defer p.Halt()
+
+	for deadline := time.Now().Add(time.Second); p.FailedFetch(testEpoch) == nil; {
+		require.True(time.Now().Before(deadline), "FailedFetch(): not set")
+		time.Sleep(10 * time.Millisecond)
+	}
+	err = p.FailedFetch(testEpoch)
+	require.NotEqual(cpki.ErrNoDocument, err, "FailedFetch(): rejected")
+	require.Nil(p.EntryForEpoch(testEpoch), "EntryForEpoch(): rejected")
+
+	// The rejected document still bounds the authority's civil time.
+	status, _ := g.skew.Status(time.Minute)
+	require.Equal(clock.SkewOk, status, "Skew: rejected")
+	for deadline := time.Now().Add(time.Second); p.FailedFetch(testEpoch-1) == nil; {
+		require.True(time.Now().Before(deadline), "FailedFetch(): previous epoch not set")
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(cpki.ErrNoDocument, p.FailedFetch(testEpoch-1), "FailedFetch(): not published")
+}
+
+func TestAuthenticateConnection(t *testing.T) {
+	require := require.New(t)
+
+	p, g, _ := newTestPKI(t)
+
+	newDesc := func(name string, idKey *eddsa.PublicKey, layer uint8) (*cpki.MixDescriptor, *ecdh.PrivateKey) {
+		linkKey, err := ecdh.NewKeypair(rand.Reader)
+		require.NoError(err, "ecdh.NewKeypair()")
+		return &cpki.MixDescriptor{
+			Name:        name,
+			IdentityKey: idKey,
+			LinkKey:     linkKey.PublicKey(),
+			Layer:       layer,
+		}, linkKey
+	}
+
+	// The node under test is the only mix in a single layer topology, so
+	// the provider is both an incoming and outgoing peer.
+	selfDesc, _ := newDesc("self", g.identityKey.PublicKey(), 0)
+	peerIdentityKey, err := eddsa.NewKeypair(rand.Reader)
+	require.NoError(err, "eddsa.NewKeypair()")
+	peerDesc, peerLinkKey := newDesc("peer", peerIdentityKey.PublicKey(), cpki.LayerProvider)
+
+	setDocs := func(epochs map[uint64]bool) {
+		p.docs = make(map[uint64]*pkicache.Entry)
+		for epoch, withPeer := range epochs {
+			doc := &cpki.Document{
+				Epoch:    epoch,
+				Topology: [][]*cpki.MixDescriptor{{selfDesc}},
+			}
+			if withPeer {
+				doc.Providers = []*cpki.MixDescriptor{peerDesc}
+			}
+			ent, err := pkicache.New(doc, g.identityKey.PublicKey(), false)
+			require.NoError(err, "pkicache.New()")
+			p.docs[epoch] = ent
+		}
+	}
+	peerCreds := &wire.PeerCredentials{
+		AdditionalData: peerIdentityKey.PublicKey().Bytes(),
+		PublicKey:      peerLinkKey.PublicKey(),
+	}
+	midEpoch := clock.EpochStart(testEpoch).Add(epochtime.Period / 2)
+	nextEpoch := clock.EpochStart(testEpoch + 1)
+
+	for _, v := range []struct {
+		name       string
+		at         time.Time
+		docs       map[uint64]bool
+		isOutgoing bool
+		canSend    bool
+		isValid    bool
+	}{
+		{"current", midEpoch, map[uint64]bool{testEpoch: true}, false, true, true},
+		{"current (outgoing)", midEpoch, map[uint64]bool{testEpoch: true}, true, true, true},
+		{"not listed", midEpoch, map[uint64]bool{testEpoch: false}, false, false, false},
+		{"no documents", midEpoch, map[uint64]bool{}, false, false, false},
+
+		// The next epoch's document is only considered close to the
+		// transition, and is only used to send after the early send
+		// slack for incoming connections.
+		{"next (mid epoch)", midEpoch, map[uint64]bool{testEpoch: false, testEpoch + 1: true}, false, false, false},
+		{"next (early connect)", nextEpoch.Add(-10 * time.Minute), map[uint64]bool{testEpoch: false, testEpoch + 1: true}, false, false, true},
+		{"next (early send)", nextEpoch.Add(-time.Minute), map[uint64]bool{testEpoch: false, testEpoch + 1: true}, false, true, true},
+		{"next (early send, outgoing)", nextEpoch.Add(-time.Minute), map[uint64]bool{testEpoch: false, testEpoch + 1: true}, true, false, true},
+
+		// Nodes listed in previous epochs are honored iff they are still
+		// listed in the current epoch's document.
+		{"previous (still listed)", midEpoch, map[uint64]bool{testEpoch - 1: true, testEpoch: true}, false, true, true},
+		{"previous (delisted)", midEpoch, map[uint64]bool{testEpoch - 1: true, testEpoch: false}, false, false, false},
+		{"previous (no current)", midEpoch, map[uint64]bool{testEpoch - 1: true}, false, false, false},
+	} {
+		g.clock.Set(v.at)
+		setDocs(v.docs)
+		desc, canSend, isValid := p.AuthenticateConnection(peerCreds, v.isOutgoing)
+		require.Equal(v.canSend, canSend, "%v: canSend", v.name)
+		require.Equal(v.isValid, isValid, "%v: isValid", v.name)
+		if v.isValid {
+			require.Equal(peerDesc, desc, "%v: desc", v.name)
+		}
+	}
+
+	// The link key must match the descriptor.
+	g.clock.Set(midEpoch)
+	setDocs(map[uint64]bool{testEpoch: true})
+	badLinkKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err, "ecdh.NewKeypair()")
+	badCreds := &wire.PeerCredentials{
+		AdditionalData: peerCreds.AdditionalData,
+		PublicKey:      badLinkKey.PublicKey(),
+	}
+	_, canSend, isValid := p.AuthenticateConnection(badCreds, false)
+	require.False(canSend, "link key mismatch: canSend")
+	require.False(isValid, "link key mismatch: isValid")
+
+	// The additional data must be an identity key.
+	badCreds = &wire.PeerCredentials{
+		AdditionalData: []byte("alice"),
+		PublicKey:      peerCreds.PublicKey,
+	}
+	_, canSend, isValid = p.AuthenticateConnection(badCreds, false)
+	require.False(canSend, "bad AD: canSend")
+	require.False(isValid, "bad AD: isValid")
+}
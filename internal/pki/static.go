@@ -0,0 +1,162 @@
+// static.go - Katzenpost server file based static PKI backend.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package pki
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	nClient "github.com/katzenpost/authority/nonvoting/client"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/log"
+	cpki "github.com/katzenpost/core/pki"
+	"github.com/katzenpost/server/config"
+	"gopkg.in/op/go-logging.v1"
+)
+
+const (
+	// StaticDocumentFmt is the format string corresponding to the filenames
+	// of the documents read by the static PKI backend.
+	StaticDocumentFmt = "document-%d"
+
+	// StaticDescriptorFmt is the format string corresponding to the filenames
+	// of the descriptors written by the static PKI backend, by epoch and
+	// hex encoded identity key.
+	StaticDescriptorFmt = "descriptor-%d-%s.json"
+
+	// The (unreachable) authority address used to construct the document
+	// verifier, which is never dialed.
+	staticVerifierAddress = "127.0.0.1:1"
+)
+
+// StaticDescriptor is the descriptor envelope written by the static PKI
+// backend.
+type StaticDescriptor struct {
+	// Descriptor is the JSON serialized descriptor.
+	Descriptor json.RawMessage
+
+	// Signature is the descriptor's signing key signature over Descriptor.
+	Signature []byte
+}
+
+type staticClient struct {
+	cfg *config.Static
+	log *logging.Logger
+
+	// verifier is used to verify and parse signed documents, and is nil if
+	// documents are unsigned.
+	verifier cpki.Client
+}
+
+func (c *staticClient) Get(ctx context.Context, epoch uint64) (*cpki.Document, []byte, error) {
+	f := filepath.Join(c.cfg.DocumentDir, fmt.Sprintf(StaticDocumentFmt, epoch))
+	rawDoc, err := ioutil.ReadFile(f)
+	if err != nil {
+		// A missing document is not treated as cpki.ErrNoDocument, since
+		// the document may be written at any time.
+		return nil, nil, err
+	}
+	d, err := c.Deserialize(rawDoc)
+	if err != nil {
+		return nil, nil, err
+	}
+	if d.Epoch != epoch {
+		return nil, nil, fmt.Errorf("pki/static: document epoch mismatch: %v", d.Epoch)
+	}
+	return d, rawDoc, nil
+}
+
+func (c *staticClient) Post(ctx context.Context, epoch uint64, signingKey *eddsa.PrivateKey, d *cpki.MixDescriptor) error {
+	// Ensure that the descriptor is signed by the descriptor's key.
+	if !signingKey.PublicKey().Equal(d.IdentityKey) {
+		return fmt.Errorf("pki/static: descriptor signing key mismatch")
+	}
+
+	b, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	b, err = json.Marshal(&StaticDescriptor{
+		Descriptor: b,
+		Signature:  signingKey.Sign(b),
+	})
+	if err != nil {
+		return err
+	}
+
+	fn := fmt.Sprintf(StaticDescriptorFmt, epoch, hex.EncodeToString(d.IdentityKey.Bytes()))
+	f := filepath.Join(c.cfg.DescriptorDir, fn)
+	tmp := f + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err = os.Rename(tmp, f); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	c.log.Debugf("Wrote descriptor for epoch %v: %v", epoch, f)
+
+	return nil
+}
+
+func (c *staticClient) Deserialize(raw []byte) (*cpki.Document, error) {
+	if c.verifier != nil {
+		return c.verifier.Deserialize(raw)
+	}
+
+	// Unsigned documents are just JSON serialized.
+	d := new(cpki.Document)
+	if err := json.Unmarshal(raw, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func newStaticClient(cfg *config.Static, allowUnsigned bool, logBackend *log.Backend) (cpki.Client, error) {
+	c := &staticClient{
+		cfg: cfg,
+		log: logBackend.GetLogger("pki/static"),
+	}
+
+	if allowUnsigned {
+		c.log.Warningf("Unsigned PKI documents are accepted, this is only suitable for testing.")
+		return c, nil
+	}
+
+	// Signed documents use the same format as the non-voting authority,
+	// so reuse the client's verification.
+	pubKey := new(eddsa.PublicKey)
+	if err := pubKey.FromString(cfg.PublicKey); err != nil {
+		return nil, fmt.Errorf("BUG: pki/static: Failed to deserialize validated public key: %v", err)
+	}
+	var err error
+	c.verifier, err = nClient.New(&nClient.Config{
+		LogBackend: logBackend,
+		Address:    staticVerifierAddress,
+		PublicKey:  pubKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
@@ -0,0 +1,125 @@
+// kaetzchen_test.go - Kaetzchen test helpers.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package kaetzchen
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/log"
+	"github.com/katzenpost/server/config"
+	"github.com/katzenpost/server/internal/clock"
+	"github.com/katzenpost/server/internal/glue"
+	"github.com/katzenpost/server/internal/translog"
+	"github.com/katzenpost/server/userdb"
+	"github.com/katzenpost/server/userdb/boltuserdb"
+	"github.com/stretchr/testify/require"
+)
+
+type testProvider struct {
+	glue.Provider
+
+	userDB      userdb.UserDB
+	identityLog *translog.Log
+}
+
+func (p *testProvider) UserDB() userdb.UserDB {
+	return p.userDB
+}
+
+func (p *testProvider) IdentityLog() *translog.Log {
+	return p.identityLog
+}
+
+type testGlue struct {
+	glue.Glue
+
+	cfg         *config.Config
+	logBackend  *log.Backend
+	clock       *clock.Fake
+	identityKey *eddsa.PrivateKey
+	provider    *testProvider
+}
+
+func (g *testGlue) Config() *config.Config {
+	return g.cfg
+}
+
+func (g *testGlue) LogBackend() *log.Backend {
+	return g.logBackend
+}
+
+func (g *testGlue) Clock() clock.Clock {
+	return g.clock
+}
+
+func (g *testGlue) IdentityKey() *eddsa.PrivateKey {
+	return g.identityKey
+}
+
+func (g *testGlue) Provider() glue.Provider {
+	return g.provider
+}
+
+// newTestGlue returns a testGlue, backed by a user database and identity log
+// in a temporary directory, and a function that cleans it up.
+func newTestGlue(t *testing.T) (*testGlue, func()) {
+	require := require.New(t)
+
+	logBackend, err := log.New("", "ERROR", false)
+	require.NoError(err, "log.New()")
+	identityKey, err := eddsa.NewKeypair(rand.Reader)
+	require.NoError(err, "eddsa.NewKeypair()")
+
+	dir, err := ioutil.TempDir("", "kaetzchen_test")
+	require.NoError(err, "TempDir()")
+	db, err := boltuserdb.New(filepath.Join(dir, "users.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+	}
+	require.NoError(err, "boltuserdb.New()")
+	idLog, err := translog.New(filepath.Join(dir, translog.LogFile))
+	if err != nil {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+	require.NoError(err, "translog.New()")
+
+	g := &testGlue{
+		cfg: &config.Config{
+			Server: &config.Server{
+				Identifier: "provider.example.com",
+				DataDir:    dir,
+				IsProvider: true,
+			},
+		},
+		logBackend:  logBackend,
+		clock:       clock.NewFake(time.Unix(1500000000, 0)),
+		identityKey: identityKey,
+		provider:    &testProvider{userDB: db, identityLog: idLog},
+	}
+	return g, func() {
+		idLog.Close()
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
@@ -20,7 +20,9 @@ import (
 	"bytes"
 
 	"github.com/katzenpost/server/config"
+	"github.com/katzenpost/server/internal/debug"
 	"github.com/katzenpost/server/internal/glue"
+	"github.com/katzenpost/server/internal/translog"
 	"github.com/katzenpost/server/userdb"
 	"github.com/ugorji/go/codec"
 	"gopkg.in/op/go-logging.v1"
@@ -28,7 +30,30 @@ import (
 
 const (
 	keyserverCapability = "keyserver"
-	keyserverVersion    = 0
+
+	// keyserverVersion0 requests query a single user, and the response is
+	// not signed.
+	keyserverVersion0 = 0
+
+	// keyserverVersion1 requests query up to keyserverMaxUsers users, and
+	// the response is signed by the provider's identity key.
+	keyserverVersion1 = 1
+
+	// keyserverVersion2 requests are as version 1, and the response also
+	// includes the signed identity log head, and a log inclusion proof for
+	// each identity key.
+	keyserverVersion2 = 2
+
+	keyserverMaxUsers = 16
+
+	// keyserverSignatureContext, keyserverSignatureContextV2 and
+	// keyserverLogHeadSignatureContext are prepended to the signed data,
+	// for domain separation.
+	keyserverSignatureContext        = "katzenpost-keyserver-response-v1:"
+	keyserverSignatureContextV2      = "katzenpost-keyserver-response-v2:"
+	keyserverLogHeadSignatureContext = "katzenpost-keyserver-log-head-v1:"
+
+	keyserverParameterVersions = "versions"
 
 	keyserverStatusOk          = 0
 	keyserverStatusSyntaxError = 1
@@ -37,7 +62,8 @@ const (
 
 type keyserverRequest struct {
 	Version int
-	User    string
+	User    string   // Version 0 only.
+	Users   []string // Version 1 and later.
 }
 
 type keyserverResponse struct {
@@ -47,6 +73,75 @@ type keyserverResponse struct {
 	PublicKey  string
 }
 
+// keyserverSignedResponse is the version 1 response, where Payload is the
+// canonical JSON encoding of a keyserverResponseV1, and Signature is the
+// provider's identity key signature over keyserverSignatureContext
+// concatenated with Payload.
+type keyserverSignedResponse struct {
+	Version   int
+	Payload   []byte
+	Signature []byte
+}
+
+type keyserverResponseV1 struct {
+	Version    int
+	StatusCode int
+	Provider   string
+	Epoch      uint64
+	Entries    []keyserverEntry
+}
+
+type keyserverEntry struct {
+	User       string
+	StatusCode int
+	PublicKey  string
+
+	// CreatedAt is the time the identity key was set, in seconds since the
+	// UNIX epoch, or 0 if unknown.
+	CreatedAt int64
+}
+
+// keyserverResponseV2 is the version 2 response payload, where LogHead is
+// the canonical JSON encoding of a keyserverLogHead, and LogHeadSignature
+// is the provider's identity key signature over
+// keyserverLogHeadSignatureContext concatenated with LogHead.  The log head
+// is signed separately from the response so that clients may share it with
+// each other to detect a provider presenting different logs.
+type keyserverResponseV2 struct {
+	Version          int
+	StatusCode       int
+	Provider         string
+	Epoch            uint64
+	LogHead          []byte
+	LogHeadSignature []byte
+	Entries          []keyserverEntryV2
+}
+
+type keyserverLogHead struct {
+	Provider string
+	TreeSize uint64
+	RootHash []byte
+
+	// Timestamp is the time the head was taken, in seconds since the UNIX
+	// epoch.
+	Timestamp int64
+}
+
+type keyserverEntryV2 struct {
+	User       string
+	StatusCode int
+	PublicKey  string
+	CreatedAt  int64
+
+	// LogEntry is the serialized log entry for the identity key, which is
+	// at LogIndex, and InclusionProof is it's audit path in the tree
+	// described by the log head.  LogEntry is empty if the identity key
+	// has not been logged.
+	LogIndex       uint64
+	LogEntry       []byte
+	InclusionProof [][]byte
+}
+
 type kaetzchenKeyserver struct {
 	log  *logging.Logger
 	glue glue.Glue
@@ -70,7 +165,7 @@ func (k *kaetzchenKeyserver) OnRequest(id uint64, payload []byte, hasSURB bool)
 
 	k.log.Debugf("Handling request: %v", id)
 	resp := keyserverResponse{
-		Version:    keyserverVersion,
+		Version:    keyserverVersion0,
 		StatusCode: keyserverStatusSyntaxError,
 	}
 
@@ -79,44 +174,202 @@ func (k *kaetzchenKeyserver) OnRequest(id uint64, payload []byte, hasSURB bool)
 	dec := codec.NewDecoderBytes(bytes.TrimRight(payload, "\x00"), &k.jsonHandle)
 	if err := dec.Decode(&req); err != nil {
 		k.log.Debugf("Failed to decode request: %v (%v)", id, err)
-		return k.encodeResp(&resp), nil
+		return k.encode(&resp), nil
 	}
-	if req.Version != keyserverVersion {
+	switch req.Version {
+	case keyserverVersion0:
+	case keyserverVersion1:
+		return k.onRequestV1(id, &req), nil
+	case keyserverVersion2:
+		return k.onRequestV2(id, &req), nil
+	default:
 		k.log.Debugf("Failed to parse request: %v (invalid version: %v)", id, req.Version)
-		return k.encodeResp(&resp), nil
+		return k.encode(&resp), nil
+	}
+	if req.Users != nil {
+		k.log.Debugf("Failed to parse request: %v (Users set in version 0)", id)
+		return k.encode(&resp), nil
 	}
 	resp.User = req.User
 
 	// Query the public key.
-	pubKey, err := k.glue.Provider().UserDB().Identity([]byte(req.User))
+	ent := k.lookup(id, req.User)
+	resp.StatusCode = ent.StatusCode
+	resp.PublicKey = ent.PublicKey
+
+	return k.encode(&resp), nil
+}
+
+func (k *kaetzchenKeyserver) onRequestV1(id uint64, req *keyserverRequest) []byte {
+	epoch, _, _ := k.glue.Clock().Epoch()
+	resp := keyserverResponseV1{
+		Version:    keyserverVersion1,
+		StatusCode: keyserverStatusSyntaxError,
+		Provider:   k.glue.Config().Server.Identifier,
+		Epoch:      epoch,
+	}
+
+	if k.validateUsers(id, req) {
+		resp.StatusCode = keyserverStatusOk
+		resp.Entries = make([]keyserverEntry, 0, len(req.Users))
+		for _, v := range req.Users {
+			resp.Entries = append(resp.Entries, k.lookup(id, v))
+		}
+	}
+
+	return k.encodeSigned(keyserverVersion1, keyserverSignatureContext, &resp)
+}
+
+func (k *kaetzchenKeyserver) onRequestV2(id uint64, req *keyserverRequest) []byte {
+	epoch, _, _ := k.glue.Clock().Epoch()
+	resp := keyserverResponseV2{
+		Version:    keyserverVersion2,
+		StatusCode: keyserverStatusSyntaxError,
+		Provider:   k.glue.Config().Server.Identifier,
+		Epoch:      epoch,
+	}
+
+	// The head is taken before the lookups, so that every proof is against
+	// the same tree, even if the log is appended to in the meantime.
+	idLog := k.glue.Provider().IdentityLog()
+	head := idLog.Head()
+	rawHead := k.encode(&keyserverLogHead{
+		Provider:  resp.Provider,
+		TreeSize:  head.Size,
+		RootHash:  head.Root,
+		Timestamp: k.glue.Clock().Now().Unix(),
+	})
+	resp.LogHead = rawHead
+	resp.LogHeadSignature = k.glue.IdentityKey().Sign(keyserverSignedMessage(keyserverLogHeadSignatureContext, rawHead))
+
+	if k.validateUsers(id, req) {
+		resp.StatusCode = keyserverStatusOk
+		resp.Entries = make([]keyserverEntryV2, 0, len(req.Users))
+		for _, v := range req.Users {
+			resp.Entries = append(resp.Entries, k.lookupWithProof(id, v, idLog, head))
+		}
+	}
+
+	return k.encodeSigned(keyserverVersion2, keyserverSignatureContextV2, &resp)
+}
+
+func (k *kaetzchenKeyserver) validateUsers(id uint64, req *keyserverRequest) bool {
+	switch {
+	case req.User != "":
+		k.log.Debugf("Failed to parse request: %v (User set in version %v)", id, req.Version)
+	case len(req.Users) == 0 || len(req.Users) > keyserverMaxUsers:
+		k.log.Debugf("Failed to parse request: %v (invalid number of users: %v)", id, len(req.Users))
+	default:
+		return true
+	}
+	return false
+}
+
+func (k *kaetzchenKeyserver) lookupWithProof(id uint64, user string, idLog *translog.Log, head *translog.Head) keyserverEntryV2 {
+	ent := k.lookup(id, user)
+	entV2 := keyserverEntryV2{
+		User:       ent.User,
+		StatusCode: ent.StatusCode,
+		PublicKey:  ent.PublicKey,
+		CreatedAt:  ent.CreatedAt,
+	}
+	if ent.StatusCode != keyserverStatusOk {
+		return entV2
+	}
+
+	// Only prove the most recent log entry, and only if it is for the
+	// identity key being served.  A change that has yet to be logged, for
+	// example with a UserDB that can not list users, has no entry.
+	u := []byte(user)
+	idx, ok := idLog.Latest(u)
+	if !ok || idx >= head.Size {
+		return entV2
+	}
+	rawEnt, err := idLog.Entry(idx)
+	if err != nil {
+		k.log.Debugf("Failed to query identity log: %v '%v' (%v)", id, debug.UserToPrintString(u), err)
+		return entV2
+	}
+	var logEnt translog.Entry
+	if err = logEnt.UnmarshalBinary(rawEnt); err != nil {
+		k.log.Debugf("Failed to parse identity log entry: %v %v (%v)", id, idx, err)
+		return entV2
+	}
+	pubKey, err := k.glue.Provider().UserDB().Identity(u)
+	if err != nil || !bytes.Equal(logEnt.PublicKey, pubKey.Bytes()) {
+		k.log.Debugf("Identity log entry does not match: %v '%v'", id, debug.UserToPrintString(u))
+		return entV2
+	}
+	proof, err := idLog.InclusionProof(idx, head.Size)
+	if err != nil {
+		k.log.Debugf("Failed to generate inclusion proof: %v %v (%v)", id, idx, err)
+		return entV2
+	}
+
+	entV2.LogIndex = idx
+	entV2.LogEntry = rawEnt
+	entV2.InclusionProof = proof
+	return entV2
+}
+
+func (k *kaetzchenKeyserver) lookup(id uint64, user string) keyserverEntry {
+	ent := keyserverEntry{
+		User:       user,
+		StatusCode: keyserverStatusNoIdentity,
+	}
+
+	u := []byte(user)
+	db := k.glue.Provider().UserDB()
+	pubKey, err := db.Identity(u)
 	switch err {
 	case nil:
-		resp.StatusCode = keyserverStatusOk
-		resp.PublicKey = pubKey.String()
+		ent.StatusCode = keyserverStatusOk
+		ent.PublicKey = pubKey.String()
 	case userdb.ErrNoSuchUser, userdb.ErrNoIdentity:
 		// Treat the user being missing as the user not having an
 		// identity key to make enumeration attacks minutely harder.
-		resp.StatusCode = keyserverStatusNoIdentity
 	default:
-	}
-	if err != nil {
 		k.log.Debugf("Failed to service request: %v (%v)", id, err)
+		ent.StatusCode = keyserverStatusSyntaxError
+		return ent
 	}
 
-	return k.encodeResp(&resp), nil
+	if tDB, ok := db.(userdb.IdentityTimeDB); ok && err == nil {
+		t, err := tDB.IdentityTime(u)
+		switch {
+		case err != nil:
+			k.log.Debugf("Failed to query identity time: %v '%v' (%v)", id, debug.UserToPrintString(u), err)
+		case !t.IsZero():
+			ent.CreatedAt = t.Unix()
+		}
+	}
+	return ent
 }
 
 func (k *kaetzchenKeyserver) Halt() {
 	// No termination required.
 }
 
-func (k *kaetzchenKeyserver) encodeResp(resp *keyserverResponse) []byte {
+func (k *kaetzchenKeyserver) encodeSigned(version int, ctx string, resp interface{}) []byte {
+	rawResp := k.encode(resp)
+	return k.encode(&keyserverSignedResponse{
+		Version:   version,
+		Payload:   rawResp,
+		Signature: k.glue.IdentityKey().Sign(keyserverSignedMessage(ctx, rawResp)),
+	})
+}
+
+func (k *kaetzchenKeyserver) encode(v interface{}) []byte {
 	var out []byte
 	enc := codec.NewEncoderBytes(&out, &k.jsonHandle)
-	enc.Encode(resp)
+	enc.Encode(v)
 	return out
 }
 
+func keyserverSignedMessage(ctx string, payload []byte) []byte {
+	return append([]byte(ctx), payload...)
+}
+
 // NewKeyserver constructs a new Keyserver Kaetzchen instance, providing the
 // "keyserver" capability on the configured endpoint.
 func NewKeyserver(cfg *config.Kaetzchen, glue glue.Glue) (Kaetzchen, error) {
@@ -128,6 +381,7 @@ func NewKeyserver(cfg *config.Kaetzchen, glue glue.Glue) (Kaetzchen, error) {
 	k.jsonHandle.Canonical = true
 	k.jsonHandle.ErrorIfNoField = true
 	k.params[ParameterEndpoint] = cfg.Endpoint
+	k.params[keyserverParameterVersions] = []int{keyserverVersion0, keyserverVersion1, keyserverVersion2}
 
 	return k, nil
 }
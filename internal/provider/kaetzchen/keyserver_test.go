@@ -0,0 +1,214 @@
+// keyserver_test.go - Keyserver Kaetzchen tests.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package kaetzchen
+
+import (
+	"testing"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/server/config"
+	"github.com/katzenpost/server/internal/translog"
+	"github.com/stretchr/testify/require"
+	"github.com/ugorji/go/codec"
+)
+
+func TestKeyserver(t *testing.T) {
+	require := require.New(t)
+
+	g, cleanupFn := newTestGlue(t)
+	defer cleanupFn()
+	k, err := NewKeyserver(&config.Kaetzchen{Endpoint: "+keyserver"}, g)
+	require.NoError(err, "NewKeyserver()")
+	require.Equal([]int{0, 1, 2}, k.Parameters()[keyserverParameterVersions], "Parameters()")
+
+	// Populate the user database.
+	db := g.provider.userDB
+	linkKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err, "ecdh.NewKeypair()")
+	identityKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err, "ecdh.NewKeypair()")
+	for _, u := range []string{"alice", "bob"} {
+		require.NoError(db.Add([]byte(u), linkKey.PublicKey(), false), "Add(%v)", u)
+	}
+	require.NoError(db.SetIdentity([]byte("alice"), identityKey.PublicKey()), "SetIdentity()")
+
+	var jsonHandle codec.JsonHandle
+	jsonHandle.Canonical = true
+	jsonHandle.ErrorIfNoField = true
+	encode := func(v interface{}) []byte {
+		var out []byte
+		require.NoError(codec.NewEncoderBytes(&out, &jsonHandle).Encode(v), "Encode()")
+		// Requests are padded to the full payload size.
+		return append(out, make([]byte, 64)...)
+	}
+	decode := func(b []byte, v interface{}) {
+		require.NoError(codec.NewDecoderBytes(b, &jsonHandle).Decode(v), "Decode()")
+	}
+
+	t.Run("Version0", func(t *testing.T) {
+		require := require.New(t)
+
+		b, err := k.OnRequest(1, encode(&keyserverRequest{Version: 0, User: "alice"}), true)
+		require.NoError(err, "OnRequest()")
+		var resp keyserverResponse
+		decode(b, &resp)
+		require.Equal(keyserverResponse{
+			Version:    0,
+			StatusCode: keyserverStatusOk,
+			User:       "alice",
+			PublicKey:  identityKey.PublicKey().String(),
+		}, resp, "OnRequest(): alice")
+
+		b, err = k.OnRequest(2, encode(&keyserverRequest{Version: 0, User: "bob"}), true)
+		require.NoError(err, "OnRequest()")
+		resp = keyserverResponse{}
+		decode(b, &resp)
+		require.Equal(keyserverStatusNoIdentity, resp.StatusCode, "OnRequest(): bob")
+
+		b, err = k.OnRequest(3, encode(&keyserverRequest{Version: 0, Users: []string{"alice"}}), true)
+		require.NoError(err, "OnRequest()")
+		resp = keyserverResponse{}
+		decode(b, &resp)
+		require.Equal(keyserverStatusSyntaxError, resp.StatusCode, "OnRequest(): Users")
+
+		_, err = k.OnRequest(4, encode(&keyserverRequest{Version: 0, User: "alice"}), false)
+		require.Equal(ErrNoResponse, err, "OnRequest(): No SURB")
+	})
+
+	t.Run("Version1", func(t *testing.T) {
+		require := require.New(t)
+
+		query := func(id uint64, req *keyserverRequest) *keyserverResponseV1 {
+			b, err := k.OnRequest(id, encode(req), true)
+			require.NoError(err, "OnRequest()")
+
+			var signed keyserverSignedResponse
+			decode(b, &signed)
+			require.Equal(keyserverVersion1, signed.Version, "Signed: Version")
+			require.True(g.identityKey.PublicKey().Verify(signed.Signature, keyserverSignedMessage(keyserverSignatureContext, signed.Payload)), "Signed: Verify()")
+
+			var resp keyserverResponseV1
+			decode(signed.Payload, &resp)
+			require.Equal(keyserverVersion1, resp.Version, "Version")
+			require.Equal("provider.example.com", resp.Provider, "Provider")
+			epoch, _, _ := g.clock.Epoch()
+			require.Equal(epoch, resp.Epoch, "Epoch")
+			return &resp
+		}
+
+		resp := query(5, &keyserverRequest{Version: 1, Users: []string{"alice", "bob", "mallory"}})
+		require.Equal(keyserverStatusOk, resp.StatusCode, "StatusCode")
+		require.Len(resp.Entries, 3, "Entries")
+		require.Equal("alice", resp.Entries[0].User, "alice: User")
+		require.Equal(keyserverStatusOk, resp.Entries[0].StatusCode, "alice: StatusCode")
+		require.Equal(identityKey.PublicKey().String(), resp.Entries[0].PublicKey, "alice: PublicKey")
+		require.NotZero(resp.Entries[0].CreatedAt, "alice: CreatedAt")
+		for _, v := range resp.Entries[1:] {
+			require.Equal(keyserverStatusNoIdentity, v.StatusCode, "%v: StatusCode", v.User)
+			require.Empty(v.PublicKey, "%v: PublicKey", v.User)
+			require.Zero(v.CreatedAt, "%v: CreatedAt", v.User)
+		}
+
+		// Invalid requests still get a signed response.
+		resp = query(6, &keyserverRequest{Version: 1})
+		require.Equal(keyserverStatusSyntaxError, resp.StatusCode, "No users: StatusCode")
+		users := make([]string, keyserverMaxUsers+1)
+		for i := range users {
+			users[i] = "alice"
+		}
+		resp = query(7, &keyserverRequest{Version: 1, Users: users})
+		require.Equal(keyserverStatusSyntaxError, resp.StatusCode, "Too many users: StatusCode")
+		require.Empty(resp.Entries, "Too many users: Entries")
+
+		// Tampering with the payload invalidates the signature.
+		b, err := k.OnRequest(8, encode(&keyserverRequest{Version: 1, Users: []string{"alice"}}), true)
+		require.NoError(err, "OnRequest()")
+		var signed keyserverSignedResponse
+		decode(b, &signed)
+		signed.Payload[len(signed.Payload)-2] ^= 0x01
+		require.False(g.identityKey.PublicKey().Verify(signed.Signature, keyserverSignedMessage(keyserverSignatureContext, signed.Payload)), "Tampered: Verify()")
+	})
+
+	t.Run("Version2", func(t *testing.T) {
+		require := require.New(t)
+
+		// alice's current key is logged, carol's log entry is for a
+		// previous key, and bob has no identity key.
+		oldKey, err := ecdh.NewKeypair(rand.Reader)
+		require.NoError(err, "ecdh.NewKeypair()")
+		require.NoError(db.Add([]byte("carol"), linkKey.PublicKey(), false), "Add(carol)")
+		require.NoError(db.SetIdentity([]byte("carol"), identityKey.PublicKey()), "SetIdentity(carol)")
+		idLog := g.provider.identityLog
+		for _, v := range []*translog.Entry{
+			{User: []byte("alice"), PublicKey: oldKey.PublicKey().Bytes(), Time: 1400000000},
+			{User: []byte("carol"), PublicKey: oldKey.PublicKey().Bytes(), Time: 1400000001},
+			{User: []byte("alice"), PublicKey: identityKey.PublicKey().Bytes(), Time: 1400000002},
+		} {
+			_, err = idLog.Append(v)
+			require.NoError(err, "Append()")
+		}
+
+		b, err := k.OnRequest(9, encode(&keyserverRequest{Version: 2, Users: []string{"alice", "bob", "carol"}}), true)
+		require.NoError(err, "OnRequest()")
+		var signed keyserverSignedResponse
+		decode(b, &signed)
+		require.Equal(keyserverVersion2, signed.Version, "Signed: Version")
+		require.True(g.identityKey.PublicKey().Verify(signed.Signature, keyserverSignedMessage(keyserverSignatureContextV2, signed.Payload)), "Signed: Verify()")
+		require.False(g.identityKey.PublicKey().Verify(signed.Signature, keyserverSignedMessage(keyserverSignatureContext, signed.Payload)), "Signed: Verify(): Version 1 context")
+
+		var resp keyserverResponseV2
+		decode(signed.Payload, &resp)
+		require.Equal(keyserverStatusOk, resp.StatusCode, "StatusCode")
+		require.Len(resp.Entries, 3, "Entries")
+
+		// The log head is signed separately.
+		require.True(g.identityKey.PublicKey().Verify(resp.LogHeadSignature, keyserverSignedMessage(keyserverLogHeadSignatureContext, resp.LogHead)), "LogHead: Verify()")
+		var head keyserverLogHead
+		decode(resp.LogHead, &head)
+		require.Equal("provider.example.com", head.Provider, "LogHead: Provider")
+		require.Equal(uint64(3), head.TreeSize, "LogHead: TreeSize")
+		require.Equal(idLog.Head().Root, head.RootHash, "LogHead: RootHash")
+		require.Equal(int64(1500000000), head.Timestamp, "LogHead: Timestamp")
+
+		alice := resp.Entries[0]
+		require.Equal(keyserverStatusOk, alice.StatusCode, "alice: StatusCode")
+		require.Equal(identityKey.PublicKey().String(), alice.PublicKey, "alice: PublicKey")
+		require.Equal(uint64(2), alice.LogIndex, "alice: LogIndex")
+		var ent translog.Entry
+		require.NoError(ent.UnmarshalBinary(alice.LogEntry), "alice: LogEntry")
+		require.Equal(identityKey.PublicKey().Bytes(), ent.PublicKey, "alice: LogEntry: PublicKey")
+		require.True(translog.VerifyInclusion(translog.LeafHash(alice.LogEntry), alice.LogIndex, head.TreeSize, alice.InclusionProof, head.RootHash), "alice: VerifyInclusion()")
+
+		for _, v := range resp.Entries[1:] {
+			require.Empty(v.LogEntry, "%v: LogEntry", v.User)
+			require.Empty(v.InclusionProof, "%v: InclusionProof", v.User)
+		}
+		require.Equal(keyserverStatusNoIdentity, resp.Entries[1].StatusCode, "bob: StatusCode")
+		require.Equal(keyserverStatusOk, resp.Entries[2].StatusCode, "carol: StatusCode")
+
+		// Invalid requests still include the signed log head.
+		b, err = k.OnRequest(10, encode(&keyserverRequest{Version: 2, User: "alice"}), true)
+		require.NoError(err, "OnRequest()")
+		signed = keyserverSignedResponse{}
+		decode(b, &signed)
+		resp = keyserverResponseV2{}
+		decode(signed.Payload, &resp)
+		require.Equal(keyserverStatusSyntaxError, resp.StatusCode, "User: StatusCode")
+		require.NotEmpty(resp.LogHead, "User: LogHead")
+	})
+}
@@ -17,6 +17,11 @@
 package kaetzchen
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+
 	"github.com/katzenpost/server/config"
 	"github.com/katzenpost/server/internal/glue"
 	"gopkg.in/op/go-logging.v1"
@@ -25,8 +30,36 @@ import (
 // LoopCapability is the standardized capability for the loop/discard service.
 const LoopCapability = "loop"
 
+// The loop service request mode is selected by a header at the start of the
+// payload, consisting of loopMagic followed by the mode.  Requests without
+// the header are treated as loopModeEmpty, as that was the only behavior
+// prior to modes being introduced.
+//
+//   - loopModeEmpty: The response is empty.
+//
+//   - loopModeEcho: The response is the entire request payload.
+//
+//   - loopModeDigest: The header is followed by a loopDigestKeyLength byte
+//     key, and the data.  The response is the header, followed by the
+//     provider's time in milliseconds since the UNIX epoch as a big endian
+//     uint64, and HMAC-SHA256(key, time | data).
+const (
+	loopMagic            = "loop"
+	loopHeaderLength     = len(loopMagic) + 1
+	loopDigestKeyLength  = 32
+	loopParameterModes   = "modes"
+	loopModeEmpty        = 0
+	loopModeEcho         = 1
+	loopModeDigest       = 2
+	loopModeNameEmpty    = "empty"
+	loopModeNameEcho     = "echo"
+	loopModeNameDigest   = "digest"
+	loopDigestRespLength = loopHeaderLength + 8 + sha256.Size
+)
+
 type kaetzchenLoop struct {
-	log *logging.Logger
+	log  *logging.Logger
+	glue glue.Glue
 
 	params Parameters
 }
@@ -44,12 +77,44 @@ func (k *kaetzchenLoop) OnRequest(id uint64, payload []byte, hasSURB bool) ([]by
 		return nil, ErrNoResponse
 	}
 
-	k.log.Debugf("Handling request: %v", id)
+	mode := byte(loopModeEmpty)
+	if len(payload) >= loopHeaderLength && bytes.Equal(payload[:len(loopMagic)], []byte(loopMagic)) {
+		mode = payload[len(loopMagic)]
+	}
+
+	k.log.Debugf("Handling request: %v (Mode: %v)", id, mode)
 
-	// TODO: Should this do anything with the payload, and should this send
-	// a meaningful response?  Maybe a digest of the payload?
+	switch mode {
+	case loopModeEmpty:
+		return nil, nil
+	case loopModeEcho:
+		// The payload is only used as the response body, so it does not
+		// need to be copied.
+		return payload, nil
+	case loopModeDigest:
+		if len(payload) < loopHeaderLength+loopDigestKeyLength {
+			k.log.Debugf("Failed to handle request: %v (truncated digest request)", id)
+			return nil, nil
+		}
+		key := payload[loopHeaderLength : loopHeaderLength+loopDigestKeyLength]
+		data := payload[loopHeaderLength+loopDigestKeyLength:]
 
-	return nil, nil
+		resp := make([]byte, loopHeaderLength, loopDigestRespLength)
+		copy(resp, payload[:loopHeaderLength])
+		var ts [8]byte
+		binary.BigEndian.PutUint64(ts[:], uint64(k.glue.Clock().Now().UnixNano()/1e6))
+		resp = append(resp, ts[:]...)
+
+		m := hmac.New(sha256.New, key)
+		m.Write(ts[:])
+		m.Write(data)
+		return m.Sum(resp), nil
+	default:
+		// Unknown modes get the legacy response, so that clients can probe
+		// for support even without consulting the Parameters.
+		k.log.Debugf("Failed to handle request: %v (unknown mode: %v)", id, mode)
+		return nil, nil
+	}
 }
 
 func (k *kaetzchenLoop) Halt() {
@@ -61,9 +126,11 @@ func (k *kaetzchenLoop) Halt() {
 func NewLoop(cfg *config.Kaetzchen, glue glue.Glue) (Kaetzchen, error) {
 	k := &kaetzchenLoop{
 		log:    glue.LogBackend().GetLogger("kaetzchen/loop"),
+		glue:   glue,
 		params: make(Parameters),
 	}
 	k.params[ParameterEndpoint] = cfg.Endpoint
+	k.params[loopParameterModes] = []string{loopModeNameEmpty, loopModeNameEcho, loopModeNameDigest}
 
 	return k, nil
 }
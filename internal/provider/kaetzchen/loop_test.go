@@ -0,0 +1,79 @@
+// loop_test.go - Loop Kaetzchen tests.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package kaetzchen
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"testing"
+
+	"github.com/katzenpost/server/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoop(t *testing.T) {
+	require := require.New(t)
+
+	g, cleanupFn := newTestGlue(t)
+	defer cleanupFn()
+	k, err := NewLoop(&config.Kaetzchen{Endpoint: "+loop"}, g)
+	require.NoError(err, "NewLoop()")
+	require.Equal([]string{"empty", "echo", "digest"}, k.Parameters()[loopParameterModes], "Parameters()")
+
+	// Requests without a SURB never get a response.
+	_, err = k.OnRequest(1, []byte("loop\x01"), false)
+	require.Equal(ErrNoResponse, err, "OnRequest(): No SURB")
+
+	// Legacy requests, and unknown modes get an empty response.
+	payload := make([]byte, 128)
+	resp, err := k.OnRequest(2, payload, true)
+	require.NoError(err, "OnRequest(): Legacy")
+	require.Empty(resp, "OnRequest(): Legacy")
+	resp, err = k.OnRequest(3, []byte("loop\x7f"), true)
+	require.NoError(err, "OnRequest(): Unknown")
+	require.Empty(resp, "OnRequest(): Unknown")
+
+	// Echo.
+	payload = append([]byte("loop\x01"), []byte("Hello world")...)
+	resp, err = k.OnRequest(4, payload, true)
+	require.NoError(err, "OnRequest(): Echo")
+	require.Equal(payload, resp, "OnRequest(): Echo")
+
+	// Digest.
+	key := make([]byte, loopDigestKeyLength)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	data := []byte("The quick brown fox jumps over the lazy dog")
+	payload = append(append([]byte("loop\x02"), key...), data...)
+	resp, err = k.OnRequest(5, payload, true)
+	require.NoError(err, "OnRequest(): Digest")
+	require.Len(resp, loopDigestRespLength, "OnRequest(): Digest")
+	require.Equal([]byte("loop\x02"), resp[:loopHeaderLength], "OnRequest(): Digest header")
+	ts := resp[loopHeaderLength : loopHeaderLength+8]
+	require.Equal(uint64(1500000000*1000), binary.BigEndian.Uint64(ts), "OnRequest(): Digest time")
+	m := hmac.New(sha256.New, key)
+	m.Write(ts)
+	m.Write(data)
+	require.Equal(m.Sum(nil), resp[loopHeaderLength+8:], "OnRequest(): Digest")
+
+	// Truncated digest requests get an empty response.
+	resp, err = k.OnRequest(6, []byte("loop\x02short"), true)
+	require.NoError(err, "OnRequest(): Truncated digest")
+	require.Empty(resp, "OnRequest(): Truncated digest")
+}
@@ -21,26 +21,26 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/katzenpost/core/constants"
 	"github.com/katzenpost/core/crypto/ecdh"
-	"github.com/katzenpost/core/monotime"
 	"github.com/katzenpost/core/sphinx"
-	"github.com/katzenpost/core/sphinx/commands"
 	sConstants "github.com/katzenpost/core/sphinx/constants"
 	"github.com/katzenpost/core/thwack"
-	"github.com/katzenpost/core/utils"
 	"github.com/katzenpost/core/wire"
 	"github.com/katzenpost/core/worker"
 	"github.com/katzenpost/server/config"
 	"github.com/katzenpost/server/internal/debug"
 	"github.com/katzenpost/server/internal/glue"
+	"github.com/katzenpost/server/internal/management"
 	"github.com/katzenpost/server/internal/packet"
 	"github.com/katzenpost/server/internal/provider/kaetzchen"
 	"github.com/katzenpost/server/internal/sqldb"
+	"github.com/katzenpost/server/internal/translog"
 	"github.com/katzenpost/server/spool"
 	"github.com/katzenpost/server/spool/boltspool"
 	"github.com/katzenpost/server/userdb"
@@ -63,6 +63,8 @@ type provider struct {
 	userDB userdb.UserDB
 	spool  spool.Spool
 
+	identityLog *translog.Log
+
 	kaetzchen map[[sConstants.RecipientIDLength]byte]kaetzchen.Kaetzchen
 }
 
@@ -82,6 +84,10 @@ func (p *provider) Halt() {
 		p.spool.Close()
 		p.spool = nil
 	}
+	if p.identityLog != nil {
+		p.identityLog.Close()
+		p.identityLog = nil
+	}
 	if p.sqlDB != nil {
 		p.sqlDB.Close()
 	}
@@ -95,6 +101,10 @@ func (p *provider) UserDB() userdb.UserDB {
 	return p.userDB
 }
 
+func (p *provider) IdentityLog() *translog.Log {
+	return p.identityLog
+}
+
 func (p *provider) AuthenticateClient(c *wire.PeerCredentials) bool {
 	ad, err := p.fixupUserNameCase(c.AdditionalData)
 	if err != nil {
@@ -103,9 +113,9 @@ func (p *provider) AuthenticateClient(c *wire.PeerCredentials) bool {
 	isValid := p.userDB.IsValid(ad, c.PublicKey)
 	if !isValid {
 		if len(c.AdditionalData) == sConstants.NodeIDLength {
-			p.log.Errorf("Authenticate failed: User: '%v', Key: '%v' (Probably a peer)", debug.BytesToPrintString(c.AdditionalData), c.PublicKey)
+			p.log.Errorf("Authenticate failed: User: '%v', Key: '%v' (Probably a peer)", debug.CredentialToPrintString(c.AdditionalData), debug.KeyToPrintString(c.PublicKey))
 		} else {
-			p.log.Errorf("Authenticate failed: User: '%v', Key: '%v'", utils.ASCIIBytesToPrintString(c.AdditionalData), c.PublicKey)
+			p.log.Errorf("Authenticate failed: User: '%v', Key: '%v'", debug.UserToPrintString(c.AdditionalData), debug.KeyToPrintString(c.PublicKey))
 		}
 	}
 	return isValid
@@ -115,6 +125,12 @@ func (p *provider) OnPacket(pkt *packet.Packet) {
 	p.ch.In() <- pkt
 }
 
+func (p *provider) OnPackets(pkts []*packet.Packet) {
+	for _, pkt := range pkts {
+		p.ch.In() <- pkt
+	}
+}
+
 func (p *provider) KaetzchenForPKI() map[string]map[string]interface{} {
 	if len(p.kaetzchen) == 0 {
 		return nil
@@ -184,8 +200,8 @@ func (p *provider) worker() {
 			return
 		case e := <-ch:
 			pkt = e.(*packet.Packet)
-			if dwellTime := monotime.Now() - pkt.DispatchAt; dwellTime > maxDwell {
-				p.log.Debugf("Dropping packet: %v (Spend %v in queue)", pkt.ID, dwellTime)
+			if dwellTime := p.glue.Clock().Mono() - pkt.DispatchAt; dwellTime > maxDwell {
+				p.log.Debugf("Dropping packet: %v (%v)", debug.PacketID(pkt.ID), debug.NewReason("Spend %v in queue", dwellTime))
 				pkt.Dispose()
 				continue
 			}
@@ -199,7 +215,7 @@ func (p *provider) worker() {
 			// Packet is destined for a Kaetzchen auto-responder agent, and
 			// can't be a SURB-Reply.
 			if pkt.IsSURBReply() {
-				p.log.Debugf("Dropping packet: %v (SURB-Reply for Kaetzchen)", pkt.ID)
+				p.log.Debugf("Dropping packet: %v (%v)", debug.PacketID(pkt.ID), debug.NewReason("SURB-Reply for Kaetzchen"))
 			} else {
 				p.onToKaetzchen(pkt, dstKaetzchen)
 			}
@@ -210,14 +226,14 @@ func (p *provider) worker() {
 		// Post-process the recipient.
 		recipient, err := p.fixupRecipient(pkt.Recipient.ID[:])
 		if err != nil {
-			p.log.Debugf("Dropping packet: %v (Invalid Recipient: '%v')", pkt.ID, utils.ASCIIBytesToPrintString(recipient))
+			p.log.Debugf("Dropping packet: %v (%v)", debug.PacketID(pkt.ID), debug.NewReason("Invalid Recipient: '%v'", debug.UserToPrintString(recipient)))
 			pkt.Dispose()
 			continue
 		}
 
 		// Ensure the packet is for a valid recipient.
 		if !p.userDB.Exists(recipient) {
-			p.log.Debugf("Dropping packet: %v (Invalid Recipient: '%v')", pkt.ID, utils.ASCIIBytesToPrintString(recipient))
+			p.log.Debugf("Dropping packet: %v (%v)", debug.PacketID(pkt.ID), debug.NewReason("Invalid Recipient: '%v'", debug.UserToPrintString(recipient)))
 			pkt.Dispose()
 			continue
 		}
@@ -252,7 +268,7 @@ func (p *provider) onSURBReply(pkt *packet.Packet, recipient []byte) {
 func (p *provider) onToUser(pkt *packet.Packet, recipient []byte) {
 	ct, surb, err := parseForwardPacket(pkt)
 	if err != nil {
-		p.log.Debugf("Dropping packet: %v (%v)", pkt.ID, err)
+		p.log.Debugf("Dropping packet: %v (%v)", debug.PacketID(pkt.ID), debug.NewReason("%v", err))
 		return
 	}
 
@@ -262,16 +278,18 @@ func (p *provider) onToUser(pkt *packet.Packet, recipient []byte) {
 		return
 	}
 
-	// Iff there is a SURB, generate a SURB-ACK and schedule.
+	// Iff there is a SURB, have the crypto workers generate a SURB-ACK
+	// and schedule.
 	if surb != nil {
-		ackPkt, err := newPacketFromSURB(pkt, surb, nil)
+		job, err := newSURBJob(pkt, surb, nil)
 		if err != nil {
 			p.log.Debugf("Failed to generate SURB-ACK: %v (%v)", pkt.ID, err)
 			return
 		}
+		job.IsSURBACK = true
 
-		p.log.Debugf("Handing off newly generated SURB-ACK: %v (Src:%v)", ackPkt.ID, pkt.ID)
-		p.glue.Scheduler().OnPacket(ackPkt)
+		p.log.Debugf("Handing off SURB-ACK job: %v", pkt.ID)
+		p.glue.SubmitCryptoJob(job)
 	} else {
 		p.log.Debugf("Stored Message: %v (No SURB)", pkt.ID)
 	}
@@ -296,19 +314,20 @@ func (p *provider) onToKaetzchen(pkt *packet.Packet, dst kaetzchen.Kaetzchen) {
 		return
 	}
 
-	// Iff there is a SURB, generate a SURB-Reply and schedule.
+	// Iff there is a SURB, have the crypto workers generate a SURB-Reply
+	// and schedule.
 	if surb != nil {
 		// Prepend the response header.
 		resp = append([]byte{0x01, 0x00}, resp...)
 
-		respPkt, err := newPacketFromSURB(pkt, surb, resp)
+		job, err := newSURBJob(pkt, surb, resp)
 		if err != nil {
 			p.log.Debugf("Failed to generate SURB-Reply: %v (%v)", pkt.ID, err)
 			return
 		}
 
-		p.log.Debugf("Handing off newly generated SURB-Reply: %v (Src:%v)", respPkt.ID, pkt.ID)
-		p.glue.Scheduler().OnPacket(respPkt)
+		p.log.Debugf("Handing off SURB-Reply job: %v", pkt.ID)
+		p.glue.SubmitCryptoJob(job)
 	} else if resp != nil {
 		// This is silly and I'm not sure why anyone will do this, but
 		// there's nothing that can be done at this point, the Kaetzchen
@@ -408,17 +427,33 @@ func (p *provider) onRemoveUser(c *thwack.Conn, l string) error {
 		return c.WriteReply(thwack.StatusSyntaxError)
 	}
 
+	// Removing the user also removes their identity key, which is logged
+	// like any other identity key change.
+	_, err = p.userDB.Identity(u)
+	hadIdentity := err == nil
+
 	// Remove the user from the UserDB.
-	if err = p.userDB.Remove(u); err != nil {
-		c.Log().Errorf("Failed to remove user '%v': %v", u, err)
+	removedAt := p.glue.Clock().Now()
+	if err = p.removeUser(u, removedAt); err != nil {
+		c.Log().Errorf("Failed to remove user '%v': %v", debug.UserToPrintString(u), err)
 		return c.WriteReply(thwack.StatusTransactionFailed)
 	}
+	if hadIdentity {
+		ent := &translog.Entry{
+			User: u,
+			Time: removedAt.Unix(),
+		}
+		if err = p.appendIdentityLog(ent); err != nil {
+			c.Log().Errorf("Failed to log identity removal for user '%v': %v", debug.UserToPrintString(u), err)
+			return c.WriteReply(thwack.StatusTransactionFailed)
+		}
+	}
 
 	// Remove the user's spool.
 	if err = p.spool.Remove(u); err != nil {
 		// Log an error, but don't return a failed status, because the
 		// user has been obliterated from the UserDB at this point.
-		c.Log().Errorf("Failed to remove spool '%v': %v", u, err)
+		c.Log().Errorf("Failed to remove spool '%v': %v", debug.UserToPrintString(u), err)
 	}
 
 	return c.WriteReply(thwack.StatusOk)
@@ -450,14 +485,152 @@ func (p *provider) onSetUserIdentity(c *thwack.Conn, l string) error {
 		return c.WriteReply(thwack.StatusSyntaxError)
 	}
 
-	if err = p.userDB.SetIdentity(u, pubKey); err != nil {
-		c.Log().Errorf("Failed to set identity for user '%v': %v", u, err)
+	// Removing an identity key that isn't set is not a change, and is not
+	// logged.
+	_, err = p.userDB.Identity(u)
+	isChange := pubKey != nil || err == nil
+
+	if err = p.setIdentity(u, pubKey); err != nil {
+		c.Log().Errorf("Failed to set identity for user '%v': %v", debug.UserToPrintString(u), err)
 		return c.WriteReply(thwack.StatusTransactionFailed)
 	}
 
+	// The user database and the log can not be updated atomically.  The
+	// user database is authoritative, and a change that fails to be logged
+	// here is logged by reconcileIdentityLog() on the next startup.
+	if isChange {
+		if err = p.logIdentityChange(u, pubKey); err != nil {
+			c.Log().Errorf("Failed to log identity change for user '%v': %v", debug.UserToPrintString(u), err)
+			return c.WriteReply(thwack.StatusTransactionFailed)
+		}
+	}
+
 	return c.WriteReply(thwack.StatusOk)
 }
 
+// setIdentity sets the user's identity key, with the change recorded at the
+// server's time if the user database supports it.
+func (p *provider) setIdentity(u []byte, pubKey *ecdh.PublicKey) error {
+	if tDB, ok := p.userDB.(userdb.TimedUpdateDB); ok {
+		return tDB.SetIdentityAt(u, pubKey, p.glue.Clock().Now())
+	}
+	return p.userDB.SetIdentity(u, pubKey)
+}
+
+// removeUser removes the user, with the removal of any identity key recorded
+// at the provided time if the user database supports it.
+func (p *provider) removeUser(u []byte, t time.Time) error {
+	if tDB, ok := p.userDB.(userdb.TimedUpdateDB); ok {
+		return tDB.RemoveAt(u, t)
+	}
+	return p.userDB.Remove(u)
+}
+
+func (p *provider) logIdentityChange(u []byte, pubKey *ecdh.PublicKey) error {
+	ent := &translog.Entry{
+		User: u,
+		Time: p.glue.Clock().Now().Unix(),
+	}
+	if pubKey != nil {
+		ent.PublicKey = pubKey.Bytes()
+	}
+
+	// Use the time from the user database's history if possible, so that
+	// the log entry matches the history entry exactly.  Keys set before the
+	// history was recorded fall back to the time the key was set, if known.
+	// Removed users no longer have a history.
+	if hDB, ok := p.userDB.(userdb.IdentityHistoryDB); ok {
+		h, err := hDB.IdentityHistory(u)
+		if err != nil && err != userdb.ErrNoSuchUser {
+			return err
+		}
+		if len(h) > 0 {
+			ent.Time = h[len(h)-1].Time.Unix()
+		} else if tDB, ok := p.userDB.(userdb.IdentityTimeDB); ok && pubKey != nil {
+			if t, err := tDB.IdentityTime(u); err == nil && !t.IsZero() {
+				ent.Time = t.Unix()
+			}
+		}
+	}
+
+	return p.appendIdentityLog(ent)
+}
+
+func (p *provider) appendIdentityLog(ent *translog.Entry) error {
+	idx, err := p.identityLog.Append(ent)
+	if err != nil {
+		return err
+	}
+	p.log.Debugf("Logged identity change for user '%v' at index %v.", debug.UserToPrintString(ent.User), idx)
+	return nil
+}
+
+// reconcileIdentityLog logs the identity key of every user whose key in the
+// user database differs from the most recently logged key.  This covers both
+// changes that failed to be logged, and keys set before the log existed.
+// Users that have been removed from the user database are logged as having
+// no key.
+func (p *provider) reconcileIdentityLog() error {
+	lDB, ok := p.userDB.(userdb.UserListDB)
+	if !ok {
+		p.log.Noticef("UserDB can not list users, unlogged identity keys will be logged when next changed.")
+		return nil
+	}
+	users, err := lDB.Users()
+	if err != nil {
+		return err
+	}
+	isListed := make(map[string]bool)
+	for _, u := range users {
+		isListed[string(u)] = true
+	}
+	for _, u := range p.identityLog.Users() {
+		if !isListed[string(u)] {
+			users = append(users, u)
+		}
+	}
+
+	nrLogged := 0
+	for _, u := range users {
+		pubKey, err := p.userDB.Identity(u)
+		switch err {
+		case nil:
+		case userdb.ErrNoIdentity, userdb.ErrNoSuchUser:
+			pubKey = nil
+		default:
+			return err
+		}
+
+		idx, ok := p.identityLog.Latest(u)
+		switch {
+		case ok:
+			b, err := p.identityLog.Entry(idx)
+			if err != nil {
+				return err
+			}
+			var ent translog.Entry
+			if err = ent.UnmarshalBinary(b); err != nil {
+				return err
+			}
+			if (pubKey == nil && ent.PublicKey == nil) || (pubKey != nil && bytes.Equal(ent.PublicKey, pubKey.Bytes())) {
+				continue
+			}
+		case pubKey == nil:
+			// Users that never had an identity key are not logged.
+			continue
+		}
+
+		if err = p.logIdentityChange(u, pubKey); err != nil {
+			return err
+		}
+		nrLogged++
+	}
+	if nrLogged > 0 {
+		p.log.Noticef("Logged %v identity keys missing from the identity log.", nrLogged)
+	}
+	return nil
+}
+
 func (p *provider) onUserIdentity(c *thwack.Conn, l string) error {
 	p.Lock()
 	defer p.Unlock()
@@ -476,7 +649,7 @@ func (p *provider) onUserIdentity(c *thwack.Conn, l string) error {
 
 	pubKey, err := p.userDB.Identity(u)
 	if err != nil {
-		c.Log().Errorf("Failed to query identity for user '%v': %v", u, err)
+		c.Log().Errorf("Failed to query identity for user '%v': %v", debug.UserToPrintString(u), err)
 		return c.WriteReply(thwack.StatusTransactionFailed)
 	}
 
@@ -520,56 +693,30 @@ func parseForwardPacket(pkt *packet.Packet) ([]byte, []byte, error) {
 	return ct, surb, nil
 }
 
-func newPacketFromSURB(pkt *packet.Packet, surb, payload []byte) (*packet.Packet, error) {
+func newSURBJob(pkt *packet.Packet, surb, payload []byte) (*packet.SURBJob, error) {
 	if !pkt.IsToUser() {
 		return nil, fmt.Errorf("invalid commands to generate a SURB reply")
 	}
 
 	// Pad out payloads to the full packet size.
-	var respPayload [constants.ForwardPayloadLength]byte
+	respPayload := make([]byte, constants.ForwardPayloadLength)
 	switch {
 	case len(payload) == 0:
 	case len(payload) > constants.ForwardPayloadLength:
 		return nil, fmt.Errorf("oversized response payload: %v", len(payload))
 	default:
-		copy(respPayload[:], payload)
-	}
-
-	// Build a response packet using a SURB.
-	//
-	// TODO/perf: This is a crypto operation that is paralleizable, and
-	// could be handled by the crypto worker(s), since those are allocated
-	// based on hardware acceleration considerations.  However the forward
-	// packet processing doesn't constantly utilize the AES-NI units due
-	// to the non-AEZ components of a Sphinx Unwrap operation.
-	rawRespPkt, firstHop, err := sphinx.NewPacketFromSURB(surb, respPayload[:])
-	if err != nil {
-		return nil, err
-	}
-
-	// Build the command vector for the SURB-ACK
-	cmds := make([]commands.RoutingCommand, 0, 2)
-
-	nextHopCmd := new(commands.NextNodeHop)
-	copy(nextHopCmd.ID[:], firstHop[:])
-	cmds = append(cmds, nextHopCmd)
-
-	nodeDelayCmd := new(commands.NodeDelay)
-	nodeDelayCmd.Delay = pkt.NodeDelay.Delay
-	cmds = append(cmds, nodeDelayCmd)
-
-	// Assemble the response packet.
-	respPkt, _ := packet.New(rawRespPkt)
-	respPkt.Set(nil, cmds)
-
-	respPkt.RecvAt = pkt.RecvAt
-	respPkt.Delay = time.Duration(nodeDelayCmd.Delay) * time.Millisecond
-	respPkt.MustForward = true
-
-	// XXX: This should probably fudge the delay to account for processing
-	// time.
-
-	return respPkt, nil
+		copy(respPayload, payload)
+	}
+
+	// The SURB is copied, since pkt is disposed of before the crypto
+	// workers get around to building the response packet.
+	return &packet.SURBJob{
+		SrcID:   pkt.ID,
+		SURB:    append([]byte{}, surb...),
+		Payload: respPayload,
+		Delay:   pkt.NodeDelay.Delay,
+		RecvAt:  pkt.RecvAt,
+	}, nil
 }
 
 // New constructs a new provider instance.
@@ -636,6 +783,15 @@ func New(glue glue.Glue) (glue.Provider, error) {
 		return nil, err
 	}
 
+	// Bring the identity log up to date with the user database.
+	p.identityLog, err = translog.New(filepath.Join(cfg.Server.DataDir, translog.LogFile))
+	if err != nil {
+		return nil, err
+	}
+	if err = p.reconcileIdentityLog(); err != nil {
+		return nil, err
+	}
+
 	// Purge spools that belong to users that no longer exist in the user db.
 	if err = p.spool.Vaccum(p.userDB); err != nil {
 		return nil, err
@@ -651,11 +807,11 @@ func New(glue glue.Glue) (glue.Provider, error) {
 			cmdUserIdentity    = "USER_IDENTITY"
 		)
 
-		glue.Management().RegisterCommand(cmdAddUser, p.onAddUser)
-		glue.Management().RegisterCommand(cmdUpdateUser, p.onUpdateUser)
-		glue.Management().RegisterCommand(cmdRemoveUser, p.onRemoveUser)
-		glue.Management().RegisterCommand(cmdSetUserIdentity, p.onSetUserIdentity)
-		glue.Management().RegisterCommand(cmdUserIdentity, p.onUserIdentity)
+		glue.Management().RegisterCommand(cmdAddUser, management.RoleUserAdmin, p.onAddUser)
+		glue.Management().RegisterCommand(cmdUpdateUser, management.RoleUserAdmin, p.onUpdateUser)
+		glue.Management().RegisterCommand(cmdRemoveUser, management.RoleUserAdmin, p.onRemoveUser)
+		glue.Management().RegisterCommand(cmdSetUserIdentity, management.RoleUserAdmin, p.onSetUserIdentity)
+		glue.Management().RegisterCommand(cmdUserIdentity, management.RoleReadOnly, p.onUserIdentity)
 	}
 
 	// Initialize the Kaetzchen.
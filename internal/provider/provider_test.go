@@ -0,0 +1,117 @@
+// provider_test.go - Katzenpost server provider tests.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package provider
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/log"
+	"github.com/katzenpost/server/internal/clock"
+	"github.com/katzenpost/server/internal/glue"
+	"github.com/katzenpost/server/internal/translog"
+	"github.com/katzenpost/server/userdb/boltuserdb"
+	"github.com/stretchr/testify/require"
+)
+
+type testGlue struct {
+	glue.Glue
+
+	clock *clock.Fake
+}
+
+func (g *testGlue) Clock() clock.Clock {
+	return g.clock
+}
+
+func TestReconcileIdentityLog(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "provider_test")
+	require.NoError(err, "TempDir()")
+	defer os.RemoveAll(dir)
+
+	logBackend, err := log.New("", "ERROR", false)
+	require.NoError(err, "log.New()")
+	db, err := boltuserdb.New(filepath.Join(dir, "users.db"))
+	require.NoError(err, "boltuserdb.New()")
+	defer db.Close()
+	idLog, err := translog.New(filepath.Join(dir, translog.LogFile))
+	require.NoError(err, "translog.New()")
+	defer idLog.Close()
+
+	p := &provider{
+		glue:        &testGlue{clock: clock.NewFake(clock.EpochStart(1000))},
+		log:         logBackend.GetLogger("provider"),
+		userDB:      db,
+		identityLog: idLog,
+	}
+	newKey := func() *ecdh.PublicKey {
+		k, err := ecdh.NewKeypair(rand.Reader)
+		require.NoError(err, "ecdh.NewKeypair()")
+		return k.PublicKey()
+	}
+	latestKey := func(u string) []byte {
+		idx, ok := idLog.Latest([]byte(u))
+		require.True(ok, "Latest(%v)", u)
+		b, err := idLog.Entry(idx)
+		require.NoError(err, "Entry(%v)", idx)
+		var ent translog.Entry
+		require.NoError(ent.UnmarshalBinary(b), "UnmarshalBinary()")
+		return ent.PublicKey
+	}
+
+	// Keys set without being logged, such as before the log existed, are
+	// logged, and users that never had a key are not.
+	aliceKey, bobKey := newKey(), newKey()
+	for _, u := range []string{"alice", "bob", "carol"} {
+		require.NoError(db.Add([]byte(u), newKey(), false), "Add(%v)", u)
+	}
+	require.NoError(db.SetIdentity([]byte("alice"), aliceKey), "SetIdentity(alice)")
+	require.NoError(db.SetIdentity([]byte("bob"), bobKey), "SetIdentity(bob)")
+	require.NoError(p.reconcileIdentityLog(), "reconcileIdentityLog()")
+	require.Equal(uint64(2), idLog.Head().Size, "reconcileIdentityLog(): Size")
+	require.Equal(aliceKey.Bytes(), latestKey("alice"), "reconcileIdentityLog(): alice")
+	require.Equal(bobKey.Bytes(), latestKey("bob"), "reconcileIdentityLog(): bob")
+	_, ok := idLog.Latest([]byte("carol"))
+	require.False(ok, "reconcileIdentityLog(): carol")
+
+	// A log that is up to date is left alone.
+	require.NoError(p.reconcileIdentityLog(), "reconcileIdentityLog(): Up to date")
+	require.Equal(uint64(2), idLog.Head().Size, "reconcileIdentityLog(): Up to date")
+
+	// Changes that were not logged, including removals, are logged.
+	aliceKey = newKey()
+	require.NoError(db.SetIdentity([]byte("alice"), aliceKey), "SetIdentity(alice): Change")
+	require.NoError(db.SetIdentity([]byte("bob"), nil), "SetIdentity(bob): Remove")
+	require.NoError(p.reconcileIdentityLog(), "reconcileIdentityLog(): Changed")
+	require.Equal(uint64(4), idLog.Head().Size, "reconcileIdentityLog(): Changed")
+	require.Equal(aliceKey.Bytes(), latestKey("alice"), "reconcileIdentityLog(): alice changed")
+	require.Nil(latestKey("bob"), "reconcileIdentityLog(): bob removed")
+
+	// Removed users are logged as having no key, once.
+	require.NoError(db.Remove([]byte("alice")), "Remove(alice)")
+	require.NoError(p.reconcileIdentityLog(), "reconcileIdentityLog(): User removed")
+	require.Equal(uint64(5), idLog.Head().Size, "reconcileIdentityLog(): User removed")
+	require.Nil(latestKey("alice"), "reconcileIdentityLog(): alice removed")
+	require.NoError(p.reconcileIdentityLog(), "reconcileIdentityLog(): User removed, up to date")
+	require.Equal(uint64(5), idLog.Head().Size, "reconcileIdentityLog(): User removed, up to date")
+}
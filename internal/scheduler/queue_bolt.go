@@ -25,8 +25,8 @@ import (
 	"time"
 
 	bolt "github.com/coreos/bbolt"
-	"github.com/katzenpost/core/monotime"
 	"github.com/katzenpost/core/sphinx/commands"
+	"github.com/katzenpost/server/internal/debug"
 	"github.com/katzenpost/server/internal/glue"
 	"github.com/katzenpost/server/internal/packet"
 	"gopkg.in/op/go-logging.v1"
@@ -205,7 +205,7 @@ func (q *boltQueue) Pop() {
 		panic("BUG: Pop() called on empty queue")
 	}
 
-	now := monotime.Now()
+	now := q.glue.Clock().Mono()
 	timerSlack := time.Duration(q.glue.Config().Debug.SchedulerSlack) * time.Millisecond
 
 	var removed uint64
@@ -229,9 +229,9 @@ func (q *boltQueue) Pop() {
 			var pkt *packet.Packet
 			var err error
 			if deltaT := now - prio; deltaT > timerSlack {
-				q.log.Debugf("Dropping packet: %v (Deadline blown by %v)", id, deltaT)
+				q.log.Debugf("Dropping packet: %v (%v)", debug.PacketID(id), debug.NewReason("Deadline blown by %v", deltaT))
 			} else if pkt, err = packetFromBoltBkt(packetsBkt, k); err != nil {
-				q.log.Debugf("Dropping packet: %v (s11n failure: %v)", id, err)
+				q.log.Debugf("Dropping packet: %v (%v)", debug.PacketID(id), debug.NewReason("s11n failure: %v", err))
 			}
 
 			// Regardless of what happened, obliterate the bucket.
@@ -251,13 +251,20 @@ func (q *boltQueue) Pop() {
 		q.log.Errorf("Pop(): Transaction failed: %v", err)
 	} else {
 		q.dbCount -= removed
-		q.log.Debugf("Pop(): Count %v (Removed %v, Elapsed: %v).", q.dbCount, removed, monotime.Now()-now)
+		q.log.Debugf("Pop(): Count %v (Removed %v, Elapsed: %v).", q.dbCount, removed, q.glue.Clock().Mono()-now)
 	}
 }
 
+func (q *boltQueue) Len() int {
+	if q.headPkt == nil {
+		return 0
+	}
+	return int(q.dbCount) + 1
+}
+
 func (q *boltQueue) BulkEnqueue(batch []*packet.Packet) {
 	var added uint64
-	now := monotime.Now()
+	now := q.glue.Clock().Mono()
 
 	// Special case enqueuing a single packet, with a totally empty queue.
 	if len(batch) == 1 && q.dbCount == 0 && q.headPkt == nil {
@@ -296,7 +303,7 @@ func (q *boltQueue) BulkEnqueue(batch []*packet.Packet) {
 		q.log.Errorf("BulkEnqueue(): Transaction failed: %v", err)
 	} else {
 		q.dbCount += added
-		q.log.Debugf("BulkEnqueue(): Count %v (Added %v, Elapsed: %v).", q.dbCount, added, monotime.Now()-now)
+		q.log.Debugf("BulkEnqueue(): Count %v (Added %v, Elapsed: %v).", q.dbCount, added, q.glue.Clock().Mono()-now)
 	}
 }
 
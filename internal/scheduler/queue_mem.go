@@ -21,7 +21,6 @@ import (
 	"time"
 
 	"github.com/katzenpost/core/crypto/rand"
-	"github.com/katzenpost/core/monotime"
 	"github.com/katzenpost/core/queue"
 	"github.com/katzenpost/server/internal/glue"
 	"github.com/katzenpost/server/internal/packet"
@@ -53,8 +52,12 @@ func (q *memoryQueue) Pop() {
 	q.q.Pop()
 }
 
+func (q *memoryQueue) Len() int {
+	return q.q.Len()
+}
+
 func (q *memoryQueue) BulkEnqueue(batch []*packet.Packet) {
-	now := monotime.Now()
+	now := q.glue.Clock().Mono()
 	for _, pkt := range batch {
 		q.doEnqueue(now+pkt.Delay, pkt)
 	}
@@ -19,10 +19,10 @@ package scheduler
 
 import (
 	"math"
+	"sync/atomic"
 	"time"
 
 	"github.com/katzenpost/core/epochtime"
-	"github.com/katzenpost/core/monotime"
 	"github.com/katzenpost/core/worker"
 	"github.com/katzenpost/server/internal/constants"
 	"github.com/katzenpost/server/internal/debug"
@@ -37,6 +37,7 @@ type queueImpl interface {
 	Peek() (time.Duration, *packet.Packet)
 	Pop()
 	BulkEnqueue([]*packet.Packet)
+	Len() int
 }
 
 type scheduler struct {
@@ -49,6 +50,7 @@ type scheduler struct {
 	inCh       *channels.InfiniteChannel
 	outCh      *channels.BatchingChannel
 	maxDelayCh chan uint64
+	nrQueued   int64
 }
 
 func (sch *scheduler) Halt() {
@@ -57,14 +59,57 @@ func (sch *scheduler) Halt() {
 	sch.q.Halt()
 }
 
+func (sch *scheduler) QueueLength() int {
+	// Packets are counted from when they are handed to the scheduler, until
+	// they are dispatched or dropped, which includes the packets that have
+	// yet to be enqueued.
+	return int(atomic.LoadInt64(&sch.nrQueued))
+}
+
+func (sch *scheduler) onRemoved(n int) {
+	atomic.AddInt64(&sch.nrQueued, -int64(n))
+}
+
 func (sch *scheduler) OnNewMixMaxDelay(newMixMaxDelay uint64) {
 	sch.maxDelayCh <- newMixMaxDelay
 }
 
 func (sch *scheduler) OnPacket(pkt *packet.Packet) {
+	atomic.AddInt64(&sch.nrQueued, 1)
 	sch.inCh.In() <- pkt
 }
 
+func (sch *scheduler) OnPackets(pkts []*packet.Packet) {
+	// The entire batch is sent as a single channel element.
+	atomic.AddInt64(&sch.nrQueued, int64(len(pkts)))
+	sch.inCh.In() <- pkts
+}
+
+func (sch *scheduler) validatePacket(toEnqueue []*packet.Packet, pkt *packet.Packet, maxDelay time.Duration) []*packet.Packet {
+	// Note: This assumes that pkt.delay has already been adjusted to account
+	// for the packet processing time up to the point where the packet was
+	// enqueued.
+
+	// Ensure that the packet's delay is not pathologically malformed.
+	if pkt.Delay > maxDelay {
+		sch.log.Debugf("Dropping packet: %v (%v)", debug.PacketID(pkt.ID), debug.NewReason("Delay exceeds max: %v", pkt.Delay))
+		pkt.Dispose()
+		sch.onRemoved(1)
+		return toEnqueue
+	}
+
+	// Ensure the peer is valid by querying the outgoing connection table.
+	if sch.glue.Connector().IsValidForwardDest(&pkt.NextNodeHop.ID) {
+		sch.log.Debugf("Enqueueing packet: %v delta-t: %v", pkt.ID, pkt.Delay)
+		return append(toEnqueue, pkt)
+	}
+	sID := debug.NodeIDToPrintString(&pkt.NextNodeHop.ID)
+	sch.log.Debugf("Dropping packet: %v (%v)", debug.PacketID(pkt.ID), debug.NewReason("Next hop is invalid: %v", sID))
+	pkt.Dispose()
+	sch.onRemoved(1)
+	return toEnqueue
+}
+
 func (sch *scheduler) worker() {
 	const absoluteMaxDelay = epochtime.Period * constants.NumMixKeys
 
@@ -94,32 +139,21 @@ func (sch *scheduler) worker() {
 			sch.log.Debugf("Batch processing %v packets.", len(batch))
 			toEnqueue := make([]*packet.Packet, 0, len(batch))
 			for _, e := range batch {
-				// New packet from the crypto workers.
-				//
-				// Note: This assumes that pkt.delay has already been adjusted
-				// to account for the packet processing time up to the point
-				// where the packet was enqueued.
-				pkt := e.(*packet.Packet)
-
-				// Ensure that the packet's delay is not pathologically malformed.
-				if pkt.Delay > maxDelay {
-					sch.log.Debugf("Dropping packet: %v (Delay exceeds max: %v)", pkt.ID, pkt.Delay)
-					pkt.Dispose()
-					continue
-				}
-
-				// Ensure the peer is valid by querying the outgoing connection
-				// table.
-				if sch.glue.Connector().IsValidForwardDest(&pkt.NextNodeHop.ID) {
-					sch.log.Debugf("Enqueueing packet: %v delta-t: %v", pkt.ID, pkt.Delay)
-					toEnqueue = append(toEnqueue, pkt)
-				} else {
-					sID := debug.NodeIDToPrintString(&pkt.NextNodeHop.ID)
-					sch.log.Debugf("Dropping packet: %v (Next hop is invalid: %v)", pkt.ID, sID)
-					pkt.Dispose()
+				// New packet(s) from the crypto workers.
+				switch v := e.(type) {
+				case *packet.Packet:
+					toEnqueue = sch.validatePacket(toEnqueue, v, maxDelay)
+				case []*packet.Packet:
+					for _, pkt := range v {
+						toEnqueue = sch.validatePacket(toEnqueue, pkt, maxDelay)
+					}
 				}
 			}
+
+			// The queue may discard packets when it is over capacity.
+			nrBefore := sch.q.Len()
 			sch.q.BulkEnqueue(toEnqueue)
+			sch.onRemoved(nrBefore + len(toEnqueue) - sch.q.Len())
 		case newMaxDelay := <-sch.maxDelayCh:
 			pkiMaxDelay := time.Duration(newMaxDelay) * time.Millisecond
 			if pkiMaxDelay > absoluteMaxDelay || pkiMaxDelay == 0 {
@@ -153,7 +187,7 @@ func (sch *scheduler) worker() {
 			}
 
 			// Figure out if the packet needs to be handled now.
-			now := monotime.Now()
+			now := sch.glue.Clock().Mono()
 			if dispatchAt > now {
 				// Packet dispatch will happen at a later time, so schedule
 				// the next timer tick, and go back to waiting for something
@@ -173,6 +207,10 @@ func (sch *scheduler) worker() {
 
 			// The packet will be dispatched somehow, so remove it from the
 			// queue, and do the type assertion.
+			//
+			// Note: The queue may discard further packets with blown
+			// deadlines as part of the Pop().
+			nrBefore := sch.q.Len()
 			sch.q.Pop()
 
 			// Packet dispatch time is now or in the past, so it needs to be
@@ -180,7 +218,7 @@ func (sch *scheduler) worker() {
 			if now-dispatchAt > timerSlack {
 				// ... unless the deadline has been blown by more than the
 				// configured slack time.
-				sch.log.Debugf("Dropping packet: %v (Deadline blown by %v)", pkt.ID, now-dispatchAt)
+				sch.log.Debugf("Dropping packet: %v (%v)", debug.PacketID(pkt.ID), debug.NewReason("Deadline blown by %v", now-dispatchAt))
 				pkt.Dispose()
 			} else {
 				// Dispatch the packet to the next hop.  Note that the callee
@@ -191,6 +229,7 @@ func (sch *scheduler) worker() {
 				pkt.DispatchAt = now
 				sch.glue.Connector().DispatchPacket(pkt)
 			}
+			sch.onRemoved(nrBefore - sch.q.Len())
 		}
 	}
 
@@ -26,7 +26,7 @@ import (
 	"github.com/katzenpost/core/crypto/ecdh"
 	"github.com/katzenpost/core/sphinx"
 	sConstants "github.com/katzenpost/core/sphinx/constants"
-	"github.com/katzenpost/core/utils"
+	"github.com/katzenpost/server/internal/debug"
 	"github.com/katzenpost/server/spool"
 	"github.com/katzenpost/server/userdb"
 )
@@ -222,7 +222,7 @@ func (d *pgxUserDB) getAuthKey(u []byte) *ecdh.PublicKey {
 
 	pk := new(ecdh.PublicKey)
 	if err := pk.FromBytes(raw); err != nil {
-		d.pgx.d.log.Warningf("Failed to deserialize authentication key for user '%v': %v", utils.ASCIIBytesToPrintString(u), err)
+		d.pgx.d.log.Warningf("Failed to deserialize authentication key for user '%v': %v", debug.UserToPrintString(u), err)
 		return nil
 	}
 
@@ -74,7 +74,7 @@ func New(glue glue.Glue) (*SQLDB, error) {
 	switch sCfg.Backend {
 	case implPgx:
 		var err error
-		db.impl, err = newPgxImpl(db, sCfg.DataSourceName)
+		db.impl, err = newPgxImpl(db, sCfg.ResolvedDataSourceName())
 		if err != nil {
 			return nil, err
 		}
@@ -0,0 +1,182 @@
+// client.go - Minimal test network client.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package testnet
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/katzenpost/core/constants"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	cpki "github.com/katzenpost/core/pki"
+	"github.com/katzenpost/core/sphinx"
+	sConstants "github.com/katzenpost/core/sphinx/constants"
+	"github.com/katzenpost/core/sphinx/path"
+	"github.com/katzenpost/core/wire"
+	"github.com/katzenpost/core/wire/commands"
+)
+
+const dialTimeout = 10 * time.Second
+
+// Client is a minimal client, connected to a single provider.
+type Client struct {
+	doc      *cpki.Document
+	provider *cpki.MixDescriptor
+
+	user    []byte
+	conn    net.Conn
+	session *wire.Session
+	seq     uint32
+}
+
+// IsPeerValid authenticates the provider, as part of the wire handshake.
+func (c *Client) IsPeerValid(creds *wire.PeerCredentials) bool {
+	if !bytes.Equal(creds.AdditionalData, c.provider.IdentityKey.Bytes()) {
+		return false
+	}
+	return creds.PublicKey.Equal(c.provider.LinkKey)
+}
+
+// SendMessage sends a message with a SURB to the recipient at the provider
+// dst, and returns the SURB ID and the SURB decryption key.
+func (c *Client) SendMessage(recipient string, dst *cpki.MixDescriptor, msg []byte) (*[sConstants.SURBIDLength]byte, []byte, error) {
+	if len(msg) > constants.UserForwardPayloadLength {
+		return nil, nil, fmt.Errorf("testnet: oversized message: %v", len(msg))
+	}
+
+	surbID := new([sConstants.SURBIDLength]byte)
+	if _, err := rand.Reader.Read(surbID[:]); err != nil {
+		return nil, nil, err
+	}
+
+	rng := rand.NewMath()
+	fwdPath, then, err := path.New(rng, c.doc, []byte(recipient), c.provider, dst, surbID, time.Now(), true, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	revPath, _, err := path.New(rng, c.doc, c.user, dst, c.provider, surbID, then, false, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	surb, surbKey, err := sphinx.NewSURB(rand.Reader, revPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	payload := make([]byte, 2, 2+sphinx.SURBLength+constants.UserForwardPayloadLength)
+	payload[0] = 1 // Packet has a SURB.
+	payload = append(payload, surb...)
+	payload = append(payload, msg...)
+	payload = append(payload, make([]byte, constants.UserForwardPayloadLength-len(msg))...)
+
+	pkt, err := sphinx.NewPacket(rand.Reader, fwdPath, payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = c.session.SendCommand(&commands.SendPacket{SphinxPacket: pkt}); err != nil {
+		return nil, nil, err
+	}
+
+	return surbID, surbKey, nil
+}
+
+// Retrieve retrieves the next entry from the user's spool, returning a
+// *commands.Message, *commands.MessageACK, or nil if the spool is empty.
+func (c *Client) Retrieve() (commands.Command, error) {
+	if err := c.session.SendCommand(&commands.RetrieveMessage{Sequence: c.seq}); err != nil {
+		return nil, err
+	}
+	rawCmd, err := c.session.RecvCommand()
+	if err != nil {
+		return nil, err
+	}
+
+	switch cmd := rawCmd.(type) {
+	case *commands.MessageEmpty:
+		return nil, nil
+	case *commands.Message:
+		// The next retrieval will pop this entry off the spool.
+		c.seq++
+		return cmd, nil
+	case *commands.MessageACK:
+		c.seq++
+		return cmd, nil
+	default:
+		return nil, fmt.Errorf("testnet: unexpected command: %T", rawCmd)
+	}
+}
+
+// Close closes the client's connection.
+func (c *Client) Close() {
+	c.session.Close()
+	c.conn.Close()
+}
+
+// Dial connects to a provider in the network as the specified user.
+func (n *Network) Dial(provider int, user string, linkKey *ecdh.PrivateKey) (*Client, error) {
+	if n.doc == nil {
+		return nil, errNotStarted
+	}
+	if provider < 0 || provider >= len(n.doc.Providers) {
+		return nil, fmt.Errorf("testnet: invalid provider: %v", provider)
+	}
+	c := &Client{
+		doc:      n.doc,
+		provider: n.ProviderDescriptor(provider),
+		user:     []byte(user),
+	}
+
+	addrs := c.provider.Addresses[cpki.TransportTCPv4]
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("testnet: provider has no TCPv4 address")
+	}
+
+	cfg := &wire.SessionConfig{
+		Authenticator:     c,
+		AdditionalData:    c.user,
+		AuthenticationKey: linkKey,
+		RandomReader:      rand.Reader,
+	}
+	var err error
+	if c.session, err = wire.NewSession(cfg, true); err != nil {
+		return nil, err
+	}
+	if c.conn, err = net.DialTimeout("tcp", addrs[0], dialTimeout); err != nil {
+		c.session.Close()
+		return nil, err
+	}
+	if err = c.session.Initialize(c.conn); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// ProviderDescriptor returns the descriptor of a provider in the network.
+func (n *Network) ProviderDescriptor(provider int) *cpki.MixDescriptor {
+	id := n.Providers[provider].IdentityKey()
+	for _, v := range n.doc.Providers {
+		if v.IdentityKey.Equal(id) {
+			return v
+		}
+	}
+	return nil
+}
@@ -0,0 +1,373 @@
+// testnet.go - In-process test network.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package testnet implements an in-process Katzenpost network, consisting of
+// mixes and providers bound to the loopback interface, and a minimal client,
+// for integration testing.
+package testnet
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/epochtime"
+	cpki "github.com/katzenpost/core/pki"
+	"github.com/katzenpost/server"
+	"github.com/katzenpost/server/config"
+	"github.com/katzenpost/server/internal/pki"
+	"github.com/katzenpost/server/userdb/boltuserdb"
+)
+
+const (
+	// The network parameters are chosen so that packets traverse the
+	// network quickly, and so that decoy traffic is effectively disabled.
+	mixLambda       = 0.01 // Mean delay of 100 ms.
+	mixMaxDelay     = 500
+	sendLambda      = 0.00001
+	sendMaxInterval = 3600 * 1000
+
+	descriptorWait = 30 * time.Second
+)
+
+var errNotStarted = errors.New("testnet: network is not running")
+
+// Node is a server that is part of a Network.
+type Node struct {
+	// Config is the node's configuration.
+	Config *config.Config
+
+	// Server is the running server instance, if any.
+	Server *server.Server
+
+	identityKey *eddsa.PrivateKey
+	layer       uint8
+}
+
+// IdentityKey returns the node's identity public key.
+func (n *Node) IdentityKey() *eddsa.PublicKey {
+	return n.identityKey.PublicKey()
+}
+
+func (n *Node) start() error {
+	var err error
+	n.Server, err = server.New(n.Config)
+	return err
+}
+
+func (n *Node) stop() {
+	if n.Server != nil {
+		n.Server.Shutdown()
+		n.Server.Wait()
+		n.Server = nil
+	}
+}
+
+// Network is an in-process Katzenpost network.
+type Network struct {
+	baseDir       string
+	documentDir   string
+	descriptorDir string
+
+	// Mixes are the mix nodes, ordered by layer.
+	Mixes []*Node
+
+	// Providers are the provider nodes.
+	Providers []*Node
+
+	doc *cpki.Document
+}
+
+// Nodes returns all of the nodes in the network.
+func (n *Network) Nodes() []*Node {
+	nodes := make([]*Node, 0, len(n.Mixes)+len(n.Providers))
+	nodes = append(nodes, n.Mixes...)
+	return append(nodes, n.Providers...)
+}
+
+// AddUser adds a user to a provider's user database, and returns the user's
+// link key.  Users must be added before the network is started.
+func (n *Network) AddUser(provider int, user string) (*ecdh.PrivateKey, error) {
+	if provider < 0 || provider >= len(n.Providers) {
+		return nil, fmt.Errorf("testnet: invalid provider: %v", provider)
+	}
+	p := n.Providers[provider]
+	if p.Server != nil {
+		return nil, errors.New("testnet: users must be added before starting the network")
+	}
+
+	linkKey, err := ecdh.NewKeypair(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(p.Config.Server.DataDir, 0700); err != nil {
+		return nil, err
+	}
+	db, err := boltuserdb.New(p.Config.Provider.UserDB.Bolt.UserDB)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	if err = db.Add([]byte(user), linkKey.PublicKey(), false); err != nil {
+		return nil, err
+	}
+	return linkKey, nil
+}
+
+// Document returns the PKI document for the current epoch.
+func (n *Network) Document() *cpki.Document {
+	return n.doc
+}
+
+// Start brings the network online.
+//
+// Since the nodes only fetch PKI documents infrequently, the network is
+// bootstrapped in two passes.  Each node is started so that it generates and
+// publishes a descriptor, the PKI documents are assembled from the
+// descriptors, and then each node is restarted so that it immediately picks
+// up the documents.
+func (n *Network) Start() error {
+	epoch, _, _ := epochtime.Now()
+
+	for _, node := range n.Nodes() {
+		if err := node.start(); err != nil {
+			n.Shutdown()
+			return err
+		}
+	}
+
+	doc, err := n.assembleDocument(epoch)
+	if err != nil {
+		n.Shutdown()
+		return err
+	}
+	for e := epoch; e < epoch+2; e++ {
+		d := *doc
+		d.Epoch = e
+		if err = n.writeDocument(&d); err != nil {
+			n.Shutdown()
+			return err
+		}
+	}
+	n.doc = doc
+
+	n.Shutdown()
+	for _, node := range n.Nodes() {
+		if err := node.start(); err != nil {
+			n.Shutdown()
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Shutdown stops all of the nodes in the network.
+func (n *Network) Shutdown() {
+	for _, node := range n.Nodes() {
+		node.stop()
+	}
+}
+
+func (n *Network) assembleDocument(epoch uint64) (*cpki.Document, error) {
+	doc := &cpki.Document{
+		Epoch:           epoch,
+		MixLambda:       mixLambda,
+		MixMaxDelay:     mixMaxDelay,
+		SendLambda:      sendLambda,
+		SendMaxInterval: sendMaxInterval,
+	}
+
+	for _, node := range n.Nodes() {
+		desc, err := n.waitForDescriptor(node, epoch)
+		if err != nil {
+			return nil, err
+		}
+		if node.Config.Server.IsProvider {
+			doc.Providers = append(doc.Providers, desc)
+			continue
+		}
+
+		desc.Layer = node.layer
+		for int(node.layer) >= len(doc.Topology) {
+			doc.Topology = append(doc.Topology, nil)
+		}
+		doc.Topology[node.layer] = append(doc.Topology[node.layer], desc)
+	}
+
+	return doc, nil
+}
+
+func (n *Network) waitForDescriptor(node *Node, epoch uint64) (*cpki.MixDescriptor, error) {
+	fn := fmt.Sprintf(pki.StaticDescriptorFmt, epoch, hex.EncodeToString(node.IdentityKey().Bytes()))
+	f := filepath.Join(n.descriptorDir, fn)
+
+	deadline := time.Now().Add(descriptorWait)
+	for {
+		b, err := ioutil.ReadFile(f)
+		if err == nil {
+			return parseDescriptor(node, b)
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("testnet: timed out waiting for descriptor: %v", node.Config.Server.Identifier)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func parseDescriptor(node *Node, b []byte) (*cpki.MixDescriptor, error) {
+	var sd pki.StaticDescriptor
+	if err := json.Unmarshal(b, &sd); err != nil {
+		return nil, err
+	}
+	if !node.IdentityKey().Verify(sd.Signature, sd.Descriptor) {
+		return nil, fmt.Errorf("testnet: invalid descriptor signature: %v", node.Config.Server.Identifier)
+	}
+	desc := new(cpki.MixDescriptor)
+	if err := json.Unmarshal(sd.Descriptor, desc); err != nil {
+		return nil, err
+	}
+	return desc, nil
+}
+
+func (n *Network) writeDocument(doc *cpki.Document) error {
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	f := filepath.Join(n.documentDir, fmt.Sprintf(pki.StaticDocumentFmt, doc.Epoch))
+	return ioutil.WriteFile(f, b, 0600)
+}
+
+func (n *Network) newNode(identifier string, isProvider bool) (*Node, error) {
+	addr, err := freeAddress()
+	if err != nil {
+		return nil, err
+	}
+	healthAddr, err := freeAddress()
+	if err != nil {
+		return nil, err
+	}
+	identityKey, err := eddsa.NewKeypair(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &config.Config{
+		Server: &config.Server{
+			Identifier: identifier,
+			Addresses:  []string{addr},
+			DataDir:    filepath.Join(n.baseDir, identifier),
+			IsProvider: isProvider,
+		},
+		Logging: &config.Logging{
+			File:  "katzenpost.log",
+			Level: "DEBUG",
+		},
+		PKI: &config.PKI{
+			Static: &config.Static{
+				DocumentDir:   n.documentDir,
+				DescriptorDir: n.descriptorDir,
+			},
+		},
+		Health: &config.Health{
+			Enable:  true,
+			Address: healthAddr,
+		},
+		Debug: &config.Debug{
+			IdentityKey:      identityKey,
+			NumSphinxWorkers: 1,
+			AllowUnsignedPKI: true,
+			DisableRateLimit: true,
+			ReplayFilterSize: 20, // The default is excessive for testing.
+		},
+	}
+	if isProvider {
+		cfg.Provider = &config.Provider{}
+	}
+	if err = cfg.FixupAndValidate(); err != nil {
+		return nil, err
+	}
+
+	return &Node{
+		Config:      cfg,
+		identityKey: identityKey,
+	}, nil
+}
+
+func freeAddress() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return l.Addr().String(), nil
+}
+
+// New constructs a new Network under baseDir, with nrLayers layers of
+// nrMixesPerLayer mixes each, and nrProviders providers.  The network is not
+// started till Start is called.
+func New(baseDir string, nrLayers, nrMixesPerLayer, nrProviders int) (*Network, error) {
+	if !filepath.IsAbs(baseDir) {
+		return nil, fmt.Errorf("testnet: '%v' is not an absolute path", baseDir)
+	}
+	if nrLayers <= 0 || nrMixesPerLayer <= 0 || nrProviders <= 0 {
+		return nil, errors.New("testnet: invalid topology")
+	}
+
+	n := &Network{
+		baseDir:       baseDir,
+		documentDir:   filepath.Join(baseDir, "documents"),
+		descriptorDir: filepath.Join(baseDir, "descriptors"),
+	}
+	for _, d := range []string{n.documentDir, n.descriptorDir} {
+		if err := os.MkdirAll(d, 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	for l := 0; l < nrLayers; l++ {
+		for i := 0; i < nrMixesPerLayer; i++ {
+			node, err := n.newNode(fmt.Sprintf("mix-%d-%d", l, i), false)
+			if err != nil {
+				return nil, err
+			}
+			node.layer = uint8(l)
+			n.Mixes = append(n.Mixes, node)
+		}
+	}
+	for i := 0; i < nrProviders; i++ {
+		node, err := n.newNode(fmt.Sprintf("provider-%d", i), true)
+		if err != nil {
+			return nil, err
+		}
+		n.Providers = append(n.Providers, node)
+	}
+
+	return n, nil
+}
@@ -0,0 +1,197 @@
+// testnet_test.go - In-process test network tests.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package testnet
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/core/sphinx"
+	"github.com/katzenpost/core/wire/commands"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNetwork(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+
+	require := require.New(t)
+
+	baseDir, err := ioutil.TempDir("", "testnet")
+	require.NoError(err, "TempDir()")
+	defer os.RemoveAll(baseDir)
+
+	n, err := New(baseDir, 3, 1, 2)
+	require.NoError(err, "New()")
+
+	aliceKey, err := n.AddUser(0, "alice")
+	require.NoError(err, "AddUser(alice)")
+	bobKey, err := n.AddUser(1, "bob")
+	require.NoError(err, "AddUser(bob)")
+
+	require.NoError(n.Start(), "Start()")
+	defer n.Shutdown()
+
+	alice, err := n.Dial(0, "alice", aliceKey)
+	require.NoError(err, "Dial(alice)")
+	defer alice.Close()
+	bob, err := n.Dial(1, "bob", bobKey)
+	require.NoError(err, "Dial(bob)")
+	defer bob.Close()
+
+	// Send a message from alice to bob, with a SURB for the ACK.  The
+	// outgoing connections between the nodes may not be established yet,
+	// so resend periodically till the message is delivered.
+	msg := []byte("The quick brown fox jumps over the lazy dog.")
+	surbKeys := make(map[[16]byte][]byte)
+	sendFn := func() {
+		surbID, surbKey, err := alice.SendMessage("bob", n.ProviderDescriptor(1), msg)
+		require.NoError(err, "SendMessage()")
+		surbKeys[*surbID] = surbKey
+	}
+	sendFn()
+
+	var gotMessage, gotACK bool
+	deadline := time.Now().Add(60 * time.Second)
+	lastSend := time.Now()
+	for !gotMessage || !gotACK {
+		require.True(time.Now().Before(deadline), "Timed out: Message: %v ACK: %v", gotMessage, gotACK)
+
+		if !gotMessage && time.Since(lastSend) > 5*time.Second {
+			sendFn()
+			lastSend = time.Now()
+		}
+
+		if !gotMessage {
+			cmd, err := bob.Retrieve()
+			require.NoError(err, "bob.Retrieve()")
+			if m, ok := cmd.(*commands.Message); ok {
+				require.True(bytes.HasPrefix(m.Payload, msg), "Message: payload mismatch")
+				require.Equal(make([]byte, len(m.Payload)-len(msg)), m.Payload[len(msg):], "Message: padding")
+				gotMessage = true
+			}
+		}
+
+		if !gotACK {
+			cmd, err := alice.Retrieve()
+			require.NoError(err, "alice.Retrieve()")
+			if ack, ok := cmd.(*commands.MessageACK); ok {
+				surbKey, ok := surbKeys[ack.ID]
+				require.True(ok, "MessageACK: unknown SURB ID")
+				_, err = sphinx.DecryptSURBPayload(ack.Payload, surbKey)
+				require.NoError(err, "DecryptSURBPayload()")
+				gotACK = true
+			}
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// Every node relayed traffic, so every node should be ready.
+	for _, node := range n.Nodes() {
+		requireHealthy(t, node, "/healthz")
+		requireHealthy(t, node, "/readyz")
+	}
+}
+
+// requireHealthy polls a node's health check endpoint till it reports that
+// all of the checks pass.
+func requireHealthy(t *testing.T, node *Node, endpoint string) {
+	require := require.New(t)
+
+	url := "http://" + node.Config.Health.Address + endpoint
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		resp, err := http.Get(url)
+		require.NoError(err, "%v: GET %v", node.Config.Server.Identifier, endpoint)
+
+		var report struct {
+			Ok     bool
+			Checks []struct {
+				Name   string
+				Ok     bool
+				Detail string
+			}
+		}
+		err = json.NewDecoder(resp.Body).Decode(&report)
+		resp.Body.Close()
+		require.NoError(err, "%v: %v: Decode()", node.Config.Server.Identifier, endpoint)
+		if report.Ok {
+			require.Equal(http.StatusOK, resp.StatusCode, "%v: %v: StatusCode", node.Config.Server.Identifier, endpoint)
+			return
+		}
+		require.Equal(http.StatusServiceUnavailable, resp.StatusCode, "%v: %v: StatusCode", node.Config.Server.Identifier, endpoint)
+		require.True(time.Now().Before(deadline), "%v: %v: Timed out: %+v", node.Config.Server.Identifier, endpoint, report.Checks)
+		time.Sleep(time.Second)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+
+	require := require.New(t)
+
+	baseDir, err := ioutil.TempDir("", "testnet")
+	require.NoError(err, "TempDir()")
+	defer os.RemoveAll(baseDir)
+
+	n, err := New(baseDir, 1, 1, 1)
+	require.NoError(err, "New()")
+
+	aliceKey, err := n.AddUser(0, "alice")
+	require.NoError(err, "AddUser(alice)")
+
+	require.NoError(n.Start(), "Start()")
+	defer n.Shutdown()
+
+	alice, err := n.Dial(0, "alice", aliceKey)
+	require.NoError(err, "Dial(alice)")
+
+	s := n.Providers[0].Server
+	s.Drain(time.Minute)
+
+	// New connections are refused, existing clients can still retrieve.
+	_, err = n.Dial(0, "alice", aliceKey)
+	require.Error(err, "Dial(alice): Draining")
+	_, err = alice.Retrieve()
+	require.NoError(err, "Retrieve(): Draining")
+	resp, err := http.Get("http://" + n.Providers[0].Config.Health.Address + "/readyz")
+	require.NoError(err, "GET /readyz: Draining")
+	resp.Body.Close()
+	require.Equal(http.StatusServiceUnavailable, resp.StatusCode, "/readyz: Draining")
+
+	// Once the last client disconnects the drain completes.
+	alice.Close()
+	haltedCh := make(chan struct{})
+	go func() {
+		s.Wait()
+		close(haltedCh)
+	}()
+	select {
+	case <-haltedCh:
+	case <-time.After(10 * time.Second):
+		require.Fail("Timed out waiting for the drain to complete")
+	}
+}
@@ -0,0 +1,402 @@
+// translog.go - Identity key transparency log.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package translog implements the append-only Merkle tree log of user
+// identity key changes, that allows clients to audit the keys served by the
+// provider.  The tree hashing and inclusion proofs follow RFC 6962.
+package translog
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"sort"
+	"sync"
+
+	bolt "github.com/coreos/bbolt"
+)
+
+const (
+	// LogFile is the name of the file under the DataDir that holds the log.
+	LogFile = "identitylog.db"
+
+	// HashSize is the size of a tree hash in bytes.
+	HashSize = sha256.Size
+
+	metadataBucket = "metadata"
+	entriesBucket  = "entries"
+	versionKey     = "version"
+
+	maxFieldLength = 255
+	leafPrefix     = 0x00
+	nodePrefix     = 0x01
+)
+
+var (
+	// ErrInvalidEntry is the error returned when an entry is malformed.
+	ErrInvalidEntry = errors.New("translog: invalid entry")
+
+	// ErrInvalidIndex is the error returned when a leaf index or tree size
+	// is out of range.
+	ErrInvalidIndex = errors.New("translog: invalid index")
+)
+
+// Entry is a log entry, that records a change to a user's identity key.
+type Entry struct {
+	// User is the user name.
+	User []byte
+
+	// PublicKey is the new identity key, or nil if the key was removed.
+	PublicKey []byte
+
+	// Time is the unix time at which the change was made.
+	Time int64
+}
+
+// MarshalBinary returns the canonical serialization of the Entry, which is
+// the leaf data that is hashed into the tree.
+func (e *Entry) MarshalBinary() ([]byte, error) {
+	if len(e.User) == 0 || len(e.User) > maxFieldLength || len(e.PublicKey) > maxFieldLength {
+		return nil, ErrInvalidEntry
+	}
+
+	b := make([]byte, 0, 2+len(e.User)+len(e.PublicKey)+8)
+	b = append(b, byte(len(e.User)))
+	b = append(b, e.User...)
+	b = append(b, byte(len(e.PublicKey)))
+	b = append(b, e.PublicKey...)
+	var rawTime [8]byte
+	binary.BigEndian.PutUint64(rawTime[:], uint64(e.Time))
+	return append(b, rawTime[:]...), nil
+}
+
+// UnmarshalBinary deserializes an Entry.
+func (e *Entry) UnmarshalBinary(b []byte) error {
+	if len(b) < 1 {
+		return ErrInvalidEntry
+	}
+	uLen := int(b[0])
+	b = b[1:]
+	if uLen == 0 || len(b) < uLen+1 {
+		return ErrInvalidEntry
+	}
+	e.User = append([]byte{}, b[:uLen]...)
+	b = b[uLen:]
+
+	kLen := int(b[0])
+	b = b[1:]
+	if len(b) != kLen+8 {
+		return ErrInvalidEntry
+	}
+	e.PublicKey = nil
+	if kLen > 0 {
+		e.PublicKey = append([]byte{}, b[:kLen]...)
+	}
+	e.Time = int64(binary.BigEndian.Uint64(b[kLen:]))
+	return nil
+}
+
+// Head is a tree head, that commits to every entry in the log at the time
+// that it was taken.
+type Head struct {
+	// Size is the number of entries in the tree.
+	Size uint64
+
+	// Root is the tree's root hash.
+	Root []byte
+}
+
+// Log is an append-only identity key transparency log.
+type Log struct {
+	sync.RWMutex
+
+	db     *bolt.DB
+	latest map[string]uint64
+
+	// nodes[level] holds the hashes of the complete subtrees of 2^level
+	// leaves, left to right, so nodes[0] holds the leaf hashes.  Every
+	// subtree hash that is needed for a tree head or an inclusion proof is
+	// derived from at most log2(size) of these.
+	nodes [][][]byte
+	root  []byte
+}
+
+// Append appends the entry e to the log, and returns it's leaf index.
+func (l *Log) Append(e *Entry) (uint64, error) {
+	b, err := e.MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	idx := l.size()
+	if err = l.db.Update(func(tx *bolt.Tx) error {
+		var rawIdx [8]byte
+		binary.BigEndian.PutUint64(rawIdx[:], idx)
+		return tx.Bucket([]byte(entriesBucket)).Put(rawIdx[:], b)
+	}); err != nil {
+		return 0, err
+	}
+
+	l.appendLeaf(LeafHash(b))
+	l.latest[string(e.User)] = idx
+	return idx, nil
+}
+
+func (l *Log) size() uint64 {
+	if len(l.nodes) == 0 {
+		return 0
+	}
+	return uint64(len(l.nodes[0]))
+}
+
+// appendLeaf appends the leaf hash h to the tree, and updates the cached
+// subtree hashes and root hash.
+func (l *Log) appendLeaf(h []byte) {
+	for level := 0; ; level++ {
+		if level == len(l.nodes) {
+			l.nodes = append(l.nodes, nil)
+		}
+		l.nodes[level] = append(l.nodes[level], h)
+
+		// A subtree is completed by every second node at each level.
+		n := len(l.nodes[level])
+		if n&1 == 1 {
+			break
+		}
+		h = nodeHash(l.nodes[level][n-2], l.nodes[level][n-1])
+	}
+	l.root = l.subtreeHash(0, l.size())
+}
+
+// subtreeHash returns the hash of the subtree over the leaves [lo, hi), as
+// split by RFC 6962.  lo must be a multiple of the largest power of 2 less
+// than hi - lo, which holds for every subtree of the tree over [0, size).
+func (l *Log) subtreeHash(lo, hi uint64) []byte {
+	n := hi - lo
+	switch {
+	case n == 0:
+		h := sha256.Sum256(nil)
+		return h[:]
+	case n&(n-1) == 0:
+		level := uint(bits.TrailingZeros64(n))
+		return l.nodes[level][lo>>level]
+	}
+	k := splitPoint(n)
+	return nodeHash(l.subtreeHash(lo, lo+k), l.subtreeHash(lo+k, hi))
+}
+
+// auditPath returns the audit path for the leaf index idx in the subtree over
+// the leaves [lo, hi).
+func (l *Log) auditPath(idx, lo, hi uint64) [][]byte {
+	if hi-lo <= 1 {
+		return nil
+	}
+	k := splitPoint(hi - lo)
+	if idx < lo+k {
+		return append(l.auditPath(idx, lo, lo+k), l.subtreeHash(lo+k, hi))
+	}
+	return append(l.auditPath(idx, lo+k, hi), l.subtreeHash(lo, lo+k))
+}
+
+// Head returns the current tree head.
+func (l *Log) Head() *Head {
+	l.RLock()
+	defer l.RUnlock()
+
+	return &Head{
+		Size: l.size(),
+		Root: append([]byte{}, l.root...),
+	}
+}
+
+// Latest returns the leaf index of the most recent entry for the user u,
+// and true iff such an entry exists.
+func (l *Log) Latest(u []byte) (uint64, bool) {
+	l.RLock()
+	defer l.RUnlock()
+
+	idx, ok := l.latest[string(u)]
+	return idx, ok
+}
+
+// Users returns the user name of every user with an entry in the log,
+// sorted.
+func (l *Log) Users() [][]byte {
+	l.RLock()
+	defer l.RUnlock()
+
+	users := make([][]byte, 0, len(l.latest))
+	for u := range l.latest {
+		users = append(users, []byte(u))
+	}
+	sort.Slice(users, func(i, j int) bool { return bytes.Compare(users[i], users[j]) < 0 })
+	return users
+}
+
+// Entry returns the serialized entry at the leaf index idx.
+func (l *Log) Entry(idx uint64) ([]byte, error) {
+	var b []byte
+	err := l.db.View(func(tx *bolt.Tx) error {
+		var rawIdx [8]byte
+		binary.BigEndian.PutUint64(rawIdx[:], idx)
+		if v := tx.Bucket([]byte(entriesBucket)).Get(rawIdx[:]); v != nil {
+			b = append([]byte{}, v...)
+			return nil
+		}
+		return ErrInvalidIndex
+	})
+	return b, err
+}
+
+// InclusionProof returns the audit path for the leaf index idx in the tree
+// of size entries.
+func (l *Log) InclusionProof(idx, size uint64) ([][]byte, error) {
+	l.RLock()
+	defer l.RUnlock()
+
+	if size > l.size() || idx >= size {
+		return nil, ErrInvalidIndex
+	}
+	return l.auditPath(idx, 0, size), nil
+}
+
+// Close closes the log.
+func (l *Log) Close() {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.db != nil {
+		l.db.Close()
+		l.db = nil
+	}
+}
+
+// LeafHash returns the hash of the serialized entry b.
+func LeafHash(b []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{leafPrefix})
+	h.Write(b)
+	return h.Sum(nil)
+}
+
+func nodeHash(l, r []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{nodePrefix})
+	h.Write(l)
+	h.Write(r)
+	return h.Sum(nil)
+}
+
+// splitPoint returns the largest power of 2 less than n.
+func splitPoint(n uint64) uint64 {
+	k := uint64(1)
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+// VerifyInclusion returns true iff proof shows that the leaf hash leafHash
+// is at the leaf index idx of the tree of size entries with the root hash
+// root.
+func VerifyInclusion(leafHash []byte, idx, size uint64, proof [][]byte, root []byte) bool {
+	if idx >= size {
+		return false
+	}
+
+	fn, sn := idx, size-1
+	r := leafHash
+	for _, p := range proof {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			r = nodeHash(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = nodeHash(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	return sn == 0 && bytes.Equal(r, root)
+}
+
+// New creates (or loads) a log with the given file name f.
+func New(f string) (*Log, error) {
+	var err error
+
+	l := &Log{
+		latest: make(map[string]uint64),
+	}
+	l.root = l.subtreeHash(0, 0)
+	l.db, err = bolt.Open(f, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = l.db.Update(func(tx *bolt.Tx) error {
+		// Ensure that all the buckets exists, and grab the metadata bucket.
+		bkt, err := tx.CreateBucketIfNotExists([]byte(metadataBucket))
+		if err != nil {
+			return err
+		}
+		eBkt, err := tx.CreateBucketIfNotExists([]byte(entriesBucket))
+		if err != nil {
+			return err
+		}
+
+		if b := bkt.Get([]byte(versionKey)); b != nil {
+			// Well it looks like we loaded as opposed to created.
+			if len(b) != 1 || b[0] != 0 {
+				return fmt.Errorf("translog: incompatible version: %d", uint(b[0]))
+			}
+
+			// Rebuild the tree, ensuring that the log is contiguous.
+			return eBkt.ForEach(func(k, v []byte) error {
+				idx := l.size()
+				if len(k) != 8 || binary.BigEndian.Uint64(k) != idx {
+					return fmt.Errorf("translog: corrupted log at index %d", idx)
+				}
+				var e Entry
+				if err := e.UnmarshalBinary(v); err != nil {
+					return err
+				}
+				l.latest[string(e.User)] = idx
+				l.appendLeaf(LeafHash(v))
+				return nil
+			})
+		}
+
+		// We created a new database, so populate the new `metadata` bucket.
+		return bkt.Put([]byte(versionKey), []byte{0})
+	}); err != nil {
+		// The struct isn't getting returned so clean up the database.
+		l.db.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
@@ -0,0 +1,130 @@
+// translog_test.go - Identity key transparency log tests.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package translog
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// treeHash is the RFC 6962 tree hash computed directly from the leaf hashes,
+// that the cached subtree hashes are checked against.
+func treeHash(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 0:
+		h := sha256.Sum256(nil)
+		return h[:]
+	case 1:
+		return leaves[0]
+	}
+	k := splitPoint(uint64(len(leaves)))
+	return nodeHash(treeHash(leaves[:k]), treeHash(leaves[k:]))
+}
+
+func TestLog(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "translog_test")
+	require.NoError(err, "TempDir()")
+	defer os.RemoveAll(dir)
+	f := filepath.Join(dir, LogFile)
+
+	l, err := New(f)
+	require.NoError(err, "New()")
+
+	// The empty tree hash is the hash of the empty string.
+	h := l.Head()
+	require.Equal(uint64(0), h.Size, "Head(): Empty")
+	require.Equal(treeHash(nil), h.Root, "Head(): Empty")
+
+	_, err = l.Append(&Entry{Time: 1})
+	require.Equal(ErrInvalidEntry, err, "Append(): No user")
+
+	const nrEntries = 13
+	for i := 0; i < nrEntries; i++ {
+		e := &Entry{
+			User: []byte(fmt.Sprintf("user%d", i%5)),
+			Time: int64(1500000000 + i),
+		}
+		if i%4 != 3 {
+			e.PublicKey = bytes.Repeat([]byte{byte(i)}, 32)
+		}
+		idx, err := l.Append(e)
+		require.NoError(err, "Append(%d)", i)
+		require.Equal(uint64(i), idx, "Append(%d)", i)
+	}
+
+	idx, ok := l.Latest([]byte("user1"))
+	require.True(ok, "Latest(user1)")
+	require.Equal(uint64(11), idx, "Latest(user1)")
+	_, ok = l.Latest([]byte("malory"))
+	require.False(ok, "Latest(malory)")
+	users := l.Users()
+	require.Len(users, 5, "Users()")
+	require.Equal([]byte("user0"), users[0], "Users()[0]")
+	require.Equal([]byte("user4"), users[4], "Users()[4]")
+
+	b, err := l.Entry(idx)
+	require.NoError(err, "Entry(%d)", idx)
+	var e Entry
+	require.NoError(e.UnmarshalBinary(b), "UnmarshalBinary()")
+	require.Equal([]byte("user1"), e.User, "Entry(): User")
+	require.Nil(e.PublicKey, "Entry(): Removed key")
+	require.Equal(int64(1500000011), e.Time, "Entry(): Time")
+	_, err = l.Entry(nrEntries)
+	require.Equal(ErrInvalidIndex, err, "Entry(): Out of range")
+
+	// Every entry is provably included in every tree that contains it, and
+	// the cached hashes match the tree hashed from the leaves.
+	h = l.Head()
+	require.Equal(uint64(nrEntries), h.Size, "Head()")
+	leaves := l.nodes[0]
+	require.Equal(treeHash(leaves), h.Root, "Head(): Root")
+	for size := uint64(1); size <= h.Size; size++ {
+		root := treeHash(leaves[:size])
+		require.Equal(root, l.subtreeHash(0, size), "subtreeHash(0, %d)", size)
+		for i := uint64(0); i < size; i++ {
+			proof, err := l.InclusionProof(i, size)
+			require.NoError(err, "InclusionProof(%d, %d)", i, size)
+			require.True(VerifyInclusion(leaves[i], i, size, proof, root), "VerifyInclusion(%d, %d)", i, size)
+			if size > 1 {
+				require.False(VerifyInclusion(leaves[(i+1)%size], i, size, proof, root), "VerifyInclusion(%d, %d): Wrong leaf", i, size)
+			}
+		}
+	}
+	_, err = l.InclusionProof(h.Size, h.Size)
+	require.Equal(ErrInvalidIndex, err, "InclusionProof(): Out of range")
+	_, err = l.InclusionProof(0, h.Size+1)
+	require.Equal(ErrInvalidIndex, err, "InclusionProof(): Too large")
+
+	// The tree is rebuilt when the log is loaded.
+	l.Close()
+	l, err = New(f)
+	require.NoError(err, "New() load")
+	defer l.Close()
+	require.Equal(h, l.Head(), "Head(): Loaded")
+	idx, ok = l.Latest([]byte("user1"))
+	require.True(ok, "Latest(user1): Loaded")
+	require.Equal(uint64(11), idx, "Latest(user1): Loaded")
+}
@@ -0,0 +1,258 @@
+// linkkey.go - Katzenpost server link key store.
+// Copyright (C) 2017  Yawning Angel.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/server/internal/clock"
+	"github.com/katzenpost/server/internal/constants"
+	"github.com/katzenpost/server/internal/keystore"
+	"gopkg.in/op/go-logging.v1"
+)
+
+const (
+	// LegacyLinkKeyFile is the name of the file under the DataDir that holds
+	// the link key when link key rotation is disabled.
+	LegacyLinkKeyFile = "link.private.pem"
+
+	// LinkKeyGlob is the pattern that matches the names of the files under
+	// the DataDir that hold the link keys when link key rotation is enabled.
+	LinkKeyGlob = "link-*.private.pem"
+
+	linkKeyFmt = "link-%d.private.pem"
+)
+
+// LinkKeyFile returns the name of the file under the DataDir that holds the
+// link key that becomes active at epoch, when link key rotation is enabled.
+func LinkKeyFile(epoch uint64) string {
+	return fmt.Sprintf(linkKeyFmt, epoch)
+}
+
+// linkKeys is the set of link keys, indexed by the epoch at which each key
+// becomes active.
+type linkKeys struct {
+	sync.RWMutex
+
+	log      *logging.Logger
+	clock    clock.Clock
+	dataDir  string
+	lifetime uint64
+	keystore *keystore.Keystore
+
+	keys map[uint64]*ecdh.PrivateKey
+}
+
+func (l *linkKeys) init() error {
+	legacyFile := filepath.Join(l.dataDir, LegacyLinkKeyFile)
+	if l.lifetime == 0 {
+		// Link key rotation is disabled, just use the single key.
+		k, err := l.load(legacyFile)
+		if err != nil {
+			return err
+		}
+		l.keys[0] = k
+		return nil
+	}
+
+	// Load all of the persisted link keys.
+	files, err := filepath.Glob(filepath.Join(l.dataDir, LinkKeyGlob))
+	if err != nil {
+		return err
+	}
+	keyFmt := filepath.Join(l.dataDir, linkKeyFmt)
+	for _, f := range files {
+		e := uint64(0)
+		if _, err := fmt.Sscanf(f, keyFmt, &e); err != nil {
+			l.log.Debugf("Failed to extract epoch from '%v': %v", f, err)
+			continue
+		}
+		k, err := l.load(f)
+		if err != nil {
+			return err
+		}
+		l.keys[e] = k
+	}
+
+	// Migrate (or generate) the initial key, which is considered active
+	// as of the current epoch.
+	if len(l.keys) == 0 {
+		epoch, _, _ := l.clock.Epoch()
+		f := filepath.Join(l.dataDir, LinkKeyFile(epoch))
+		if _, err := os.Lstat(legacyFile); err == nil {
+			l.log.Noticef("Migrating link key to support rotation.")
+			if err = os.Rename(legacyFile, f); err != nil {
+				return err
+			}
+		}
+		k, err := l.load(f)
+		if err != nil {
+			return err
+		}
+		l.keys[epoch] = k
+	}
+
+	return nil
+}
+
+func (l *linkKeys) load(f string) (*ecdh.PrivateKey, error) {
+	if l.keystore != nil {
+		return l.keystore.LoadLinkKey(f)
+	}
+	return ecdh.Load(f, "", rand.Reader)
+}
+
+// activeEpoch returns the epoch at which the key used for epoch became
+// active.  The caller must hold the lock.
+func (l *linkKeys) activeEpoch(epoch uint64) (uint64, bool) {
+	var (
+		activeEpoch uint64
+		found       bool
+	)
+	for e := range l.keys {
+		if e <= epoch && (!found || e > activeEpoch) {
+			activeEpoch = e
+			found = true
+		}
+	}
+	return activeEpoch, found
+}
+
+// Current returns the link key for the current epoch.
+func (l *linkKeys) Current() *ecdh.PrivateKey {
+	epoch, _, _ := l.clock.Epoch()
+
+	l.RLock()
+	defer l.RUnlock()
+
+	if e, ok := l.activeEpoch(epoch); ok {
+		return l.keys[e]
+	}
+
+	// The clock must have jumped backwards past every key that we have,
+	// use the oldest key since it's the least wrong.
+	if epochs := l.sortedEpochs(); len(epochs) > 0 {
+		return l.keys[epochs[0]]
+	}
+	return nil
+}
+
+func (l *linkKeys) Generate(epoch uint64) (bool, error) {
+	if l.lifetime == 0 {
+		return false, nil
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	// Generate a new key, active from epoch, if the key that would otherwise
+	// be used for epoch has hit the end of it's lifetime.
+	if e, ok := l.activeEpoch(epoch); ok && epoch-e < l.lifetime {
+		return false, nil
+	}
+	f := filepath.Join(l.dataDir, LinkKeyFile(epoch))
+	k, err := l.load(f)
+	if err != nil {
+		return false, err
+	}
+	l.log.Noticef("Generated link key for epoch %v: %s", epoch, k.PublicKey())
+	l.keys[epoch] = k
+
+	return true, nil
+}
+
+func (l *linkKeys) Prune() bool {
+	if l.lifetime == 0 {
+		return false
+	}
+	epoch, _, _ := l.clock.Epoch()
+	didPrune := false
+
+	l.Lock()
+	defer l.Unlock()
+
+	// Retain every key that is listed in a PKI document that may still
+	// be used to authenticate connections, which is every key superseded
+	// after the oldest of the documents.
+	epochs := l.sortedEpochs()
+	for i := 0; i < len(epochs)-1; i++ {
+		if epochs[i+1]+constants.NumMixKeys-1 > epoch {
+			break
+		}
+		f := filepath.Join(l.dataDir, LinkKeyFile(epochs[i]))
+		l.log.Debugf("Purging expired link key for epoch: %v", epochs[i])
+		l.keys[epochs[i]].Reset()
+		delete(l.keys, epochs[i])
+		os.Remove(f)
+		didPrune = true
+	}
+
+	return didPrune
+}
+
+func (l *linkKeys) Get(epoch uint64) (*ecdh.PublicKey, bool) {
+	l.RLock()
+	defer l.RUnlock()
+
+	if e, ok := l.activeEpoch(epoch); ok {
+		return l.keys[e].PublicKey(), true
+	}
+	return nil, false
+}
+
+func (l *linkKeys) Halt() {
+	l.Lock()
+	defer l.Unlock()
+
+	for e, k := range l.keys {
+		k.Reset()
+		delete(l.keys, e)
+	}
+}
+
+func (l *linkKeys) sortedEpochs() []uint64 {
+	epochs := make([]uint64, 0, len(l.keys))
+	for e := range l.keys {
+		epochs = append(epochs, e)
+	}
+	sort.Slice(epochs, func(i, j int) bool { return epochs[i] < epochs[j] })
+	return epochs
+}
+
+func newLinkKeys(s *Server) (*linkKeys, error) {
+	l := &linkKeys{
+		log:      s.logBackend.GetLogger("linkkeys"),
+		clock:    s.clock,
+		dataDir:  s.cfg.Server.DataDir,
+		lifetime: s.cfg.Server.LinkKeyLifetime,
+		keystore: s.keystore,
+		keys:     make(map[uint64]*ecdh.PrivateKey),
+	}
+
+	if err := l.init(); err != nil {
+		l.Halt()
+		return nil, err
+	}
+
+	return l, nil
+}
@@ -21,11 +21,12 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/katzenpost/core/crypto/ecdh"
-	"github.com/katzenpost/core/epochtime"
 	"github.com/katzenpost/server/internal/constants"
 	"github.com/katzenpost/server/internal/glue"
+	"github.com/katzenpost/server/internal/keystore"
 	"github.com/katzenpost/server/internal/mixkey"
 	"gopkg.in/op/go-logging.v1"
 )
@@ -33,23 +34,40 @@ import (
 type mixKeys struct {
 	sync.Mutex
 
-	glue glue.Glue
-	log  *logging.Logger
+	glue     glue.Glue
+	log      *logging.Logger
+	keystore *keystore.Keystore
 
 	keys map[uint64]*mixkey.MixKey
 }
 
 func (m *mixKeys) init() error {
 	// Generate/load the initial set of keys.
-	//
-	// TODO: In theory this should also try to load the previous epoch's key
-	// if the current time is in the clock skew grace period.  But it may not
-	// matter much in practice.
-	epoch, _, _ := epochtime.Now()
+	epoch, elapsed, _ := m.glue.Clock().Epoch()
 	if _, err := m.Generate(epoch); err != nil {
 		return err
 	}
 
+	// If the current time is in the clock skew grace period, load the
+	// previous epoch's key (and replay filter) if it was persisted, so that
+	// restarting right after an epoch transition does not drop delayed
+	// packets.
+	if elapsed < constants.MixKeyGracePeriod {
+		f := filepath.Join(m.glue.Config().Server.DataDir, fmt.Sprintf(mixkey.KeyFmt, epoch-1))
+		if _, err := os.Lstat(f); err == nil {
+			k, err := mixkey.New(m.glue.Config().Server.DataDir, epoch-1, m.keystore, m.filterConfig(), m.glue.Clock())
+			if err != nil {
+				m.log.Warningf("Failed to load previous epoch's key: %v", err)
+			} else {
+				m.log.Debugf("Loaded previous epoch's key for the grace period: %v", epoch-1)
+				k.SetUnlinkIfExpired(true)
+				m.Lock()
+				m.keys[epoch-1] = k
+				m.Unlock()
+			}
+		}
+	}
+
 	// Clean up stale mix keys hanging around the data directory.
 	files, err := filepath.Glob(filepath.Join(m.glue.Config().Server.DataDir, mixkey.KeyGlob))
 	if err != nil {
@@ -65,12 +83,22 @@ func (m *mixKeys) init() error {
 		if _, ok := m.keys[e]; !ok && e < epoch {
 			m.log.Debugf("Purging stale key: %v", f)
 			os.Remove(f)
+			os.Remove(filepath.Join(m.glue.Config().Server.DataDir, fmt.Sprintf(mixkey.SnapshotFmt, e)))
 		}
 	}
 
 	return nil
 }
 
+func (m *mixKeys) filterConfig() *mixkey.FilterConfig {
+	dCfg := m.glue.Config().Debug
+	return &mixkey.FilterConfig{
+		Size:              dCfg.ReplayFilterSize,
+		FalsePositiveRate: dCfg.ReplayFilterFalsePositiveRate,
+		SnapshotInterval:  time.Duration(dCfg.ReplayFilterSnapshotInterval) * time.Millisecond,
+	}
+}
+
 func (m *mixKeys) Generate(baseEpoch uint64) (bool, error) {
 	didGenerate := false
 
@@ -83,7 +111,7 @@ func (m *mixKeys) Generate(baseEpoch uint64) (bool, error) {
 		}
 
 		didGenerate = true
-		k, err := mixkey.New(m.glue.Config().Server.DataDir, e)
+		k, err := mixkey.New(m.glue.Config().Server.DataDir, e, m.keystore, m.filterConfig(), m.glue.Clock())
 		if err != nil {
 			// Clean up whatever keys that may have succeded.
 			for ee := baseEpoch; ee < baseEpoch+constants.NumMixKeys; ee++ {
@@ -102,13 +130,17 @@ func (m *mixKeys) Generate(baseEpoch uint64) (bool, error) {
 }
 
 func (m *mixKeys) Prune() bool {
-	epoch, _, _ := epochtime.Now()
+	epoch, elapsed, _ := m.glue.Clock().Epoch()
 	didPrune := false
 
 	m.Lock()
 	defer m.Unlock()
 
 	for idx, v := range m.keys {
+		if idx == epoch-1 && elapsed < constants.MixKeyGracePeriod {
+			// The previous epoch's key is still valid for the grace period.
+			continue
+		}
 		if idx < epoch {
 			m.log.Debugf("Purging expired key for epoch: %v", idx)
 			v.Deref()
@@ -161,11 +193,12 @@ func (m *mixKeys) Halt() {
 	}
 }
 
-func newMixKeys(glue glue.Glue) (glue.MixKeys, error) {
+func newMixKeys(glue glue.Glue, ks *keystore.Keystore) (glue.MixKeys, error) {
 	m := &mixKeys{
-		glue: glue,
-		log:  glue.LogBackend().GetLogger("mixkeys"),
-		keys: make(map[uint64]*mixkey.MixKey),
+		glue:     glue,
+		log:      glue.LogBackend().GetLogger("mixkeys"),
+		keystore: ks,
+		keys:     make(map[uint64]*mixkey.MixKey),
 	}
 
 	if err := m.init(); err != nil {
@@ -20,6 +20,7 @@ import (
 	"time"
 
 	"github.com/katzenpost/core/worker"
+	"github.com/katzenpost/server/internal/clock"
 )
 
 type periodicTimer struct {
@@ -32,7 +33,8 @@ func (t *periodicTimer) worker() {
 	ticker := time.NewTicker(time.Second)
 	defer ticker.Stop()
 
-	lastCallbackTime := time.Now()
+	lastCallbackTime, lastCallbackMono := t.s.clock.Now(), t.s.clock.Mono()
+	lastSkewStatus := clock.SkewUnknown
 	for {
 		select {
 		case <-t.HaltCh():
@@ -49,24 +51,37 @@ func (t *periodicTimer) worker() {
 		// a need to do anything that's long lived, then it MUST be done async
 		// in a go routine.
 
-		// Ensure civil time sanity.
-		//
-		// TODO: Not sure what to do when the clock jumps around, it probably
-		// screws with epoch timing and PKI interactions, but everything
-		// should keep working, for varying amounts of "working".
-		now := time.Now()
-		deltaT := now.Sub(lastCallbackTime)
-		if deltaT < 0 {
-			t.s.log.Warningf("Civil time jumped backwards: %v", deltaT)
-		} else if deltaT > 2*time.Second {
-			t.s.log.Warningf("Civil time jumped forward: %v", deltaT)
+		// Ensure civil time sanity, by comparing the elapsed civil time
+		// against the elapsed monotonic time.  Jumps mess with the epoch
+		// timing and PKI interactions, so those are re-triggered.
+		now, nowMono := t.s.clock.Now(), t.s.clock.Mono()
+		jump := clock.Jump(now, lastCallbackTime, nowMono, lastCallbackMono)
+		if jump > maxClockJump || jump < -maxClockJump {
+			t.s.onClockJump(jump)
+		}
+
+		// Check the estimated skew against the rest of the network.
+		lastSkewStatus = t.s.checkClockSkew(lastSkewStatus)
+
+		// Discard mix keys that are no longer valid, in particular the
+		// previous epoch's key once the grace period has elapsed.  Normally
+		// this is done when the descriptor is published, which may not
+		// happen for a while after startup.
+		if t.s.mixKeys.Prune() {
+			t.s.reshadowCryptoWorkers()
 		}
 
-		// TODO: Figure out what needs to be triggered from the top level
-		// server instead of from timers belonging to a sub component.
+		// Resize the Sphinx worker pool if autoscaling is enabled.
+		t.s.cryptoWorkers.Autoscale()
+
+		// Report the progress of, and complete any drain in progress.
+		t.s.checkDrain()
+
+		// TODO: Figure out what else needs to be triggered from the top
+		// level server instead of from timers belonging to a sub component.
 
 		// Stash the time we got unblocked as the last callback time.
-		lastCallbackTime = now
+		lastCallbackTime, lastCallbackMono = now, nowMono
 	}
 }
 
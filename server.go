@@ -20,8 +20,10 @@ package server
 import (
 	"errors"
 	"fmt"
+	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 
 	"git.schwanenlied.me/yawning/aez.git"
 	"github.com/katzenpost/core/crypto/ecdh"
@@ -31,11 +33,16 @@ import (
 	"github.com/katzenpost/core/thwack"
 	"github.com/katzenpost/core/utils"
 	"github.com/katzenpost/server/config"
-	"github.com/katzenpost/server/internal/cryptoworker"
+	"github.com/katzenpost/server/internal/clock"
+	"github.com/katzenpost/server/internal/debug"
 	"github.com/katzenpost/server/internal/decoy"
 	"github.com/katzenpost/server/internal/glue"
 	"github.com/katzenpost/server/internal/incoming"
+	"github.com/katzenpost/server/internal/keystore"
+	"github.com/katzenpost/server/internal/logbackend"
+	"github.com/katzenpost/server/internal/management"
 	"github.com/katzenpost/server/internal/outgoing"
+	"github.com/katzenpost/server/internal/packet"
 	"github.com/katzenpost/server/internal/pki"
 	"github.com/katzenpost/server/internal/provider"
 	"github.com/katzenpost/server/internal/scheduler"
@@ -49,18 +56,22 @@ var ErrGenerateOnly = errors.New("server: GenerateOnly set")
 
 // Server is a Katzenpost server instance.
 type Server struct {
-	cfg *config.Config
+	cfg   *config.Config
+	clock clock.Clock
+	skew  *clock.Skew
 
 	identityKey *eddsa.PrivateKey
-	linkKey     *ecdh.PrivateKey
+	linkKeys    *linkKeys
+	keystore    *keystore.Keystore
 
 	logBackend *log.Backend
 	log        *logging.Logger
 
 	inboundPackets *channels.InfiniteChannel
+	nrUnwrapping   int64
 
 	scheduler     glue.Scheduler
-	cryptoWorkers []*cryptoworker.Worker
+	cryptoWorkers *cryptoWorkers
 	periodic      *periodicTimer
 	mixKeys       glue.MixKeys
 	pki           glue.PKI
@@ -68,7 +79,13 @@ type Server struct {
 	connector     glue.Connector
 	provider      glue.Provider
 	decoy         glue.Decoy
-	management    *thwack.Server
+	management    *management.Server
+	health        *healthServer
+
+	drainLock  sync.Mutex
+	drain      *drainState
+	drainSigCh chan os.Signal
+	isHalting  bool
 
 	fatalErrCh chan error
 	haltedCh   chan interface{}
@@ -84,18 +101,24 @@ func (s *Server) initLogging() error {
 	}
 
 	var err error
-	s.logBackend, err = log.New(p, s.cfg.Logging.Level, s.cfg.Logging.Disable)
+	s.logBackend, err = logbackend.New(s.cfg.Logging, p)
 	if err == nil {
 		s.log = s.logBackend.GetLogger("server")
 	}
 	return err
 }
 
+// submitInbound hands work off to the Sphinx workers.  The work is counted
+// before it is enqueued, so that it is never missing from the drain backlog
+// while it is being handed off.
+func (s *Server) submitInbound(e interface{}) {
+	atomic.AddInt64(&s.nrUnwrapping, 1)
+	s.inboundPackets.In() <- e
+}
+
 func (s *Server) reshadowCryptoWorkers() {
 	s.log.Debugf("Calling all crypto workers to re-shadow the mix keys.")
-	for _, w := range s.cryptoWorkers {
-		w.UpdateMixKeys()
-	}
+	s.cryptoWorkers.Reshadow()
 }
 
 // IdentityKey returns the running server's identity public key.
@@ -120,6 +143,11 @@ func (s *Server) halt() {
 
 	s.log.Noticef("Starting graceful shutdown.")
 
+	// Stop any drain in progress from completing, and new ones from
+	// starting.
+	s.stopDrainSignal()
+	s.stopDrain()
+
 	// Stop the 1 Hz periodic utility timer.
 	if s.periodic != nil {
 		s.periodic.Halt()
@@ -132,6 +160,12 @@ func (s *Server) halt() {
 		s.management = nil
 	}
 
+	// Stop the health check endpoints.
+	if s.health != nil {
+		s.health.Halt()
+		s.health = nil
+	}
+
 	// Stop the decoy source/sink.
 	if s.decoy != nil {
 		s.decoy.Halt()
@@ -153,11 +187,8 @@ func (s *Server) halt() {
 	}
 
 	// Stop the Sphinx workers.
-	for i, w := range s.cryptoWorkers {
-		if w != nil {
-			w.Halt()
-			s.cryptoWorkers[i] = nil
-		}
+	if s.cryptoWorkers != nil {
+		s.cryptoWorkers.Halt()
 	}
 
 	// Provider specific cleanup.
@@ -192,8 +223,13 @@ func (s *Server) halt() {
 	if s.inboundPackets != nil {
 		s.inboundPackets.Close()
 	}
-	s.linkKey.Reset()
+	if s.linkKeys != nil {
+		s.linkKeys.Halt()
+	}
 	s.identityKey.Reset()
+	if s.keystore != nil {
+		s.keystore.Reset()
+	}
 	close(s.fatalErrCh)
 
 	s.log.Noticef("Shutdown complete.")
@@ -205,9 +241,11 @@ func (s *Server) halt() {
 func New(cfg *config.Config) (*Server, error) {
 	s := &Server{
 		cfg:        cfg,
+		clock:      clock.Real,
 		fatalErrCh: make(chan error),
 		haltedCh:   make(chan interface{}),
 	}
+	s.skew = clock.NewSkew(s.clock)
 	goo := &serverGlue{s}
 
 	// Do the early initialization and bring up logging.
@@ -217,14 +255,20 @@ func New(cfg *config.Config) (*Server, error) {
 	if err := s.initLogging(); err != nil {
 		return nil, err
 	}
+	if s.cfg.Logging.Redact {
+		debug.EnableRedaction()
+	}
 
 	s.log.Notice("Katzenpost is still pre-alpha.  DO NOT DEPEND ON IT FOR STRONG SECURITY OR ANONYMITY.")
 	if s.cfg.Debug.IsUnsafe() {
 		s.log.Warning("Unsafe Debug configuration options are set.")
 	}
-	if s.cfg.Logging.Level == "DEBUG" {
+	if s.cfg.Logging.IsUnsafe() {
 		s.log.Warning("Unsafe Debug logging is enabled.")
 	}
+	if debug.IsRedacting() {
+		s.log.Noticef("User identifiers and keys are redacted from the log.")
+	}
 	if aez.IsHardwareAccelerated() {
 		s.log.Noticef("AEZv5 implementation is hardware accelerated.")
 	} else {
@@ -232,8 +276,17 @@ func New(cfg *config.Config) (*Server, error) {
 	}
 	s.log.Noticef("Server identifier is: '%v'", s.cfg.Server.Identifier)
 
-	// Initialize the server identity and link keys.
+	// Unlock the key encryption passphrase if enabled.
 	var err error
+	if s.cfg.KeyEncryption.Enable {
+		if s.keystore, err = keystore.NewFromConfig(s.cfg.KeyEncryption); err != nil {
+			s.log.Errorf("Failed to initialize key encryption: %v", err)
+			return nil, err
+		}
+		s.log.Noticef("Private keys are encrypted at rest.")
+	}
+
+	// Initialize the server identity and link keys.
 	if s.cfg.Debug.IdentityKey != nil {
 		s.log.Warning("IdentityKey should NOT be used for production deployments.")
 		s.identityKey = new(eddsa.PrivateKey)
@@ -241,25 +294,32 @@ func New(cfg *config.Config) (*Server, error) {
 	} else {
 		identityPrivateKeyFile := filepath.Join(s.cfg.Server.DataDir, "identity.private.pem")
 		identityPublicKeyFile := filepath.Join(s.cfg.Server.DataDir, "identity.public.pem")
-		if s.identityKey, err = eddsa.Load(identityPrivateKeyFile, identityPublicKeyFile, rand.Reader); err != nil {
+		if s.keystore != nil {
+			s.identityKey, err = s.keystore.LoadIdentityKey(identityPrivateKeyFile, identityPublicKeyFile)
+		} else {
+			s.identityKey, err = eddsa.Load(identityPrivateKeyFile, identityPublicKeyFile, rand.Reader)
+		}
+		if err != nil {
 			s.log.Errorf("Failed to initialize identity: %v", err)
 			return nil, err
 		}
 	}
 	s.log.Noticef("Server identity public key is: %s", s.identityKey.PublicKey())
-	linkKeyFile := filepath.Join(s.cfg.Server.DataDir, "link.private.pem")
-	if s.linkKey, err = ecdh.Load(linkKeyFile, "", rand.Reader); err != nil {
+	if s.linkKeys, err = newLinkKeys(s); err != nil {
 		s.log.Errorf("Failed to initialize link key: %v", err)
 		return nil, err
 	}
-	s.log.Noticef("Server link public key is: %s", s.linkKey.PublicKey())
+	s.log.Noticef("Server link public key is: %s", s.linkKeys.Current().PublicKey())
 
 	if s.cfg.Debug.GenerateOnly {
+		if s.keystore != nil {
+			s.keystore.Reset()
+		}
 		return nil, ErrGenerateOnly
 	}
 
 	// Load and or generate mix keys.
-	if s.mixKeys, err = newMixKeys(goo); err != nil {
+	if s.mixKeys, err = newMixKeys(goo, s.keystore); err != nil {
 		s.log.Errorf("Failed to initialize mix keys: %v", err)
 		return nil, err
 	}
@@ -289,23 +349,21 @@ func New(cfg *config.Config) (*Server, error) {
 	//
 	// Note: This is done first so that other subsystems may register commands.
 	if s.cfg.Management.Enable {
-		mgmtCfg := &thwack.Config{
-			Net:         "unix",
-			Addr:        s.cfg.Management.Path,
-			ServiceName: s.cfg.Server.Identifier + " Katzenpost Management Interface",
-			LogModule:   "mgmt",
-			NewLoggerFn: s.logBackend.GetLogger,
-		}
-		if s.management, err = thwack.New(mgmtCfg); err != nil {
+		if s.management, err = management.New(s.cfg, s.logBackend); err != nil {
 			s.log.Errorf("Failed to initialize management interface: %v", err)
 			return nil, err
 		}
 
 		const shutdownCmd = "SHUTDOWN"
-		s.management.RegisterCommand(shutdownCmd, func(c *thwack.Conn, l string) error {
+		s.management.RegisterCommand(shutdownCmd, management.RoleOperator, func(c *thwack.Conn, l string) error {
+			// Acknowledge the request first, since the shutdown will tear
+			// down the connection.
+			err := c.WriteReply(thwack.StatusOk)
 			s.fatalErrCh <- fmt.Errorf("user requested shutdown via mgmt interface")
-			return nil
+			return err
 		})
+		s.management.RegisterCommand(cmdClockSkew, management.RoleReadOnly, s.onClockSkew)
+		s.management.RegisterCommand(cmdDrain, management.RoleOperator, s.onDrain)
 	}
 
 	// Initialize the PKI interface.
@@ -330,11 +388,7 @@ func New(cfg *config.Config) (*Server, error) {
 
 	// Initialize and start the Sphinx workers.
 	s.inboundPackets = channels.NewInfiniteChannel()
-	s.cryptoWorkers = make([]*cryptoworker.Worker, 0, s.cfg.Debug.NumSphinxWorkers)
-	for i := 0; i < s.cfg.Debug.NumSphinxWorkers; i++ {
-		w := cryptoworker.New(goo, s.inboundPackets.Out(), i)
-		s.cryptoWorkers = append(s.cryptoWorkers, w)
-	}
+	s.cryptoWorkers = newCryptoWorkers(goo, s.inboundPackets.Out(), &s.nrUnwrapping)
 
 	// Initialize the outgoing connection manager, decoy source/sink, and then
 	// start the PKI worker.
@@ -348,7 +402,7 @@ func New(cfg *config.Config) (*Server, error) {
 	// Bring the listener(s) online.
 	s.listeners = make([]glue.Listener, 0, len(s.cfg.Server.Addresses))
 	for i, addr := range s.cfg.Server.Addresses {
-		l, err := incoming.New(goo, s.inboundPackets.In(), i, addr)
+		l, err := incoming.New(goo, i, addr)
 		if err != nil {
 			s.log.Errorf("Failed to spawn listener on address: %v (%v).", addr, err)
 			return nil, err
@@ -359,6 +413,17 @@ func New(cfg *config.Config) (*Server, error) {
 	// Start the periodic 1 Hz utility timer.
 	s.periodic = newPeriodicTimer(s)
 
+	// Allow draining the server via a signal, where supported.
+	s.startDrainSignal()
+
+	// Start the HTTP health check endpoints if enabled.
+	if s.cfg.Health.Enable {
+		if s.health, err = newHealthServer(s, goo); err != nil {
+			s.log.Errorf("Failed to initialize health check endpoints: %v", err)
+			return nil, err
+		}
+	}
+
 	// Start listening on the management interface if enabled, now that every
 	// subsystem that wants to register commands has had the opportunity to do
 	// so.
@@ -382,15 +447,27 @@ func (g *serverGlue) LogBackend() *log.Backend {
 	return g.s.logBackend
 }
 
+func (g *serverGlue) Clock() clock.Clock {
+	return g.s.clock
+}
+
+func (g *serverGlue) Skew() *clock.Skew {
+	return g.s.skew
+}
+
 func (g *serverGlue) IdentityKey() *eddsa.PrivateKey {
 	return g.s.identityKey
 }
 
 func (g *serverGlue) LinkKey() *ecdh.PrivateKey {
-	return g.s.linkKey
+	return g.s.linkKeys.Current()
+}
+
+func (g *serverGlue) LinkKeys() glue.LinkKeys {
+	return g.s.linkKeys
 }
 
-func (g *serverGlue) Management() *thwack.Server {
+func (g *serverGlue) Management() *management.Server {
 	return g.s.management
 }
 
@@ -425,3 +502,11 @@ func (g *serverGlue) Decoy() glue.Decoy {
 func (g *serverGlue) ReshadowCryptoWorkers() {
 	g.s.reshadowCryptoWorkers()
 }
+
+func (g *serverGlue) SubmitPacket(pkt *packet.Packet) {
+	g.s.submitInbound(pkt)
+}
+
+func (g *serverGlue) SubmitCryptoJob(job *packet.SURBJob) {
+	g.s.submitInbound(job)
+}
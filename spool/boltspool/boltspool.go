@@ -65,7 +65,7 @@ func (s *boltSpool) StoreSURBReply(u []byte, id *[sConstants.SURBIDLength]byte,
 
 func (s *boltSpool) doStore(u []byte, id *[sConstants.SURBIDLength]byte, msg []byte) error {
 	if len(u) == 0 || len(u) > userdb.MaxUsernameSize {
-		return fmt.Errorf("spool: invalid username: `%v`", u)
+		return fmt.Errorf("spool: invalid username length: %d", len(u))
 	}
 
 	return s.db.Update(func(tx *bolt.Tx) error {
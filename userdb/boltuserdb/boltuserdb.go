@@ -20,8 +20,10 @@ package boltuserdb
 
 import (
 	"crypto/subtle"
+	"encoding/binary"
 	"fmt"
 	"sync"
+	"time"
 
 	bolt "github.com/coreos/bbolt"
 	"github.com/katzenpost/core/crypto/ecdh"
@@ -29,8 +31,14 @@ import (
 )
 
 const (
-	usersBucket      = "users"
-	identitiesBucket = "identities"
+	usersBucket         = "users"
+	identitiesBucket    = "identities"
+	identityTimesBucket = "identityTimes"
+
+	// identityHistoryBucket holds a sub-bucket per user, mapping a big
+	// endian sequence number to the big endian unix time of the change,
+	// followed by the new key if any.
+	identityHistoryBucket = "identityHistory"
 )
 
 type boltUserDB struct {
@@ -78,7 +86,7 @@ func (d *boltUserDB) IsValid(u []byte, k *ecdh.PublicKey) bool {
 
 func (d *boltUserDB) Add(u []byte, k *ecdh.PublicKey, update bool) error {
 	if !userOk(u) {
-		return fmt.Errorf("userdb: invalid username: `%v`", u)
+		return fmt.Errorf("userdb: invalid username length: %d", len(u))
 	}
 	if k == nil {
 		return fmt.Errorf("userdb: must provide a public key")
@@ -111,8 +119,12 @@ func (d *boltUserDB) Add(u []byte, k *ecdh.PublicKey, update bool) error {
 }
 
 func (d *boltUserDB) SetIdentity(u []byte, k *ecdh.PublicKey) error {
+	return d.SetIdentityAt(u, k, time.Now())
+}
+
+func (d *boltUserDB) SetIdentityAt(u []byte, k *ecdh.PublicKey, t time.Time) error {
 	if !userOk(u) {
-		return fmt.Errorf("userdb: invalid username: `%v`", u)
+		return fmt.Errorf("userdb: invalid username length: %d", len(u))
 	}
 
 	return d.db.Update(func(tx *bolt.Tx) error {
@@ -122,16 +134,118 @@ func (d *boltUserDB) SetIdentity(u []byte, k *ecdh.PublicKey) error {
 		}
 
 		iBkt := tx.Bucket([]byte(identitiesBucket))
+		tBkt := tx.Bucket([]byte(identityTimesBucket))
+		if k == nil && iBkt.Get(u) == nil {
+			// Removing a non-existent key is not a change.
+			return nil
+		}
+
+		var rawTime [8]byte
+		binary.BigEndian.PutUint64(rawTime[:], uint64(t.Unix()))
+		if err := appendIdentityHistory(tx, u, rawTime[:], k); err != nil {
+			return err
+		}
+
 		if k == nil {
+			if err := tBkt.Delete(u); err != nil {
+				return err
+			}
 			return iBkt.Delete(u)
 		}
+		if err := tBkt.Put(u, rawTime[:]); err != nil {
+			return err
+		}
 		return iBkt.Put(u, k.Bytes())
 	})
 }
 
+func appendIdentityHistory(tx *bolt.Tx, u, rawTime []byte, k *ecdh.PublicKey) error {
+	hBkt, err := tx.Bucket([]byte(identityHistoryBucket)).CreateBucketIfNotExists(u)
+	if err != nil {
+		return err
+	}
+	seq, err := hBkt.NextSequence()
+	if err != nil {
+		return err
+	}
+
+	var rawSeq [8]byte
+	binary.BigEndian.PutUint64(rawSeq[:], seq)
+	ent := append([]byte{}, rawTime...)
+	if k != nil {
+		ent = append(ent, k.Bytes()...)
+	}
+	return hBkt.Put(rawSeq[:], ent)
+}
+
+func (d *boltUserDB) IdentityHistory(u []byte) ([]userdb.IdentityChange, error) {
+	if !userOk(u) {
+		return nil, fmt.Errorf("userdb: invalid username length: %d", len(u))
+	}
+
+	var h []userdb.IdentityChange
+	err := d.db.View(func(tx *bolt.Tx) error {
+		uBkt := tx.Bucket([]byte(usersBucket))
+		if uEnt := uBkt.Get(u); uEnt == nil {
+			return userdb.ErrNoSuchUser
+		}
+
+		hBkt := tx.Bucket([]byte(identityHistoryBucket)).Bucket(u)
+		if hBkt == nil {
+			return nil
+		}
+		return hBkt.ForEach(func(_, v []byte) error {
+			if len(v) < 8 {
+				return fmt.Errorf("userdb: corrupted identity history entry")
+			}
+			c := userdb.IdentityChange{
+				Time: time.Unix(int64(binary.BigEndian.Uint64(v)), 0),
+			}
+			if len(v) > 8 {
+				c.PublicKey = new(ecdh.PublicKey)
+				if err := c.PublicKey.FromBytes(v[8:]); err != nil {
+					return err
+				}
+			}
+			h = append(h, c)
+			return nil
+		})
+	})
+
+	return h, err
+}
+
+func (d *boltUserDB) IdentityTime(u []byte) (time.Time, error) {
+	if !userOk(u) {
+		return time.Time{}, fmt.Errorf("userdb: invalid username length: %d", len(u))
+	}
+
+	var t time.Time
+	err := d.db.View(func(tx *bolt.Tx) error {
+		uBkt := tx.Bucket([]byte(usersBucket))
+		if uEnt := uBkt.Get(u); uEnt == nil {
+			return userdb.ErrNoSuchUser
+		}
+
+		iBkt := tx.Bucket([]byte(identitiesBucket))
+		if iBkt.Get(u) == nil {
+			return userdb.ErrNoIdentity
+		}
+
+		// Identity keys set by older versions have no time recorded.
+		tBkt := tx.Bucket([]byte(identityTimesBucket))
+		if rawTime := tBkt.Get(u); len(rawTime) == 8 {
+			t = time.Unix(int64(binary.BigEndian.Uint64(rawTime)), 0)
+		}
+		return nil
+	})
+
+	return t, err
+}
+
 func (d *boltUserDB) Identity(u []byte) (*ecdh.PublicKey, error) {
 	if !userOk(u) {
-		return nil, fmt.Errorf("userdb: invalid username: `%v`", u)
+		return nil, fmt.Errorf("userdb: invalid username length: %d", len(u))
 	}
 
 	var pubKey *ecdh.PublicKey
@@ -154,9 +268,25 @@ func (d *boltUserDB) Identity(u []byte) (*ecdh.PublicKey, error) {
 	return pubKey, err
 }
 
+func (d *boltUserDB) Users() ([][]byte, error) {
+	var users [][]byte
+	err := d.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(usersBucket)).ForEach(func(k, _ []byte) error {
+			users = append(users, append([]byte{}, k...))
+			return nil
+		})
+	})
+
+	return users, err
+}
+
 func (d *boltUserDB) Remove(u []byte) error {
+	return d.RemoveAt(u, time.Now())
+}
+
+func (d *boltUserDB) RemoveAt(u []byte, t time.Time) error {
 	if !userOk(u) {
-		return fmt.Errorf("userdb: invalid username: `%v`", u)
+		return fmt.Errorf("userdb: invalid username length: %d", len(u))
 	}
 
 	err := d.db.Update(func(tx *bolt.Tx) error {
@@ -166,6 +296,23 @@ func (d *boltUserDB) Remove(u []byte) error {
 		if ent := bkt.Get(u); ent == nil {
 			return userdb.ErrNoSuchUser
 		}
+
+		// The identity key goes with the user, and the removal is retained
+		// in the history, so that re-adding the user does not restore it.
+		iBkt := tx.Bucket([]byte(identitiesBucket))
+		if iBkt.Get(u) != nil {
+			var rawTime [8]byte
+			binary.BigEndian.PutUint64(rawTime[:], uint64(t.Unix()))
+			if err := appendIdentityHistory(tx, u, rawTime[:], nil); err != nil {
+				return err
+			}
+			if err := tx.Bucket([]byte(identityTimesBucket)).Delete(u); err != nil {
+				return err
+			}
+			if err := iBkt.Delete(u); err != nil {
+				return err
+			}
+		}
 		return bkt.Delete(u)
 	})
 	if err == nil {
@@ -213,6 +360,12 @@ func New(f string) (userdb.UserDB, error) {
 		if _, err = tx.CreateBucketIfNotExists([]byte(identitiesBucket)); err != nil {
 			return err
 		}
+		if _, err = tx.CreateBucketIfNotExists([]byte(identityTimesBucket)); err != nil {
+			return err
+		}
+		if _, err = tx.CreateBucketIfNotExists([]byte(identityHistoryBucket)); err != nil {
+			return err
+		}
 
 		if b := bkt.Get([]byte(versionKey)); b != nil {
 			// Well it looks like we loaded as opposed to created.
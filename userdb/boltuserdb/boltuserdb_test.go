@@ -21,9 +21,12 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"testing"
+	"time"
 
 	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/server/userdb"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -68,6 +71,45 @@ func doTestCreate(t *testing.T) {
 	}
 	assert.False(d.Exists([]byte("malory")), "Exists('malory')")
 	assert.False(d.IsValid([]byte("malory"), testUsers["alice"]), "IsValid('malory', k)")
+
+	// Identity keys record when they were set.
+	tDB, ok := d.(userdb.IdentityTimeDB)
+	require.True(ok, "IdentityTimeDB")
+	_, err = tDB.IdentityTime([]byte("alice"))
+	assert.Equal(userdb.ErrNoIdentity, err, "IdentityTime('alice'): No identity")
+	before := time.Now().Truncate(time.Second)
+	err = d.SetIdentity([]byte("alice"), testUsers["bob"])
+	require.NoError(err, "SetIdentity('alice', k)")
+	setAt, err := tDB.IdentityTime([]byte("alice"))
+	require.NoError(err, "IdentityTime('alice')")
+	assert.False(setAt.Before(before), "IdentityTime('alice')")
+	assert.False(setAt.After(time.Now()), "IdentityTime('alice')")
+
+	// Identity key changes are retained, including removals.
+	err = d.SetIdentity([]byte("alice"), nil)
+	require.NoError(err, "SetIdentity('alice', nil)")
+	err = d.SetIdentity([]byte("alice"), nil)
+	require.NoError(err, "SetIdentity('alice', nil): No identity")
+	uDB, ok := d.(userdb.TimedUpdateDB)
+	require.True(ok, "TimedUpdateDB")
+	changedAt := setAt.Add(time.Hour)
+	err = uDB.SetIdentityAt([]byte("alice"), testUsers["alice"], changedAt)
+	require.NoError(err, "SetIdentityAt('alice', k)")
+	hDB, ok := d.(userdb.IdentityHistoryDB)
+	require.True(ok, "IdentityHistoryDB")
+	h, err := hDB.IdentityHistory([]byte("alice"))
+	require.NoError(err, "IdentityHistory('alice')")
+	require.Len(h, 3, "IdentityHistory('alice')")
+	assert.Equal(testUsers["bob"].Bytes(), h[0].PublicKey.Bytes(), "IdentityHistory('alice')[0]")
+	assert.Equal(setAt, h[0].Time, "IdentityHistory('alice')[0]")
+	assert.Nil(h[1].PublicKey, "IdentityHistory('alice')[1]")
+	assert.Equal(testUsers["alice"].Bytes(), h[2].PublicKey.Bytes(), "IdentityHistory('alice')[2]")
+	assert.Equal(changedAt, h[2].Time, "IdentityHistory('alice')[2]")
+	h, err = hDB.IdentityHistory([]byte("bob"))
+	require.NoError(err, "IdentityHistory('bob')")
+	assert.Empty(h, "IdentityHistory('bob')")
+	_, err = hDB.IdentityHistory([]byte("malory"))
+	assert.Equal(userdb.ErrNoSuchUser, err, "IdentityHistory('malory')")
 }
 
 func doTestLoad(t *testing.T) {
@@ -87,6 +129,36 @@ func doTestLoad(t *testing.T) {
 
 	err = d.Add([]byte("alice"), testUsers["alice"], false)
 	assert.Error(err, "Add('alice', k, false)")
+
+	lDB, ok := d.(userdb.UserListDB)
+	require.True(ok, "UserListDB")
+	users, err := lDB.Users()
+	require.NoError(err, "Users()")
+	var names []string
+	for _, u := range users {
+		names = append(names, string(u))
+	}
+	sort.Strings(names)
+	assert.Equal(testUsernames, names, "Users()")
+
+	// Removing a user removes their identity key, and records the removal.
+	removedAt := time.Now().Add(time.Hour).Truncate(time.Second)
+	uDB, ok := d.(userdb.TimedUpdateDB)
+	require.True(ok, "TimedUpdateDB")
+	err = uDB.RemoveAt([]byte("alice"), removedAt)
+	require.NoError(err, "RemoveAt('alice')")
+	assert.False(d.Exists([]byte("alice")), "Exists('alice'): Removed")
+	err = d.Add([]byte("alice"), testUsers["alice"], false)
+	require.NoError(err, "Add('alice', k, false): Re-add")
+	_, err = d.Identity([]byte("alice"))
+	assert.Equal(userdb.ErrNoIdentity, err, "Identity('alice'): Re-add")
+	hDB, ok := d.(userdb.IdentityHistoryDB)
+	require.True(ok, "IdentityHistoryDB")
+	h, err := hDB.IdentityHistory([]byte("alice"))
+	require.NoError(err, "IdentityHistory('alice')")
+	require.Len(h, 4, "IdentityHistory('alice')")
+	assert.Nil(h[3].PublicKey, "IdentityHistory('alice')[3]")
+	assert.Equal(removedAt, h[3].Time, "IdentityHistory('alice')[3]")
 }
 
 func init() {
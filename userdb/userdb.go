@@ -20,6 +20,7 @@ package userdb
 
 import (
 	"errors"
+	"time"
 
 	"github.com/katzenpost/core/crypto/ecdh"
 	"github.com/katzenpost/core/sphinx/constants"
@@ -61,9 +62,57 @@ type UserDB interface {
 	// by the user name.
 	Identity([]byte) (*ecdh.PublicKey, error)
 
-	// Remove removes the user identified by the username from the database.
+	// Remove removes the user identified by the username from the database,
+	// along with the user's identity key.
 	Remove([]byte) error
 
 	// Close closes the UserDB instance.
 	Close()
 }
+
+// IdentityTimeDB is the optional interface provided by user database
+// implementations that record when identity keys are set.
+type IdentityTimeDB interface {
+	// IdentityTime returns the time at which the identity key of the user
+	// identified by the user name was set.  The zero time is returned if
+	// the identity key predates the time being recorded.
+	IdentityTime([]byte) (time.Time, error)
+}
+
+// TimedUpdateDB is the optional interface provided by user database
+// implementations that record when identity keys are set, that allows the
+// caller to provide the time of the change.
+type TimedUpdateDB interface {
+	// SetIdentityAt sets the identity key like SetIdentity, recording the
+	// change as made at the provided time.
+	SetIdentityAt([]byte, *ecdh.PublicKey, time.Time) error
+
+	// RemoveAt removes the user like Remove, recording the removal of the
+	// identity key as made at the provided time.
+	RemoveAt([]byte, time.Time) error
+}
+
+// IdentityChange is a change to a user's identity key.
+type IdentityChange struct {
+	// Time is the time at which the change was made.
+	Time time.Time
+
+	// PublicKey is the new identity key, or nil if the key was removed.
+	PublicKey *ecdh.PublicKey
+}
+
+// IdentityHistoryDB is the optional interface provided by user database
+// implementations that retain an append-only history of identity key
+// changes.
+type IdentityHistoryDB interface {
+	// IdentityHistory returns every change to the identity key of the user
+	// identified by the user name, oldest first.
+	IdentityHistory([]byte) ([]IdentityChange, error)
+}
+
+// UserListDB is the optional interface provided by user database
+// implementations that can enumerate their users.
+type UserListDB interface {
+	// Users returns the user name of every user in the database.
+	Users() ([][]byte, error)
+}